@@ -16,10 +16,12 @@ go-bindata --prefix frontend/public/ -o tty-server/assets_bundle.go \
     frontend/public/404.css frontend/public/404.html \
     frontend/public/bootstrap.min.css frontend/public/index.html \
     frontend/public/invalid-session.html frontend/public/tty-receiver.in.html \
+    frontend/public/tty-player.in.html frontend/public/tty-player.js \
+    frontend/public/login.in.html \
+    frontend/public/share-error.in.html \
     frontend/public/tty-receiver.js
 mkdir out
-go build -o out/tty-server ./tty-server/pty_master.go \
-    ./tty-server/server.go ./tty-server/server_main.go \
-    ./tty-server/websockets_connection.go ./tty-server/assets_bundle.go
+# Built as a package, so the files for other platforms and the tests are left out by go itself
+go build -o out/tty-server ./tty-server
 
 mv out/tty-server /tmp/tty-server
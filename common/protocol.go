@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 type ProtocolMessageIDType string
@@ -17,6 +18,25 @@ const (
 	MsgIDReceiverInitReply          = "ReceiverInitReply"
 	MsgIDWrite                      = "Write"
 	MsgIDWinSize                    = "WinSize"
+	MsgIDResourceEvent              = "ResourceEvent"
+	MsgIDLimitExceeded              = "LimitExceeded"
+	MsgIDFloorControl               = "FloorControl"
+	MsgIDFloorState                 = "FloorState"
+	MsgIDPresence                   = "Presence"
+	MsgIDReceiverJoined             = "ReceiverJoined"
+	MsgIDReceiverLeft               = "ReceiverLeft"
+	MsgIDChat                       = "Chat"
+	MsgIDChatMessage                = "ChatMessage"
+	MsgIDChatHistory                = "ChatHistory"
+	MsgIDWindowControl              = "WindowControl"
+	MsgIDWindows                    = "Windows"
+	MsgIDEffectiveSize              = "EffectiveSize"
+	MsgIDJoinStatus                 = "JoinStatus"
+	MsgIDWaitingRoom                = "WaitingRoom"
+	MsgIDAdmission                  = "Admission"
+	MsgIDModerate                   = "Moderate"
+	MsgIDModerationResult           = "ModerationResult"
+	MsgIDTerminate                  = "Terminate"
 )
 
 // Message used to encapsulate the rest of the bessages bellow
@@ -52,6 +72,8 @@ type MsgTTYReceiverInitReply struct {
 type MsgTTYWrite struct {
 	Data []byte
 	Size int
+	// Window is the window of the session the output is from, or the main window if it is empty
+	Window string `json:",omitempty"`
 }
 
 type MsgTTYWinSize struct {
@@ -59,6 +81,212 @@ type MsgTTYWinSize struct {
 	Rows int
 }
 
+// MsgTTYResourceEvent is sent by the server to the receivers when the session hits one of its
+// resource limits
+type MsgTTYResourceEvent struct {
+	Kind    string
+	Count   uint64
+	Message string
+}
+
+// MsgTTYLimitExceeded is sent by the server to a receiver which hit one of its rate limits, such as
+// how fast it can type
+type MsgTTYLimitExceeded struct {
+	Limit   string
+	Message string
+}
+
+// The actions of MsgTTYFloorControl
+const (
+	FloorActionRequest = "request"
+	FloorActionRelease = "release"
+	FloorActionGrant   = "grant"
+	FloorActionDeny    = "deny"
+)
+
+// MsgTTYFloorControl is sent by a receiver to ask for the keyboard of a session, to give it up, or,
+// for its holder or the owner of the session, to grant or deny it to the receiver with ReceiverID
+type MsgTTYFloorControl struct {
+	Action     string
+	ReceiverID string
+}
+
+// FloorReceiver is a receiver of a session, as the floor control messages show it
+type FloorReceiver struct {
+	ID   string
+	Name string
+}
+
+// MsgTTYFloorState is sent by the server to the receivers of a session with floor control, when the
+// receiver holding its keyboard, or the receivers asking for it, change. Self is the receiver the
+// message is sent to, and Message tells it what happened to it, if anything.
+type MsgTTYFloorState struct {
+	Holder   *FloorReceiver
+	Requests []FloorReceiver
+	Self     string
+	Owner    bool
+	Message  string
+}
+
+// PresenceReceiver is a receiver connected to a session, as the other receivers see it. Its
+// address is only shown to the owner of the session.
+type PresenceReceiver struct {
+	ID            string
+	Name          string
+	Identity      string
+	Role          string
+	Authenticated bool
+	ViewOnly      bool
+	Owner         bool
+	Address       string `json:",omitempty"`
+	ConnectedAt   time.Time
+}
+
+// MsgTTYPresence is sent by the server to a receiver joining a session, with the receivers already
+// connected to it, and itself, which is Self
+type MsgTTYPresence struct {
+	Receivers []PresenceReceiver
+	Self      string
+	// Moderator tells the receiver it can kick and ban the others, and give the session away
+	Moderator bool
+}
+
+// MsgTTYReceiverJoined is sent by the server to the receivers of a session when another one joins
+type MsgTTYReceiverJoined struct {
+	Receiver PresenceReceiver
+}
+
+// MsgTTYReceiverLeft is sent by the server to the receivers of a session when another one leaves
+type MsgTTYReceiverLeft struct {
+	ID   string
+	Name string
+}
+
+// MsgTTYChat is sent by a receiver to say something in the chat of its session
+type MsgTTYChat struct {
+	Text string
+}
+
+// MsgTTYChatMessage is sent by the server to the receivers of a session when one of them says
+// something in its chat. Any receiver can take any name, so the receivers which are not
+// Authenticated can't be told apart from the Identity with the same name by their Name.
+type MsgTTYChatMessage struct {
+	ReceiverID    string
+	Name          string
+	Identity      string
+	Authenticated bool
+	Text          string
+	Time          time.Time
+}
+
+// MsgTTYChatHistory is sent by the server to a receiver joining a session, with the last messages
+// of its chat
+type MsgTTYChatHistory struct {
+	Messages []MsgTTYChatMessage
+}
+
+// The actions of MsgTTYWindowControl
+const (
+	WindowActionCreate = "create"
+	WindowActionSwitch = "switch"
+	WindowActionRename = "rename"
+	WindowActionClose  = "close"
+)
+
+// MsgTTYWindowControl is sent by a receiver to open a window in its session, running Command, or
+// the command of the session if it is empty, to show the window with the ID Window, which its input
+// then goes to, or to rename or close it
+type MsgTTYWindowControl struct {
+	Action  string
+	Window  string
+	Name    string
+	Command string
+}
+
+// WindowInfo is a window of a session
+type WindowInfo struct {
+	ID   string
+	Name string
+}
+
+// MsgTTYWindows is sent by the server to the receivers of a session when its windows change, with
+// the commands new windows can run, and at most how many windows it can have. Message tells the
+// receiver it is sent to why what it asked failed, if it did.
+type MsgTTYWindows struct {
+	Windows  []WindowInfo
+	Commands []string
+	Max      int
+	Message  string
+}
+
+// MsgTTYEffectiveSize is sent by the server to the receivers of a session when its size changes,
+// which may not be the size they asked for, for them to letterbox or scale their terminal. Policy is
+// how the server decides the size of the session.
+type MsgTTYEffectiveSize struct {
+	Cols   int
+	Rows   int
+	Policy string
+}
+
+// The states of MsgTTYJoinStatus
+const (
+	JoinStatePending  = "pending"
+	JoinStateAdmitted = "admitted"
+	JoinStateDenied   = "denied"
+)
+
+// MsgTTYJoinStatus is sent by the server to a receiver joining a session with a waiting room, when
+// it starts waiting, and when it is let in or turned away
+type MsgTTYJoinStatus struct {
+	State   string
+	Message string
+}
+
+// MsgTTYWaitingRoom is sent by the server to the receivers which can let the others in a session,
+// whenever the receivers waiting to join it change
+type MsgTTYWaitingRoom struct {
+	Pending []PresenceReceiver
+}
+
+// MsgTTYAdmission is sent by a receiver to let the receiver ReceiverID in the session, or turn it
+// away
+type MsgTTYAdmission struct {
+	ReceiverID string
+	Admit      bool
+}
+
+// The actions of MsgTTYModerate
+const (
+	ModerateActionTransfer    = "transfer"
+	ModerateActionKick        = "kick"
+	ModerateActionBanIdentity = "ban_identity"
+	ModerateActionBanAddress  = "ban_address"
+)
+
+// MsgTTYModerate is sent by the owner of a session, or an admin, to give the session to the receiver
+// ReceiverID, to kick it out of the session, or to ban its identity or its IP from joining again
+type MsgTTYModerate struct {
+	Action     string
+	ReceiverID string
+}
+
+// MsgTTYModerationResult is sent by the server to a receiver, with what its MsgTTYModerate did
+type MsgTTYModerationResult struct {
+	Message string
+}
+
+// The reasons of MsgTTYTerminate
+const (
+	TerminateReasonKicked = "kicked"
+	TerminateReasonBanned = "banned"
+)
+
+// MsgTTYTerminate is sent by the server to a receiver it disconnects, which shouldn't reconnect
+type MsgTTYTerminate struct {
+	Reason  string
+	Message string
+}
+
 func ReadAndUnmarshalMsg(reader io.Reader, aMessage interface{}) (err error) {
 	var wrapperMsg MsgAll
 	// Wait here for the right message to come
@@ -126,6 +354,177 @@ func MarshalMsg(aMessage interface{}) (_ []byte, err error) {
 		return json.Marshal(msg)
 	}
 
+	if resourceMsg, ok := aMessage.(MsgTTYResourceEvent); ok {
+		msg.Type = MsgIDResourceEvent
+		msg.Data, err = json.Marshal(resourceMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if limitMsg, ok := aMessage.(MsgTTYLimitExceeded); ok {
+		msg.Type = MsgIDLimitExceeded
+		msg.Data, err = json.Marshal(limitMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if floorMsg, ok := aMessage.(MsgTTYFloorControl); ok {
+		msg.Type = MsgIDFloorControl
+		msg.Data, err = json.Marshal(floorMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if floorStateMsg, ok := aMessage.(MsgTTYFloorState); ok {
+		msg.Type = MsgIDFloorState
+		msg.Data, err = json.Marshal(floorStateMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if presenceMsg, ok := aMessage.(MsgTTYPresence); ok {
+		msg.Type = MsgIDPresence
+		msg.Data, err = json.Marshal(presenceMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if joinedMsg, ok := aMessage.(MsgTTYReceiverJoined); ok {
+		msg.Type = MsgIDReceiverJoined
+		msg.Data, err = json.Marshal(joinedMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if leftMsg, ok := aMessage.(MsgTTYReceiverLeft); ok {
+		msg.Type = MsgIDReceiverLeft
+		msg.Data, err = json.Marshal(leftMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if chatMsg, ok := aMessage.(MsgTTYChat); ok {
+		msg.Type = MsgIDChat
+		msg.Data, err = json.Marshal(chatMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if chatMessageMsg, ok := aMessage.(MsgTTYChatMessage); ok {
+		msg.Type = MsgIDChatMessage
+		msg.Data, err = json.Marshal(chatMessageMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if chatHistoryMsg, ok := aMessage.(MsgTTYChatHistory); ok {
+		msg.Type = MsgIDChatHistory
+		msg.Data, err = json.Marshal(chatHistoryMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if windowControlMsg, ok := aMessage.(MsgTTYWindowControl); ok {
+		msg.Type = MsgIDWindowControl
+		msg.Data, err = json.Marshal(windowControlMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if windowsMsg, ok := aMessage.(MsgTTYWindows); ok {
+		msg.Type = MsgIDWindows
+		msg.Data, err = json.Marshal(windowsMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if sizeMsg, ok := aMessage.(MsgTTYEffectiveSize); ok {
+		msg.Type = MsgIDEffectiveSize
+		msg.Data, err = json.Marshal(sizeMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if joinStatusMsg, ok := aMessage.(MsgTTYJoinStatus); ok {
+		msg.Type = MsgIDJoinStatus
+		msg.Data, err = json.Marshal(joinStatusMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if waitingRoomMsg, ok := aMessage.(MsgTTYWaitingRoom); ok {
+		msg.Type = MsgIDWaitingRoom
+		msg.Data, err = json.Marshal(waitingRoomMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if admissionMsg, ok := aMessage.(MsgTTYAdmission); ok {
+		msg.Type = MsgIDAdmission
+		msg.Data, err = json.Marshal(admissionMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if moderateMsg, ok := aMessage.(MsgTTYModerate); ok {
+		msg.Type = MsgIDModerate
+		msg.Data, err = json.Marshal(moderateMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if moderationResultMsg, ok := aMessage.(MsgTTYModerationResult); ok {
+		msg.Type = MsgIDModerationResult
+		msg.Data, err = json.Marshal(moderationResultMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
+	if terminateMsg, ok := aMessage.(MsgTTYTerminate); ok {
+		msg.Type = MsgIDTerminate
+		msg.Data, err = json.Marshal(terminateMsg)
+		if err != nil {
+			return
+		}
+		return json.Marshal(msg)
+	}
+
 	return nil, nil
 }
 
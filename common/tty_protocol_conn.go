@@ -46,6 +46,11 @@ func (protoConn *TTYProtocolConn) SetWinSize(cols, rows int) error {
 	return MarshalAndWriteMsg(protoConn.netConnection, msgWinChanged)
 }
 
+// WriteMessage sends one of the protocol messages to the other side
+func (protoConn *TTYProtocolConn) WriteMessage(aMessage interface{}) error {
+	return MarshalAndWriteMsg(protoConn.netConnection, aMessage)
+}
+
 func (protoConn *TTYProtocolConn) Close() error {
 	return protoConn.netConnection.Close()
 }
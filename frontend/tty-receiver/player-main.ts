@@ -0,0 +1,15 @@
+import 'xterm/css/xterm.css';
+import './main.css';
+
+import { TTYPlayer } from './tty-player';
+
+let playerWindow = window as any;
+let initialData = playerWindow.ttyPlayerInitialData;
+
+const ttyPlayer = new TTYPlayer(initialData.eventsPath, initialData.duration,
+    document.getElementById('player-terminal') as HTMLDivElement, {
+        play: document.getElementById('player-play') as HTMLButtonElement,
+        speed: document.getElementById('player-speed') as HTMLSelectElement,
+        seek: document.getElementById('player-seek') as HTMLInputElement,
+        time: document.getElementById('player-time') as HTMLElement,
+    });
@@ -0,0 +1,201 @@
+import { Terminal } from "xterm";
+
+// An event of an asciicast recording: [time, type, data]
+type RecordingEvent = [number, string, string];
+
+interface IPlayerControls {
+    play: HTMLButtonElement;
+    speed: HTMLSelectElement;
+    seek: HTMLInputElement;
+    time: HTMLElement;
+}
+
+class TTYPlayer {
+    private xterminal: Terminal;
+    private controls: IPlayerControls;
+    private eventsPath: string;
+    private duration: number;
+    private request: XMLHttpRequest;
+    private parsedLength: number;
+    private headerParsed: boolean;
+    private events: RecordingEvent[];
+    private nextEvent: number;
+    private loaded: boolean;
+    private playing: boolean;
+    private speed: number;
+    // The position in the recording, in seconds, at the moment given by positionTimestamp
+    private position: number;
+    private positionTimestamp: number;
+    private timer: number;
+
+    constructor(eventsPath: string, duration: number, container: HTMLDivElement, controls: IPlayerControls) {
+        this.xterminal = new Terminal({
+            cursorBlink: false,
+            disableStdin: true,
+            scrollback: 1000,
+            fontSize: 16,
+        });
+        this.xterminal.open(container);
+        this.eventsPath = eventsPath;
+        this.duration = duration;
+        this.controls = controls;
+        this.playing = true;
+        this.speed = 1;
+        this.timer = null;
+
+        this.controls.seek.max = String(duration);
+        this.controls.play.onclick = () => {
+            this.setPlaying(!this.playing);
+        };
+        this.controls.speed.onchange = () => {
+            this.setSpeed(parseFloat(this.controls.speed.value));
+        };
+        this.controls.seek.onchange = () => {
+            this.seek(parseFloat(this.controls.seek.value));
+        };
+        window.setInterval(() => {
+            this.updateControls();
+        }, 250);
+
+        this.seek(0);
+    }
+
+    public setPlaying(playing: boolean) {
+        this.position = this.currentPosition();
+        this.positionTimestamp = Date.now();
+        this.playing = playing;
+        this.controls.play.textContent = playing ? "Pause" : "Play";
+        this.schedule();
+    }
+
+    public setSpeed(speed: number) {
+        this.position = this.currentPosition();
+        this.positionTimestamp = Date.now();
+        this.speed = speed;
+        this.schedule();
+    }
+
+    // Seeking asks the server for the events starting at the given time. The server sends the last
+    // keyframe before that time first, so only a few events have to be replayed to catch up.
+    public seek(time: number) {
+        if (this.request) {
+            this.request.abort();
+        }
+        this.position = time;
+        this.positionTimestamp = Date.now();
+        this.events = [];
+        this.nextEvent = 0;
+        this.parsedLength = 0;
+        this.headerParsed = false;
+        this.loaded = false;
+        this.xterminal.reset();
+
+        const request = new XMLHttpRequest();
+        request.open("GET", this.eventsPath + "?from=" + encodeURIComponent(String(time)));
+        request.onprogress = () => {
+            this.parseEvents(request);
+        };
+        request.onload = () => {
+            this.parseEvents(request);
+            this.loaded = true;
+            this.schedule();
+        };
+        request.send();
+        this.request = request;
+    }
+
+    private parseEvents(request: XMLHttpRequest) {
+        if (request !== this.request) {
+            return;
+        }
+        const text = request.responseText;
+        let lineEnd = text.indexOf("\n", this.parsedLength);
+        while (lineEnd >= 0) {
+            const line = text.substring(this.parsedLength, lineEnd);
+            this.parsedLength = lineEnd + 1;
+            lineEnd = text.indexOf("\n", this.parsedLength);
+            if (line.trim() === "") {
+                continue;
+            }
+            const parsed = JSON.parse(line);
+            if (!this.headerParsed) {
+                this.headerParsed = true;
+                this.xterminal.resize(parsed.width, parsed.height);
+                continue;
+            }
+            this.events.push(parsed as RecordingEvent);
+        }
+        this.schedule();
+    }
+
+    private currentPosition(): number {
+        if (!this.playing) {
+            return this.position;
+        }
+        return this.position + (Date.now() - this.positionTimestamp) / 1000 * this.speed;
+    }
+
+    private applyEvent(event: RecordingEvent) {
+        switch (event[1]) {
+            case "o":
+                this.xterminal.write(event[2]);
+                break;
+            case "k":
+                this.xterminal.reset();
+                this.xterminal.write(event[2]);
+                break;
+            case "r":
+                const size = event[2].split("x");
+                this.xterminal.resize(parseInt(size[0], 10), parseInt(size[1], 10));
+                break;
+        }
+    }
+
+    // Plays all the events that are due, and sets a timer for the next one
+    private schedule() {
+        if (this.timer !== null) {
+            window.clearTimeout(this.timer);
+            this.timer = null;
+        }
+
+        const position = this.currentPosition();
+        while (this.nextEvent < this.events.length && this.events[this.nextEvent][0] <= position) {
+            this.applyEvent(this.events[this.nextEvent]);
+            this.nextEvent++;
+        }
+
+        if (this.nextEvent >= this.events.length) {
+            if (this.loaded && this.playing) {
+                this.position = Math.min(position, this.duration);
+                this.setPlaying(false);
+            }
+            return;
+        }
+        if (!this.playing) {
+            return;
+        }
+        const delay = (this.events[this.nextEvent][0] - position) / this.speed * 1000;
+        this.timer = window.setTimeout(() => {
+            this.timer = null;
+            this.schedule();
+        }, Math.max(delay, 0));
+    }
+
+    private updateControls() {
+        const position = Math.min(this.currentPosition(), this.duration);
+        if (document.activeElement !== this.controls.seek) {
+            this.controls.seek.value = String(position);
+        }
+        this.controls.time.textContent = formatTime(position) + " / " + formatTime(this.duration);
+    }
+}
+
+function formatTime(seconds: number): string {
+    const minutes = Math.floor(seconds / 60);
+    const secs = Math.floor(seconds % 60);
+    return minutes + ":" + (secs < 10 ? "0" : "") + secs;
+}
+
+export {
+    TTYPlayer
+}
@@ -8,46 +8,104 @@ interface IRectSize {
     height: number;
 }
 
+interface IFloorReceiver {
+    ID: string;
+    Name: string;
+}
+
+interface IPresenceReceiver {
+    ID: string;
+    Name: string;
+    Identity: string;
+    Role: string;
+    Authenticated: boolean;
+    ViewOnly: boolean;
+    Owner: boolean;
+    Address?: string;
+    ConnectedAt: string;
+}
+
+interface IChatMessage {
+    ReceiverID: string;
+    Name: string;
+    Identity: string;
+    Authenticated: boolean;
+    Text: string;
+    Time: string;
+}
+
+interface IWindow {
+    ID: string;
+    Name: string;
+}
+
+interface IWindows {
+    Windows: IWindow[];
+    Commands: string[];
+    Max: number;
+    Message: string;
+}
+
+// A terminal showing one of the windows of the session
+interface ITerminal {
+    xterminal: Terminal;
+    fitAddon: FitAddon;
+    element: HTMLElement;
+}
+
+// The window the output without a window is from
+const mainWindow = "1";
+
+// The size of the session, which its terminals have unless its receivers resize it themselves
+interface IEffectiveSize {
+    Cols: number;
+    Rows: number;
+    Policy: string;
+}
+
+interface IFloorState {
+    Holder: IFloorReceiver | null;
+    Requests: IFloorReceiver[];
+    Self: string;
+    Owner: boolean;
+    Message: string;
+}
+
 class TTYReceiver {
     private xterminal: Terminal;
     private containerElement: HTMLElement;
     private fitAddon: FitAddon;
     private connection: WebSocket;
     private retry: boolean;
+    private floorElement: HTMLElement;
+    private presenceElement: HTMLElement;
+    private presence: IPresenceReceiver[];
+    private self: string;
+    // moderator tells if this receiver can kick and ban the others, and give the session away
+    private moderator: boolean;
+    private chatMessagesElement: HTMLElement;
+    // The terminals of the windows of the session, by their ID, and the one shown
+    private terminals: { [id: string]: ITerminal };
+    private window: string;
+    private windowsElement: HTMLElement;
+    private windowsState: IWindows;
+    // The windows before this receiver asked for a new one, to show it once it is opened
+    private windowsBeforeCreate: string[];
+    private effectiveSize: IEffectiveSize;
+    private waitingRoomElement: HTMLElement;
 
     constructor(wsAddress: string, container: HTMLDivElement) {
-        this.xterminal = new Terminal({
-            cursorBlink: true,
-            macOptionIsMeta: true,
-            scrollback: 1000,
-            fontSize: 16,
-            letterSpacing: 0,
-        });
         this.retry = true;
-        this.fitAddon = new FitAddon();
-        this.xterminal.loadAddon(this.fitAddon);
+        this.presence = [];
+        this.terminals = {};
         this.containerElement = container;
-        this.xterminal.open(container);
         var ttyReceiver = this;
-        this.xterminal.onData(function (data: string) {
-            let writeMessage = {
-                Type: "Write",
-                Data: base64.encode(JSON.stringify({ Size: data.length, Data: base64.encode(data)})),
-            }
-            let dataToSend = JSON.stringify(writeMessage);
-            ttyReceiver.connection.send(dataToSend);
-        });
-
-        this.xterminal.onResize((e) => {
-            let writeMessage = {
-                Type: "WinSize",
-                Data: base64.encode(JSON.stringify({ Cols: e.cols, Rows: e.rows})),
-            }
-            let dataToSend = JSON.stringify(writeMessage)
-            ttyReceiver.connection.send(dataToSend);
-        })
+        this.window = mainWindow;
+        this.addTerminal(mainWindow);
+        this.xterminal = this.terminals[mainWindow].xterminal;
+        this.fitAddon = this.terminals[mainWindow].fitAddon;
         window.onresize = () => {
-            ttyReceiver.fitAddon.fit();
+            ttyReceiver.fitWindow();
         }
         this.xterminal.write("Connecting to the server...\n\r");
         this.initWebSocket(wsAddress)
@@ -59,8 +117,12 @@ class TTYReceiver {
         this.connection.onopen = (evt: Event) => {
             this.xterminal.focus();
             this.xterminal.resize(this.xterminal.cols-1, this.xterminal.rows-1);
-            this.fitAddon.fit();
+            this.fitWindow();
             this.xterminal.setOption('cursorBlink', true);
+            // The server shows the main window to the receivers connecting
+            if (this.window !== mainWindow) {
+                this.sendMessage("WindowControl", { Action: 'switch', Window: this.window });
+            }
         }
         this.connection.onclose =  (evt: CloseEvent) => {
             this.xterminal.blur();
@@ -78,11 +140,439 @@ class TTYReceiver {
             if (message.Type === "Write") {
                 let msgData = base64.decode(message.Data)
                 let writeMsg = JSON.parse(msgData)
-                this.xterminal.writeUtf8(base64.base64ToArrayBuffer(writeMsg.Data));
+                const id = writeMsg.Window || mainWindow;
+                if (!this.terminals[id]) {
+                    this.addTerminal(id);
+                }
+                this.terminals[id].xterminal.writeUtf8(base64.base64ToArrayBuffer(writeMsg.Data));
+            }
+            if (message.Type === "EffectiveSize") {
+                this.effectiveSize = JSON.parse(base64.decode(message.Data));
+                if (!this.resizedByReceivers()) {
+                    for (const id in this.terminals) {
+                        this.terminals[id].xterminal.resize(this.effectiveSize.Cols, this.effectiveSize.Rows);
+                    }
+                }
+            }
+            if (message.Type === "JoinStatus") {
+                let joinStatus = JSON.parse(base64.decode(message.Data));
+                if (joinStatus.State === 'denied') {
+                    ttyReceiver.retry = false;
+                }
+                if (joinStatus.Message) {
+                    this.xterminal.write('\r\n\x1b[33m[' + joinStatus.Message + ']\x1b[0m\r\n');
+                }
+            }
+            if (message.Type === "WaitingRoom") {
+                this.showWaitingRoom(JSON.parse(base64.decode(message.Data)).Pending);
+            }
+            if (message.Type === "Windows") {
+                this.updateWindows(JSON.parse(base64.decode(message.Data)));
+            }
+            if (message.Type === "ResourceEvent" || message.Type === "LimitExceeded") {
+                let resourceMsg = JSON.parse(base64.decode(message.Data))
+                this.xterminal.write('\r\n\x1b[33m[' + resourceMsg.Message + ']\x1b[0m\r\n');
+            }
+            if (message.Type === "Presence") {
+                let presenceMsg = JSON.parse(base64.decode(message.Data));
+                this.presence = presenceMsg.Receivers;
+                this.self = presenceMsg.Self;
+                this.moderator = presenceMsg.Moderator;
+                this.showPresence();
+            }
+            if (message.Type === "ReceiverJoined") {
+                let joinedMsg = JSON.parse(base64.decode(message.Data));
+                this.presence = this.presence.filter((r) => r.ID !== joinedMsg.Receiver.ID);
+                this.presence.push(joinedMsg.Receiver);
+                this.showPresence();
+            }
+            if (message.Type === "ReceiverLeft") {
+                let leftMsg = JSON.parse(base64.decode(message.Data));
+                this.presence = this.presence.filter((r) => r.ID !== leftMsg.ID);
+                this.showPresence();
+            }
+            if (message.Type === "ChatHistory") {
+                let historyMsg = JSON.parse(base64.decode(message.Data));
+                this.showChat();
+                while (this.chatMessagesElement.firstChild) {
+                    this.chatMessagesElement.removeChild(this.chatMessagesElement.firstChild);
+                }
+                for (const chatMessage of historyMsg.Messages) {
+                    this.addChatMessage(chatMessage);
+                }
+            }
+            if (message.Type === "ChatMessage") {
+                this.addChatMessage(JSON.parse(base64.decode(message.Data)));
+            }
+            if (message.Type === "FloorState") {
+                let floorState: IFloorState = JSON.parse(base64.decode(message.Data));
+                if (floorState.Message) {
+                    this.xterminal.write('\r\n\x1b[33m[' + floorState.Message + ']\x1b[0m\r\n');
+                }
+                this.showFloorState(floorState);
             }
             if (message.Type === "Terminate") {
                 ttyReceiver.retry = false;
+                let terminateMsg = JSON.parse(base64.decode(message.Data));
+                if (terminateMsg.Message) {
+                    this.xterminal.write('\r\n\x1b[33m[' + terminateMsg.Message + ']\x1b[0m\r\n');
+                }
+            }
+            if (message.Type === "ModerationResult") {
+                let resultMsg = JSON.parse(base64.decode(message.Data));
+                this.xterminal.write('\r\n\x1b[33m[' + resultMsg.Message + ']\x1b[0m\r\n');
+            }
+        }
+    }
+
+    // Creates the terminal of a window, which is hidden until it is shown
+    private addTerminal(id: string) {
+        const element = document.createElement('div');
+        element.className = 'window';
+        element.style.display = id === this.window ? '' : 'none';
+        this.containerElement.appendChild(element);
+        const xterminal = new Terminal({
+            cursorBlink: true,
+            macOptionIsMeta: true,
+            scrollback: 1000,
+            fontSize: 16,
+            letterSpacing: 0,
+        });
+        const fitAddon = new FitAddon();
+        xterminal.loadAddon(fitAddon);
+        xterminal.open(element);
+        // The server sends the input to the window this receiver shows
+        xterminal.onData((data: string) => {
+            if (id === this.window) {
+                this.sendMessage("Write", { Size: data.length, Data: base64.encode(data) });
+            }
+        });
+        // The server is told the size of the browser, unless the terminal is only resized to the size
+        // of the session
+        xterminal.onResize((e) => {
+            if (id === this.window && this.resizedByReceivers()) {
+                this.sendMessage("WinSize", { Cols: e.cols, Rows: e.rows });
+            }
+        });
+        this.terminals[id] = { xterminal: xterminal, fitAddon: fitAddon, element: element };
+        if (!this.resizedByReceivers()) {
+            xterminal.resize(this.effectiveSize.Cols, this.effectiveSize.Rows);
+        }
+    }
+
+    // Tells if the session is resized to the size of the receiver resizing last, in which case the
+    // terminals fit the browser. Otherwise, they have the size of the session, and are letterboxed.
+    private resizedByReceivers(): boolean {
+        return !this.effectiveSize || this.effectiveSize.Policy === 'last';
+    }
+
+    // Fits the terminal shown to the browser, or asks the server for the size of the browser
+    private fitWindow() {
+        if (this.resizedByReceivers()) {
+            this.fitAddon.fit();
+            return;
+        }
+        const dimensions = this.fitAddon.proposeDimensions();
+        if (dimensions) {
+            this.sendMessage("WinSize", { Cols: dimensions.cols, Rows: dimensions.rows });
+        }
+    }
+
+    // Shows the terminal of a window, which this receiver then types in
+    private showWindow(id: string) {
+        if (!this.terminals[id]) {
+            this.addTerminal(id);
+        }
+        for (const windowID in this.terminals) {
+            this.terminals[windowID].element.style.display = windowID === id ? '' : 'none';
+        }
+        this.window = id;
+        this.xterminal = this.terminals[id].xterminal;
+        this.fitAddon = this.terminals[id].fitAddon;
+        this.fitWindow();
+        this.xterminal.focus();
+        this.sendMessage("WindowControl", { Action: 'switch', Window: id });
+        this.showWindowsTabs();
+    }
+
+    // Keeps the terminals of the windows of the session in line with them
+    private updateWindows(state: IWindows) {
+        this.windowsState = state;
+        const ids = state.Windows.map((w) => w.ID);
+        // The terminals of the closed windows are removed, with the window shown if it is one
+        for (const id in this.terminals) {
+            if (id !== mainWindow && ids.indexOf(id) < 0) {
+                this.terminals[id].xterminal.dispose();
+                this.containerElement.removeChild(this.terminals[id].element);
+                delete this.terminals[id];
+                if (id === this.window) {
+                    this.showWindow(mainWindow);
+                }
+            }
+        }
+        if (this.windowsBeforeCreate) {
+            const created = ids.filter((id) => this.windowsBeforeCreate.indexOf(id) < 0);
+            this.windowsBeforeCreate = null;
+            if (created.length > 0) {
+                this.showWindow(created[0]);
+            }
+        }
+        if (state.Message) {
+            this.xterminal.write('\r\n\x1b[33m[' + state.Message + ']\x1b[0m\r\n');
+        }
+        this.showWindowsTabs();
+    }
+
+    // Shows a tab for each window of the session, with buttons to open, rename and close them
+    private showWindowsTabs() {
+        const state = this.windowsState;
+        if (!state || state.Max <= 1) {
+            return;
+        }
+        if (!this.windowsElement) {
+            this.windowsElement = document.createElement('div');
+            this.windowsElement.id = 'windows';
+            document.body.appendChild(this.windowsElement);
+        }
+        const element = this.windowsElement;
+        while (element.firstChild) {
+            element.removeChild(element.firstChild);
+        }
+
+        for (const w of state.Windows) {
+            const tab = document.createElement('button');
+            tab.textContent = w.ID + ': ' + w.Name;
+            tab.className = w.ID === this.window ? 'active' : '';
+            tab.title = 'Double click to rename';
+            tab.onclick = () => this.showWindow(w.ID);
+            tab.ondblclick = () => {
+                const name = prompt('Rename the window', w.Name);
+                if (name) {
+                    this.sendMessage("WindowControl", { Action: 'rename', Window: w.ID, Name: name });
+                }
+            };
+            element.appendChild(tab);
+            if (w.ID !== mainWindow) {
+                const close = document.createElement('button');
+                close.textContent = '\u00d7';
+                close.title = 'Close the window';
+                close.onclick = () => this.sendMessage("WindowControl", { Action: 'close', Window: w.ID });
+                element.appendChild(close);
+            }
+        }
+        if (state.Windows.length < state.Max) {
+            let command: HTMLSelectElement;
+            if (state.Commands.length > 0) {
+                command = document.createElement('select');
+                for (const name of [''].concat(state.Commands)) {
+                    const option = document.createElement('option');
+                    option.value = name;
+                    option.textContent = name || 'Session command';
+                    command.appendChild(option);
+                }
+                element.appendChild(command);
+            }
+            const create = document.createElement('button');
+            create.textContent = '+';
+            create.title = 'Open a window';
+            create.onclick = () => {
+                this.windowsBeforeCreate = state.Windows.map((w) => w.ID);
+                this.sendMessage("WindowControl", { Action: 'create', Command: command ? command.value : '' });
+            };
+            element.appendChild(create);
+        }
+    }
+
+    private sendMessage(type: string, data: object) {
+        this.connection.send(JSON.stringify({
+            Type: type,
+            Data: base64.encode(JSON.stringify(data)),
+        }));
+    }
+
+    private floorButton(label: string, action: string, receiverID: string): HTMLButtonElement {
+        let button = document.createElement('button');
+        button.textContent = label;
+        button.onclick = () => {
+            this.sendMessage("FloorControl", { Action: action, ReceiverID: receiverID });
+            this.xterminal.focus();
+        };
+        return button;
+    }
+
+    // Shows who holds the keyboard of the session, with the buttons to ask for it, give it up, or
+    // grant it to the receivers asking for it
+    private showFloorState(state: IFloorState) {
+        if (!this.floorElement) {
+            this.floorElement = document.createElement('div');
+            this.floorElement.id = 'floor-control';
+            document.body.appendChild(this.floorElement);
+        }
+        const element = this.floorElement;
+        while (element.firstChild) {
+            element.removeChild(element.firstChild);
+        }
+
+        const holds = state.Holder !== null && state.Holder.ID === state.Self;
+        const status = document.createElement('span');
+        if (state.Holder === null) {
+            status.textContent = 'Nobody holds the keyboard';
+        } else {
+            status.textContent = 'Keyboard: ' + state.Holder.Name + (holds ? ' (you)' : '');
+        }
+        element.appendChild(status);
+
+        if (holds) {
+            element.appendChild(this.floorButton('Release', 'release', ''));
+        } else if (state.Requests.some((r) => r.ID === state.Self)) {
+            element.appendChild(this.floorButton('Cancel request', 'release', ''));
+        } else {
+            element.appendChild(this.floorButton('Request', 'request', ''));
+        }
+        if (state.Owner && !holds) {
+            element.appendChild(this.floorButton('Take', 'grant', state.Self));
+        }
+
+        for (const request of state.Requests) {
+            const row = document.createElement('div');
+            const name = document.createElement('span');
+            name.textContent = request.Name + ' asks for the keyboard';
+            row.appendChild(name);
+            if (holds || state.Owner) {
+                row.appendChild(this.floorButton('Grant', 'grant', request.ID));
+                row.appendChild(this.floorButton('Deny', 'deny', request.ID));
+            }
+            element.appendChild(row);
+        }
+    }
+
+    // Shows the chat of the session, with a field to say something in it
+    private showChat() {
+        if (this.chatMessagesElement) {
+            return;
+        }
+        const element = document.createElement('div');
+        element.id = 'chat';
+        this.chatMessagesElement = document.createElement('div');
+        this.chatMessagesElement.className = 'chat-messages';
+        element.appendChild(this.chatMessagesElement);
+
+        const input = document.createElement('input');
+        input.type = 'text';
+        input.placeholder = 'Say something';
+        input.maxLength = 2000;
+        input.onkeydown = (ev: KeyboardEvent) => {
+            if (ev.key === 'Enter' && input.value.trim() !== '') {
+                this.sendMessage("Chat", { Text: input.value });
+                input.value = '';
+            }
+        };
+        element.appendChild(input);
+        document.body.appendChild(element);
+    }
+
+    private addChatMessage(chatMessage: IChatMessage) {
+        this.showChat();
+        const row = document.createElement('div');
+        const name = document.createElement('b');
+        // Anyone can take any name, so the ones who are not logged in are marked as guests
+        name.textContent = chatMessage.Name + (chatMessage.Authenticated ? '' : ' (guest)') +
+            (chatMessage.ReceiverID === this.self ? ' (you)' : '') + ': ';
+        row.appendChild(name);
+        row.appendChild(document.createTextNode(chatMessage.Text));
+        row.title = (chatMessage.Authenticated ? chatMessage.Identity : 'Not logged in') + ', ' +
+            new Date(chatMessage.Time).toLocaleTimeString();
+        this.chatMessagesElement.appendChild(row);
+        this.chatMessagesElement.scrollTop = this.chatMessagesElement.scrollHeight;
+    }
+
+    // Shows the receivers waiting to join the session, to the receivers which can let them in
+    private showWaitingRoom(pending: IPresenceReceiver[]) {
+        if (!this.waitingRoomElement) {
+            this.waitingRoomElement = document.createElement('div');
+            this.waitingRoomElement.id = 'waiting-room';
+            document.body.appendChild(this.waitingRoomElement);
+        }
+        const element = this.waitingRoomElement;
+        while (element.firstChild) {
+            element.removeChild(element.firstChild);
+        }
+        element.style.display = pending.length > 0 ? '' : 'none';
+
+        const title = document.createElement('div');
+        title.className = 'presence-title';
+        title.textContent = pending.length + ' waiting to join';
+        element.appendChild(title);
+        for (const receiver of pending) {
+            const row = document.createElement('div');
+            row.textContent = receiver.Name + (receiver.Authenticated ? '' : ' (guest)');
+            row.title = (receiver.Authenticated ? receiver.Identity + ', ' + receiver.Role : 'Not logged in') +
+                (receiver.Address ? '\nFrom ' + receiver.Address : '');
+            for (const [label, admit] of [['Let in', true], ['Turn away', false]] as [string, boolean][]) {
+                const button = document.createElement('button');
+                button.textContent = label;
+                button.onclick = () => this.sendMessage("Admission", { ReceiverID: receiver.ID, Admit: admit });
+                row.appendChild(button);
+            }
+            element.appendChild(row);
+        }
+    }
+
+    // Shows the receivers connected to the session
+    private showPresence() {
+        if (!this.presenceElement) {
+            this.presenceElement = document.createElement('div');
+            this.presenceElement.id = 'presence';
+            document.body.appendChild(this.presenceElement);
+        }
+        const element = this.presenceElement;
+        while (element.firstChild) {
+            element.removeChild(element.firstChild);
+        }
+
+        const title = document.createElement('div');
+        title.className = 'presence-title';
+        title.textContent = this.presence.length + (this.presence.length === 1 ? ' person here' : ' people here');
+        element.appendChild(title);
+        for (const receiver of this.presence) {
+            const row = document.createElement('div');
+            let tags = [];
+            if (receiver.ID === this.self) {
+                tags.push('you');
+            }
+            if (receiver.Owner) {
+                tags.push('owner');
+            }
+            if (receiver.ViewOnly) {
+                tags.push('view only');
+            }
+            if (!receiver.Authenticated) {
+                tags.push('guest');
+            }
+            row.textContent = receiver.Name + (tags.length > 0 ? ' (' + tags.join(', ') + ')' : '');
+            let details = 'Connected at ' + new Date(receiver.ConnectedAt).toLocaleTimeString();
+            if (receiver.Authenticated) {
+                details = receiver.Identity + ', ' + receiver.Role + '\n' + details;
+            }
+            if (receiver.Address) {
+                details += '\nFrom ' + receiver.Address;
+            }
+            row.title = details;
+            if (this.moderator && receiver.ID !== this.self) {
+                const actions: [string, string][] = [['Make owner', 'transfer'], ['Kick', 'kick']];
+                actions.push(receiver.Authenticated ? ['Ban', 'ban_identity'] : ['Ban IP', 'ban_address']);
+                for (const [label, action] of actions) {
+                    const button = document.createElement('button');
+                    button.textContent = label;
+                    button.onclick = () => {
+                        if (action === 'kick' || confirm(label + ' ' + receiver.Name + '?')) {
+                            this.sendMessage("Moderate", { Action: action, ReceiverID: receiver.ID });
+                        }
+                    };
+                    row.appendChild(button);
+                }
             }
+            element.appendChild(row);
         }
     }
 
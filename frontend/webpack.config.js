@@ -6,6 +6,7 @@ const develBuild = process.env.TTY_SHARE_ENV === 'development';
 let mainConfig  = {
     entry: {
         'tty-receiver': './tty-receiver/main.ts',
+        'tty-player': './tty-receiver/player-main.ts',
     },
     output: {
         path: __dirname + '/public/',
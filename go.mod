@@ -4,11 +4,15 @@ go 1.13
 
 require (
 	github.com/creack/pty v1.1.11
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-bindata/go-bindata v3.1.2+incompatible // indirect
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/objx v0.1.1 // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	gopkg.in/go-jose/go-jose.v2 v2.6.3
 )
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// writeJSON sends a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	writeJSONStatus(w, http.StatusOK, value)
+}
+
+// writeJSONStatus sends a JSON response, with a status
+func writeJSONStatus(w http.ResponseWriter, status int, value interface{}) {
+	jsonResp, err := json.Marshal(value)
+
+	if err != nil {
+		log.Info(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResp)
+}
+
+type sessionInfo struct {
+	ID        string         `json:"id"`
+	Profile   string         `json:"profile"`
+	Receivers []receiverInfo `json:"receivers"`
+	// Resources is only set for the sessions with limits
+	Resources *cgroupStats `json:"resources,omitempty"`
+}
+
+type receiverInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Identity    Identity  `json:"identity"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Share       string    `json:"share,omitempty"`
+	ViewOnly    bool      `json:"view_only"`
+	Owner       bool      `json:"owner"`
+}
+
+// handleSessionList sends the active sessions the request can see, with the receivers connected to
+// them, as JSON
+func (server *TTYServer) handleSessionList(w http.ResponseWriter, r *http.Request) {
+	server.activeSessionsRWLock.RLock()
+	sessions := make([]*ptyMaster, 0, len(server.activeSessions))
+	for _, session := range server.activeSessions {
+		sessions = append(sessions, session)
+	}
+	server.activeSessionsRWLock.RUnlock()
+
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		if !server.canSeeSession(r, session) {
+			continue
+		}
+		info := sessionInfo{
+			ID:        session.GetSessionID(),
+			Profile:   session.GetProfile(),
+			Receivers: []receiverInfo{},
+			Resources: session.GetResources(),
+		}
+		for _, receiver := range session.GetReceivers() {
+			info.Receivers = append(info.Receivers, receiverInfo{
+				ID:          receiver.id,
+				Name:        receiver.name,
+				Identity:    receiver.identity,
+				RemoteAddr:  receiver.remoteAddr,
+				ConnectedAt: receiver.connectedAt,
+				Share:       receiver.share,
+				ViewOnly:    receiver.viewOnly,
+				Owner:       session.IsOwner(receiver),
+			})
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	writeJSON(w, infos)
+}
+
+// handleSessionCommands sends the history of the commands run in a session, as JSON
+func (server *TTYServer) handleSessionCommands(w http.ResponseWriter, r *http.Request) {
+	session := server.seenSession(w, r)
+	if session == nil {
+		return
+	}
+	writeJSON(w, session.GetCommands())
+}
+
+// handleSessionKill stops a session, disconnecting its receivers. Only its owner, logged in, and the
+// admins can, whatever else the policy allows.
+func (server *TTYServer) handleSessionKill(w http.ResponseWriter, r *http.Request) {
+	session := server.getSession(mux.Vars(r)["sessionID"])
+	if session == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	identity := server.identify(r)
+	if !session.IsOwnedBy(identity) && !server.config.Policy.IsAdmin(identity, session.GetProfile()) {
+		log.Warnf("Refused %s killing session %s, which they don't own", identity.Name, session.GetSessionID())
+		http.Error(w, "Only the owner of the session, logged in, or an admin can kill it", http.StatusForbidden)
+		return
+	}
+	log.Infof("Session %s killed by %s", session.GetSessionID(), identity.Name)
+	session.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The events written in the audit log
+const (
+	auditEventJoin      = "join"
+	auditEventLeave     = "leave"
+	auditEventInput     = "input"
+	auditEventResize    = "resize"
+	auditEventTerminate = "terminate"
+	auditEventChat      = "chat"
+	auditEventAdmit     = "admit"
+	auditEventDeny      = "deny"
+	auditEventTransfer  = "transfer"
+	auditEventKick      = "kick"
+	auditEventBan       = "ban"
+)
+
+// How much of the receivers' input is written in the audit log
+const (
+	auditInputFull   = "full"
+	auditInputRedact = "redact"
+	auditInputSize   = "size"
+	auditInputNone   = "none"
+)
+
+const (
+	auditRedactedText = "[REDACTED]"
+	// maxAuditInputLine is how much a receiver can type without ending the line, when the input is
+	// redacted, before it is logged anyway
+	maxAuditInputLine = 4096
+)
+
+// auditEvent is one line of the audit log
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	SessionID  string    `json:"session_id"`
+	Receiver   string    `json:"receiver,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	// The input is in Data if it is valid UTF-8, otherwise base64 encoded in DataBase64
+	Data       string `json:"data,omitempty"`
+	DataBase64 string `json:"data_base64,omitempty"`
+	Size       int    `json:"size,omitempty"`
+	Redacted   bool   `json:"redacted,omitempty"`
+	Cols       int    `json:"cols,omitempty"`
+	Rows       int    `json:"rows,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// AuditConfig configures what the audit log records
+type AuditConfig struct {
+	Path string
+	// Input is one of "full", "redact", "size" or "none"
+	Input string
+	// RedactPatterns are regular expressions, and the input matching them is replaced, when Input
+	// is "redact"
+	RedactPatterns []string
+	// RedactNoEcho redacts the input typed while the terminal doesn't echo it, which is what
+	// password prompts do
+	RedactNoEcho bool
+}
+
+// auditLog is an append-only log, in JSON lines, of everything the receivers do in the sessions.
+// All the methods can be called on a nil auditLog, in which case nothing is logged.
+type auditLog struct {
+	lock           sync.Mutex
+	file           *os.File
+	encoder        *json.Encoder
+	input          string
+	redactPatterns []*regexp.Regexp
+	redactNoEcho   bool
+	// pendingInput is the input of each receiver, since the last line it typed, when the input is
+	// redacted. It is logged a line at a time, so the patterns match what was typed a key at a time.
+	inputLock    sync.Mutex
+	pendingInput map[*ttyReceiver]*pendingAuditInput
+}
+
+type pendingAuditInput struct {
+	sessionID string
+	data      []byte
+}
+
+func newAuditLog(config AuditConfig) (audit *auditLog, err error) {
+	audit = &auditLog{
+		input:        config.Input,
+		redactNoEcho: config.RedactNoEcho,
+		pendingInput: make(map[*ttyReceiver]*pendingAuditInput),
+	}
+	switch audit.input {
+	case auditInputFull, auditInputRedact, auditInputSize, auditInputNone:
+	case "":
+		audit.input = auditInputFull
+	default:
+		return nil, &TTYServerError{msg: "Unknown audit input mode: " + config.Input}
+	}
+	for _, pattern := range config.RedactPatterns {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+		audit.redactPatterns = append(audit.redactPatterns, re)
+	}
+
+	audit.file, err = os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	audit.encoder = json.NewEncoder(audit.file)
+	return audit, nil
+}
+
+func (audit *auditLog) write(event auditEvent) {
+	if audit == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if err := audit.encoder.Encode(event); err != nil {
+		log.Errorf("Cannot write to the audit log: %s", err.Error())
+	}
+}
+
+func receiverAuditEvent(event, sessionID string, receiver *ttyReceiver) auditEvent {
+	return auditEvent{
+		Event:      event,
+		SessionID:  sessionID,
+		Receiver:   receiver.id,
+		Identity:   receiver.identity.Name,
+		Role:       receiver.identity.Role,
+		RemoteAddr: receiver.remoteAddr,
+	}
+}
+
+// Join logs a receiver connecting to a session
+func (audit *auditLog) Join(sessionID string, receiver *ttyReceiver) {
+	audit.write(receiverAuditEvent(auditEventJoin, sessionID, receiver))
+}
+
+// Leave logs a receiver disconnecting from a session
+func (audit *auditLog) Leave(sessionID string, receiver *ttyReceiver, reason string) {
+	audit.flushInput(func(pendingReceiver *ttyReceiver, _ string) bool { return pendingReceiver == receiver })
+	event := receiverAuditEvent(auditEventLeave, sessionID, receiver)
+	event.Reason = reason
+	audit.write(event)
+}
+
+// Resize logs a receiver changing the window size of a session
+func (audit *auditLog) Resize(sessionID string, receiver *ttyReceiver, cols, rows int) {
+	event := receiverAuditEvent(auditEventResize, sessionID, receiver)
+	event.Cols, event.Rows = cols, rows
+	audit.write(event)
+}
+
+// Input logs what a receiver typed in a session. echo tells if the terminal was echoing the input.
+// When the input is redacted, it is logged once the receiver ends the line, as the receivers send
+// what they type a key at a time, and a secret has to be whole to match the patterns.
+func (audit *auditLog) Input(sessionID string, receiver *ttyReceiver, data []byte, echo bool) {
+	if audit == nil || audit.input == auditInputNone {
+		return
+	}
+	if audit.input == auditInputRedact && (echo || !audit.redactNoEcho) {
+		audit.inputLock.Lock()
+		defer audit.inputLock.Unlock()
+		pending := audit.pendingInput[receiver]
+		if pending == nil {
+			pending = &pendingAuditInput{sessionID: sessionID}
+			audit.pendingInput[receiver] = pending
+		}
+		pending.data = append(pending.data, data...)
+		if bytes.ContainsAny(data, "\r\n") || len(pending.data) >= maxAuditInputLine {
+			delete(audit.pendingInput, receiver)
+			audit.writeInput(sessionID, receiver, pending.data)
+		}
+		return
+	}
+
+	// The line typed so far is logged before the input without echo
+	audit.flushInput(func(pendingReceiver *ttyReceiver, _ string) bool { return pendingReceiver == receiver })
+	event := receiverAuditEvent(auditEventInput, sessionID, receiver)
+	event.Size = len(data)
+	switch {
+	case audit.input == auditInputSize:
+	case audit.redactNoEcho && !echo:
+		event.Redacted = true
+	default:
+		event.setInput(data)
+	}
+	audit.write(event)
+}
+
+// writeInput logs input of a receiver, with the parts matching the patterns redacted
+func (audit *auditLog) writeInput(sessionID string, receiver *ttyReceiver, data []byte) {
+	event := receiverAuditEvent(auditEventInput, sessionID, receiver)
+	event.Size = len(data)
+	for _, re := range audit.redactPatterns {
+		redacted := re.ReplaceAllLiteral(data, []byte(auditRedactedText))
+		if !bytes.Equal(redacted, data) {
+			event.Redacted = true
+		}
+		data = redacted
+	}
+	event.setInput(data)
+	audit.write(event)
+}
+
+// flushInput logs the input that is left of the receivers selected by the filter, before the line
+// they typed was ended
+func (audit *auditLog) flushInput(filter func(receiver *ttyReceiver, sessionID string) bool) {
+	if audit == nil {
+		return
+	}
+	audit.inputLock.Lock()
+	defer audit.inputLock.Unlock()
+	for receiver, pending := range audit.pendingInput {
+		if filter(receiver, pending.sessionID) {
+			delete(audit.pendingInput, receiver)
+			audit.writeInput(pending.sessionID, receiver, pending.data)
+		}
+	}
+}
+
+func (event *auditEvent) setInput(data []byte) {
+	if utf8.Valid(data) {
+		event.Data = string(data)
+	} else {
+		event.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+// Chat logs what a receiver said in the chat of a session
+func (audit *auditLog) Chat(sessionID string, receiver *ttyReceiver, text string) {
+	event := receiverAuditEvent(auditEventChat, sessionID, receiver)
+	event.Data = text
+	event.Size = len(text)
+	audit.write(event)
+}
+
+// Admission logs a receiver being let in a session from its waiting room, or turned away, and why
+func (audit *auditLog) Admission(sessionID string, receiver *ttyReceiver, admitted bool, reason string) {
+	event := receiverAuditEvent(auditEventDeny, sessionID, receiver)
+	if admitted {
+		event.Event = auditEventAdmit
+	}
+	event.Reason = reason
+	audit.write(event)
+}
+
+// Moderation logs the owner of a session, or an admin, giving the session to a receiver, kicking
+// it out of the session, or banning it
+func (audit *auditLog) Moderation(sessionID string, receiver *ttyReceiver, event, by string) {
+	moderation := receiverAuditEvent(event, sessionID, receiver)
+	moderation.Reason = "by " + by
+	audit.write(moderation)
+}
+
+// Terminate logs the end of a session. exitCode is nil if the exit code is not known.
+func (audit *auditLog) Terminate(sessionID string, exitCode *int, reason string) {
+	audit.flushInput(func(_ *ttyReceiver, pendingSessionID string) bool { return pendingSessionID == sessionID })
+	audit.write(auditEvent{
+		Event:     auditEventTerminate,
+		SessionID: sessionID,
+		ExitCode:  exitCode,
+		Reason:    reason,
+	})
+}
+
+// Close closes the audit log file
+func (audit *auditLog) Close() error {
+	if audit == nil {
+		return nil
+	}
+	audit.flushInput(func(*ttyReceiver, string) bool { return true })
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	return audit.file.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAuditEvents(t *testing.T, path string) (events []auditEvent) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid audit log line %q: %s", scanner.Text(), err.Error())
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+func TestAuditLogRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := newAuditLog(AuditConfig{
+		Path:           path,
+		Input:          auditInputRedact,
+		RedactPatterns: []string{`token=\S+`},
+		RedactNoEcho:   true,
+	})
+	if err != nil {
+		t.Fatalf("Cannot open the audit log: %s", err.Error())
+	}
+	receiver := &ttyReceiver{id: "r1", identity: Identity{Name: "alice", Role: "admin"}, remoteAddr: "10.0.0.1:1234"}
+
+	audit.Join("s1", receiver)
+	audit.Input("s1", receiver, []byte("curl -d token=secret host\r"), true)
+	audit.Input("s1", receiver, []byte("hunter2\r"), false)
+	audit.Input("s1", receiver, []byte{0xff, 'a'}, true)
+	audit.Leave("s1", receiver, "closed")
+	audit.Close()
+
+	events := readAuditEvents(t, path)
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 audit events, got %d", len(events))
+	}
+	if events[0].Event != auditEventJoin || events[0].Identity != "alice" || events[0].RemoteAddr != "10.0.0.1:1234" {
+		t.Fatalf("Unexpected join event: %+v", events[0])
+	}
+	if events[1].Data != "curl -d [REDACTED] host\r" || !events[1].Redacted || events[1].Size != 26 {
+		t.Fatalf("The input matching the pattern was not redacted: %+v", events[1])
+	}
+	if events[2].Data != "" || !events[2].Redacted {
+		t.Fatalf("The input typed without echo was not redacted: %+v", events[2])
+	}
+	if events[3].DataBase64 != "/2E=" {
+		t.Fatalf("Invalid UTF-8 input was not base64 encoded: %+v", events[3])
+	}
+	if events[4].Event != auditEventLeave || events[4].Reason != "closed" {
+		t.Fatalf("Unexpected leave event: %+v", events[4])
+	}
+}
+
+func TestAuditLogRedactsTypedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := newAuditLog(AuditConfig{Path: path, Input: auditInputRedact, RedactPatterns: []string{`token=\S+`}})
+	if err != nil {
+		t.Fatalf("Cannot open the audit log: %s", err.Error())
+	}
+	alice := &ttyReceiver{id: "r1", identity: Identity{Name: "alice"}}
+	bob := &ttyReceiver{id: "r2", identity: Identity{Name: "bob"}}
+
+	// The receivers type a key at a time, at the same time
+	for _, key := range "token=secret\r" {
+		audit.Input("s1", alice, []byte(string(key)), true)
+		audit.Input("s1", bob, []byte(string(key)), true)
+	}
+	audit.Input("s1", alice, []byte("token=unfinished"), true)
+	audit.Terminate("s1", nil, "exited")
+	audit.Close()
+
+	events := readAuditEvents(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 audit events, got %+v", events)
+	}
+	for i, receiver := range []string{"r1", "r2"} {
+		if event := events[i]; event.Receiver != receiver || event.Data != "[REDACTED]\r" || !event.Redacted || event.Size != 13 {
+			t.Errorf("Expected the line typed by %s to be redacted, got %+v", receiver, event)
+		}
+	}
+	if events[2].Data != "[REDACTED]" || events[3].Event != auditEventTerminate {
+		t.Errorf("Expected the unfinished line to be logged before the end of the session, got %+v", events[2:])
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	authCookieName = "tty_auth"
+	authCookieTTL  = 12 * time.Hour
+	loginPath      = "/auth/login"
+	logoutPath     = "/auth/logout"
+)
+
+var errInvalidCookie = errors.New("Invalid or expired cookie")
+
+// loginProvider logs the users in, interactively, in the browser
+type loginProvider interface {
+	// HandleLogin starts the login of a user, who is sent to next once logged in
+	HandleLogin(w http.ResponseWriter, r *http.Request, next string)
+	// RegisterRoutes adds the routes the provider needs, under /auth/. The provider logs the users
+	// in with server.completeLogin, once it knows who they are.
+	RegisterRoutes(router *mux.Router, server *TTYServer)
+}
+
+// cookieSigner signs the values the server keeps in cookies, so the clients can't change them.
+// The purpose of a value is part of the signature, so a value signed for one purpose can't be
+// used for another one.
+type cookieSigner struct {
+	key []byte
+}
+
+type signedValue struct {
+	Value   json.RawMessage `json:"v"`
+	Expires int64           `json:"e"`
+}
+
+func newCookieSigner(key []byte) *cookieSigner {
+	return &cookieSigner{key: key}
+}
+
+func (signer *cookieSigner) mac(purpose, payload string) string {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encode returns the signed value, valid for the given time
+func (signer *cookieSigner) Encode(purpose string, value interface{}, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	signed, err := json.Marshal(signedValue{Value: data, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(signed)
+	return payload + "." + signer.mac(purpose, payload), nil
+}
+
+// Decode checks the signature and the expiry time of an encoded value, and decodes it in value
+func (signer *cookieSigner) Decode(purpose, encoded string, value interface{}) error {
+	separator := strings.LastIndexByte(encoded, '.')
+	if separator < 0 {
+		return errInvalidCookie
+	}
+	payload, mac := encoded[:separator], encoded[separator+1:]
+	if !hmac.Equal([]byte(mac), []byte(signer.mac(purpose, payload))) {
+		return errInvalidCookie
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidCookie
+	}
+	var signed signedValue
+	if err = json.Unmarshal(data, &signed); err != nil || time.Now().Unix() > signed.Expires {
+		return errInvalidCookie
+	}
+	return json.Unmarshal(signed.Value, value)
+}
+
+// setSignedCookie sets a cookie holding a signed value, only readable by the server
+func (signer *cookieSigner) setSignedCookie(w http.ResponseWriter, r *http.Request, name, path string, value interface{}, ttl time.Duration) error {
+	encoded, err := signer.Encode(name, value, ttl)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded,
+		Path:     path,
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readSignedCookie decodes the value of a cookie set with setSignedCookie
+func (signer *cookieSigner) readSignedCookie(r *http.Request, name string, value interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return signer.Decode(name, cookie.Value, value)
+}
+
+func clearCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, HttpOnly: true})
+}
+
+// identify returns the identity of the user making the request
+func (server *TTYServer) identify(r *http.Request) Identity {
+	if identity, ok := server.config.ClientCertAuth.Identify(r); ok {
+		return identity
+	}
+	if server.config.Cookies != nil {
+		var identity Identity
+		if err := server.config.Cookies.readSignedCookie(r, authCookieName, &identity); err == nil {
+			return identity
+		}
+	}
+	return anonymous
+}
+
+// safeRedirectPath returns next if it is a path on this server, so the login can't be used to
+// send the users somewhere else
+func safeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// authMiddleware makes sure the users are logged in, when a login provider is configured. The
+// browsers are sent to the login page, and the other clients get an error.
+func (server *TTYServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.config.Login == nil || strings.HasPrefix(r.URL.Path, "/static/") ||
+			strings.HasPrefix(r.URL.Path, "/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if server.identify(r).Method != authMethodNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		server.config.Metrics.AuthFailure("unauthenticated")
+		if websocket.IsWebSocketUpgrade(r) || strings.HasPrefix(r.URL.Path, "/api/") ||
+			strings.HasPrefix(r.URL.Path, "/ws/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	})
+}
+
+// completeLogin logs a user in, with a signed cookie holding their identity
+func (server *TTYServer) completeLogin(w http.ResponseWriter, r *http.Request, identity Identity, next string) {
+	if err := server.config.Cookies.setSignedCookie(w, r, authCookieName, "/", identity, authCookieTTL); err != nil {
+		log.Errorf("Cannot log in %s: %s", identity.Name, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Logged in %s (%s), with role %s", identity.Name, identity.Method, identity.Role)
+	http.Redirect(w, r, safeRedirectPath(next), http.StatusFound)
+}
+
+func (server *TTYServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if server.config.Login == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	server.config.Login.HandleLogin(w, r, safeRedirectPath(r.URL.Query().Get("next")))
+}
+
+func (server *TTYServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, authCookieName, "/")
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleMe sends the identity of the user making the request, as JSON
+func (server *TTYServer) handleMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server.identify(r))
+}
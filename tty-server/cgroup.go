@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCgroupRoot  = "/sys/fs/cgroup/tty-server"
+	cgroupCPUPeriod    = 100000
+	cgroupPollInterval = 2 * time.Second
+
+	// sessionInitCommand is the argument the server re-executes itself with, to run the command of
+	// a session only once the server has put it in its cgroup
+	sessionInitCommand = "session-init"
+	// sessionWaitEnvName is the variable holding the file descriptor the process reads from, until
+	// the server lets it run
+	sessionWaitEnvName = "TTY_SERVER_WAIT_FD"
+)
+
+// The resource events sent to the receivers
+const (
+	resourceEventOOMKill      = "oom_kill"
+	resourceEventCPUThrottled = "cpu_throttled"
+	resourceEventPIDsMax      = "pids_max"
+)
+
+var (
+	cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+	cgroupNamePattern = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+	ioDeviceNumbers   = regexp.MustCompile(`^[0-9]+:[0-9]+$`)
+	byteSizeUnits     = map[string]uint64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+)
+
+// ioLimit limits how much a session reads from and writes to a block device
+type ioLimit struct {
+	// Device is the path of the block device, or its "major:minor" numbers
+	Device    string `json:"device"`
+	ReadBPS   uint64 `json:"read_bps,omitempty"`
+	WriteBPS  uint64 `json:"write_bps,omitempty"`
+	ReadIOPS  uint64 `json:"read_iops,omitempty"`
+	WriteIOPS uint64 `json:"write_iops,omitempty"`
+}
+
+// resourceLimits are the limits of the cgroup each session of a profile runs in
+type resourceLimits struct {
+	// CPUs is how many CPUs the session can use, e.g. 0.5 for half of one
+	CPUs float64 `json:"cpus,omitempty"`
+	// Memory is the memory limit, in bytes, or with a K, M, G or T suffix
+	Memory string    `json:"memory,omitempty"`
+	PIDs   int       `json:"pids,omitempty"`
+	IO     []ioLimit `json:"io,omitempty"`
+
+	memoryBytes uint64
+}
+
+// cgroupSetting is a value written to a file of a cgroup
+type cgroupSetting struct {
+	file  string
+	value string
+}
+
+// parseByteSize parses a size in bytes, with an optional K, M, G or T suffix
+func parseByteSize(size string) (uint64, error) {
+	size = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	suffix := ""
+	if size != "" && strings.ContainsAny(size[len(size)-1:], "KMGT") {
+		suffix = size[len(size)-1:]
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, &TTYServerError{msg: "Invalid size: " + size + suffix}
+	}
+	return value * byteSizeUnits[suffix], nil
+}
+
+// validate checks the limits of a profile, and finds the numbers of their devices
+func (limits *resourceLimits) validate(profileName string) (err error) {
+	invalid := func(reason string) error {
+		return &TTYServerError{msg: "Invalid limits in the profile " + profileName + ": " + reason}
+	}
+	if limits.CPUs < 0 || limits.PIDs < 0 {
+		return invalid("the limits can't be negative")
+	}
+	if limits.Memory != "" {
+		if limits.memoryBytes, err = parseByteSize(limits.Memory); err != nil {
+			return invalid(err.Error())
+		}
+	}
+	for i := range limits.IO {
+		limit := &limits.IO[i]
+		if ioDeviceNumbers.MatchString(limit.Device) {
+			continue
+		}
+		var stat unix.Stat_t
+		if err = unix.Stat(limit.Device, &stat); err != nil || stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+			return invalid(limit.Device + " is not a block device")
+		}
+		rdev := uint64(stat.Rdev)
+		limit.Device = fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))
+	}
+	return nil
+}
+
+// settings returns what is written to the files of a cgroup to set the limits
+func (limits *resourceLimits) settings() (settings []cgroupSetting) {
+	if limits.CPUs > 0 {
+		quota := int(limits.CPUs * cgroupCPUPeriod)
+		settings = append(settings, cgroupSetting{"cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)})
+	}
+	if limits.memoryBytes > 0 {
+		settings = append(settings, cgroupSetting{"memory.max", strconv.FormatUint(limits.memoryBytes, 10)})
+	}
+	if limits.PIDs > 0 {
+		settings = append(settings, cgroupSetting{"pids.max", strconv.Itoa(limits.PIDs)})
+	}
+	for _, limit := range limits.IO {
+		value := limit.Device
+		rates := []uint64{limit.ReadBPS, limit.WriteBPS, limit.ReadIOPS, limit.WriteIOPS}
+		for i, key := range []string{"rbps", "wbps", "riops", "wiops"} {
+			if rates[i] > 0 {
+				value += " " + key + "=" + strconv.FormatUint(rates[i], 10)
+			}
+		}
+		settings = append(settings, cgroupSetting{"io.max", value})
+	}
+	return
+}
+
+// cgroupManager creates the cgroups of the sessions, in a cgroup v2 the server can write to
+type cgroupManager struct {
+	root string
+}
+
+// newCgroupManager creates the cgroup holding the cgroups of the sessions, and enables the
+// controllers it needs in it
+func newCgroupManager(root string) (*cgroupManager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	available, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return nil, &TTYServerError{msg: root + " is not a cgroup v2: " + err.Error()}
+	}
+	for _, controller := range cgroupControllers {
+		if !containsString(strings.Fields(string(available)), controller) {
+			log.Warnf("The %s controller is not enabled for %s, so its limits won't apply", controller, root)
+			continue
+		}
+		if err = writeCgroupFile(root, "cgroup.subtree_control", "+"+controller); err != nil {
+			return nil, err
+		}
+	}
+	return &cgroupManager{root: root}, nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return &TTYServerError{msg: "Cannot write " + value + " to " + filepath.Join(dir, file) + ": " + err.Error()}
+	}
+	return nil
+}
+
+// Create creates the cgroup of a session, with its limits
+func (manager *cgroupManager) Create(sessionID string, limits *resourceLimits) (*sessionCgroup, error) {
+	if manager == nil {
+		return nil, &TTYServerError{msg: "The cgroups are not set up"}
+	}
+	// Another session with the same ID may be ending
+	name := "session-" + cgroupNamePattern.ReplaceAllString(sessionID, "_") + "-" + cgroupNamePattern.ReplaceAllString(randomString()[:8], "_")
+	dir := filepath.Join(manager.root, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, setting := range limits.settings() {
+		if err := writeCgroupFile(dir, setting.file, setting.value); err != nil {
+			os.Remove(dir)
+			return nil, err
+		}
+	}
+	return &sessionCgroup{dir: dir, done: make(chan struct{})}, nil
+}
+
+// sessionCgroup is the cgroup a session runs in
+type sessionCgroup struct {
+	dir        string
+	done       chan struct{}
+	removeOnce sync.Once
+}
+
+// cgroupStats is what a session uses of its resources, and how often it hit its limits
+type cgroupStats struct {
+	MemoryBytes      uint64 `json:"memory_bytes"`
+	MemoryMaxEvents  uint64 `json:"memory_max_events"`
+	OOMKills         uint64 `json:"oom_kills"`
+	CPUUsageUsec     uint64 `json:"cpu_usage_usec"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	ThrottledUsec    uint64 `json:"throttled_usec"`
+	PIDs             uint64 `json:"pids"`
+	PIDsMaxEvents    uint64 `json:"pids_max_events"`
+}
+
+// Add moves a process to the cgroup
+func (cgroup *sessionCgroup) Add(pid int) error {
+	return writeCgroupFile(cgroup.dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// readKeys reads a file of a cgroup made of "key value" lines
+func (cgroup *sessionCgroup) readKeys(file string) map[string]uint64 {
+	values := make(map[string]uint64)
+	data, err := os.Open(filepath.Join(cgroup.dir, file))
+	if err != nil {
+		return values
+	}
+	defer data.Close()
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return values
+}
+
+func (cgroup *sessionCgroup) readValue(file string) uint64 {
+	data, _ := ioutil.ReadFile(filepath.Join(cgroup.dir, file))
+	value, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return value
+}
+
+// Stats returns what the session uses, from the files of the cgroup
+func (cgroup *sessionCgroup) Stats() cgroupStats {
+	memoryEvents := cgroup.readKeys("memory.events")
+	cpuStat := cgroup.readKeys("cpu.stat")
+	return cgroupStats{
+		MemoryBytes:      cgroup.readValue("memory.current"),
+		MemoryMaxEvents:  memoryEvents["max"],
+		OOMKills:         memoryEvents["oom_kill"],
+		CPUUsageUsec:     cpuStat["usage_usec"],
+		ThrottledPeriods: cpuStat["nr_throttled"],
+		ThrottledUsec:    cpuStat["throttled_usec"],
+		PIDs:             cgroup.readValue("pids.current"),
+		PIDsMaxEvents:    cgroup.readKeys("pids.events")["max"],
+	}
+}
+
+// Watch reports when the session hits its limits, until the cgroup is removed
+func (cgroup *sessionCgroup) Watch(report func(event ttyCommon.MsgTTYResourceEvent)) {
+	ticker := time.NewTicker(cgroupPollInterval)
+	defer ticker.Stop()
+	last := cgroup.Stats()
+	throttled := false
+	for {
+		select {
+		case <-cgroup.done:
+			return
+		case <-ticker.C:
+		}
+		stats := cgroup.Stats()
+		var events []ttyCommon.MsgTTYResourceEvent
+		events, throttled = resourceEvents(last, stats, throttled)
+		for _, event := range events {
+			report(event)
+		}
+		last = stats
+	}
+}
+
+// resourceEvents returns the limits the session hit between two readings of its stats, and if it
+// was throttled. The CPU throttling is only reported when it starts, not for as long as it lasts.
+func resourceEvents(last, stats cgroupStats, wasThrottled bool) (events []ttyCommon.MsgTTYResourceEvent, throttled bool) {
+	if kills := stats.OOMKills - last.OOMKills; kills > 0 {
+		events = append(events, ttyCommon.MsgTTYResourceEvent{
+			Kind:    resourceEventOOMKill,
+			Count:   kills,
+			Message: fmt.Sprintf("The session ran out of memory: %d process(es) killed", kills),
+		})
+	}
+	if stats.PIDsMaxEvents > last.PIDsMaxEvents {
+		events = append(events, ttyCommon.MsgTTYResourceEvent{
+			Kind:    resourceEventPIDsMax,
+			Count:   stats.PIDsMaxEvents - last.PIDsMaxEvents,
+			Message: "The session can't start more processes",
+		})
+	}
+	throttled = stats.ThrottledPeriods > last.ThrottledPeriods
+	if throttled && !wasThrottled {
+		events = append(events, ttyCommon.MsgTTYResourceEvent{
+			Kind:    resourceEventCPUThrottled,
+			Count:   stats.ThrottledPeriods - last.ThrottledPeriods,
+			Message: "The session is slowed down, as it uses all of its CPU",
+		})
+	}
+	return
+}
+
+// Remove kills what is left of the session, and removes its cgroup
+func (cgroup *sessionCgroup) Remove() {
+	cgroup.removeOnce.Do(cgroup.remove)
+}
+
+func (cgroup *sessionCgroup) remove() {
+	close(cgroup.done)
+	// Only supported since Linux 5.14
+	writeCgroupFile(cgroup.dir, "cgroup.kill", "1")
+	// The killed processes leave the cgroup asynchronously
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Remove(cgroup.dir); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Warnf("Cannot remove the cgroup %s: %s", cgroup.dir, err.Error())
+}
+
+// runSessionInit runs the command of a session, once the server lets it. It only returns if that
+// fails.
+func runSessionInit() {
+	err := waitForServer()
+	if err == nil && len(os.Args) < 3 {
+		err = &TTYServerError{msg: "No command to run"}
+	}
+	var path string
+	if err == nil {
+		path, err = exec.LookPath(os.Args[2])
+	}
+	if err == nil {
+		err = syscall.Exec(path, os.Args[2:], os.Environ())
+	}
+	// This goes to the terminal of the session
+	fmt.Fprintf(os.Stderr, "Cannot start the session: %s\r\n", err.Error())
+	os.Exit(1)
+}
+
+// waitForServer blocks until the server lets the process run, if it has to wait for it
+func waitForServer() error {
+	fd, err := strconv.Atoi(os.Getenv(sessionWaitEnvName))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(sessionWaitEnvName)
+	file := os.NewFile(uintptr(fd), "wait")
+	defer file.Close()
+	if _, err = io.ReadFull(file, make([]byte, 1)); err != nil {
+		return &TTYServerError{msg: "The server didn't let the session start"}
+	}
+	return nil
+}
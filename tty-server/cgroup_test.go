@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResourceLimits(t *testing.T) {
+	for size, expected := range map[string]uint64{"512": 512, "64k": 64 << 10, "512M": 512 << 20, "2GB": 2 << 30} {
+		if value, err := parseByteSize(size); err != nil || value != expected {
+			t.Errorf("Expected %s to be %d bytes, got %d %v", size, expected, value, err)
+		}
+	}
+	for _, size := range []string{"", "M", "-1M", "12X"} {
+		if _, err := parseByteSize(size); err == nil {
+			t.Errorf("Expected %q to be refused", size)
+		}
+	}
+
+	invalid := []resourceLimits{
+		{CPUs: -1},
+		{Memory: "lots"},
+		{IO: []ioLimit{{Device: "/etc/passwd", ReadBPS: 1}}},
+	}
+	for _, limits := range invalid {
+		if err := limits.validate("p"); err == nil {
+			t.Errorf("Expected %+v to be refused", limits)
+		}
+	}
+
+	limits := resourceLimits{CPUs: 0.5, Memory: "256M", PIDs: 64, IO: []ioLimit{{Device: "8:0", ReadBPS: 1000, WriteIOPS: 10}}}
+	if err := limits.validate("p"); err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]string{}
+	for _, setting := range limits.settings() {
+		settings[setting.file] = setting.value
+	}
+	expected := map[string]string{
+		"cpu.max":    "50000 100000",
+		"memory.max": strconv.Itoa(256 << 20),
+		"pids.max":   "64",
+		"io.max":     "8:0 rbps=1000 wiops=10",
+	}
+	for file, value := range expected {
+		if settings[file] != value {
+			t.Errorf("Expected %s to be %q, got %q", file, value, settings[file])
+		}
+	}
+}
+
+func TestResourceEvents(t *testing.T) {
+	last := cgroupStats{OOMKills: 1, ThrottledPeriods: 10}
+	events, throttled := resourceEvents(last, cgroupStats{OOMKills: 3, ThrottledPeriods: 12, PIDsMaxEvents: 1}, false)
+	if len(events) != 3 || !throttled || events[0].Kind != resourceEventOOMKill || events[0].Count != 2 {
+		t.Errorf("Expected an OOM kill, the PID limit and the throttling to be reported, got %+v", events)
+	}
+	// The throttling goes on, and isn't reported again
+	events, throttled = resourceEvents(last, cgroupStats{OOMKills: 1, ThrottledPeriods: 20}, true)
+	if len(events) != 0 || !throttled {
+		t.Errorf("Expected nothing to be reported, got %+v", events)
+	}
+}
+
+func TestSessionCgroup(t *testing.T) {
+	// The cgroup is a directory, with the files the kernel would have
+	root, err := ioutil.TempDir("", "tty-server-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644)
+	manager, err := newCgroupManager(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := &resourceLimits{PIDs: 10}
+	limits.validate("p")
+	cgroup, err := manager.Create("1/../2", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(cgroup.dir) != root || !strings.HasPrefix(filepath.Base(cgroup.dir), "session-1____2-") {
+		t.Errorf("Expected the cgroup to be created in %s, got %s", root, cgroup.dir)
+	}
+	ioutil.WriteFile(filepath.Join(cgroup.dir, "memory.events"), []byte("low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(cgroup.dir, "memory.current"), []byte("4096\n"), 0644)
+	if stats := cgroup.Stats(); stats.OOMKills != 1 || stats.MemoryMaxEvents != 4 || stats.MemoryBytes != 4096 {
+		t.Errorf("Expected the stats to be read, got %+v", stats)
+	}
+
+	// The command only runs once it was added to the cgroup
+	output := filepath.Join(root, "output")
+	session := ptyMasterNew("1")
+	session.SetCgroup(cgroup)
+	if err = session.Start("sh", []string{"-c", "echo $$ > " + output}, nil); err != nil {
+		t.Fatal(err)
+	}
+	session.Wait()
+	pid, _ := ioutil.ReadFile(filepath.Join(cgroup.dir, "cgroup.procs"))
+	ran, _ := ioutil.ReadFile(output)
+	if len(pid) == 0 || strings.TrimSpace(string(ran)) != string(pid) {
+		t.Errorf("Expected the command to run in the cgroup, got %q and %q", pid, ran)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+const (
+	defaultChatHistorySize = 100
+	maxChatMessageLength   = 2000
+)
+
+// chatConfig says how many messages the chats of the sessions keep for the receivers joining
+// them, and if the messages are recorded and written in the audit log
+type chatConfig struct {
+	HistorySize int
+	Record      bool
+	Audit       bool
+}
+
+// sessionChat is the chat of a session, with its last messages
+type sessionChat struct {
+	config chatConfig
+	// lock makes the receivers joining get all the messages, either in the history or one by one
+	lock    sync.Mutex
+	history []ttyCommon.MsgTTYChatMessage
+}
+
+// SetChat lets the receivers of the session chat. It has to be called before the receivers join.
+func (pty *ptyMaster) SetChat(config chatConfig) {
+	pty.chat = &sessionChat{config: config}
+}
+
+// chatJoin sends the last messages of the chat to a receiver joining the session
+func (pty *ptyMaster) chatJoin(receiver *ttyReceiver) {
+	chat := pty.chat
+	if chat == nil {
+		return
+	}
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	history := ttyCommon.MsgTTYChatHistory{Messages: append([]ttyCommon.MsgTTYChatMessage{}, chat.history...)}
+	if err := receiver.conn.WriteMessage(history); err != nil {
+		log.Debugf("Cannot send the chat history to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+	}
+}
+
+// cleanChatText removes the control characters from a chat message, but the new lines, and the
+// spaces around it
+func cleanChatText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.TrimSpace(text)
+}
+
+// handleChat sends what a receiver said to all the receivers of the session, and keeps it in the
+// history, the recording and the audit log
+func (pty *ptyMaster) handleChat(receiver *ttyReceiver, msg ttyCommon.MsgTTYChat) {
+	chat := pty.chat
+	if chat == nil {
+		return
+	}
+	text := cleanChatText(msg.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxChatMessageLength {
+		return
+	}
+	if !pty.limits.Input(receiver, len(text)) {
+		receiver.conn.WriteMessage(ttyCommon.MsgTTYLimitExceeded{
+			Limit:   "input",
+			Message: "You are sending messages too fast, your message was dropped",
+		})
+		return
+	}
+
+	message := ttyCommon.MsgTTYChatMessage{
+		ReceiverID:    receiver.id,
+		Name:          receiver.name,
+		Identity:      receiver.identity.Name,
+		Authenticated: receiver.identity.Method != authMethodNone,
+		Text:          text,
+		Time:          time.Now().UTC(),
+	}
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	if chat.config.HistorySize > 0 {
+		if len(chat.history) >= chat.config.HistorySize {
+			chat.history = append(chat.history[:0:0], chat.history[len(chat.history)-chat.config.HistorySize+1:]...)
+		}
+		chat.history = append(chat.history, message)
+	}
+	if chat.config.Record && pty.recorder != nil {
+		if err := pty.recorder.WriteChat(receiver, text); err != nil {
+			log.Warnf("Cannot record the chat of session %s: %s", pty.sessionID, err.Error())
+		}
+	}
+	if chat.config.Audit {
+		pty.audit.Chat(pty.sessionID, receiver, text)
+	}
+
+	for _, r := range pty.GetReceivers() {
+		if err := r.conn.WriteMessage(message); err != nil {
+			log.Debugf("Cannot send a chat message to receiver %s of session %s: %s", r.id, pty.sessionID, err.Error())
+		}
+	}
+}
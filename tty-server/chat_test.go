@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// chatMessages returns the texts of the chat messages a receiver was sent, in the history or one by
+// one, with the identity of the receivers which are logged in
+func chatMessages(t *testing.T, conn *messageConn) (texts []string) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	decoder := json.NewDecoder(bytes.NewReader(conn.buffer.Bytes()))
+	for decoder.More() {
+		var msg ttyCommon.MsgAll
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case ttyCommon.MsgIDChatHistory:
+			var history ttyCommon.MsgTTYChatHistory
+			json.Unmarshal(msg.Data, &history)
+			for _, message := range history.Messages {
+				texts = append(texts, "history "+chatText(message))
+			}
+		case ttyCommon.MsgIDChatMessage:
+			var message ttyCommon.MsgTTYChatMessage
+			json.Unmarshal(msg.Data, &message)
+			texts = append(texts, chatText(message))
+		}
+	}
+	return
+}
+
+func chatText(message ttyCommon.MsgTTYChatMessage) string {
+	if message.Authenticated {
+		return message.Name + " <" + message.Identity + ">: " + message.Text
+	}
+	return message.Name + ": " + message.Text
+}
+
+func TestChat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-server-chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := newAuditLog(AuditConfig{Path: filepath.Join(dir, "audit.log"), Input: auditInputNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newSessionRecorder(newStreamRecordingSink(ioutil.Discard), "1", 80, 24, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	session := ptyMasterNew("1")
+	session.SetAuditLog(audit)
+	session.SetRecorder(recorder)
+	session.SetChat(chatConfig{HistorySize: 2, Record: true, Audit: true})
+	join := func(name string) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: name}
+		return receiver, joinSession(session, receiver, false)
+	}
+
+	ada, adaConn := join("ada")
+	for _, text := range []string{"one", "  \x1b[2Jtwo\r\n", " ", "three", strings.Repeat("x", maxChatMessageLength+1)} {
+		session.handleChat(ada, ttyCommon.MsgTTYChat{Text: text})
+	}
+	_, bobConn := join("bob")
+	session.handleChat(ada, ttyCommon.MsgTTYChat{Text: "look at line 40"})
+
+	// A receiver taking the name of a logged in user is told apart from it by its identity
+	carol := &ttyReceiver{id: "carol", identity: Identity{Name: "carol", Method: authMethodOIDC}}
+	carolConn := joinSession(session, carol, false)
+	impostor := &ttyReceiver{id: "impostor", name: "carol"}
+	joinSession(session, impostor, false)
+	session.handleChat(carol, ttyCommon.MsgTTYChat{Text: "hi"})
+	session.handleChat(impostor, ttyCommon.MsgTTYChat{Text: "I'm carol"})
+
+	expected := map[*messageConn]string{
+		adaConn: "ada: one|ada: [2Jtwo|ada: three|ada: look at line 40|carol <carol>: hi|carol: I'm carol",
+		// Only the last messages are kept for the late joiners
+		bobConn:   "history ada: [2Jtwo|history ada: three|ada: look at line 40|carol <carol>: hi|carol: I'm carol",
+		carolConn: "history ada: three|history ada: look at line 40|carol <carol>: hi|carol: I'm carol",
+	}
+	for conn, messages := range expected {
+		if got := strings.Join(chatMessages(t, conn), "|"); got != messages {
+			t.Errorf("Expected the messages %q, got %q", messages, got)
+		}
+	}
+
+	recorder.lock.Lock()
+	recorded := recorder.buffer.String()
+	recorder.lock.Unlock()
+	if !strings.Contains(recorded, `"c","{\"receiver\":\"ada\",\"name\":\"ada\",\"identity\":\"anonymous\",\"text\":\"one\"}"`) {
+		t.Errorf("Expected the chat to be recorded, got %s", recorded)
+	}
+	audit.Close()
+	var events []auditEvent
+	for _, event := range readAuditEvents(t, filepath.Join(dir, "audit.log")) {
+		if event.Event == auditEventChat {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 6 || events[3].Data != "look at line 40" {
+		t.Errorf("Expected the chat to be audited, got %+v", events)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The shell integration marks the prompt and the commands in the output with OSC 133 sequences
+// (https://gitlab.freedesktop.org/Per_Bothner/specifications/blob/master/proposals/semantic-prompts.md):
+//
+//	ESC ] 133 ; A ST            - the prompt starts
+//	ESC ] 133 ; B ST            - the prompt ends, and the command line starts
+//	ESC ] 133 ; C [; cmdline_url=<url encoded command>] ST - the command starts running
+//	ESC ] 133 ; D [; <exit code>] ST - the command finished
+//
+// where ST is either BEL or ESC \.
+const (
+	markerPromptStart  = 'A'
+	markerCommandStart = 'B'
+	markerOutputStart  = 'C'
+	markerCommandEnd   = 'D'
+
+	maxMarkerLength      = 8 * 1024
+	defaultCommandsLimit = 1000
+)
+
+const (
+	markerStateGround = iota
+	markerStateEscape
+	markerStateOSC
+	markerStateOSCEscape
+)
+
+// shellCommand is a command run in a session, in its main window or in the window with that ID.
+// The output range is given as offsets in the output of the window, counted in bytes from its start.
+type shellCommand struct {
+	Window      string     `json:"window,omitempty"`
+	Command     string     `json:"command,omitempty"`
+	StartTime   time.Time  `json:"start_time"`
+	EndTime     *time.Time `json:"end_time,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	OutputStart int64      `json:"output_start"`
+	OutputEnd   *int64     `json:"output_end,omitempty"`
+}
+
+// commandTracker finds the shell integration markers in the output of a window of a session, and
+// keeps the history of the commands that were run
+type commandTracker struct {
+	lock        sync.Mutex
+	window      string
+	offset      int64
+	state       int
+	oscData     []byte
+	oscTooLong  bool
+	oscStart    int64
+	running     *shellCommand
+	history     []*shellCommand
+	maxCommands int
+}
+
+// newCommandTracker returns a tracker of the commands of a window, which is empty for the main one
+func newCommandTracker(window string, maxCommands int) *commandTracker {
+	if maxCommands <= 0 {
+		maxCommands = defaultCommandsLimit
+	}
+	return &commandTracker{window: window, maxCommands: maxCommands}
+}
+
+// Write feeds the tracker with the output of the session
+func (tracker *commandTracker) Write(data []byte) (int, error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for i, b := range data {
+		offset := tracker.offset + int64(i)
+		switch tracker.state {
+		case markerStateGround:
+			if b == 0x1b {
+				tracker.state = markerStateEscape
+				tracker.oscStart = offset
+			}
+		case markerStateEscape:
+			if b == ']' {
+				tracker.state = markerStateOSC
+				tracker.oscData = tracker.oscData[:0]
+				tracker.oscTooLong = false
+			} else if b != 0x1b {
+				tracker.state = markerStateGround
+			} else {
+				tracker.oscStart = offset
+			}
+		case markerStateOSC:
+			if b == 0x07 {
+				tracker.state = markerStateGround
+				tracker.handleOSC(offset + 1)
+			} else if b == 0x1b {
+				tracker.state = markerStateOSCEscape
+			} else if len(tracker.oscData) < maxMarkerLength {
+				tracker.oscData = append(tracker.oscData, b)
+			} else {
+				tracker.oscTooLong = true
+			}
+		case markerStateOSCEscape:
+			tracker.state = markerStateGround
+			if b == '\\' {
+				tracker.handleOSC(offset + 1)
+			} else if b == ']' {
+				// An unterminated OSC followed by a new one
+				tracker.state = markerStateOSC
+				tracker.oscData = tracker.oscData[:0]
+				tracker.oscTooLong = false
+				tracker.oscStart = offset - 1
+			}
+		}
+	}
+	tracker.offset += int64(len(data))
+	return len(data), nil
+}
+
+// handleOSC handles a complete OSC sequence, which ended right before the end offset
+func (tracker *commandTracker) handleOSC(end int64) {
+	if tracker.oscTooLong || !bytes.HasPrefix(tracker.oscData, []byte("133;")) || len(tracker.oscData) < 5 {
+		return
+	}
+	params := strings.Split(string(tracker.oscData[5:]), ";")
+	now := time.Now()
+
+	switch tracker.oscData[4] {
+	case markerOutputStart:
+		tracker.finishCommand(now, tracker.oscStart, nil)
+		command := &shellCommand{
+			Window:      tracker.window,
+			StartTime:   now,
+			OutputStart: end,
+		}
+		for _, param := range params {
+			if strings.HasPrefix(param, "cmdline_url=") {
+				command.Command, _ = url.PathUnescape(strings.TrimPrefix(param, "cmdline_url="))
+			}
+		}
+		tracker.running = command
+		tracker.history = append(tracker.history, command)
+		if len(tracker.history) > tracker.maxCommands {
+			tracker.history = tracker.history[len(tracker.history)-tracker.maxCommands:]
+		}
+	case markerCommandEnd:
+		var exitCode *int
+		if len(params) > 1 {
+			if code, err := strconv.Atoi(params[1]); err == nil {
+				exitCode = &code
+			}
+		}
+		tracker.finishCommand(now, tracker.oscStart, exitCode)
+	case markerPromptStart, markerCommandStart:
+		// A new prompt means the previous command finished, even if the shell didn't say so
+		tracker.finishCommand(now, tracker.oscStart, nil)
+	}
+}
+
+func (tracker *commandTracker) finishCommand(now time.Time, outputEnd int64, exitCode *int) {
+	if tracker.running == nil {
+		return
+	}
+	tracker.running.EndTime = &now
+	tracker.running.OutputEnd = &outputEnd
+	tracker.running.ExitCode = exitCode
+	tracker.running = nil
+}
+
+// Commands returns the commands run so far, the oldest first
+func (tracker *commandTracker) Commands() []shellCommand {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	commands := make([]shellCommand, len(tracker.history))
+	for i, command := range tracker.history {
+		commands[i] = *command
+	}
+	return commands
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandTrackerMarkers(t *testing.T) {
+	tracker := newCommandTracker("", 2)
+	output := "\x1b]133;A\x07$ \x1b]133;B\x07ls -l\r\n\x1b]133;C;cmdline_url=ls%20-l\x07" +
+		"total 0\r\n\x1b]133;D;2\x1b\\\x1b]133;A\x07$ \x1b]133;B\x07\x1b]133;C;cmdline_url=sleep%201\x07"
+	// Split the output in every place, markers included
+	for i := 0; i < len(output); i++ {
+		tracker.Write([]byte(output[i : i+1]))
+	}
+
+	commands := tracker.Commands()
+	if len(commands) != 2 {
+		t.Fatalf("Expected 2 commands, got %d", len(commands))
+	}
+	ls := commands[0]
+	if ls.Command != "ls -l" || ls.ExitCode == nil || *ls.ExitCode != 2 || ls.EndTime == nil {
+		t.Fatalf("Unexpected finished command: %+v", ls)
+	}
+	if got := output[ls.OutputStart:*ls.OutputEnd]; got != "total 0\r\n" {
+		t.Fatalf("Unexpected output range of the command: %q", got)
+	}
+	if sleep := commands[1]; sleep.Command != "sleep 1" || sleep.EndTime != nil || sleep.OutputEnd != nil {
+		t.Fatalf("Unexpected running command: %+v", sleep)
+	}
+
+	tracker.Write([]byte("\x1b]133;D;0\x07\x1b]133;C;cmdline_url=pwd\x07"))
+	if commands = tracker.Commands(); len(commands) != 2 || commands[0].Command != "sleep 1" {
+		t.Fatalf("Expected the history to keep the last 2 commands, got %+v", commands)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	csrfCookieName = "tty_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFieldName  = "csrf_token"
+	csrfPath       = "/auth/csrf"
+)
+
+// hostPattern matches the hosts which can be put in the Content-Security-Policy header as they are
+var hostPattern = regexp.MustCompile(`^[A-Za-z0-9.:\[\]-]+$`)
+
+// csrfProtector makes sure the requests changing something come from the pages of the server, and
+// not from another site the user visits. Every browser gets a random value in a cookie the other
+// sites can't read, and the requests have to carry a token derived from it, which the pages get
+// from the server (the double submit cookie pattern).
+type csrfProtector struct {
+	key []byte
+}
+
+func newCSRFProtector(key []byte) *csrfProtector {
+	return &csrfProtector{key: key}
+}
+
+func (protector *csrfProtector) token(nonce string) string {
+	mac := hmac.New(sha256.New, protector.key)
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns the token the requests of the browser have to carry, giving it a cookie if it has
+// none yet
+func (protector *csrfProtector) Token(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return protector.token(cookie.Value)
+	}
+	nonce := randomString()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    nonce,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// The request which set the cookie can already be checked
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: nonce})
+	return protector.token(nonce)
+}
+
+// Check tells if a request carries the right token, in the X-CSRF-Token header or the csrf_token
+// field of the form or the query
+func (protector *csrfProtector) Check(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		token = r.FormValue(csrfFieldName)
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(protector.token(cookie.Value)))
+}
+
+// csrfMiddleware refuses the requests which change something without the right token: all but the
+// GET, HEAD and OPTIONS ones, and the websockets, which create sessions and type in them
+func (server *TTYServer) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		safe := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+		if server.config.CSRF == nil || (safe && !websocket.IsWebSocketUpgrade(r)) ||
+			server.config.CSRF.Check(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Warnf("Refused %s %s from %s: missing or invalid CSRF token", r.Method, r.URL.Path, r.RemoteAddr)
+		server.config.Metrics.AuthFailure("csrf")
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+	})
+}
+
+// handleCSRFToken sends the token for the requests of the clients which don't get it from a page
+func (server *TTYServer) handleCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if server.config.CSRF == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"token": server.config.CSRF.Token(w, r)})
+}
+
+// csrfToken returns the token the pages embed, if CSRF tokens are used
+func (server *TTYServer) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if server.config.CSRF == nil {
+		return ""
+	}
+	return server.config.CSRF.Token(w, r)
+}
+
+// checkOrigin accepts the websockets opened by the pages of the server, or of the allowed origins.
+// The clients which are not browsers don't send an origin, and are accepted.
+func (server *TTYServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if originURL, err := url.Parse(origin); err == nil && strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range server.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Warnf("Refused the websocket from %s, opened by a page of %s", r.RemoteAddr, origin)
+	return false
+}
+
+// securityHeaders adds the headers limiting what the browsers let the pages do to every response:
+// where they load their resources from, who can frame them, and, over HTTPS, that the browsers
+// have to keep using HTTPS
+func (server *TTYServer) securityHeaders(next http.Handler) http.Handler {
+	frameAncestors := "'none'"
+	if len(server.config.FrameAncestors) > 0 {
+		frameAncestors = strings.Join(server.config.FrameAncestors, " ")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		// Some browsers don't count the websockets of the same host as 'self'
+		connectSources := "'self'"
+		if hostPattern.MatchString(r.Host) {
+			connectSources += fmt.Sprintf(" ws://%[1]s wss://%[1]s", r.Host)
+		}
+		header.Set("Content-Security-Policy", "default-src 'self'; "+
+			"script-src 'self' 'unsafe-inline' https://ajax.googleapis.com; style-src 'self' 'unsafe-inline'; "+
+			"img-src 'self' data:; font-src 'self' data:; connect-src "+connectSources+"; "+
+			"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors "+frameAncestors)
+		if len(server.config.FrameAncestors) == 0 {
+			header.Set("X-Frame-Options", "DENY")
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Referrer-Policy", "same-origin")
+		if r.TLS != nil && server.config.HSTSMaxAge > 0 {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(server.config.HSTSMaxAge/time.Second)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{CSRF: newCSRFProtector([]byte("test key")), FrontendPath: "../frontend/templates"})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// The session page doesn't create the session anymore, and gives its websocket the token
+	response, err := client.Get(ttyServer.URL + "/s/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if server.getSession("1") != nil {
+		t.Fatalf("Expected the session page not to create the session")
+	}
+	match := regexp.MustCompile(`csrfToken: "([^"]+)"`).FindSubmatch(page)
+	if match == nil || !strings.Contains(string(page), "csrf_token="+string(match[1])) {
+		t.Fatalf("Expected the page to embed the CSRF token, and to pass it to the websocket:\n%s", page)
+	}
+	token := string(match[1])
+
+	request := func(method, path, token string, header http.Header) int {
+		r, _ := http.NewRequest(method, ttyServer.URL+path, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		if token != "" {
+			r.Header.Set(csrfHeaderName, token)
+		}
+		response, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if status := request("DELETE", "/api/sessions/1", "", nil); status != http.StatusForbidden {
+		t.Errorf("Expected a request without the token to be refused, got %d", status)
+	}
+	if status := request("DELETE", "/api/sessions/1", "forged", nil); status != http.StatusForbidden {
+		t.Errorf("Expected a request with a forged token to be refused, got %d", status)
+	}
+	// The token is right, but there is no such session
+	if status := request("DELETE", "/api/sessions/1", token, nil); status != http.StatusNotFound {
+		t.Errorf("Expected a request with the token to be accepted, got %d", status)
+	}
+
+	upgrade := http.Header{
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	if status := request("GET", "/ws/1", "", upgrade); status != http.StatusForbidden {
+		t.Errorf("Expected a websocket without the token to be refused, got %d", status)
+	}
+	upgrade.Set("Origin", "https://evil.example.com")
+	if status := request("GET", "/ws/1", token, upgrade); status != http.StatusForbidden {
+		t.Errorf("Expected a websocket from another site to be refused, got %d", status)
+	}
+	if server.getSession("1") != nil {
+		t.Errorf("Expected no session to be created by the refused websockets")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	server := &TTYServer{config: TTYServerConfig{AllowedOrigins: []string{"https://portal.example.com/"}}}
+	for origin, expected := range map[string]bool{
+		"":                             true,
+		"https://tty.example.com":      true,
+		"https://portal.example.com":   true,
+		"https://evil.example.com":     false,
+		"https://tty.example.com.evil": false,
+	} {
+		r := httptest.NewRequest("GET", "https://tty.example.com/ws/1", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := server.checkOrigin(r); got != expected {
+			t.Errorf("Expected %v for the origin %q, got %v", expected, origin, got)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{})
+	recorder := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/does-not-exist", nil))
+	header := recorder.Header()
+	if csp := header.Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors 'none'") ||
+		!strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("Unexpected Content-Security-Policy: %s", csp)
+	}
+	if header.Get("X-Frame-Options") != "DENY" || header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Missing security headers: %v", header)
+	}
+	if header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("Expected no HSTS header over plain HTTP")
+	}
+}
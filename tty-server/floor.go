@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sync"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// The floor control modes of the profiles
+const (
+	floorControlDrop  = "drop"
+	floorControlQueue = "queue"
+	// floorQueueLimit is how much a receiver waiting for the keyboard can type ahead, in the queue
+	// mode
+	floorQueueLimit = 4096
+)
+
+func validateFloorControl(mode, profileName string) error {
+	if mode != "" && mode != floorControlDrop && mode != floorControlQueue {
+		return &TTYServerError{msg: "The floor control of the profile " + profileName + " has to be drop or queue"}
+	}
+	return nil
+}
+
+// floorControl gives the keyboard of a session to one receiver at a time. The others ask for it,
+// and the receiver holding it, or the owner of the session, grants it to them. The input of the
+// receivers not holding it is dropped, or, in the queue mode, kept until they get it, if they asked
+// for it.
+type floorControl struct {
+	mode     string
+	lock     sync.Mutex
+	holder   *ttyReceiver
+	requests []*ttyReceiver
+	queued   map[*ttyReceiver][]byte
+	// warned are the receivers already told their input is dropped
+	warned map[*ttyReceiver]bool
+}
+
+func newFloorControl(mode string) *floorControl {
+	return &floorControl{
+		mode:   mode,
+		queued: make(map[*ttyReceiver][]byte),
+		warned: make(map[*ttyReceiver]bool),
+	}
+}
+
+// SetFloorControl makes one receiver at a time type in the session, with a floor control mode. It
+// has to be called before the receivers join.
+func (pty *ptyMaster) SetFloorControl(mode string) {
+	if mode != "" {
+		pty.floor = newFloorControl(mode)
+	}
+}
+
+func floorReceiver(receiver *ttyReceiver) ttyCommon.FloorReceiver {
+	return ttyCommon.FloorReceiver{ID: receiver.id, Name: receiver.identity.Name}
+}
+
+// floorState returns who holds the keyboard, and who asks for it, for a receiver. It has to be
+// called with the floor lock held.
+func (pty *ptyMaster) floorState(receiver *ttyReceiver, message string) ttyCommon.MsgTTYFloorState {
+	floor := pty.floor
+	state := ttyCommon.MsgTTYFloorState{
+		Requests: []ttyCommon.FloorReceiver{},
+		Self:     receiver.id,
+		Owner:    pty.IsOwner(receiver),
+		Message:  message,
+	}
+	if floor.holder != nil {
+		holder := floorReceiver(floor.holder)
+		state.Holder = &holder
+	}
+	for _, r := range floor.requests {
+		state.Requests = append(state.Requests, floorReceiver(r))
+	}
+	return state
+}
+
+// sendFloorState tells the receivers who holds the keyboard, and who asks for it, with what
+// happened to some of them. It has to be called with the floor lock held.
+func (pty *ptyMaster) sendFloorState(notices map[*ttyReceiver]string) {
+	for _, receiver := range pty.GetReceivers() {
+		if err := receiver.conn.WriteMessage(pty.floorState(receiver, notices[receiver])); err != nil {
+			log.Debugf("Cannot send the floor state to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// grantFloor gives the keyboard to a receiver, and types what it queued. It has to be called with
+// the floor lock held.
+func (pty *ptyMaster) grantFloor(receiver *ttyReceiver) {
+	floor := pty.floor
+	floor.holder = receiver
+	floor.requests = removeFloorReceiver(floor.requests, receiver)
+	delete(floor.warned, receiver)
+	if queued := floor.queued[receiver]; len(queued) > 0 {
+		input := pty.inputFile(receiver)
+		if pty.audit != nil {
+			pty.audit.Input(pty.sessionID, receiver, queued, echoEnabled(input))
+		}
+		input.Write(queued)
+		pty.metrics.Bytes(metricsDirectionIn, len(queued))
+	}
+	delete(floor.queued, receiver)
+	log.Infof("Receiver %s (%s) holds the keyboard of session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+}
+
+// passFloor gives the keyboard nobody holds anymore to the first receiver asking for it, or else to
+// the owner of the session, unless it is the one giving it up. It has to be called with the floor
+// lock held.
+func (pty *ptyMaster) passFloor(previous *ttyReceiver) {
+	floor := pty.floor
+	floor.holder = nil
+	if len(floor.requests) > 0 {
+		pty.grantFloor(floor.requests[0])
+		return
+	}
+	for _, receiver := range pty.GetReceivers() {
+		if receiver != previous && !receiver.viewOnly && pty.IsOwner(receiver) {
+			pty.grantFloor(receiver)
+			return
+		}
+	}
+}
+
+// requested tells if a receiver asks for the keyboard. It has to be called with the floor lock held.
+func (floor *floorControl) requested(receiver *ttyReceiver) bool {
+	for _, r := range floor.requests {
+		if r == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFloorReceiver(receivers []*ttyReceiver, receiver *ttyReceiver) []*ttyReceiver {
+	for i, r := range receivers {
+		if r == receiver {
+			return append(receivers[:i:i], receivers[i+1:]...)
+		}
+	}
+	return receivers
+}
+
+// floorJoin gives the keyboard to the owner of the session, if nobody holds it when it joins
+func (pty *ptyMaster) floorJoin(receiver *ttyReceiver) {
+	floor := pty.floor
+	if floor == nil {
+		return
+	}
+	floor.lock.Lock()
+	defer floor.lock.Unlock()
+	if floor.holder == nil && !receiver.viewOnly && pty.IsOwner(receiver) {
+		pty.grantFloor(receiver)
+	}
+	pty.sendFloorState(nil)
+}
+
+// floorLeave passes the keyboard on, if the receiver leaving held it, and forgets its requests
+func (pty *ptyMaster) floorLeave(receiver *ttyReceiver) {
+	floor := pty.floor
+	if floor == nil {
+		return
+	}
+	floor.lock.Lock()
+	defer floor.lock.Unlock()
+	floor.requests = removeFloorReceiver(floor.requests, receiver)
+	delete(floor.queued, receiver)
+	delete(floor.warned, receiver)
+	if floor.holder == receiver {
+		pty.passFloor(receiver)
+	}
+	pty.sendFloorState(nil)
+}
+
+// floorInput tells if the input of a receiver can be typed in the session. The input of the
+// receivers not holding the keyboard is queued, in the queue mode, if they asked for it, and
+// dropped otherwise.
+func (pty *ptyMaster) floorInput(receiver *ttyReceiver, data []byte) bool {
+	floor := pty.floor
+	if floor == nil {
+		return true
+	}
+	floor.lock.Lock()
+	defer floor.lock.Unlock()
+	if floor.holder == receiver {
+		return true
+	}
+	if floor.mode == floorControlQueue && floor.requested(receiver) {
+		if queued := floor.queued[receiver]; len(queued)+len(data) <= floorQueueLimit {
+			floor.queued[receiver] = append(queued, data...)
+			return false
+		}
+	}
+	// Only told once, until it gets the keyboard
+	if !floor.warned[receiver] {
+		floor.warned[receiver] = true
+		log.Debugf("Dropping the input of receiver %s of session %s, who doesn't hold the keyboard", receiver.id, pty.sessionID)
+		receiver.conn.WriteMessage(pty.floorState(receiver, "You don't hold the keyboard, your input was dropped"))
+	}
+	return false
+}
+
+// handleFloorControl handles a receiver asking for the keyboard, giving it up, or granting or
+// denying it to another receiver
+func (pty *ptyMaster) handleFloorControl(receiver *ttyReceiver, msg ttyCommon.MsgTTYFloorControl) {
+	floor := pty.floor
+	if floor == nil {
+		return
+	}
+	floor.lock.Lock()
+	defer floor.lock.Unlock()
+
+	notices := make(map[*ttyReceiver]string)
+	var target *ttyReceiver
+	for _, r := range pty.GetReceivers() {
+		if r.id == msg.ReceiverID {
+			target = r
+		}
+	}
+	// The owner can grant the keyboard to anyone, the holder only to the receivers asking for it
+	canGrant := pty.IsOwner(receiver) ||
+		floor.holder == receiver && floor.requested(target)
+
+	switch msg.Action {
+	case ttyCommon.FloorActionRequest:
+		switch {
+		case receiver.viewOnly:
+			notices[receiver] = "You can't type in this session"
+		case floor.holder == nil:
+			pty.grantFloor(receiver)
+		case floor.holder != receiver && !floor.requested(receiver):
+			floor.requests = append(floor.requests, receiver)
+			notices[floor.holder] = receiver.identity.Name + " asks for the keyboard"
+		}
+	case ttyCommon.FloorActionRelease:
+		if floor.holder == receiver {
+			pty.passFloor(receiver)
+			if floor.holder != nil {
+				notices[floor.holder] = receiver.identity.Name + " gave you the keyboard"
+			}
+		} else {
+			// Gives up asking for it
+			floor.requests = removeFloorReceiver(floor.requests, receiver)
+			delete(floor.queued, receiver)
+		}
+	case ttyCommon.FloorActionGrant:
+		switch {
+		case target == nil || target.viewOnly:
+			notices[receiver] = "This receiver can't get the keyboard"
+		case !canGrant:
+			notices[receiver] = "Only the holder of the keyboard, or the owner of the session, can grant it"
+		case floor.holder != target:
+			pty.grantFloor(target)
+			notices[target] = receiver.identity.Name + " gave you the keyboard"
+		}
+	case ttyCommon.FloorActionDeny:
+		switch {
+		case target == nil:
+		case !canGrant:
+			notices[receiver] = "Only the holder of the keyboard, or the owner of the session, can deny it"
+		default:
+			floor.requests = removeFloorReceiver(floor.requests, target)
+			delete(floor.queued, target)
+			notices[target] = receiver.identity.Name + " denied you the keyboard"
+		}
+	default:
+		log.Warnf("Unknown floor control action %s from receiver %s", msg.Action, receiver.id)
+		return
+	}
+	pty.sendFloorState(notices)
+}
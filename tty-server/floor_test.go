@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// lastFloorState returns the last floor state the receiver was sent
+func (conn *messageConn) lastFloorState(t *testing.T) (state ttyCommon.MsgTTYFloorState) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	decoder := json.NewDecoder(bytes.NewReader(conn.buffer.Bytes()))
+	for decoder.More() {
+		var msg ttyCommon.MsgAll
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == ttyCommon.MsgIDFloorState {
+			state = ttyCommon.MsgTTYFloorState{}
+			json.Unmarshal(msg.Data, &state)
+		}
+	}
+	return
+}
+
+func TestFloorControl(t *testing.T) {
+	session := ptyMasterNew("1")
+	session.SetFloorControl(floorControlQueue)
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+
+	join := func(id string, owner, viewOnly bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: id, viewOnly: viewOnly}
+		return receiver, joinSession(session, receiver, owner)
+	}
+	owner, ownerConn := join("r1", true, false)
+	other, otherConn := join("r2", false, false)
+	viewer, viewerConn := join("r3", false, true)
+
+	if state := otherConn.lastFloorState(t); state.Holder == nil || state.Holder.ID != "r1" || state.Self != "r2" || state.Owner {
+		t.Fatalf("Expected the owner to hold the keyboard, got %+v", state)
+	}
+	if session.floorInput(other, []byte("ls")) || !session.floorInput(owner, []byte("ls")) {
+		t.Errorf("Expected only the holder to type")
+	}
+	if state := otherConn.lastFloorState(t); !strings.Contains(state.Message, "dropped") {
+		t.Errorf("Expected the receiver to be told its input is dropped, got %+v", state)
+	}
+
+	session.handleFloorControl(viewer, ttyCommon.MsgTTYFloorControl{Action: ttyCommon.FloorActionRequest})
+	session.handleFloorControl(other, ttyCommon.MsgTTYFloorControl{Action: ttyCommon.FloorActionRequest})
+	if state := viewerConn.lastFloorState(t); len(state.Requests) != 1 || state.Requests[0].ID != "r2" {
+		t.Errorf("Expected only the receiver which can type to ask for the keyboard, got %+v", state)
+	}
+	if state := ownerConn.lastFloorState(t); !state.Owner || !strings.Contains(state.Message, "asks for the keyboard") {
+		t.Errorf("Expected the holder to be told, got %+v", state)
+	}
+	// Typed ahead, while waiting for the keyboard
+	session.floorInput(other, []byte("pwd\n"))
+	if string(session.floor.queued[other]) != "pwd\n" {
+		t.Errorf("Expected the input to be queued, got %q", session.floor.queued[other])
+	}
+
+	// Only the holder, or the owner, grants the keyboard
+	session.handleFloorControl(viewer, ttyCommon.MsgTTYFloorControl{Action: ttyCommon.FloorActionGrant, ReceiverID: "r2"})
+	if session.floor.holder != owner {
+		t.Errorf("Expected the viewer not to grant the keyboard")
+	}
+	session.handleFloorControl(owner, ttyCommon.MsgTTYFloorControl{Action: ttyCommon.FloorActionGrant, ReceiverID: "r2"})
+	if state := otherConn.lastFloorState(t); state.Holder == nil || state.Holder.ID != "r2" || len(state.Requests) != 0 {
+		t.Errorf("Expected the keyboard to be granted, got %+v", state)
+	}
+	if len(session.floor.queued) != 0 {
+		t.Errorf("Expected the queued input to be typed")
+	}
+
+	// The keyboard goes back to the owner when its holder leaves
+	session.floorLeave(other)
+	if session.floor.holder != owner {
+		t.Errorf("Expected the owner to get the keyboard back")
+	}
+	session.handleFloorControl(owner, ttyCommon.MsgTTYFloorControl{Action: ttyCommon.FloorActionRelease})
+	if state := ownerConn.lastFloorState(t); state.Holder != nil {
+		t.Errorf("Expected nobody to hold the keyboard, got %+v", state)
+	}
+}
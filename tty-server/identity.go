@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// The ways a receiver can be authenticated
+const (
+	authMethodNone       = "none"
+	authMethodClientCert = "client_cert"
+)
+
+// The fields of a client certificate the identity can be taken from
+const (
+	certIdentityCommonName = "cn"
+	certIdentityEmail      = "email"
+	certIdentityDNS        = "dns"
+	certIdentityURI        = "uri"
+)
+
+const (
+	anonymousIdentity = "anonymous"
+	defaultRole       = "user"
+)
+
+// Identity is who a receiver is, as far as the server can tell
+type Identity struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+	Role   string   `json:"role"`
+	Method string   `json:"method"`
+}
+
+// anonymous is the identity of the receivers that are not authenticated
+var anonymous = Identity{Name: anonymousIdentity, Role: defaultRole, Method: authMethodNone}
+
+// roleMapping gives a role to the identities, from their name or their groups
+type roleMapping struct {
+	rules       []roleRule
+	defaultRole string
+}
+
+type roleRule struct {
+	user  string
+	group string
+	role  string
+}
+
+// newRoleMapping parses the role rules, which look like "<group>=<role>" or "user:<name>=<role>".
+// The first rule matching an identity gives its role, or defaultRole if none does.
+func newRoleMapping(rules []string, defaultRole string) (mapping *roleMapping, err error) {
+	mapping = &roleMapping{defaultRole: defaultRole}
+	for _, rule := range rules {
+		separator := strings.LastIndex(rule, "=")
+		if separator <= 0 || separator == len(rule)-1 {
+			return nil, &TTYServerError{msg: "Invalid role mapping: " + rule}
+		}
+		match, role := rule[:separator], rule[separator+1:]
+		if strings.HasPrefix(match, "user:") {
+			mapping.rules = append(mapping.rules, roleRule{user: strings.TrimPrefix(match, "user:"), role: role})
+		} else {
+			mapping.rules = append(mapping.rules, roleRule{group: match, role: role})
+		}
+	}
+	return
+}
+
+// Role returns the role of the identity with the given name and groups
+func (mapping *roleMapping) Role(name string, groups []string) string {
+	if mapping == nil {
+		return defaultRole
+	}
+	for _, rule := range mapping.rules {
+		if rule.user != "" && rule.user == name {
+			return rule.role
+		}
+		for _, group := range groups {
+			if rule.group != "" && rule.group == group {
+				return rule.role
+			}
+		}
+	}
+	return mapping.defaultRole
+}
+
+// clientCertAuth identifies the receivers from the TLS client certificates they connected with.
+// The identity is taken from a field of the certificate, and the organizational units in the
+// subject are used as the groups.
+type clientCertAuth struct {
+	field string
+	roles *roleMapping
+}
+
+func newClientCertAuth(field string, roles *roleMapping) (*clientCertAuth, error) {
+	switch field {
+	case certIdentityCommonName, certIdentityEmail, certIdentityDNS, certIdentityURI:
+	case "":
+		field = certIdentityCommonName
+	default:
+		return nil, &TTYServerError{msg: "Unknown client certificate identity field: " + field}
+	}
+	return &clientCertAuth{field: field, roles: roles}, nil
+}
+
+func (auth *clientCertAuth) certificateName(cert *x509.Certificate) string {
+	switch auth.field {
+	case certIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case certIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case certIdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	// The common name is used when the certificate doesn't have the field
+	return cert.Subject.CommonName
+}
+
+// Identify returns the identity of the verified client certificate of the request, if there is one
+func (auth *clientCertAuth) Identify(r *http.Request) (identity Identity, ok bool) {
+	if auth == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := auth.certificateName(cert)
+	if name == "" {
+		return
+	}
+	groups := cert.Subject.OrganizationalUnit
+	return Identity{
+		Name:   name,
+		Groups: groups,
+		Role:   auth.roles.Role(name, groups),
+		Method: authMethodClientCert,
+	}, true
+}
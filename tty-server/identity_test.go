@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRoleMapping(t *testing.T) {
+	roles, err := newRoleMapping([]string{"user:alice=admin", "ops=operator", "dev=viewer"}, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		groups []string
+		role   string
+	}{
+		{"alice", []string{"dev"}, "admin"},
+		{"bob", []string{"dev", "ops"}, "operator"},
+		{"carol", []string{"dev"}, "viewer"},
+		{"dave", nil, "guest"},
+	} {
+		if role := roles.Role(test.name, test.groups); role != test.role {
+			t.Errorf("Expected role %s for %s, got %s", test.role, test.name, role)
+		}
+	}
+
+	if _, err = newRoleMapping([]string{"ops"}, "guest"); err == nil {
+		t.Errorf("Expected an error for a mapping without a role")
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	roles, _ := newRoleMapping([]string{"sre=admin"}, defaultRole)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "Alice", OrganizationalUnit: []string{"sre"}},
+		EmailAddresses: []string{"alice@example.com"},
+	}
+	request := httptest.NewRequest("GET", "https://tty.example.com/ws/1", nil)
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	auth, _ := newClientCertAuth(certIdentityEmail, roles)
+	identity, ok := auth.Identify(request)
+	expected := Identity{Name: "alice@example.com", Groups: []string{"sre"}, Role: "admin", Method: authMethodClientCert}
+	if !ok || !reflect.DeepEqual(identity, expected) {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+
+	// Without the field, the common name is used
+	auth, _ = newClientCertAuth(certIdentityDNS, roles)
+	if identity, _ = auth.Identify(request); identity.Name != "Alice" {
+		t.Fatalf("Expected the common name as identity, got %s", identity.Name)
+	}
+
+	// Certificates which were not verified don't identify anyone
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if _, ok = auth.Identify(request); ok {
+		t.Fatalf("An unverified certificate was accepted")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gorilla/mux"
+)
+
+const (
+	authMethodLDAP = "ldap"
+
+	ldapLoginPath       = "/auth/ldap/login"
+	ldapDefaultTimeout  = 10 * time.Second
+	ldapMaxMessageSize  = 16 * 1024 * 1024
+	ldapSearchSizeLimit = 100
+)
+
+// LDAPConfig configures the LDAP login. The filters can use {username}, the name the user logged
+// in with, and the group filter also {dn}, the DN of the user. Both are escaped.
+type LDAPConfig struct {
+	// URL is ldap://host[:port] or ldaps://host[:port]
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS
+	StartTLS bool
+	// CARootsFile holds the PEM encoded certificates the LDAP server is verified with, instead of
+	// the system ones
+	CARootsFile string
+	// BindDN and BindPassword are the credentials the users are looked up with. The lookups are
+	// anonymous if BindDN is empty.
+	BindDN       string
+	BindPassword string
+	UserBase     string
+	UserFilter   string
+	// UsernameAttribute is the attribute of the user entry the identity is taken from
+	UsernameAttribute string
+	// The groups of the users are looked up with GroupFilter, under GroupBase, and named by their
+	// GroupAttribute. When GroupFilter is empty, they are taken from the memberOf attribute of the
+	// user entry, which is what Active Directory has.
+	GroupBase      string
+	GroupFilter    string
+	GroupAttribute string
+	Timeout        time.Duration
+}
+
+// LoginTemplateModel is used for templating the login page
+type LoginTemplateModel struct {
+	Action    string
+	Next      string
+	Error     string
+	CSRFToken string
+}
+
+// ldapProvider logs the users in with a login form, checking their password against an LDAP
+// directory, like OpenLDAP or Active Directory
+type ldapProvider struct {
+	config    LDAPConfig
+	roles     *roleMapping
+	tlsConfig *tls.Config
+	server    *TTYServer
+}
+
+func newLDAPProvider(config LDAPConfig, roles *roleMapping) (provider *ldapProvider, err error) {
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL.Scheme != "ldap" && serverURL.Scheme != "ldaps" {
+		return nil, &TTYServerError{msg: "The LDAP URL has to start with ldap:// or ldaps://"}
+	}
+	if config.UserBase == "" {
+		return nil, &TTYServerError{msg: "The LDAP user search base is needed"}
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid={username})"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "cn"
+	}
+	if config.GroupBase == "" {
+		config.GroupBase = config.UserBase
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = ldapDefaultTimeout
+	}
+	// Check the filters now, rather than when the first user logs in
+	for _, filter := range []string{config.UserFilter, config.GroupFilter} {
+		if filter == "" {
+			continue
+		}
+		if _, err = ldap.CompileFilter(expandLDAPFilter(filter, "user", "uid=user")); err != nil {
+			return nil, &TTYServerError{msg: "Invalid LDAP filter " + filter + ": " + err.Error()}
+		}
+	}
+
+	// The LDAP messages are the only BER the server reads, so the limit is only theirs. By default,
+	// a server could make the login allocate up to 2 GiB.
+	ber.MaxPacketLengthBytes = ldapMaxMessageSize
+
+	provider = &ldapProvider{config: config, roles: roles}
+	provider.tlsConfig = &tls.Config{ServerName: serverURL.Hostname()}
+	if config.CARootsFile != "" {
+		pemData, err := ioutil.ReadFile(config.CARootsFile)
+		if err != nil {
+			return nil, err
+		}
+		provider.tlsConfig.RootCAs = x509.NewCertPool()
+		if !provider.tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, &TTYServerError{msg: "No certificates found in " + config.CARootsFile}
+		}
+	}
+	return provider, nil
+}
+
+func (provider *ldapProvider) RegisterRoutes(router *mux.Router, server *TTYServer) {
+	provider.server = server
+	router.HandleFunc(ldapLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		provider.handleLoginForm(w, r)
+	}).Methods("POST").Name(actionAuthLDAPLogin)
+}
+
+func (provider *ldapProvider) HandleLogin(w http.ResponseWriter, r *http.Request, next string) {
+	provider.renderLoginPage(w, r, next, "")
+}
+
+func (provider *ldapProvider) renderLoginPage(w http.ResponseWriter, r *http.Request, next, message string) {
+	t, err := provider.server.loadTemplate("login.in.html")
+
+	if err != nil {
+		panic("Cannot parse the login html template")
+	}
+
+	model := LoginTemplateModel{
+		Action:    ldapLoginPath,
+		Next:      next,
+		Error:     message,
+		CSRFToken: provider.server.csrfToken(w, r),
+	}
+	if message != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err = t.Execute(w, model)
+
+	if err != nil {
+		panic("Cannot execute the login html template")
+	}
+}
+
+func (provider *ldapProvider) handleLoginForm(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	next := safeRedirectPath(r.PostFormValue("next"))
+
+	identity, err := provider.authenticate(username, r.PostFormValue("password"))
+	if err != nil {
+		log.Warnf("LDAP login of %q from %s failed: %s", username, r.RemoteAddr, err.Error())
+		provider.server.config.Metrics.AuthFailure("ldap")
+		provider.renderLoginPage(w, r, next, "Wrong username or password")
+		return
+	}
+	provider.server.completeLogin(w, r, identity, next)
+}
+
+// authenticate checks the password of a user, and returns their identity
+func (provider *ldapProvider) authenticate(username, password string) (identity Identity, err error) {
+	// An empty password would make the bind anonymous, which always succeeds
+	if username == "" || password == "" {
+		return identity, &TTYServerError{msg: "Empty username or password"}
+	}
+
+	conn, err := provider.dial()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if provider.config.BindDN != "" {
+		if err = conn.Bind(provider.config.BindDN, provider.config.BindPassword); err != nil {
+			return identity, fmt.Errorf("Cannot bind as %s: %s", provider.config.BindDN, err.Error())
+		}
+	}
+	attributes := []string{provider.config.UsernameAttribute, "memberOf"}
+	users, err := provider.search(conn, provider.config.UserBase, expandLDAPFilter(provider.config.UserFilter, username, ""), attributes)
+	if err != nil {
+		return
+	}
+	if len(users) != 1 {
+		return identity, fmt.Errorf("%d users found", len(users))
+	}
+	user := users[0]
+	if err = conn.Bind(user.DN, password); err != nil {
+		return
+	}
+
+	identity.Name = username
+	if name := user.GetEqualFoldAttributeValue(provider.config.UsernameAttribute); name != "" {
+		identity.Name = name
+	}
+	if provider.config.GroupFilter == "" {
+		for _, groupDN := range user.GetEqualFoldAttributeValues("memberOf") {
+			identity.Groups = append(identity.Groups, ldapDNName(groupDN))
+		}
+	} else {
+		// The lookups are done with the rights of the user, unless there is a service account
+		if provider.config.BindDN != "" {
+			if err = conn.Bind(provider.config.BindDN, provider.config.BindPassword); err != nil {
+				return
+			}
+		}
+		var groups []*ldap.Entry
+		filter := expandLDAPFilter(provider.config.GroupFilter, username, user.DN)
+		if groups, err = provider.search(conn, provider.config.GroupBase, filter, []string{provider.config.GroupAttribute}); err != nil {
+			return
+		}
+		for _, group := range groups {
+			if name := group.GetEqualFoldAttributeValue(provider.config.GroupAttribute); name != "" {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	identity.Role = provider.roles.Role(identity.Name, identity.Groups)
+	identity.Method = authMethodLDAP
+	return
+}
+
+// search returns the entries under a base matching a filter, with some of their attributes
+func (provider *ldapProvider) search(conn *ldap.Conn, base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		ldapSearchSizeLimit, int(provider.config.Timeout.Seconds()), false, filter, attributes, nil))
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+func (provider *ldapProvider) dial() (conn *ldap.Conn, err error) {
+	dialer := &net.Dialer{Timeout: provider.config.Timeout}
+	conn, err = ldap.DialURL(provider.config.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(provider.tlsConfig))
+	if err != nil {
+		return
+	}
+	conn.SetTimeout(provider.config.Timeout)
+	if serverURL, _ := url.Parse(provider.config.URL); serverURL.Scheme == "ldap" && provider.config.StartTLS {
+		if err = conn.StartTLS(provider.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// expandLDAPFilter replaces {username} and {dn} in a filter, escaping them
+func expandLDAPFilter(filter, username, dn string) string {
+	return strings.NewReplacer("{username}", ldapEscapeFilter(username), "{dn}", ldapEscapeFilter(dn)).Replace(filter)
+}
+
+// ldapEscapeFilter escapes a value to be used in a search filter (RFC 4515)
+func ldapEscapeFilter(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// ldapDNName returns the value of the first component of a DN, e.g. "ops" for
+// "cn=ops,ou=groups,dc=example,dc=com"
+func ldapDNName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// mockDirectory is a stand-in for an OpenLDAP server, answering the binds and the searches the
+// login does from a fixed set of entries
+type mockDirectory struct {
+	t        *testing.T
+	listener net.Listener
+	// The entries by DN, with their lower case attribute names
+	entries   map[string]map[string][]string
+	passwords map[string]string
+}
+
+func newMockDirectory(t *testing.T) *mockDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := &mockDirectory{
+		t:        t,
+		listener: listener,
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {"objectclass": {"person"}, "uid": {"alice"}},
+			"uid=bob,ou=people,dc=example,dc=com":   {"objectclass": {"person"}, "uid": {"bob"}},
+			"cn=ops,ou=groups,dc=example,dc=com":    {"objectclass": {"groupOfNames"}, "cn": {"ops"}, "member": {"uid=alice,ou=people,dc=example,dc=com"}},
+			"cn=staff,ou=groups,dc=example,dc=com":  {"objectclass": {"groupOfNames"}, "cn": {"staff"}, "member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"}},
+		},
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=com":            "admin secret",
+			"uid=alice,ou=people,dc=example,dc=com": "alice password",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob password",
+		},
+	}
+	go directory.serve()
+	return directory
+}
+
+func (directory *mockDirectory) serve() {
+	for {
+		conn, err := directory.listener.Accept()
+		if err != nil {
+			return
+		}
+		go directory.serveConn(conn)
+	}
+}
+
+func (directory *mockDirectory) serveConn(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		message, err := ber.ReadPacket(conn)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id := message.Children[0].Value
+		op := message.Children[1]
+		reply := func(op *ber.Packet) {
+			envelope := ber.NewSequence("")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(op)
+			conn.Write(envelope.Bytes())
+		}
+		result := func(tag ber.Tag, code int64) *ber.Packet {
+			packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			return packet
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			if expected, ok := directory.passwords[dn]; ok && expected == password {
+				bound = dn
+				reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess))
+			} else {
+				reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials))
+			}
+		case ldap.ApplicationSearchRequest:
+			// Only the service account can search
+			if bound != "cn=admin,dc=example,dc=com" {
+				reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			base := op.Children[0].Data.String()
+			for dn, attributes := range directory.entries {
+				if !strings.HasSuffix(dn, base) || !directory.match(op.Children[6], attributes) {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attributeList := ber.NewSequence("")
+				for _, name := range op.Children[7].Children {
+					attribute := ber.NewSequence("")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name.Data.String(), ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, value := range attributes[strings.ToLower(name.Data.String())] {
+						values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					}
+					attribute.AppendChild(values)
+					attributeList.AppendChild(attribute)
+				}
+				entry.AppendChild(attributeList)
+				reply(entry)
+			}
+			reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// match evaluates the and, or, not, equality and presence filters
+func (directory *mockDirectory) match(filter *ber.Packet, attributes map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, child := range filter.Children {
+			if directory.match(child, attributes) != (filter.Tag == ldap.FilterAnd) {
+				return filter.Tag != ldap.FilterAnd
+			}
+		}
+		return filter.Tag == ldap.FilterAnd
+	case ldap.FilterNot:
+		return !directory.match(filter.Children[0], attributes)
+	case ldap.FilterEqualityMatch:
+		for _, value := range attributes[strings.ToLower(filter.Children[0].Data.String())] {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+	case ldap.FilterPresent:
+		return len(attributes[strings.ToLower(filter.Data.String())]) > 0
+	default:
+		directory.t.Errorf("Unexpected filter type %d", filter.Tag)
+	}
+	return false
+}
+
+func TestLDAPFilter(t *testing.T) {
+	if escaped := ldapEscapeFilter("a*(b)\\"); escaped != "a\\2a\\28b\\29\\5c" {
+		t.Errorf("Unexpected escaping: %s", escaped)
+	}
+	if filter := expandLDAPFilter("(&(uid={username})(member={dn}))", "a*", "uid=a\\2a,dc=example"); filter !=
+		"(&(uid=a\\2a)(member=uid=a\\5c2a,dc=example))" {
+		t.Errorf("Unexpected expanded filter: %s", filter)
+	}
+	for _, invalid := range []string{"uid={username}", "(uid={username}", "(uid={username})(cn=a)", "(uid=\\zz)"} {
+		if _, err := newLDAPProvider(LDAPConfig{URL: "ldap://localhost", UserBase: "dc=example", UserFilter: invalid}, nil); err == nil {
+			t.Errorf("Expected %q to be refused", invalid)
+		}
+	}
+
+	for dn, name := range map[string]string{
+		"cn=ops,ou=groups,dc=example,dc=com":   "ops",
+		"CN=Domain Admins,CN=Users,DC=example": "Domain Admins",
+		"cn=a\\,b,ou=groups":                   "a,b",
+		"not a dn":                             "not a dn",
+	} {
+		if got := ldapDNName(dn); got != name {
+			t.Errorf("Expected the name of %s to be %s, got %s", dn, name, got)
+		}
+	}
+}
+
+// TestLDAPMalformedResponses checks that the login fails, rather than hangs or panics, with a
+// server answering the bind with broken messages
+func TestLDAPMalformedResponses(t *testing.T) {
+	for name, response := range map[string][]byte{
+		"truncated": {0x30, 0x0c, 0x02, 0x01, 0x01, 0x61, 0x07, 0x0a},
+		"wrong id":  {0x30, 0x0c, 0x02, 0x01, 0x09, 0x61, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00},
+		"huge":      {0x30, 0x0a, 0x02, 0x01, 0x01, 0x61, 0x05, 0x0a, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"garbage":   []byte("HTTP/1.1 400 Bad Request\r\n\r\n"),
+		"no result": {0x30, 0x05, 0x02, 0x01, 0x01, 0x61, 0x00},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(response []byte) {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			ber.ReadPacket(conn)
+			conn.Write(response)
+			ber.ReadPacket(conn)
+		}(response)
+
+		provider, err := newLDAPProvider(LDAPConfig{
+			URL:          "ldap://" + listener.Addr().String(),
+			BindDN:       "cn=admin,dc=example,dc=com",
+			BindPassword: "admin secret",
+			UserBase:     "ou=people,dc=example,dc=com",
+			Timeout:      200 * time.Millisecond,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = provider.authenticate("alice", "alice password"); err == nil {
+			t.Errorf("Expected the %s response to fail the login", name)
+		}
+		listener.Close()
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	directory := newMockDirectory(t)
+	defer directory.listener.Close()
+
+	roles, _ := newRoleMapping([]string{"ops=operator"}, defaultRole)
+	cookies := newCookieSigner([]byte("test secret"))
+	provider, err := newLDAPProvider(LDAPConfig{
+		URL:          "ldap://" + directory.listener.Addr().String(),
+		BindDN:       "cn=admin,dc=example,dc=com",
+		BindPassword: "admin secret",
+		UserBase:     "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid={username}))",
+		GroupBase:    "ou=groups,dc=example,dc=com",
+		GroupFilter:  "(member={dn})",
+	}, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTTYServer(TTYServerConfig{Login: provider, Cookies: cookies, FrontendPath: "../frontend/templates"})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// The browsers are sent to the login form
+	response, err := client.Get(ttyServer.URL + "/api/sessions")
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected the API to need a login, got %v %v", response.StatusCode, err)
+	}
+	response, err = client.Get(ttyServer.URL + loginPath + "?next=" + url.QueryEscape("/api/me"))
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the login form, got %v %v", response.StatusCode, err)
+	}
+	response.Body.Close()
+
+	for username, password := range map[string]string{
+		"alice":        "wrong password",
+		"alice)(uid=*": "alice password",
+		"*":            "alice password",
+		"bob":          "",
+	} {
+		response, err = client.PostForm(ttyServer.URL+ldapLoginPath, url.Values{"username": {username}, "password": {password}, "next": {"/api/me"}})
+		if err != nil || response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected the login of %q with %q to fail, got %v %v", username, password, response.StatusCode, err)
+		}
+		response.Body.Close()
+	}
+
+	response, err = client.PostForm(ttyServer.URL+ldapLoginPath, url.Values{"username": {"alice"}, "password": {"alice password"}, "next": {"/api/me"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Request.URL.Path != "/api/me" {
+		t.Fatalf("Expected to be sent to /api/me after the login, got %s", response.Request.URL)
+	}
+	var identity Identity
+	if err = json.NewDecoder(response.Body).Decode(&identity); err != nil {
+		t.Fatal(err)
+	}
+	groups := strings.Join(identity.Groups, ",")
+	if identity.Name != "alice" || identity.Role != "operator" || identity.Method != authMethodLDAP ||
+		(groups != "ops,staff" && groups != "staff,ops") {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+}
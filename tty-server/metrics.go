@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const metricsPath = "/metrics"
+
+// The directions of the bytes counted by the metrics
+const (
+	metricsDirectionIn  = "in"
+	metricsDirectionOut = "out"
+)
+
+var (
+	// sessionDurationBuckets go from a minute to a day, in seconds
+	sessionDurationBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+	// outputLatencyBuckets go from a millisecond to 10 seconds
+	outputLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 10}
+)
+
+// metricSeries is the value of a metric for some label values. Histograms count their
+// observations in buckets, with their sum.
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a metric, with one series per set of label values, which is written in the
+// Prometheus text format. The labels have to stay few, and their values bounded.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetricVec(kind, name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+// get returns the series of some label values, which has to be called with the lock held
+func (vec *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	series, ok := vec.series[key]
+	if !ok {
+		series = &metricSeries{labels: labels, buckets: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+	return series
+}
+
+// Add adds to the counter, or the gauge, of some label values
+func (vec *metricVec) Add(value float64, labels ...string) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	vec.get(labels).value += value
+}
+
+// Observe counts a value in the histogram of some label values
+func (vec *metricVec) Observe(value float64, labels ...string) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	series := vec.get(labels)
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labelsText returns the labels of a series, with an extra one, like {a="1",le="0.5"}
+func (vec *metricVec) labelsText(values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range vec.labels {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes the metric in the Prometheus text format, with its series sorted
+func (vec *metricVec) write(w io.Writer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	io.WriteString(w, "# HELP "+vec.name+" "+vec.help+"\n# TYPE "+vec.name+" "+vec.kind+"\n")
+	for _, key := range keys {
+		series := vec.series[key]
+		if vec.kind != "histogram" {
+			io.WriteString(w, vec.name+vec.labelsText(series.labels, "", "")+" "+formatMetricValue(series.value)+"\n")
+			continue
+		}
+		for i, bound := range vec.buckets {
+			io.WriteString(w, vec.name+"_bucket"+vec.labelsText(series.labels, "le", formatMetricValue(bound))+" "+
+				strconv.FormatUint(series.buckets[i], 10)+"\n")
+		}
+		io.WriteString(w, vec.name+"_bucket"+vec.labelsText(series.labels, "le", "+Inf")+" "+strconv.FormatUint(series.count, 10)+"\n")
+		io.WriteString(w, vec.name+"_sum"+vec.labelsText(series.labels, "", "")+" "+formatMetricValue(series.value)+"\n")
+		io.WriteString(w, vec.name+"_count"+vec.labelsText(series.labels, "", "")+" "+strconv.FormatUint(series.count, 10)+"\n")
+	}
+}
+
+// serverMetrics are the metrics of the server, served on /metrics for Prometheus. All the methods
+// can be called on a nil serverMetrics, in which case nothing is counted.
+type serverMetrics struct {
+	sessions        *metricVec
+	receivers       *metricVec
+	bytes           *metricVec
+	commandsStarted *metricVec
+	commandsExited  *metricVec
+	websocketErrors *metricVec
+	authFailures    *metricVec
+	sessionDuration *metricVec
+	outputLatency   *metricVec
+}
+
+// newServerMetrics returns the metrics of a server with some profiles, whose sessions and receivers
+// are counted from zero, so their series are there before any session is opened.
+func newServerMetrics(profiles ...string) *serverMetrics {
+	metrics := &serverMetrics{
+		sessions: newMetricVec("gauge", "tty_server_sessions",
+			"The sessions running, by profile", nil, "profile"),
+		receivers: newMetricVec("gauge", "tty_server_receivers",
+			"The receivers connected to the sessions, by profile", nil, "profile"),
+		bytes: newMetricVec("counter", "tty_server_bytes_total",
+			"The bytes typed in the sessions (in), and output by them (out)", nil, "direction"),
+		commandsStarted: newMetricVec("counter", "tty_server_commands_started_total",
+			"The commands started, for the sessions and their windows, by profile", nil, "profile"),
+		commandsExited: newMetricVec("counter", "tty_server_commands_exited_total",
+			"The commands which exited, by profile and exit code, which is signal if they were killed", nil, "profile", "exit_code"),
+		websocketErrors: newMetricVec("counter", "tty_server_websocket_errors_total",
+			"The websockets which failed, by when they did: upgrade, read or write", nil, "reason"),
+		authFailures: newMetricVec("counter", "tty_server_auth_failures_total",
+			"The failed logins (ldap, oidc), and the requests refused as the user isn't logged in (unauthenticated), by the CSRF protection (csrf), or by the policy (policy)", nil, "reason"),
+		sessionDuration: newMetricVec("histogram", "tty_server_session_duration_seconds",
+			"How long the sessions ran, by profile", sessionDurationBuckets, "profile"),
+		outputLatency: newMetricVec("histogram", "tty_server_output_queue_latency_seconds",
+			"How long the output of the sessions waits, from when it is read until it is written to all the receivers", outputLatencyBuckets),
+	}
+	for _, profile := range profiles {
+		metrics.sessions.Add(0, profile)
+		metrics.receivers.Add(0, profile)
+	}
+	return metrics
+}
+
+// Bytes counts bytes typed in a session, or output by it
+func (metrics *serverMetrics) Bytes(direction string, n int) {
+	if metrics != nil && n > 0 {
+		metrics.bytes.Add(float64(n), direction)
+	}
+}
+
+// SessionStarted counts a session running, until it ends
+func (metrics *serverMetrics) SessionStarted(profile string) {
+	if metrics != nil {
+		metrics.sessions.Add(1, profile)
+	}
+}
+
+// ReceiverJoined counts a receiver connected to a session, until it leaves
+func (metrics *serverMetrics) ReceiverJoined(profile string) {
+	if metrics != nil {
+		metrics.receivers.Add(1, profile)
+	}
+}
+
+// ReceiverLeft stops counting a receiver which left a session
+func (metrics *serverMetrics) ReceiverLeft(profile string) {
+	if metrics != nil {
+		metrics.receivers.Add(-1, profile)
+	}
+}
+
+// CommandStarted counts a command started for a session, or one of its windows
+func (metrics *serverMetrics) CommandStarted(profile string) {
+	if metrics != nil {
+		metrics.commandsStarted.Add(1, profile)
+	}
+}
+
+// CommandExited counts a command which exited with a code, or was killed if the code is -1
+func (metrics *serverMetrics) CommandExited(profile string, exitCode int) {
+	if metrics == nil {
+		return
+	}
+	code := "signal"
+	if exitCode >= 0 {
+		code = strconv.Itoa(exitCode)
+	}
+	metrics.commandsExited.Add(1, profile, code)
+}
+
+// WebsocketError counts a websocket which failed
+func (metrics *serverMetrics) WebsocketError(reason string) {
+	if metrics != nil {
+		metrics.websocketErrors.Add(1, reason)
+	}
+}
+
+// AuthFailure counts a failed login, or a request refused
+func (metrics *serverMetrics) AuthFailure(reason string) {
+	if metrics != nil {
+		metrics.authFailures.Add(1, reason)
+	}
+}
+
+// SessionEnded stops counting a session, and observes how long it ran
+func (metrics *serverMetrics) SessionEnded(profile string, duration time.Duration) {
+	if metrics != nil {
+		metrics.sessions.Add(-1, profile)
+		metrics.sessionDuration.Observe(duration.Seconds(), profile)
+	}
+}
+
+// OutputLatency observes how long some output of a session waited to be written to its receivers
+func (metrics *serverMetrics) OutputLatency(latency time.Duration) {
+	if metrics != nil {
+		metrics.outputLatency.Observe(latency.Seconds())
+	}
+}
+
+// isUnexpectedClose tells if a websocket failed, rather than being closed by the browser
+func isUnexpectedClose(err error) bool {
+	if _, ok := err.(*websocket.CloseError); !ok {
+		return true
+	}
+	return websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived)
+}
+
+// handleMetrics writes the metrics in the Prometheus text format
+func (server *TTYServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := server.config.Metrics
+	if metrics == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(w)
+	for _, vec := range []*metricVec{metrics.sessions, metrics.receivers, metrics.bytes, metrics.commandsStarted,
+		metrics.commandsExited, metrics.websocketErrors, metrics.authFailures, metrics.sessionDuration,
+		metrics.outputLatency} {
+		vec.write(buffered)
+	}
+	buffered.Flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := newMetricVec("counter", "test_total", "A test counter", nil, "reason")
+	counter.Add(2, "b")
+	counter.Add(1, `a"`)
+	histogram := newMetricVec("histogram", "test_seconds", "A test histogram", []float64{0.5, 1})
+	histogram.Observe(0.25)
+	histogram.Observe(2)
+
+	var out strings.Builder
+	counter.write(&out)
+	histogram.write(&out)
+	expected := `# HELP test_total A test counter
+# TYPE test_total counter
+test_total{reason="a\""} 1
+test_total{reason="b"} 2
+# HELP test_seconds A test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 2.25
+test_seconds_count 2
+`
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+// scrapeMetrics returns the metrics the server serves
+func scrapeMetrics(server *TTYServer) (*httptest.ResponseRecorder, string) {
+	w := httptest.NewRecorder()
+	server.handleMetrics(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	return w, w.Body.String()
+}
+
+// expectMetrics fails the test unless the metrics hold some lines
+func expectMetrics(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, expected := range lines {
+		if !strings.Contains(body, expected+"\n") {
+			t.Errorf("Expected %s in the metrics, got\n%s", expected, body)
+		}
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	metrics := newServerMetrics("default", "ops")
+	server := &TTYServer{config: TTYServerConfig{Metrics: metrics}, activeSessions: make(map[string]*ptyMaster)}
+	_, body := scrapeMetrics(server)
+	expectMetrics(t, body,
+		`tty_server_sessions{profile="default"} 0`,
+		`tty_server_sessions{profile="ops"} 0`,
+		`tty_server_receivers{profile="default"} 0`,
+		`tty_server_receivers{profile="ops"} 0`,
+	)
+
+	running := ptyMasterNew("1")
+	running.SetProfile("default")
+	running.SetMetrics(metrics)
+	if err := running.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	receiver := &ttyReceiver{id: "r1"}
+	joinSession(running, receiver, false)
+	_, body = scrapeMetrics(server)
+	expectMetrics(t, body,
+		`tty_server_sessions{profile="default"} 1`,
+		`tty_server_receivers{profile="default"} 1`,
+	)
+	running.removeReceiver(receiver)
+	running.Stop()
+	running.Wait()
+
+	session := ptyMasterNew("2")
+	session.SetProfile("default")
+	session.SetMetrics(metrics)
+	if err := session.Start("sh", []string{"-c", "exit 3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	session.Wait()
+	metrics.AuthFailure("csrf")
+	metrics.Bytes(metricsDirectionIn, 5)
+
+	w, body := scrapeMetrics(server)
+	expectMetrics(t, body,
+		`tty_server_sessions{profile="default"} 0`,
+		`tty_server_sessions{profile="ops"} 0`,
+		`tty_server_receivers{profile="default"} 0`,
+		`tty_server_bytes_total{direction="in"} 5`,
+		`tty_server_commands_started_total{profile="default"} 2`,
+		`tty_server_commands_exited_total{profile="default",exit_code="3"} 1`,
+		`tty_server_auth_failures_total{reason="csrf"} 1`,
+		`tty_server_session_duration_seconds_count{profile="default"} 2`,
+	)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %s", w.Header().Get("Content-Type"))
+	}
+
+	server.config.Metrics = nil
+	w, _ = scrapeMetrics(server)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no metrics when they are disabled, got %d", w.Code)
+	}
+}
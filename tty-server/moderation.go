@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// sessionBans are the identities and the client IPs which can't join a session anymore
+type sessionBans struct {
+	lock       sync.Mutex
+	identities map[string]bool
+	addresses  map[string]bool
+}
+
+func newSessionBans() *sessionBans {
+	return &sessionBans{
+		identities: make(map[string]bool),
+		addresses:  make(map[string]bool),
+	}
+}
+
+// isModerator tells if a receiver can let the others in the session, kick or ban them, and give
+// the session to another receiver, which its owner and the admins can
+func (pty *ptyMaster) isModerator(receiver *ttyReceiver) bool {
+	return pty.IsOwner(receiver) || pty.policy.IsAdmin(receiver.identity, pty.profile)
+}
+
+// IsBanned tells if a user, connecting from an address, was banned from the session
+func (pty *ptyMaster) IsBanned(identity Identity, address string) bool {
+	bans := pty.bans
+	bans.lock.Lock()
+	defer bans.lock.Unlock()
+	return identity.Method != authMethodNone && bans.identities[identity.Name] || bans.addresses[clientIP(address)]
+}
+
+// terminate disconnects a receiver from the session, telling it why, so it doesn't reconnect
+func (pty *ptyMaster) terminate(receiver *ttyReceiver, reason, message string) {
+	receiver.conn.WriteMessage(ttyCommon.MsgTTYTerminate{Reason: reason, Message: message})
+	// Its connection ends, so it leaves the session
+	receiver.conn.Close()
+}
+
+// transferOwnership gives the session to another receiver, and tells all the receivers
+func (pty *ptyMaster) transferOwnership(receiver *ttyReceiver) {
+	pty.SetOwner(receiver)
+	pty.sendPresence()
+	if floor := pty.floor; floor != nil {
+		floor.lock.Lock()
+		pty.sendFloorState(nil)
+		floor.lock.Unlock()
+	}
+	if room := pty.waiting; room != nil {
+		room.lock.Lock()
+		pty.sendWaitingRoom(receiver)
+		room.lock.Unlock()
+	}
+}
+
+// handleModerate handles the owner of the session, or an admin, giving the session to another
+// receiver, kicking a receiver out of it, or banning its identity or its IP
+func (pty *ptyMaster) handleModerate(receiver *ttyReceiver, msg ttyCommon.MsgTTYModerate) {
+	result := func(message string) {
+		receiver.conn.WriteMessage(ttyCommon.MsgTTYModerationResult{Message: message})
+	}
+	if !pty.isModerator(receiver) {
+		log.Warnf("Receiver %s (%s) can't moderate session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+		result("Only the owner of the session, or an admin, can do this")
+		return
+	}
+	var target *ttyReceiver
+	for _, r := range pty.GetReceivers() {
+		if r.id == msg.ReceiverID {
+			target = r
+		}
+	}
+	switch {
+	case target == nil:
+		result("This receiver isn't in the session anymore")
+		return
+	case target == receiver:
+		result("You can't do this to yourself")
+		return
+	case msg.Action != ttyCommon.ModerateActionTransfer && pty.IsOwner(target) && !pty.policy.IsAdmin(receiver.identity, pty.profile):
+		result("Only an admin can remove the owner of the session")
+		return
+	}
+
+	by := receiver.identity.Name
+	switch msg.Action {
+	case ttyCommon.ModerateActionTransfer:
+		log.Infof("Receiver %s (%s) gave session %s to %s (%s)", receiver.id, by, pty.sessionID, target.id, target.identity.Name)
+		pty.audit.Moderation(pty.sessionID, target, auditEventTransfer, by)
+		pty.transferOwnership(target)
+		result(target.name + " owns the session now")
+	case ttyCommon.ModerateActionKick:
+		log.Infof("Receiver %s (%s) kicked %s (%s) out of session %s", receiver.id, by, target.id, target.identity.Name, pty.sessionID)
+		pty.audit.Moderation(pty.sessionID, target, auditEventKick, by)
+		pty.terminate(target, ttyCommon.TerminateReasonKicked, "You were removed from the session by "+receiver.name)
+		result(target.name + " was removed from the session")
+	case ttyCommon.ModerateActionBanIdentity, ttyCommon.ModerateActionBanAddress:
+		bans := pty.bans
+		bans.lock.Lock()
+		if msg.Action == ttyCommon.ModerateActionBanIdentity {
+			if target.identity.Method == authMethodNone {
+				bans.lock.Unlock()
+				result(target.name + " isn't logged in, ban their IP instead")
+				return
+			}
+			bans.identities[target.identity.Name] = true
+		} else {
+			bans.addresses[clientIP(target.remoteAddr)] = true
+		}
+		bans.lock.Unlock()
+		log.Infof("Receiver %s (%s) banned %s (%s, %s) from session %s", receiver.id, by, target.id, target.identity.Name, target.remoteAddr, pty.sessionID)
+		pty.audit.Moderation(pty.sessionID, target, auditEventBan, by)
+		// Everyone banned leaves, with the target
+		for _, r := range pty.GetReceivers() {
+			if r != receiver && pty.IsBanned(r.identity, r.remoteAddr) {
+				pty.terminate(r, ttyCommon.TerminateReasonBanned, "You were banned from the session by "+receiver.name)
+			}
+		}
+		result(target.name + " was banned from the session")
+	default:
+		log.Warnf("Unknown moderation action %s from receiver %s", msg.Action, receiver.id)
+	}
+}
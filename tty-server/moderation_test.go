@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// lastModerationResult returns what the last moderation of the receiver did
+func (conn *messageConn) lastModerationResult(t *testing.T) (result ttyCommon.MsgTTYModerationResult) {
+	if messages := conn.messages(t, ttyCommon.MsgIDModerationResult); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &result)
+	}
+	return
+}
+
+// terminated returns why the receiver was disconnected, if it was
+func (conn *messageConn) terminated(t *testing.T) (terminate ttyCommon.MsgTTYTerminate) {
+	if messages := conn.messages(t, ttyCommon.MsgIDTerminate); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &terminate)
+	}
+	return
+}
+
+// lastPresence returns the last presence list the receiver was sent
+func (conn *messageConn) lastPresence(t *testing.T) (presence ttyCommon.MsgTTYPresence) {
+	if messages := conn.messages(t, ttyCommon.MsgIDPresence); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &presence)
+	}
+	return
+}
+
+func TestModeration(t *testing.T) {
+	session := ptyMasterNew("1")
+	session.SetPolicy(&policy{Default: policyAllow, Rules: []policyRule{
+		{Name: "admins", Effect: policyAllow, Roles: []string{"admin"}, Actions: []string{actionAdminSessions}},
+	}})
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+
+	join := func(id string, identity Identity, address string, owner bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: id, identity: identity, remoteAddr: address}
+		return receiver, joinSession(session, receiver, owner)
+	}
+	bob := Identity{Name: "bob", Role: defaultRole, Method: authMethodClientCert}
+	admin := Identity{Name: "alice", Role: "admin", Method: authMethodClientCert}
+	owner, ownerConn := join("r1", anonymous, "10.0.0.1:1000", true)
+	member, memberConn := join("r2", bob, "10.0.0.2:1000", false)
+	guest, guestConn := join("r3", anonymous, "10.0.0.3:1000", false)
+
+	session.handleModerate(guest, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionKick, ReceiverID: "r2"})
+	if memberConn.terminated(t).Reason != "" || !strings.Contains(guestConn.lastModerationResult(t).Message, "Only the owner") {
+		t.Errorf("Expected only the owner to kick the receivers")
+	}
+
+	session.handleModerate(owner, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionTransfer, ReceiverID: "r2"})
+	if !session.IsOwner(member) || session.IsOwner(owner) {
+		t.Fatalf("Expected the session to be given to the member")
+	}
+	if presence := ownerConn.lastPresence(t); presence.Moderator || !presence.Receivers[1].Owner {
+		t.Errorf("Expected the receivers to be told who owns the session, got %+v", presence)
+	}
+
+	session.handleModerate(member, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionBanIdentity, ReceiverID: "r3"})
+	if guestConn.terminated(t).Reason != "" {
+		t.Errorf("Expected the guest not to be banned by its identity")
+	}
+	session.handleModerate(member, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionBanAddress, ReceiverID: "r3"})
+	if guestConn.terminated(t).Reason != ttyCommon.TerminateReasonBanned {
+		t.Errorf("Expected the guest to be told it was banned")
+	}
+	if !session.IsBanned(anonymous, "10.0.0.3:2000") || session.IsBanned(anonymous, "10.0.0.1:1000") {
+		t.Errorf("Expected only the IP of the guest to be banned")
+	}
+
+	// Only an admin removes the owner
+	session.handleModerate(owner, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionKick, ReceiverID: "r2"})
+	if memberConn.terminated(t).Reason != "" {
+		t.Errorf("Expected the previous owner not to kick anyone")
+	}
+	moderator, _ := join("r4", admin, "10.0.0.4:1000", false)
+	session.handleModerate(moderator, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionBanIdentity, ReceiverID: "r2"})
+	if memberConn.terminated(t).Reason != ttyCommon.TerminateReasonBanned || !session.IsBanned(bob, "10.0.0.5:1000") {
+		t.Errorf("Expected the admin to ban the owner")
+	}
+	session.handleModerate(moderator, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionKick, ReceiverID: "r1"})
+	if ownerConn.terminated(t).Reason != ttyCommon.TerminateReasonKicked {
+		t.Errorf("Expected the admin to kick the receiver")
+	}
+}
+
+func TestModerationOverWebsocket(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{CommandName: "cat", FrontendPath: "../frontend/templates"})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	owner, _ := dialSession(t, ttyServer, "/ws/1")
+	session := server.getSession("1")
+	if owner == nil || session == nil {
+		t.Fatalf("Expected the session to be created")
+	}
+	defer session.Stop()
+	join := func() (*wsClient, string) {
+		client, status := dialSession(t, ttyServer, "/ws/1")
+		if client == nil {
+			t.Fatalf("Expected the receiver to join the session, got %d", status)
+		}
+		waitFor(t, "the receiver to join", func() bool {
+			return client.lastPresence(t).Self != ""
+		})
+		return client, client.lastPresence(t).Self
+	}
+
+	kicked, kickedID := join()
+	owner.send(t, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionKick, ReceiverID: kickedID})
+	<-kicked.closed
+	if kicked.terminated(t).Reason != ttyCommon.TerminateReasonKicked {
+		t.Errorf("Expected the receiver to be told it was kicked")
+	}
+	// The session runs on for the others, and the kicked receiver rejoins it
+	back, backID := join()
+	if server.getSession("1") != session || server.sessionCount() != 1 || back.lastPresence(t).Receivers[0].Owner != true ||
+		back.lastPresence(t).Moderator {
+		t.Fatalf("Expected the receiver to rejoin the same session, without owning it")
+	}
+
+	owner.send(t, ttyCommon.MsgTTYModerate{Action: ttyCommon.ModerateActionBanAddress, ReceiverID: backID})
+	<-back.closed
+	if client, status := dialSession(t, ttyServer, "/ws/1"); client != nil || status != http.StatusForbidden {
+		t.Errorf("Expected the banned receiver to be refused, got %d", status)
+	}
+	if server.getSession("1") != session {
+		t.Errorf("Expected the session to keep running")
+	}
+
+	session.Stop()
+	waitFor(t, "the session to be removed once its command exits", func() bool {
+		return server.getSession("1") == nil
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	jose "gopkg.in/go-jose/go-jose.v2"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+const (
+	authMethodOIDC = "oidc"
+
+	oidcStateCookieName = "tty_oidc"
+	oidcStateCookieTTL  = 10 * time.Minute
+	oidcCallbackPath    = "/auth/oidc/callback"
+	// How much the clocks of the server and the identity provider can differ
+	oidcClockSkew = time.Minute
+	// How often the keys of the identity provider can be fetched again, for an unknown key ID
+	oidcKeysRefreshInterval = time.Minute
+)
+
+// OIDCConfig configures the OpenID Connect login
+type OIDCConfig struct {
+	// Issuer is the URL of the identity provider, where its configuration is discovered from
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the callback route of this server. It is found out from the
+	// requests if it is empty, which only works if the server is not behind a proxy.
+	RedirectURL string
+	Scopes      []string
+	// UsernameClaim is the claim of the ID token the identity is taken from. "email" and "sub"
+	// are used if the token doesn't have it.
+	UsernameClaim string
+	// GroupsClaim is the claim of the ID token holding the groups of the user
+	GroupsClaim string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLoginState is what the server needs to remember while the user logs in at the identity
+// provider. It is kept in a signed cookie.
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// oidcProvider logs the users in with the authorization code flow, protected with PKCE
+type oidcProvider struct {
+	config     OIDCConfig
+	roles      *roleMapping
+	cookies    *cookieSigner
+	httpClient *http.Client
+	server     *TTYServer
+
+	// The configuration and the keys of the identity provider are fetched when first needed
+	lock          sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*jose.JSONWebKey
+	keysFetchedAt time.Time
+}
+
+func newOIDCProvider(config OIDCConfig, roles *roleMapping, cookies *cookieSigner) (*oidcProvider, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, &TTYServerError{msg: "The OIDC issuer and client ID are needed"}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &oidcProvider{
+		config:     config,
+		roles:      roles,
+		cookies:    cookies,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (provider *oidcProvider) RegisterRoutes(router *mux.Router, server *TTYServer) {
+	provider.server = server
+	router.HandleFunc(oidcCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		provider.handleCallback(w, r)
+	}).Name(actionAuthOIDCCallback)
+}
+
+func (provider *oidcProvider) getJSON(url string, value interface{}) error {
+	response, err := provider.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed: %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+func (provider *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+	var discovery oidcDiscovery
+	err := provider.getJSON(strings.TrimRight(provider.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != provider.config.Issuer {
+		return nil, &TTYServerError{msg: "The OIDC issuer is " + discovery.Issuer + ", not " + provider.config.Issuer}
+	}
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+func (provider *oidcProvider) redirectURL(r *http.Request) string {
+	if provider.config.RedirectURL != "" {
+		return provider.config.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+func randomString() string {
+	data := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		panic("Cannot read random data: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (provider *oidcProvider) HandleLogin(w http.ResponseWriter, r *http.Request, next string) {
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		log.Errorf("Cannot discover the OIDC provider: %s", err.Error())
+		http.Error(w, "The identity provider is not available", http.StatusBadGateway)
+		return
+	}
+
+	state := oidcLoginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		Next:     next,
+	}
+	err = provider.cookies.setSignedCookie(w, r, oidcStateCookieName, oidcCallbackPath, state, oidcStateCookieTTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.config.ClientID},
+		"redirect_uri":          {provider.redirectURL(r)},
+		"scope":                 {strings.Join(provider.config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {pkceChallenge(state.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+func (provider *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcLoginState
+	err := provider.cookies.readSignedCookie(r, oidcStateCookieName, &state)
+	clearCookie(w, oidcStateCookieName, oidcCallbackPath)
+	if err != nil || r.URL.Query().Get("state") != state.State {
+		log.Warnf("OIDC login from %s with an invalid state", r.RemoteAddr)
+		provider.server.config.Metrics.AuthFailure("oidc")
+		http.Error(w, "The login expired, or is invalid. Please try again.", http.StatusForbidden)
+		return
+	}
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		log.Warnf("OIDC login from %s failed: %s %s", r.RemoteAddr, errorCode, r.URL.Query().Get("error_description"))
+		provider.server.config.Metrics.AuthFailure("oidc")
+		http.Error(w, "The login failed: "+errorCode, http.StatusForbidden)
+		return
+	}
+
+	identity, err := provider.exchangeCode(r, r.URL.Query().Get("code"), state)
+	if err != nil {
+		log.Warnf("OIDC login from %s failed: %s", r.RemoteAddr, err.Error())
+		provider.server.config.Metrics.AuthFailure("oidc")
+		http.Error(w, "The login failed", http.StatusForbidden)
+		return
+	}
+	provider.server.completeLogin(w, r, identity, state.Next)
+}
+
+// exchangeCode gets the ID token for the authorization code, and returns the identity it holds
+func (provider *oidcProvider) exchangeCode(r *http.Request, code string, state oidcLoginState) (identity Identity, err error) {
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		return
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.redirectURL(r)},
+		"client_id":     {provider.config.ClientID},
+		"code_verifier": {state.Verifier},
+	}
+	request, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if provider.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+	}
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return identity, fmt.Errorf("The token request failed: %s %s", response.Status, string(message))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return
+	}
+
+	claims, err := provider.verifyIDToken(tokens.IDToken, discovery, state.Nonce)
+	if err != nil {
+		return
+	}
+	return provider.claimsIdentity(claims)
+}
+
+func (provider *oidcProvider) claimsIdentity(claims map[string]interface{}) (identity Identity, err error) {
+	for _, claim := range []string{provider.config.UsernameClaim, "email", "sub"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			identity.Name = name
+			break
+		}
+	}
+	if identity.Name == "" {
+		return identity, &TTYServerError{msg: "The ID token doesn't name the user"}
+	}
+	switch groups := claims[provider.config.GroupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+	identity.Role = provider.roles.Role(identity.Name, identity.Groups)
+	identity.Method = authMethodOIDC
+	return
+}
+
+// oidcSignatureAlgorithms are the algorithms the ID tokens can be signed with. The symmetric ones
+// and "none" are left out, as the keys of the identity provider are public.
+var oidcSignatureAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+}
+
+// verifyIDToken checks the signature and the claims of an ID token, and returns its claims
+func (provider *oidcProvider) verifyIDToken(token string, discovery *oidcDiscovery, nonce string) (claims map[string]interface{}, err error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, &TTYServerError{msg: "Malformed ID token: " + err.Error()}
+	}
+	if len(parsed.Headers) != 1 || !oidcSignatureAlgorithms[parsed.Headers[0].Algorithm] {
+		return nil, &TTYServerError{msg: "Unsupported ID token algorithm"}
+	}
+	key, err := provider.getKey(parsed.Headers[0].KeyID, discovery)
+	if err != nil {
+		return
+	}
+	var standard jwt.Claims
+	if err = parsed.Claims(key, &standard, &claims); err != nil {
+		return nil, &TTYServerError{msg: "Invalid ID token: " + err.Error()}
+	}
+
+	expected := jwt.Expected{Issuer: discovery.Issuer, Audience: jwt.Audience{provider.config.ClientID}, Time: time.Now()}
+	switch err = standard.ValidateWithLeeway(expected, oidcClockSkew); {
+	case err != nil:
+		err = &TTYServerError{msg: "Invalid ID token: " + err.Error()}
+	case standard.Expiry == nil:
+		err = &TTYServerError{msg: "The ID token doesn't expire"}
+	case claims["nonce"] != nonce:
+		err = &TTYServerError{msg: "The ID token has a wrong nonce"}
+	}
+	return
+}
+
+// getKey returns the key of the identity provider with the given ID. The keys are fetched again
+// when the ID is not known, as the identity provider might have rotated them, but at most once
+// every oidcKeysRefreshInterval, so tokens with made up IDs can't make the server hammer it.
+func (provider *oidcProvider) getKey(kid string, discovery *oidcDiscovery) (*jose.JSONWebKey, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	if !provider.keysFetchedAt.IsZero() && time.Since(provider.keysFetchedAt) < oidcKeysRefreshInterval {
+		return nil, &TTYServerError{msg: "Unknown ID token key: " + kid}
+	}
+	// Also when the fetch fails, so an identity provider which is down isn't asked again at once
+	provider.keysFetchedAt = time.Now()
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := provider.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	provider.keys = make(map[string]*jose.JSONWebKey)
+	for _, data := range jwks.Keys {
+		// The keys the server can't use, of unknown types or for encryption, are skipped
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(data); err != nil || !key.Valid() || !key.IsPublic() || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		provider.keys[key.KeyID] = &key
+	}
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, &TTYServerError{msg: "Unknown ID token key: " + kid}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockIdentityProvider is a stand-in for an OpenID Connect identity provider, which logs in the
+// same user every time, without asking anything
+type mockIdentityProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	// The pending authorization codes, with the PKCE challenge and the nonce they were issued for
+	codes map[string][2]string
+	// How many times the keys were fetched
+	jwksFetches int32
+}
+
+func newMockIdentityProvider(t *testing.T, claims map[string]interface{}) *mockIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdentityProvider{t: t, key: key, claims: claims, codes: make(map[string][2]string)}
+	idp.server = httptest.NewServer(idp)
+	return idp
+}
+
+func (idp *mockIdentityProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	issuer := idp.server.URL
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer,
+			AuthorizationEndpoint: issuer + "/authorize",
+			TokenEndpoint:         issuer + "/token",
+			JWKSURI:               issuer + "/jwks",
+		})
+	case "/jwks":
+		atomic.AddInt32(&idp.jwksFetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test-key",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	case "/authorize":
+		query := r.URL.Query()
+		if query.Get("client_id") != "tty" || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		code := randomString()
+		idp.codes[code] = [2]string{query.Get("code_challenge"), query.Get("nonce")}
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	case "/token":
+		r.ParseForm()
+		pending, ok := idp.codes[r.Form.Get("code")]
+		delete(idp.codes, r.Form.Get("code"))
+		if !ok || pkceChallenge(r.Form.Get("code_verifier")) != pending[0] {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{"iss": issuer, "aud": "tty", "exp": time.Now().Add(time.Hour).Unix(), "nonce": pending[1]}
+		for name, value := range idp.claims {
+			claims[name] = value
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (idp *mockIdentityProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdentityProvider(t, map[string]interface{}{
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "ops"},
+	})
+	defer idp.server.Close()
+
+	roles, _ := newRoleMapping([]string{"ops=operator"}, defaultRole)
+	cookies := newCookieSigner([]byte("test secret"))
+	provider, err := newOIDCProvider(OIDCConfig{Issuer: idp.server.URL, ClientID: "tty"}, roles, cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewTTYServer(TTYServerConfig{Login: provider, Cookies: cookies})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// Not logged in, the API refuses the request
+	response, err := client.Get(ttyServer.URL + "/api/me")
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected the API to need a login, got %v %v", response.StatusCode, err)
+	}
+
+	// The login goes to the identity provider and back, and ends where it started
+	response, err = client.Get(ttyServer.URL + loginPath + "?next=" + url.QueryEscape("/api/me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Request.URL.Path != "/api/me" {
+		t.Fatalf("Expected to be sent back to /api/me after the login, got %s", response.Request.URL)
+	}
+	var identity Identity
+	if err = json.NewDecoder(response.Body).Decode(&identity); err != nil {
+		t.Fatal(err)
+	}
+	if identity.Name != "alice" || identity.Role != "operator" || identity.Method != authMethodOIDC ||
+		strings.Join(identity.Groups, ",") != "staff,ops" {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+
+	// A forged cookie is not accepted
+	serverURL, _ := url.Parse(ttyServer.URL)
+	forged, _ := newCookieSigner([]byte("another secret")).Encode(authCookieName, Identity{Name: "mallory", Method: authMethodOIDC}, time.Hour)
+	jar.SetCookies(serverURL, []*http.Cookie{{Name: authCookieName, Value: forged, Path: "/"}})
+	if response, err = client.Get(ttyServer.URL + "/api/me"); err != nil || response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a forged cookie to be refused, got %v %v", response.StatusCode, err)
+	}
+
+	// A callback without the state of a login in progress fails
+	if response, err = client.Get(ttyServer.URL + oidcCallbackPath + "?code=x&state=y"); err != nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected an unexpected callback to fail, got %v %v", response.StatusCode, err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newMockIdentityProvider(t, nil)
+	defer idp.server.Close()
+	provider, err := newOIDCProvider(OIDCConfig{Issuer: idp.server.URL, ClientID: "tty"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": idp.server.URL, "aud": "tty", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n"}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	if _, err = provider.verifyIDToken(idp.sign(claims(nil)), discovery, "n"); err != nil {
+		t.Fatalf("Expected the ID token to be valid, got %v", err)
+	}
+	unsigned, _ := json.Marshal(map[string]string{"alg": "none", "kid": "test-key"})
+	payload, _ := json.Marshal(claims(nil))
+	for name, token := range map[string]string{
+		"for another client":  idp.sign(claims(map[string]interface{}{"aud": "other"})),
+		"from another issuer": idp.sign(claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"expired":             idp.sign(claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"without expiry":      idp.sign(claims(map[string]interface{}{"exp": nil})),
+		"with another nonce":  idp.sign(claims(map[string]interface{}{"nonce": "other"})),
+		"unsigned": base64.RawURLEncoding.EncodeToString(unsigned) + "." +
+			base64.RawURLEncoding.EncodeToString(payload) + ".",
+		"tampered": strings.Replace(idp.sign(claims(nil)), ".", "."+base64.RawURLEncoding.EncodeToString(payload)[:4], 1),
+	} {
+		if _, err = provider.verifyIDToken(token, discovery, "n"); err == nil {
+			t.Errorf("Expected the ID token %s to be refused", name)
+		}
+	}
+}
+
+func TestOIDCKeysRefresh(t *testing.T) {
+	idp := newMockIdentityProvider(t, nil)
+	defer idp.server.Close()
+	provider, err := newOIDCProvider(OIDCConfig{Issuer: idp.server.URL, ClientID: "tty"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.getKey("test-key", discovery); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unknown key IDs don't make the keys be fetched again at once
+	for i := 0; i < 5; i++ {
+		if _, err = provider.getKey(randomString(), discovery); err == nil {
+			t.Fatalf("Expected an unknown key ID to be refused")
+		}
+	}
+	if fetches := atomic.LoadInt32(&idp.jwksFetches); fetches != 1 {
+		t.Fatalf("Expected the keys to be fetched once, got %d", fetches)
+	}
+
+	// But they are once the keys are old enough, in case they were rotated
+	provider.lock.Lock()
+	provider.keysFetchedAt = provider.keysFetchedAt.Add(-oidcKeysRefreshInterval)
+	provider.lock.Unlock()
+	provider.getKey("rotated", discovery)
+	if fetches := atomic.LoadInt32(&idp.jwksFetches); fetches != 2 {
+		t.Fatalf("Expected the keys to be fetched again, got %d", fetches)
+	}
+	if _, err = provider.getKey("test-key", discovery); err != nil {
+		t.Fatalf("Expected the known key to be kept, got %v", err)
+	}
+}
+
+func TestSafeRedirectPath(t *testing.T) {
+	for next, expected := range map[string]string{
+		"/s/1?a=b":          "/s/1?a=b",
+		"https://evil.com/": "/",
+		"//evil.com/":       "/",
+		"/\\evil.com":       "/",
+		"":                  "/",
+	} {
+		if got := safeRedirectPath(next); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, next, got)
+		}
+	}
+}
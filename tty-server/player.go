@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// PlayerTemplateModel used for templating the player page
+type PlayerTemplateModel struct {
+	RecordingID string
+	EventsPath  string
+	Duration    float64
+}
+
+func getRecordingEventsPath(recordingID string) string {
+	return "/r/" + recordingID + "/events"
+}
+
+// openRecording opens the recording with the given ID, or returns nil if there is no such recording
+func (server *TTYServer) openRecording(recordingID string) recordingReader {
+	if server.config.RecordingSink == nil || !validRecordingID.MatchString(recordingID) {
+		return nil
+	}
+	recording, err := server.config.RecordingSink.Open(recordingID)
+	if err != nil {
+		if err != errRecordingNotFound {
+			log.Warnf("Cannot open recording %s: %s", recordingID, err.Error())
+		}
+		return nil
+	}
+	return recording
+}
+
+func (server *TTYServer) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	recordingID := mux.Vars(r)["recordingID"]
+	log.Debugf("Handling player for recording: %s", recordingID)
+
+	recording := server.openRecording(recordingID)
+	if recording == nil {
+		w.WriteHeader(http.StatusNotFound)
+		server.serveContent(w, r, "invalid-session.html")
+		return
+	}
+	defer recording.Close()
+
+	duration, err := recordingDuration(recording)
+	if err != nil {
+		log.Errorf("Cannot read recording %s: %s", recordingID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	t, err := server.loadTemplate("tty-player.in.html")
+
+	if err != nil {
+		panic("Cannot parse the tty-player html template")
+	}
+
+	templateModel := PlayerTemplateModel{
+		RecordingID: recordingID,
+		EventsPath:  getRecordingEventsPath(recordingID),
+		Duration:    duration,
+	}
+	err = t.Execute(w, templateModel)
+
+	if err != nil {
+		panic("Cannot execute the tty-player html template")
+	}
+}
+
+// handleRecordingEvents streams the events of a recording to the player, starting from the time
+// passed in the "from" query parameter (in seconds).
+func (server *TTYServer) handleRecordingEvents(w http.ResponseWriter, r *http.Request) {
+	recordingID := mux.Vars(r)["recordingID"]
+
+	recording := server.openRecording(recordingID)
+	if recording == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer recording.Close()
+
+	from, _ := strconv.ParseFloat(r.URL.Query().Get("from"), 64)
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := streamRecording(newFlushWriter(w), io.NewSectionReader(recording, 0, recording.Size()), from)
+	if err != nil {
+		log.Debugf("Stopped streaming recording %s: %s", recordingID, err.Error())
+	}
+}
+
+// flushWriter flushes the http response after every write, so the player gets the events as soon
+// as they are read
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (fw *flushWriter) Write(data []byte) (n int, err error) {
+	n, err = fw.w.Write(data)
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return
+}
+
+// parseRecordingEvent returns the time and the type of an event line, without decoding the whole
+// line, which can be big
+func parseRecordingEvent(line []byte) (eventTime float64, eventType string, ok bool) {
+	line = bytes.TrimLeft(line, " ")
+	if len(line) == 0 || line[0] != '[' {
+		return
+	}
+	comma := bytes.IndexByte(line, ',')
+	if comma < 0 {
+		return
+	}
+	eventTime, err := strconv.ParseFloat(string(bytes.TrimSpace(line[1:comma])), 64)
+	if err != nil {
+		return
+	}
+	rest := bytes.TrimLeft(line[comma+1:], " ")
+	end := bytes.IndexByte(rest, ',')
+	if end < 0 {
+		return
+	}
+	if err = json.Unmarshal(rest[:end], &eventType); err != nil {
+		return
+	}
+	return eventTime, eventType, true
+}
+
+// streamRecording writes the header of the recording, followed by the events that are needed to
+// play it from the given time: the last keyframe before that time, and every event after it.
+func streamRecording(w io.Writer, recording io.Reader, from float64) (err error) {
+	reader := bufio.NewReaderSize(recording, 64*1024)
+
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+
+	// The keyframes don't hold the size of the screen, so the last resize before the keyframe
+	// is sent along with it
+	var skipped [][]byte
+	var lastResize []byte
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if eventTime, eventType, ok := parseRecordingEvent(line); ok {
+			if eventTime >= from {
+				skipped = append(skipped, line)
+				break
+			}
+			switch eventType {
+			case recordingEventResize:
+				lastResize = line
+			case recordingEventKeyframe:
+				skipped = skipped[:0]
+				if lastResize != nil {
+					skipped = append(skipped, lastResize)
+				}
+			}
+			skipped = append(skipped, line)
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				return readErr
+			}
+			break
+		}
+	}
+
+	if _, err = w.Write(bytes.Join(skipped, nil)); err != nil {
+		return
+	}
+	_, err = io.Copy(w, reader)
+	return
+}
+
+// recordingDuration returns the time of the last event of a recording
+func recordingDuration(recording recordingReader) (duration float64, err error) {
+	size := recording.Size()
+
+	// The events are short, except for the keyframes, so reading the end of the file is enough
+	// to find the last one most of the time
+	for tailSize := int64(64 * 1024); ; tailSize *= 4 {
+		offset := size - tailSize
+		if offset < 0 {
+			offset = 0
+		}
+		tail := make([]byte, size-offset)
+		if _, err = recording.ReadAt(tail, offset); err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+
+		lines := bytes.Split(tail, []byte("\n"))
+		for i := len(lines) - 1; i >= 0; i-- {
+			// The first line might be incomplete, unless we read the whole file
+			if i == 0 && offset > 0 {
+				break
+			}
+			if eventTime, _, ok := parseRecordingEvent(lines[i]); ok {
+				return eventTime, nil
+			}
+		}
+		if offset == 0 {
+			return 0, nil
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamRecordingSeeks(t *testing.T) {
+	header := `{"version":2,"width":20,"height":3,"timestamp":0}` + "\n"
+	events := []string{
+		`[0.5,"r","30x3"]`,
+		`[1,"o","a"]`,
+		`[2,"o","b"]`,
+		`[2,"k","ab"]`,
+		`[3,"o","c"]`,
+		`[3.5,"r","40x3"]`,
+		`[4,"o","d"]`,
+		`[4,"k","abcd"]`,
+		`[5,"o","e"]`,
+	}
+	recording := header + strings.Join(events, "\n") + "\n"
+
+	for _, test := range []struct {
+		from     float64
+		expected []string
+	}{
+		// From the start, everything is played
+		{0, events},
+		// The keyframe is written after the output at the same time, so it isn't needed to play it
+		{2, events},
+		// After a keyframe, the events before it are skipped, but the last resize
+		{2.5, append([]string{events[0]}, events[3:]...)},
+		{4.5, append([]string{events[5]}, events[7:]...)},
+		// Past the end, the screen is still shown as it was at the end
+		{10, append([]string{events[5]}, events[7:]...)},
+	} {
+		var out bytes.Buffer
+		if err := streamRecording(&out, strings.NewReader(recording), test.from); err != nil {
+			t.Fatal(err)
+		}
+		expected := header + strings.Join(test.expected, "\n") + "\n"
+		if out.String() != expected {
+			t.Errorf("Expected the recording from %v to be\n%s\ngot\n%s", test.from, expected, out.String())
+		}
+	}
+}
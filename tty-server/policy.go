@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// The actions the policy rules are about. The routes are named by their action, and the websocket
+// messages are the "message." actions.
+const (
+	actionStatic              = "static"
+	actionIndex               = "index"
+	actionSessionPage         = "session.page"
+	actionSessionConnect      = "session.connect"
+	actionSessionCreate       = "session.create"
+	actionSessionList         = "session.list"
+	actionSessionCommands     = "session.commands"
+	actionSessionTranscript   = "session.transcript"
+	actionSessionKill         = "session.kill"
+	actionShareCreate         = "share.create"
+	actionShareList           = "share.list"
+	actionShareRevoke         = "share.revoke"
+	actionRecordingView       = "recording.view"
+	actionRecordingEvents     = "recording.events"
+	actionRecordingTranscript = "recording.transcript"
+	actionAuthLogin           = "auth.login"
+	actionAuthLogout          = "auth.logout"
+	actionAuthOIDCCallback    = "auth.oidc.callback"
+	actionAuthLDAPLogin       = "auth.ldap.login"
+	actionAuthCSRF            = "auth.csrf"
+	actionAPIMe               = "api.me"
+	actionMetrics             = "metrics"
+	actionAdminSessions       = "admin.sessions"
+	actionMessagePrefix       = "message."
+)
+
+// policyActions are all the actions, which the actions of the rules are checked against
+var policyActions = []string{
+	actionStatic, actionIndex, actionSessionPage, actionSessionConnect, actionSessionCreate,
+	actionSessionList, actionSessionCommands, actionSessionTranscript, actionSessionKill,
+	actionShareCreate, actionShareList, actionShareRevoke,
+	actionRecordingView, actionRecordingEvents, actionRecordingTranscript, actionAuthLogin,
+	actionAuthLogout, actionAuthOIDCCallback, actionAuthLDAPLogin, actionAuthCSRF, actionAPIMe,
+	actionMetrics,
+	actionMessagePrefix + ttyCommon.MsgIDWrite, actionMessagePrefix + ttyCommon.MsgIDWinSize,
+	actionMessagePrefix + ttyCommon.MsgIDFloorControl, actionMessagePrefix + ttyCommon.MsgIDChat,
+	actionMessagePrefix + ttyCommon.MsgIDWindowControl, actionMessagePrefix + ttyCommon.MsgIDAdmission,
+	actionMessagePrefix + ttyCommon.MsgIDModerate,
+	actionAdminSessions,
+}
+
+// policyRule allows or denies some actions to some users. A rule applies to everyone if it has no
+// users, groups and roles, and to the actions on the sessions of any profile if it has no profiles.
+// The actions can end with "*", e.g. "session.*", or be "*".
+type policyRule struct {
+	Name     string   `json:"name"`
+	Effect   string   `json:"effect"`
+	Users    []string `json:"users,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	Actions  []string `json:"actions"`
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// policy decides what the users can do. The first rule matching a request decides, or the default
+// effect if none does.
+type policy struct {
+	Default string       `json:"default"`
+	Rules   []policyRule `json:"rules"`
+}
+
+// loadPolicy reads a policy from a JSON file
+func loadPolicy(path string) (p *policy, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	p = &policy{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, &TTYServerError{msg: "Cannot parse the policy in " + path + ": " + err.Error()}
+	}
+	if p.Default == "" {
+		p.Default = policyDeny
+	}
+	if p.Default != policyAllow && p.Default != policyDeny {
+		return nil, &TTYServerError{msg: "The default effect of the policy has to be allow or deny"}
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return nil, &TTYServerError{msg: "A policy rule has no name"}
+		}
+		if rule.Effect != policyAllow && rule.Effect != policyDeny {
+			return nil, &TTYServerError{msg: "The effect of the policy rule " + rule.Name + " has to be allow or deny"}
+		}
+		if len(rule.Actions) == 0 {
+			return nil, &TTYServerError{msg: "The policy rule " + rule.Name + " has no actions"}
+		}
+		// Catch the typos, which would make the rule silently useless
+		for _, pattern := range rule.Actions {
+			known := false
+			for _, action := range policyActions {
+				known = known || matchPolicyPattern(pattern, action)
+			}
+			if !known {
+				return nil, &TTYServerError{msg: "Unknown action " + pattern + " in the policy rule " + rule.Name}
+			}
+		}
+		for j := 0; j < i; j++ {
+			if p.Rules[j].Name == rule.Name {
+				return nil, &TTYServerError{msg: "Duplicate policy rule " + rule.Name}
+			}
+		}
+	}
+	return
+}
+
+func matchPolicyPattern(pattern, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, pattern[:len(pattern)-1])
+	}
+	return pattern == value
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *policyRule) matches(identity Identity, action, profile string) bool {
+	if len(rule.Users) > 0 || len(rule.Groups) > 0 || len(rule.Roles) > 0 {
+		who := containsString(rule.Users, identity.Name) || containsString(rule.Roles, identity.Role)
+		for _, group := range identity.Groups {
+			who = who || containsString(rule.Groups, group)
+		}
+		if !who {
+			return false
+		}
+	}
+	if len(rule.Profiles) > 0 && !containsString(rule.Profiles, profile) {
+		return false
+	}
+	for _, pattern := range rule.Actions {
+		if matchPolicyPattern(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns if the action is allowed, and the name of the rule which decided it
+func (p *policy) decide(identity Identity, action, profile string) (allowed bool, rule string) {
+	for _, rule := range p.Rules {
+		if rule.matches(identity, action, profile) {
+			return rule.Effect == policyAllow, rule.Name
+		}
+	}
+	// Nobody could log in, or see the pages, otherwise
+	if action == actionStatic || strings.HasPrefix(action, "auth.") {
+		return true, "builtin"
+	}
+	return p.Default == policyAllow, "default"
+}
+
+// Allow tells if a user can do an action, in the session with the given profile, if the action is
+// on a session. The denials are logged. Everything is allowed without a policy.
+func (p *policy) Allow(identity Identity, action, sessionID, profile string) bool {
+	if p == nil {
+		return true
+	}
+	allowed, rule := p.decide(identity, action, profile)
+	if !allowed {
+		log.Warnf("Denied %s to %s (role %s) in session %q with profile %q, by the policy rule %s",
+			action, identity.Name, identity.Role, sessionID, profile, rule)
+	}
+	return allowed
+}
+
+// IsAdmin tells if a user is an admin of the sessions with the given profile, which only a rule
+// allowing it the admin.sessions action makes it, whatever the default of the policy is. It isn't a
+// "session." action, so the rules letting everyone use the sessions don't make everyone an admin.
+func (p *policy) IsAdmin(identity Identity, profile string) bool {
+	if p == nil {
+		return false
+	}
+	for _, rule := range p.Rules {
+		if rule.matches(identity, actionAdminSessions, profile) {
+			return rule.Effect == policyAllow
+		}
+	}
+	return false
+}
+
+// policyMiddleware checks every request against the policy, with the action the route is named by
+func (server *TTYServer) policyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var action string
+		if route := mux.CurrentRoute(r); route != nil {
+			action = route.GetName()
+		}
+		sessionID, profile := mux.Vars(r)["sessionID"], ""
+		if session := server.getSession(sessionID); session != nil {
+			profile = session.GetProfile()
+		} else if sessionID != "" {
+			// The session is created with the profile asked for
+			profile = r.URL.Query().Get("profile")
+			if profile == "" {
+				profile = defaultProfileName
+			}
+		}
+		if !server.config.Policy.Allow(server.identify(r), action, sessionID, profile) {
+			server.config.Metrics.AuthFailure("policy")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
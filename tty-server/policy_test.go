@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolicyDecisions(t *testing.T) {
+	p, err := loadPolicy("../doc/policy.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := Identity{Name: "olivia", Groups: []string{"ops"}, Role: "user"}
+	support := Identity{Name: "sam", Groups: []string{"support"}, Role: "user"}
+	admin := Identity{Name: "ada", Role: "admin"}
+
+	for _, test := range []struct {
+		identity Identity
+		action   string
+		profile  string
+		allowed  bool
+		rule     string
+	}{
+		{ops, actionSessionCreate, "prod-shell", true, "ops-may-use-prod-shell"},
+		{support, actionSessionCreate, "prod-shell", false, "only-ops-create-prod-shell"},
+		{support, actionSessionConnect, "prod-shell", true, "everyone-may-use-sessions"},
+		{support, "message.Write", "default", false, "support-may-not-type"},
+		{support, "message.WinSize", "default", true, "everyone-may-use-sessions"},
+		{ops, actionSessionKill, "prod-shell", false, "only-admins-kill"},
+		{ops, actionSessionKill, "default", false, "only-admins-kill"},
+		{admin, actionSessionKill, "default", true, "admins-may-do-anything"},
+		{anonymous, actionAuthLogin, "", true, "builtin"},
+		{anonymous, "", "", false, "default"},
+	} {
+		allowed, rule := p.decide(test.identity, test.action, test.profile)
+		if allowed != test.allowed || rule != test.rule {
+			t.Errorf("Expected %s by %s to be %v by %s, got %v by %s", test.action, test.identity.Name,
+				test.allowed, test.rule, allowed, rule)
+		}
+	}
+
+	// Only the rules allowing it the admin action make a user an admin, not the ones allowing session.*
+	for _, test := range []struct {
+		identity Identity
+		profile  string
+		admin    bool
+	}{
+		{anonymous, "default", false},
+		{support, "prod-shell", false},
+		{ops, "default", false},
+		{ops, "prod-shell", true},
+		{admin, "default", true},
+	} {
+		if p.IsAdmin(test.identity, test.profile) != test.admin {
+			t.Errorf("Expected %s to be an admin of the %s sessions: %v", test.identity.Name, test.profile, test.admin)
+		}
+	}
+
+	// Without a policy, everything is allowed
+	if !(*policy)(nil).Allow(support, actionSessionKill, "1", "default") {
+		t.Errorf("Expected everything to be allowed without a policy")
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, invalid := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "allow", "actions": ["*"]}]}`,
+		`{"rules": [{"name": "a", "effect": "permit", "actions": ["*"]}]}`,
+		`{"rules": [{"name": "a", "effect": "allow"}]}`,
+		`{"rules": [{"name": "a", "effect": "allow", "actions": ["session.destroy"]}]}`,
+		`{"rules": [{"name": "a", "effect": "allow", "actions": ["*"]}, {"name": "a", "effect": "deny", "actions": ["*"]}]}`,
+	} {
+		path := filepath.Join(dir, "policy.json")
+		ioutil.WriteFile(path, []byte(invalid), 0600)
+		if _, err = loadPolicy(path); err == nil {
+			t.Errorf("Expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	p, err := loadPolicy("../doc/policy.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := newCookieSigner([]byte("test secret"))
+	profiles := map[string]*sessionProfile{"prod-shell": {Name: "prod-shell", Command: "true"}}
+	server := NewTTYServer(TTYServerConfig{Cookies: cookies, Policy: p, Profiles: profiles})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	request := func(method, path string, identity Identity) int {
+		r, _ := http.NewRequest(method, ttyServer.URL+path, nil)
+		encoded, _ := cookies.Encode(authCookieName, identity, time.Hour)
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	support := Identity{Name: "sam", Groups: []string{"support"}, Role: "user", Method: authMethodOIDC}
+	admin := Identity{Name: "ada", Role: "admin", Method: authMethodOIDC}
+	if status := request("GET", "/api/sessions", support); status != http.StatusOK {
+		t.Errorf("Expected support to list the sessions, got %d", status)
+	}
+	if status := request("DELETE", "/api/sessions/1", support); status != http.StatusForbidden {
+		t.Errorf("Expected support not to kill sessions, got %d", status)
+	}
+	// Allowed, but there is no such session
+	if status := request("DELETE", "/api/sessions/1", admin); status != http.StatusNotFound {
+		t.Errorf("Expected admins to kill sessions, got %d", status)
+	}
+	if status := request("GET", "/ws/1?profile=prod-shell", support); status != http.StatusForbidden {
+		t.Errorf("Expected support not to open prod-shell sessions, got %d", status)
+	}
+}
+
+func TestSessionKillWithoutPolicy(t *testing.T) {
+	cookies := newCookieSigner([]byte("test secret"))
+	server := NewTTYServer(TTYServerConfig{Cookies: cookies})
+	bob := Identity{Name: "bob", Role: defaultRole, Method: authMethodOIDC}
+	session := ptyMasterNew("1")
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+	session.SetOwner(&ttyReceiver{id: "r1", identity: bob})
+	server.addSession("1", session)
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	kill := func(identity Identity) int {
+		r, _ := http.NewRequest("DELETE", ttyServer.URL+"/api/sessions/1", nil)
+		if identity.Method != authMethodNone {
+			encoded, _ := cookies.Encode(authCookieName, identity, time.Hour)
+			r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// Everything is allowed without a policy, but killing the sessions of others
+	alice := Identity{Name: "alice", Role: defaultRole, Method: authMethodOIDC}
+	for _, identity := range []Identity{anonymous, alice} {
+		if status := kill(identity); status != http.StatusForbidden {
+			t.Errorf("Expected %s not to kill the session, got %d", identity.Name, status)
+		}
+	}
+	if status := kill(bob); status != http.StatusNoContent {
+		t.Errorf("Expected the owner to kill the session, got %d", status)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+const (
+	// displayNameQueryName is the query parameter the anonymous receivers choose their name with
+	displayNameQueryName = "name"
+	maxDisplayNameLength = 32
+)
+
+// displayName returns the name a receiver is shown with to the others. The receivers which are
+// logged in are shown with their identity, and the others with the name they chose, if any.
+func displayName(receiver *ttyReceiver, requested string) string {
+	if receiver.identity.Method != authMethodNone {
+		return receiver.identity.Name
+	}
+	name := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, requested))
+	if runes := []rune(name); len(runes) > maxDisplayNameLength {
+		name = string(runes[:maxDisplayNameLength])
+	}
+	if name == "" {
+		name = "Guest " + strings.TrimPrefix(receiver.id, "r")
+	}
+	return name
+}
+
+// presenceReceiver returns a receiver of the session, as another one sees it
+func (pty *ptyMaster) presenceReceiver(receiver, to *ttyReceiver) ttyCommon.PresenceReceiver {
+	presence := ttyCommon.PresenceReceiver{
+		ID:            receiver.id,
+		Name:          receiver.name,
+		Identity:      receiver.identity.Name,
+		Role:          receiver.identity.Role,
+		Authenticated: receiver.identity.Method != authMethodNone,
+		ViewOnly:      receiver.viewOnly,
+		Owner:         pty.IsOwner(receiver),
+		ConnectedAt:   receiver.connectedAt,
+	}
+	if pty.IsOwner(to) {
+		presence.Address = receiver.remoteAddr
+	}
+	return presence
+}
+
+// presenceJoin tells a receiver joining the session who is already there, and the others that it
+// joined
+func (pty *ptyMaster) presenceJoin(receiver *ttyReceiver) {
+	presence := ttyCommon.MsgTTYPresence{Self: receiver.id, Moderator: pty.isModerator(receiver)}
+	for _, r := range pty.GetReceivers() {
+		presence.Receivers = append(presence.Receivers, pty.presenceReceiver(r, receiver))
+		if r == receiver {
+			continue
+		}
+		joined := ttyCommon.MsgTTYReceiverJoined{Receiver: pty.presenceReceiver(receiver, r)}
+		if err := r.conn.WriteMessage(joined); err != nil {
+			log.Debugf("Cannot tell receiver %s of session %s that %s joined: %s", r.id, pty.sessionID, receiver.id, err.Error())
+		}
+	}
+	if err := receiver.conn.WriteMessage(presence); err != nil {
+		log.Debugf("Cannot send the presence list to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+	}
+}
+
+// sendPresence sends the receivers of the session to all of them again, as when they joined
+func (pty *ptyMaster) sendPresence() {
+	receivers := pty.GetReceivers()
+	for _, to := range receivers {
+		presence := ttyCommon.MsgTTYPresence{Self: to.id, Moderator: pty.isModerator(to)}
+		for _, r := range receivers {
+			presence.Receivers = append(presence.Receivers, pty.presenceReceiver(r, to))
+		}
+		if err := to.conn.WriteMessage(presence); err != nil {
+			log.Debugf("Cannot send the presence list to receiver %s of session %s: %s", to.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// presenceLeave tells the receivers of the session that one of them left
+func (pty *ptyMaster) presenceLeave(receiver *ttyReceiver) {
+	left := ttyCommon.MsgTTYReceiverLeft{ID: receiver.id, Name: receiver.name}
+	for _, r := range pty.GetReceivers() {
+		if err := r.conn.WriteMessage(left); err != nil {
+			log.Debugf("Cannot tell receiver %s of session %s that %s left: %s", r.id, pty.sessionID, receiver.id, err.Error())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+func TestDisplayName(t *testing.T) {
+	receiver := &ttyReceiver{id: "r7", identity: anonymous}
+	cases := map[string]string{
+		"":                      "Guest 7",
+		"  Ada \x1b[31m ":       "Ada [31m",
+		strings.Repeat("é", 40): strings.Repeat("é", maxDisplayNameLength),
+	}
+	for requested, expected := range cases {
+		if name := displayName(receiver, requested); name != expected {
+			t.Errorf("Expected %q to be shown as %q, got %q", requested, expected, name)
+		}
+	}
+	// The receivers which logged in can't choose
+	receiver.identity = Identity{Name: "alice", Method: authMethodClientCert}
+	if name := displayName(receiver, "bob"); name != "alice" {
+		t.Errorf("Expected the identity to be shown, got %q", name)
+	}
+}
+
+// presenceMessages returns the types of the presence messages a receiver was sent, and the
+// receivers they were about
+func presenceMessages(t *testing.T, conn *messageConn) (messages []string) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	decoder := json.NewDecoder(bytes.NewReader(conn.buffer.Bytes()))
+	for decoder.More() {
+		var msg ttyCommon.MsgAll
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case ttyCommon.MsgIDPresence:
+			var presence ttyCommon.MsgTTYPresence
+			json.Unmarshal(msg.Data, &presence)
+			for _, receiver := range presence.Receivers {
+				messages = append(messages, "present "+receiver.Name+" "+receiver.Address)
+			}
+		case ttyCommon.MsgIDReceiverJoined:
+			var joined ttyCommon.MsgTTYReceiverJoined
+			json.Unmarshal(msg.Data, &joined)
+			messages = append(messages, "joined "+joined.Receiver.Name+" "+joined.Receiver.Address)
+		case ttyCommon.MsgIDReceiverLeft:
+			var left ttyCommon.MsgTTYReceiverLeft
+			json.Unmarshal(msg.Data, &left)
+			messages = append(messages, "left "+left.Name)
+		}
+	}
+	return
+}
+
+func TestPresence(t *testing.T) {
+	session := ptyMasterNew("1")
+	join := func(name string, owner bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: name, remoteAddr: name + ":1"}
+		return receiver, joinSession(session, receiver, owner)
+	}
+	_, ownerConn := join("ada", true)
+	other, otherConn := join("bob", false)
+	session.removeReceiver(other)
+	session.presenceLeave(other)
+
+	// Only the owner sees the addresses
+	expected := map[*messageConn]string{
+		ownerConn: "present ada ada:1|joined bob bob:1|left bob",
+		otherConn: "present ada |present bob ",
+	}
+	for conn, messages := range expected {
+		if got := strings.Join(presenceMessages(t, conn), "|"); got != messages {
+			t.Errorf("Expected the messages %q, got %q", messages, got)
+		}
+	}
+}
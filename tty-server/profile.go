@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const defaultProfileName = "default"
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// sessionProfile is a kind of session the receivers can open, which says what the session runs,
+// and as which local user. The sessions run as the server's user if none is set.
+type sessionProfile struct {
+	Name    string   `json:"-"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// User is the name, or the uid, of the user the sessions run as
+	User string  `json:"user,omitempty"`
+	UID  *uint32 `json:"uid,omitempty"`
+	// GID and Groups replace the primary and the supplementary groups of the user
+	GID    *uint32  `json:"gid,omitempty"`
+	Groups []uint32 `json:"groups,omitempty"`
+	// IdentityUsers maps the identities opening the sessions to the local users the sessions run
+	// as. "*" maps every other identity, and "*" as a user is the one named like the identity.
+	IdentityUsers map[string]string `json:"identity_users,omitempty"`
+	// MinUID is the lowest uid an identity is mapped to by its name, with "*" as a user, so the
+	// identities can't be mapped to the system users. It is 1000 if not set.
+	MinUID *uint32 `json:"min_uid,omitempty"`
+	// Sandbox isolates the sessions in Linux namespaces, if set
+	Sandbox *sandboxConfig `json:"sandbox,omitempty"`
+	// Limits runs each session in its own cgroup, with these limits, if set
+	Limits *resourceLimits `json:"limits,omitempty"`
+	// FloorControl makes one receiver at a time type in the sessions, and is what happens to the
+	// input of the others: "drop" or "queue"
+	FloorControl string `json:"floor_control,omitempty"`
+	// WaitingRoom makes the receivers joining the sessions wait until their owner, or an admin, lets
+	// them in
+	WaitingRoom bool `json:"waiting_room,omitempty"`
+	// WindowSize decides the size of the sessions, when their receivers have different sizes: last,
+	// owner, smallest or fixed:<cols>x<rows>
+	WindowSize string `json:"window_size,omitempty"`
+	// MaxWindows is how many windows the sessions can have, with the main one. 0 is the default.
+	MaxWindows int `json:"max_windows,omitempty"`
+	// WindowCommands are what the receivers can run in new windows, by their name, besides the
+	// command of the profile
+	WindowCommands map[string]windowCommand `json:"window_commands,omitempty"`
+}
+
+// validateWindows checks the windows of a profile
+func (profile *sessionProfile) validateWindows() error {
+	if profile.MaxWindows < 0 {
+		return &TTYServerError{msg: "The profile " + profile.Name + " can't have less than no windows"}
+	}
+	for name, command := range profile.WindowCommands {
+		if name == "" || command.Command == "" {
+			return &TTYServerError{msg: "Invalid window command " + name + " in the profile " + profile.Name}
+		}
+	}
+	return nil
+}
+
+// windows returns how many windows the sessions of the profile can have, and what they can run
+func (profile *sessionProfile) windows() windowsConfig {
+	config := windowsConfig{Max: profile.MaxWindows, Commands: profile.WindowCommands}
+	if config.Max == 0 {
+		config.Max = defaultMaxWindows
+	}
+	return config
+}
+
+// loadProfiles reads the profiles from a JSON file holding an object, with the profiles by their
+// name. The default profile is used for the sessions opened without asking for one, unless the
+// file has a profile named "default".
+func loadProfiles(path string, defaultProfile sessionProfile) (profiles map[string]*sessionProfile, err error) {
+	profiles = make(map[string]*sessionProfile)
+	if path != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		if err = json.Unmarshal(data, &profiles); err != nil {
+			return nil, &TTYServerError{msg: "Cannot parse the profiles in " + path + ": " + err.Error()}
+		}
+	}
+	for name, profile := range profiles {
+		if !profileNamePattern.MatchString(name) || profile == nil || profile.Command == "" {
+			return nil, &TTYServerError{msg: "Invalid profile: " + name}
+		}
+		profile.Name = name
+		if err = profile.validateUser(); err != nil {
+			return nil, err
+		}
+		if profile.Sandbox != nil {
+			if err = profile.Sandbox.validate(name); err != nil {
+				return nil, err
+			}
+		}
+		if profile.Limits != nil {
+			if err = profile.Limits.validate(name); err != nil {
+				return nil, err
+			}
+		}
+		if err = validateFloorControl(profile.FloorControl, name); err != nil {
+			return nil, err
+		}
+		if err = profile.validateWindows(); err != nil {
+			return nil, err
+		}
+		if _, err = parseWindowSize(profile.WindowSize, name); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := profiles[defaultProfileName]; !ok {
+		defaultProfile.Name = defaultProfileName
+		if err = validateFloorControl(defaultProfile.FloorControl, defaultProfileName); err != nil {
+			return nil, err
+		}
+		if err = defaultProfile.validateWindows(); err != nil {
+			return nil, err
+		}
+		if _, err = parseWindowSize(defaultProfile.WindowSize, defaultProfileName); err != nil {
+			return nil, err
+		}
+		profiles[defaultProfileName] = &defaultProfile
+	}
+	return
+}
+
+// getProfile returns the profile a session is opened with, or nil if there is no such profile
+func (server *TTYServer) getProfile(name string) *sessionProfile {
+	if name == "" {
+		name = defaultProfileName
+	}
+	if profile, ok := server.config.Profiles[name]; ok {
+		return profile
+	}
+	// Without profiles, the sessions run the command of the configuration
+	if server.config.Profiles == nil && name == defaultProfileName {
+		return &sessionProfile{
+			Name:    defaultProfileName,
+			Command: server.config.CommandName,
+			Args:    strings.Fields(server.config.CommandArgs),
+		}
+	}
+	return nil
+}
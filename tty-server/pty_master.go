@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"io"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -14,22 +15,73 @@ import (
 	ttyCommon "github.com/Yi-Tseng/tty-share/common"
 	ptyDevice "github.com/creack/pty"
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
 )
 
 // This defines a PTY Master whih will encapsulate the command we want to run, and provide simple
 // access to the command, to write and read IO, but also to control the window size.
 type ptyMaster struct {
-	sessionID              string
-	mainRWLock             sync.RWMutex
-	ptyFile                *os.File
-	command                *exec.Cmd
-	ttyReceiverConnections []*ttyCommon.TTYProtocolConn
+	sessionID      string
+	mainRWLock     sync.RWMutex
+	ptyFile        *os.File
+	command        *exec.Cmd
+	receivers      []*ttyReceiver
+	recorder       *sessionRecorder
+	audit          *auditLog
+	commands       *commandTracker
+	history        *outputHistory
+	profile        string
+	policy         *policy
+	user           *sessionUser
+	sandbox        *sandboxConfig
+	sandboxCleanup func()
+	cgroup         *sessionCgroup
+	limits         *rateLimiter
+	redactor       *redactor
+	floor          *floorControl
+	chat           *sessionChat
+	// owner is the receiver which created the session, or was given it
+	owner *ttyReceiver
+	// startCommand is what the session was started with, which the windows run by default
+	startCommand  windowCommand
+	windowsConfig windowsConfig
+	windowsLock   sync.Mutex
+	windows       map[string]*sessionWindow
+	// windowCommands tracks the commands of the windows, but the main one, by their ID. They are
+	// kept once the windows close.
+	windowCommands map[string]*commandTracker
+	windowsClosed  bool
+	lastWindow     int
+	mainWindowName string
+	winRows        int
+	winCols        int
+	redactionRules *redactionRules
+	sizePolicy     windowSizePolicy
+	// sizeLock guards the size of the session, and the sizes its receivers ask for
+	sizeLock sync.Mutex
+	cols     int
+	rows     int
+	waiting  *waitingRoom
+	bans     *sessionBans
+	metrics  *serverMetrics
+	// startedAt is when the command of the session started
+	startedAt time.Time
+	// outputReadAt is when the oldest output not written to the receivers yet was read, if any
+	outputLock   sync.Mutex
+	outputReadAt time.Time
 }
 
 func ptyMasterNew(sessionID string) *ptyMaster {
 	return &ptyMaster{
-		sessionID:              sessionID,
-		ttyReceiverConnections: make([]*ttyCommon.TTYProtocolConn, 10),
+		sessionID:      sessionID,
+		receivers:      make([]*ttyReceiver, 0, 10),
+		commands:       newCommandTracker("", defaultCommandsLimit),
+		windows:        make(map[string]*sessionWindow),
+		windowCommands: make(map[string]*commandTracker),
+		bans:           newSessionBans(),
+		// The first window is the main one
+		lastWindow:    1,
+		windowsConfig: windowsConfig{Max: 1},
 	}
 }
 
@@ -37,20 +89,350 @@ func (pty *ptyMaster) GetSessionID() string {
 	return pty.sessionID
 }
 
-func (pty *ptyMaster) Start(command string, args []string) (err error) {
-	pty.command = exec.Command(command, args...)
-	pty.ptyFile, err = ptyDevice.Start(pty.command)
+// SetRecorder makes the session record its output. It has to be called before Start.
+func (pty *ptyMaster) SetRecorder(recorder *sessionRecorder) {
+	pty.recorder = recorder
+}
 
-	if err != nil {
+// SetProfile sets the name of the profile the session was opened with
+func (pty *ptyMaster) SetProfile(profile string) {
+	pty.profile = profile
+}
+
+func (pty *ptyMaster) GetProfile() string {
+	return pty.profile
+}
+
+// SetOwner makes a receiver the owner of the session, with the other receivers logged in as the
+// same user
+func (pty *ptyMaster) SetOwner(receiver *ttyReceiver) {
+	pty.mainRWLock.Lock()
+	pty.owner = receiver
+	pty.mainRWLock.Unlock()
+}
+
+// IsOwner tells if a receiver owns the session
+func (pty *ptyMaster) IsOwner(receiver *ttyReceiver) bool {
+	pty.mainRWLock.RLock()
+	owner := pty.owner
+	pty.mainRWLock.RUnlock()
+	if owner == nil || receiver == nil {
+		return false
+	}
+	return receiver == owner || owner.identity.Method != authMethodNone &&
+		receiver.identity.Method == owner.identity.Method && receiver.identity.Name == owner.identity.Name
+}
+
+// IsOwnedBy tells if a logged in user owns the session. The users who aren't logged in never do, as
+// nothing tells them apart.
+func (pty *ptyMaster) IsOwnedBy(identity Identity) bool {
+	pty.mainRWLock.RLock()
+	owner := pty.owner
+	pty.mainRWLock.RUnlock()
+	return owner != nil && identity.Method != authMethodNone && owner.identity.Method == identity.Method &&
+		owner.identity.Name == identity.Name
+}
+
+// SetUser makes the session run as a local user, instead of the server's one. It has to be called
+// before Start.
+func (pty *ptyMaster) SetUser(user *sessionUser) {
+	pty.user = user
+}
+
+// SetSandbox makes the session run in a sandbox. It has to be called before Start.
+func (pty *ptyMaster) SetSandbox(sandbox *sandboxConfig) {
+	pty.sandbox = sandbox
+}
+
+// SetCgroup makes the session run in a cgroup. It has to be called before Start.
+func (pty *ptyMaster) SetCgroup(cgroup *sessionCgroup) {
+	pty.cgroup = cgroup
+}
+
+// GetResources returns what the session uses of its resources, or nil if it has no cgroup
+func (pty *ptyMaster) GetResources() *cgroupStats {
+	if pty.cgroup == nil {
+		return nil
+	}
+	stats := pty.cgroup.Stats()
+	return &stats
+}
+
+// SetRateLimiter makes the session limit how fast the receivers can type
+func (pty *ptyMaster) SetRateLimiter(limits *rateLimiter) {
+	pty.limits = limits
+}
+
+// SetRedaction makes the session mask the secrets matching the rules in its output, before it
+// reaches the receivers, the history and the recording. It has to be called before Start.
+func (pty *ptyMaster) SetRedaction(rules *redactionRules) {
+	if rules != nil {
+		pty.redactor = newRedactor(rules, pty.broadcast)
+		pty.redactionRules = rules
+	}
+}
+
+// SetMetrics makes the session count what it does in the metrics of the server
+func (pty *ptyMaster) SetMetrics(metrics *serverMetrics) {
+	pty.metrics = metrics
+}
+
+// SetPolicy makes the session check the messages of the receivers against the policy
+func (pty *ptyMaster) SetPolicy(p *policy) {
+	pty.policy = p
+}
+
+// SetAuditLog makes the session log what the receivers do in the audit log
+func (pty *ptyMaster) SetAuditLog(audit *auditLog) {
+	pty.audit = audit
+}
+
+// GetCommands returns the commands run in all the windows of the session, by the time they started.
+// They are only known when the shell marks them in its output.
+func (pty *ptyMaster) GetCommands() []shellCommand {
+	commands := pty.commands.Commands()
+	pty.windowsLock.Lock()
+	trackers := make([]*commandTracker, 0, len(pty.windowCommands))
+	for _, tracker := range pty.windowCommands {
+		trackers = append(trackers, tracker)
+	}
+	pty.windowsLock.Unlock()
+	if len(trackers) == 0 {
+		return commands
+	}
+
+	for _, tracker := range trackers {
+		commands = append(commands, tracker.Commands()...)
+	}
+	sort.SliceStable(commands, func(i, j int) bool {
+		return commands[i].StartTime.Before(commands[j].StartTime)
+	})
+	return commands
+}
+
+// SetOutputHistory makes the session keep its last output, which the transcripts are made from. It
+// has to be called before Start.
+func (pty *ptyMaster) SetOutputHistory(history *outputHistory) {
+	pty.history = history
+}
+
+// GetOutputHistory returns the output the session keeps, with the window size changes
+func (pty *ptyMaster) GetOutputHistory() []transcriptEvent {
+	return pty.history.Events()
+}
+
+// Start runs the command in the PTY, in the sandbox and in the cgroup of the session if it has them.
+// env is added to the environment of the server, or of the user the session runs as.
+func (pty *ptyMaster) Start(command string, args []string, env []string) (err error) {
+	if pty.command, pty.ptyFile, pty.sandboxCleanup, err = pty.startProcess(command, args, env); err != nil {
+		pty.cleanup()
 		return
 	}
+	pty.startCommand = windowCommand{Command: command, Args: args, env: env}
+	pty.startedAt = time.Now()
+	pty.metrics.CommandStarted(pty.profile)
+	pty.metrics.SessionStarted(pty.profile)
+	pty.mainWindowName = filepath.Base(command)
+	if pty.cgroup != nil {
+		go pty.cgroup.Watch(pty.reportResources)
+	}
 
-	// Set the initial window size
-	cols, rows, err := terminal.GetSize(0)
+	// Set the initial window size. The server may not run in a terminal.
+	cols, rows, _ := terminal.GetSize(0)
+	if pty.sizePolicy.mode == windowSizeFixed {
+		cols, rows = pty.sizePolicy.cols, pty.sizePolicy.rows
+	}
+	pty.cols, pty.rows = cols, rows
 	pty.SetWinSize(rows, cols)
+
+	go pty.forwardOutput()
+	return
+}
+
+// startProcess runs a command in a new PTY, as the user of the session, and in its sandbox and its
+// cgroup, if it has them. The sandbox is removed by sandboxCleanup, once the command exits.
+func (pty *ptyMaster) startProcess(name string, args []string, env []string) (command *exec.Cmd, ptyFile *os.File, sandboxCleanup func(), err error) {
+	if pty.sandbox != nil {
+		if command, sandboxCleanup, err = pty.sandbox.command(name, args, env, pty.user); err != nil {
+			return
+		}
+	} else {
+		command = exec.Command(name, args...)
+	}
+	failed := func() {
+		if sandboxCleanup != nil {
+			sandboxCleanup()
+		}
+	}
+	if len(env) > 0 && pty.sandbox == nil {
+		command.Env = append(os.Environ(), env...)
+	}
+	if pty.user != nil && pty.sandbox == nil {
+		// The server keeps its privileges, to start the next sessions, and the process drops them
+		// before running the command
+		command.SysProcAttr = &syscall.SysProcAttr{Credential: pty.user.credential()}
+		command.Env = pty.user.environment(env)
+		if info, err := os.Stat(pty.user.Home); err == nil && info.IsDir() {
+			command.Dir = pty.user.Home
+		}
+	}
+	var wait, release *os.File
+	if pty.cgroup != nil {
+		if wait, release, err = holdUntilInCgroup(command, name, args, pty.sandbox != nil); err != nil {
+			failed()
+			return
+		}
+		defer wait.Close()
+		defer release.Close()
+	}
+	if ptyFile, err = ptyDevice.Start(command); err != nil {
+		failed()
+		return
+	}
+	if release != nil {
+		// The process exits if the pipe is closed before it could be moved to the cgroup
+		if err = pty.cgroup.Add(command.Process.Pid); err == nil {
+			_, err = release.Write([]byte{1})
+		}
+		if err != nil {
+			release.Close()
+			command.Wait()
+			ptyFile.Close()
+			failed()
+			return
+		}
+	}
 	return
 }
 
+// holdUntilInCgroup makes a command wait until the server moved it to the cgroup of the session, so
+// none of its processes escape the limits. It returns the ends of the pipe the command waits on.
+func holdUntilInCgroup(command *exec.Cmd, name string, args []string, sandboxed bool) (wait, release *os.File, err error) {
+	if wait, release, err = os.Pipe(); err != nil {
+		return
+	}
+	// The sandboxes wait by themselves
+	if !sandboxed {
+		command.Path = "/proc/self/exe"
+		command.Args = append([]string{"tty-server", sessionInitCommand, name}, args...)
+	}
+	if command.Env == nil {
+		command.Env = os.Environ()
+	}
+	// The first extra file is the descriptor 3 of the process
+	command.ExtraFiles = []*os.File{wait}
+	command.Env = append(command.Env, sessionWaitEnvName+"=3")
+	return
+}
+
+// cleanup removes what was created on the host for the session
+func (pty *ptyMaster) cleanup() {
+	pty.closeWindows()
+	if pty.sandboxCleanup != nil {
+		pty.sandboxCleanup()
+	}
+	if pty.cgroup != nil {
+		pty.cgroup.Remove()
+	}
+}
+
+// reportResources tells the receivers that the session hit one of its resource limits
+func (pty *ptyMaster) reportResources(event ttyCommon.MsgTTYResourceEvent) {
+	log.Warnf("Session %s: %s", pty.sessionID, event.Message)
+	for _, receiver := range pty.GetReceivers() {
+		if err := receiver.conn.WriteMessage(event); err != nil {
+			log.Debugf("Cannot write to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// forwardOutput reads the output of the command, and sends it to all the receivers, and to the
+// recorder. There is only one reader of the PTY, so every receiver gets all of the output.
+func (pty *ptyMaster) forwardOutput() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := pty.ptyFile.Read(buf)
+		if n > 0 {
+			pty.metrics.Bytes(metricsDirectionOut, n)
+			pty.outputLock.Lock()
+			if pty.outputReadAt.IsZero() {
+				pty.outputReadAt = time.Now()
+			}
+			pty.outputLock.Unlock()
+			if pty.redactor != nil {
+				pty.redactor.Write(buf[:n])
+			} else {
+				pty.broadcast(buf[:n])
+			}
+		}
+		if err != nil {
+			log.Debugf("Finished reading the output of session %s: %s", pty.sessionID, err.Error())
+			break
+		}
+	}
+	if pty.redactor != nil {
+		pty.redactor.Flush()
+	}
+
+	if pty.recorder != nil {
+		pty.recorder.Close()
+	}
+}
+
+// dropReceiver disconnects a receiver the output of the session can't be written to, like one which
+// didn't read it in time, so it leaves the session
+func (pty *ptyMaster) dropReceiver(receiver *ttyReceiver, err error) {
+	log.Debugf("Cannot write to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+	pty.metrics.WebsocketError("write")
+	receiver.conn.Close()
+}
+
+func (pty *ptyMaster) broadcast(data []byte) {
+	pty.commands.Write(data)
+	pty.history.WriteOutput(data)
+	if pty.recorder != nil {
+		if err := pty.recorder.WriteOutput(data); err != nil {
+			log.Warnf("Cannot record the output of session %s: %s", pty.sessionID, err.Error())
+		}
+	}
+
+	pty.mainRWLock.RLock()
+	receivers := append([]*ttyReceiver(nil), pty.receivers...)
+	pty.mainRWLock.RUnlock()
+
+	for _, receiver := range receivers {
+		if _, err := receiver.conn.Write(data); err != nil {
+			pty.dropReceiver(receiver, err)
+		}
+	}
+
+	pty.outputLock.Lock()
+	if !pty.outputReadAt.IsZero() {
+		pty.metrics.OutputLatency(time.Since(pty.outputReadAt))
+		pty.outputReadAt = time.Time{}
+	}
+	pty.outputLock.Unlock()
+}
+
+// GetReceivers returns the receivers connected to the session
+func (pty *ptyMaster) GetReceivers() []*ttyReceiver {
+	pty.mainRWLock.RLock()
+	defer pty.mainRWLock.RUnlock()
+	return append([]*ttyReceiver(nil), pty.receivers...)
+}
+
+func (pty *ptyMaster) removeReceiver(receiver *ttyReceiver) {
+	pty.mainRWLock.Lock()
+	defer pty.mainRWLock.Unlock()
+	for i, r := range pty.receivers {
+		if r == receiver {
+			pty.receivers = append(pty.receivers[:i], pty.receivers[i+1:]...)
+			pty.metrics.ReceiverLeft(pty.profile)
+			return
+		}
+	}
+}
+
 func (pty *ptyMaster) GetWinSize() (int, int, error) {
 	cols, rows, err := terminal.GetSize(0)
 	return cols, rows, err
@@ -65,6 +447,15 @@ func (pty *ptyMaster) Read(b []byte) (int, error) {
 }
 
 func (pty *ptyMaster) SetWinSize(rows, cols int) {
+	if pty.recorder != nil {
+		pty.recorder.Resize(cols, rows)
+	}
+	pty.history.Resize(cols, rows)
+	pty.setPtySize(rows, cols)
+	pty.resizeWindows(rows, cols)
+}
+
+func (pty *ptyMaster) setPtySize(rows, cols int) {
 	// ptyDevice.Setsize(pty.ptyFile, rows, cols)
 
 	ws := &ptyDevice.Winsize{
@@ -84,19 +475,35 @@ func (pty *ptyMaster) Refresh() {
 		return
 	}
 
-	pty.SetWinSize(rows-1, cols)
+	pty.setPtySize(rows-1, cols)
+	pty.refreshWindows()
 
 	go func() {
 		time.Sleep(time.Millisecond * 50)
-		pty.SetWinSize(rows, cols)
+		pty.setPtySize(rows, cols)
 	}()
 }
 
 func (pty *ptyMaster) Wait() (err error) {
 	err = pty.command.Wait()
+	pty.cleanup()
+	pty.metrics.SessionEnded(pty.profile, time.Since(pty.startedAt))
+	if state := pty.command.ProcessState; state != nil {
+		exitCode := state.ExitCode()
+		pty.metrics.CommandExited(pty.profile, exitCode)
+		pty.audit.Terminate(pty.sessionID, &exitCode, state.String())
+	} else {
+		pty.audit.Terminate(pty.sessionID, nil, err.Error())
+	}
 	return
 }
 
+// echoEnabled tells if a terminal echoes the input. Programs asking for passwords turn it off.
+func echoEnabled(ptyFile *os.File) bool {
+	termios, err := unix.IoctlGetTermios(int(ptyFile.Fd()), ioctlGetTermios)
+	return err != nil || termios.Lflag&unix.ECHO != 0
+}
+
 func (pty *ptyMaster) Stop() (err error) {
 	signal.Ignore(syscall.SIGWINCH)
 
@@ -105,56 +512,142 @@ func (pty *ptyMaster) Stop() (err error) {
 	// if the command hasn't reacted to SIGTERM, then send a SIGKILL
 	// (bash for example doesn't finish if only a SIGTERM has been sent)
 	pty.command.Process.Signal(syscall.SIGKILL)
+	pty.closeWindows()
 	pty.mainRWLock.Lock()
-	for _, conn := range pty.ttyReceiverConnections {
-		_ = conn.Close()
+	for _, receiver := range pty.receivers {
+		_ = receiver.conn.Close()
 	}
 	pty.mainRWLock.Unlock()
 	return
 }
 
-func (pty *ptyMaster) HandleReceiver(rawConn *WSConnection) bool{
-
-	rcvProtoConn := ttyCommon.NewTTYProtocolConn(rawConn)
-	log.Debugf("Got new TTYReceiver connection (%s). Serving it..", rawConn.Address())
+// attachReceiver adds a receiver to the session, which then gets its output
+func (pty *ptyMaster) attachReceiver(receiver *ttyReceiver) {
 	pty.mainRWLock.Lock()
-	pty.ttyReceiverConnections = append(pty.ttyReceiverConnections, rcvProtoConn)
+	pty.receivers = append(pty.receivers, receiver)
 	pty.mainRWLock.Unlock()
-
-	go func() {
-		_, err := io.Copy(rcvProtoConn, pty)
-		if err != nil {
-			log.Debug("Lost connection with the server.\n")
-		}
-	}()
+	pty.metrics.ReceiverJoined(pty.profile)
+	pty.audit.Join(pty.sessionID, receiver)
+	pty.presenceJoin(receiver)
+	pty.floorJoin(receiver)
+	pty.chatJoin(receiver)
+	pty.sendWindows(receiver, "")
+	pty.sizeJoin(receiver)
 
 	pty.Refresh()
+}
+
+// HandleReceiver serves a receiver until it leaves the session. The session keeps running for the
+// others.
+func (pty *ptyMaster) HandleReceiver(receiver *ttyReceiver) {
+	rcvProtoConn := receiver.conn
+	log.Debugf("Got new TTYReceiver connection (%s). Serving it..", receiver.remoteAddr)
+	// The receivers in the waiting room are attached once they are let in
+	if !pty.waitingRoomJoin(receiver) {
+		pty.attachReceiver(receiver)
+	}
 
+	var reason string
 	for {
 		msg, err := rcvProtoConn.ReadMessage()
 
 		if err != nil {
 			log.Warnf("Finishing handling the TTYReceiver loop because: %s", err.Error())
+			if isUnexpectedClose(err) {
+				pty.metrics.WebsocketError("read")
+			}
+			reason = err.Error()
 			break
 		}
 
+		// Nothing is taken from the receivers waiting to join
+		if pty.waitingRoomPending(receiver) {
+			continue
+		}
+
+		if !pty.policy.Allow(receiver.identity, actionMessagePrefix+string(msg.Type), pty.sessionID, pty.profile) {
+			pty.metrics.AuthFailure("policy")
+			continue
+		}
+
 		switch msg.Type {
 		case ttyCommon.MsgIDWinSize:
 			var msgWinSize common.MsgTTYWinSize
 			json.Unmarshal(msg.Data, &msgWinSize)
-			pty.SetWinSize(msgWinSize.Rows, msgWinSize.Cols)
+			pty.audit.Resize(pty.sessionID, receiver, msgWinSize.Cols, msgWinSize.Rows)
+			pty.resizeRequest(receiver, msgWinSize.Cols, msgWinSize.Rows)
 		case ttyCommon.MsgIDWrite:
+			if receiver.viewOnly {
+				log.Debugf("Ignoring the input of the view only receiver %s of session %s", receiver.id, pty.sessionID)
+				continue
+			}
 			var msgWrite common.MsgTTYWrite
 			json.Unmarshal(msg.Data, &msgWrite)
-			pty.Write(msgWrite.Data[:msgWrite.Size])
+			// The size comes from the receiver, so it is kept within the data
+			size := msgWrite.Size
+			if size < 0 {
+				size = 0
+			} else if size > len(msgWrite.Data) {
+				size = len(msgWrite.Data)
+			}
+			data := msgWrite.Data[:size]
+			if !pty.limits.Input(receiver, len(data)) {
+				// Only told once, until its input is accepted again
+				if !receiver.inputLimited {
+					log.Warnf("Dropping the input of receiver %s of session %s, who types too fast", receiver.id, pty.sessionID)
+					receiver.conn.WriteMessage(ttyCommon.MsgTTYLimitExceeded{
+						Limit:   "input",
+						Message: "You are typing too fast, some of your input was dropped",
+					})
+				}
+				receiver.inputLimited = true
+				continue
+			}
+			receiver.inputLimited = false
+			if !pty.floorInput(receiver, data) {
+				continue
+			}
+			// The input goes to the window the receiver shows
+			input := pty.inputFile(receiver)
+			if pty.audit != nil {
+				pty.audit.Input(pty.sessionID, receiver, data, echoEnabled(input))
+			}
+			input.Write(data)
+			pty.metrics.Bytes(metricsDirectionIn, len(data))
+		case ttyCommon.MsgIDFloorControl:
+			var msgFloor common.MsgTTYFloorControl
+			json.Unmarshal(msg.Data, &msgFloor)
+			pty.handleFloorControl(receiver, msgFloor)
+		case ttyCommon.MsgIDChat:
+			var msgChat common.MsgTTYChat
+			json.Unmarshal(msg.Data, &msgChat)
+			pty.handleChat(receiver, msgChat)
+		case ttyCommon.MsgIDWindowControl:
+			var msgWindow common.MsgTTYWindowControl
+			json.Unmarshal(msg.Data, &msgWindow)
+			pty.handleWindowControl(receiver, msgWindow)
+		case ttyCommon.MsgIDModerate:
+			var msgModerate common.MsgTTYModerate
+			json.Unmarshal(msg.Data, &msgModerate)
+			pty.handleModerate(receiver, msgModerate)
+		case ttyCommon.MsgIDAdmission:
+			var msgAdmission common.MsgTTYAdmission
+			json.Unmarshal(msg.Data, &msgAdmission)
+			pty.handleAdmission(receiver, msgAdmission)
 		default:
 			log.Warnf("Receiving unknown data from the receiver")
 		}
 	}
 
 	log.Debugf("Closing receiver connection")
+	if pty.waitingRoomLeave(receiver) {
+		rcvProtoConn.Close()
+		return
+	}
+	pty.removeReceiver(receiver)
+	pty.presenceLeave(receiver)
+	pty.floorLeave(receiver)
+	pty.sizeLeave(receiver)
+	pty.audit.Leave(pty.sessionID, receiver, reason)
 	rcvProtoConn.Close()
-	return true
-
 }
-
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitPruneInterval = time.Minute
+
+// rateLimit lets Burst events happen at once, and then Rate events per second
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseRateLimit parses a limit like "10/1m", for 10 events per minute, which can all happen at
+// once. An empty limit, or a limit of 0, is no limit.
+func parseRateLimit(limit string) (rateLimit, error) {
+	if limit == "" {
+		return rateLimit{}, nil
+	}
+	parts := strings.SplitN(limit, "/", 2)
+	if len(parts) != 2 {
+		return rateLimit{}, &TTYServerError{msg: "Invalid rate limit " + limit + ", expected a count and a duration, like 10/1m"}
+	}
+	count, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || count < 0 {
+		return rateLimit{}, &TTYServerError{msg: "Invalid count in the rate limit " + limit}
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return rateLimit{}, &TTYServerError{msg: "Invalid duration in the rate limit " + limit}
+	}
+	return rateLimit{Rate: count / period.Seconds(), Burst: count}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// keyedLimiter keeps a token bucket for each client IP and each identity
+type keyedLimiter struct {
+	limit     rateLimit
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newKeyedLimiter(limit rateLimit) *keyedLimiter {
+	if limit.Burst <= 0 {
+		return nil
+	}
+	return &keyedLimiter{limit: limit, buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+// refill returns the bucket of a key, with the tokens it got back since it was last used. It has
+// to be called with the lock held.
+func (limiter *keyedLimiter) refill(key string, now time.Time) *tokenBucket {
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.limit.Burst, last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limiter.limit.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.limit.Rate)
+	bucket.last = now
+	return bucket
+}
+
+// Allow takes n tokens from the buckets of all the keys, if they all have them. Otherwise, it
+// returns how long to wait until they do.
+func (limiter *keyedLimiter) Allow(keys []string, n float64) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	limiter.prune(now)
+
+	var wait time.Duration
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket := limiter.refill(key, now)
+		if bucket.tokens < n {
+			missing := time.Duration((n - bucket.tokens) / limiter.limit.Rate * float64(time.Second))
+			if missing > wait {
+				wait = missing
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	if wait > 0 || n > limiter.limit.Burst {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens -= n
+	}
+	return true, 0
+}
+
+// prune forgets the buckets which are full again, so the clients seen once don't stay in memory. It
+// has to be called with the lock held.
+func (limiter *keyedLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	limiter.lastPrune = now
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.limit.Rate >= limiter.limit.Burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// limitError is a limit a client hit, with the HTTP status telling it
+type limitError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (err *limitError) Error() string {
+	return err.message
+}
+
+func (err *limitError) write(w http.ResponseWriter) {
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	}
+	http.Error(w, err.message, err.status)
+}
+
+// rateLimiter limits how fast each client IP and each identity can create sessions, connect to
+// them and type in them, and how many sessions and receivers there can be
+type rateLimiter struct {
+	sessionCreate *keyedLimiter
+	connect       *keyedLimiter
+	input         *keyedLimiter
+	// The maximum numbers of sessions, and of receivers of each session, or 0 for no limit
+	maxSessions  int
+	maxReceivers int
+}
+
+func newRateLimiter(sessionCreate, connect, input rateLimit, maxSessions, maxReceivers int) *rateLimiter {
+	return &rateLimiter{
+		sessionCreate: newKeyedLimiter(sessionCreate),
+		connect:       newKeyedLimiter(connect),
+		input:         newKeyedLimiter(input),
+		maxSessions:   maxSessions,
+		maxReceivers:  maxReceivers,
+	}
+}
+
+// clientIP returns the IP of an address with a port, like the remote address of a request
+func clientIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// limitKeys returns the buckets a client takes its tokens from: the one of its IP, and, if it
+// logged in, the one of its identity
+func limitKeys(address string, identity Identity) []string {
+	keys := []string{"ip:" + clientIP(address)}
+	if identity.Method != authMethodNone {
+		keys = append(keys, "identity:"+identity.Name)
+	}
+	return keys
+}
+
+func rateLimited(limiter *keyedLimiter, address string, identity Identity, message string) *limitError {
+	if ok, wait := limiter.Allow(limitKeys(address, identity), 1); !ok {
+		return &limitError{status: http.StatusTooManyRequests, message: message, retryAfter: wait}
+	}
+	return nil
+}
+
+// SessionCreate counts a session created by a client, or tells it has created too many of them
+func (limiter *rateLimiter) SessionCreate(address string, identity Identity) *limitError {
+	if limiter == nil {
+		return nil
+	}
+	return rateLimited(limiter.sessionCreate, address, identity, "Too many sessions created, try again later")
+}
+
+// Connect counts a websocket opened by a client, or tells it has opened too many of them
+func (limiter *rateLimiter) Connect(address string, identity Identity) *limitError {
+	if limiter == nil {
+		return nil
+	}
+	return rateLimited(limiter.connect, address, identity, "Too many connections, try again later")
+}
+
+// Input tells if a receiver can send n more bytes of input
+func (limiter *rateLimiter) Input(receiver *ttyReceiver, n int) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, _ := limiter.input.Allow(limitKeys(receiver.remoteAddr, receiver.identity), float64(n))
+	return ok
+}
+
+// Sessions tells if there can be another session, when there are count of them
+func (limiter *rateLimiter) Sessions(count int) *limitError {
+	if limiter == nil || limiter.maxSessions <= 0 || count < limiter.maxSessions {
+		return nil
+	}
+	return &limitError{status: http.StatusServiceUnavailable, message: "The server runs as many sessions as it can, try again later"}
+}
+
+// Receivers tells if another receiver can join a session, which has count of them
+func (limiter *rateLimiter) Receivers(count int) *limitError {
+	if limiter == nil || limiter.maxReceivers <= 0 || count < limiter.maxReceivers {
+		return nil
+	}
+	return &limitError{status: http.StatusServiceUnavailable, message: "This session has as many receivers as it can"}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("10/1m")
+	if err != nil || limit.Burst != 10 || limit.Rate != 10.0/60 {
+		t.Errorf("Expected 10 per minute, got %+v %v", limit, err)
+	}
+	if limit, err = parseRateLimit(""); err != nil || newKeyedLimiter(limit) != nil {
+		t.Errorf("Expected no limit, got %+v %v", limit, err)
+	}
+	for _, invalid := range []string{"10", "x/1m", "10/x", "-1/1s", "10/0s"} {
+		if _, err = parseRateLimit(invalid); err == nil {
+			t.Errorf("Expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := newKeyedLimiter(rateLimit{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow([]string{"ip:1"}, 1); !ok {
+			t.Fatalf("Expected the burst to be allowed")
+		}
+	}
+	if ok, wait := limiter.Allow([]string{"ip:1"}, 1); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Expected to wait for at most a second, got %v %v", ok, wait)
+	}
+	// Another IP, but the same identity, which has no tokens left
+	limiter.Allow([]string{"identity:bob"}, 2)
+	if ok, _ := limiter.Allow([]string{"ip:2", "identity:bob"}, 1); ok {
+		t.Errorf("Expected the identity to be limited")
+	}
+	if ok, _ := limiter.Allow([]string{"ip:3"}, 3); ok {
+		t.Errorf("Expected more than the burst to be refused")
+	}
+
+	// The buckets refill
+	limiter.buckets["ip:1"].last = time.Now().Add(-2 * time.Second)
+	if ok, _ := limiter.Allow([]string{"ip:1"}, 2); !ok {
+		t.Errorf("Expected the bucket to be refilled")
+	}
+	limiter.lastPrune = time.Now().Add(-2 * rateLimitPruneInterval)
+	limiter.buckets["ip:2"].last = time.Now().Add(-time.Hour)
+	limiter.prune(time.Now())
+	if _, ok := limiter.buckets["ip:2"]; ok {
+		t.Errorf("Expected the full buckets to be forgotten")
+	}
+}
+
+func TestRateLimitedWebsocket(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{
+		RateLimits:   newRateLimiter(rateLimit{Rate: 0.01, Burst: 1}, rateLimit{}, rateLimit{}, 0, 1),
+		FrontendPath: "../frontend/templates",
+	})
+	session := ptyMasterNew("1")
+	session.receivers = append(session.receivers, &ttyReceiver{id: "r1"})
+	server.addSession("1", session)
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	get := func(path string) *http.Response {
+		response, err := http.Get(ttyServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+	if response := get("/ws/1"); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the session to be full, got %d", response.StatusCode)
+	}
+	// The first new session would be created, by a websocket upgrade
+	get("/ws/2?profile=none")
+	if response := get("/ws/3"); response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected the sessions to be created too fast, got %d", response.StatusCode)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{
+		CommandName:  "cat",
+		RateLimits:   newRateLimiter(rateLimit{}, rateLimit{}, rateLimit{}, 1, 0),
+		FrontendPath: "../frontend/templates",
+	})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	if client, status := dialSession(t, ttyServer, "/ws/1"); client == nil {
+		t.Fatalf("Expected the first session to be created, got %d", status)
+	}
+	session := server.getSession("1")
+	if _, status := dialSession(t, ttyServer, "/ws/2"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the server to run only one session, got %d", status)
+	}
+
+	// The session is counted until its command exits, and the ones which can't start aren't
+	session.Stop()
+	waitFor(t, "the session to be removed", func() bool {
+		return server.getSession("1") == nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, status := dialSession(t, ttyServer, "/ws/2?profile=none"); status != http.StatusNotFound {
+			t.Errorf("Expected no session with an unknown profile, got %d", status)
+		}
+	}
+	client, status := dialSession(t, ttyServer, "/ws/2")
+	if client == nil {
+		t.Fatalf("Expected a new session once the first one ended, got %d", status)
+	}
+	server.getSession("2").Stop()
+}
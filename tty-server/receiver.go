@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+var lastReceiverID uint64
+
+// ttyReceiver is a receiver (a browser) connected to a session
+type ttyReceiver struct {
+	id          string
+	identity    Identity
+	remoteAddr  string
+	connectedAt time.Time
+	conn        *ttyCommon.TTYProtocolConn
+	// name is what the other receivers see it as
+	name string
+	// share is the ID of the share link the receiver joined with, if any
+	share string
+	// cols and rows are the size of the browser of the receiver, which the session may not have
+	cols int
+	rows int
+	// window is the ID of the window of the session the receiver shows, and types in
+	window string
+	// viewOnly receivers can't type in the session
+	viewOnly bool
+	// inputLimited is set while the input of the receiver is dropped, as it types too fast
+	inputLimited bool
+}
+
+func newTTYReceiver(rawConn *WSConnection, identity Identity) *ttyReceiver {
+	return &ttyReceiver{
+		id:          "r" + strconv.FormatUint(atomic.AddUint64(&lastReceiverID, 1), 10),
+		identity:    identity,
+		remoteAddr:  rawConn.Address(),
+		connectedAt: time.Now(),
+		conn:        ttyCommon.NewTTYProtocolConn(rawConn),
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The recordings are stored in the asciicast v2 format
+// (https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md): a JSON header on the
+// first line, followed by one JSON array per line for each event. Next to the standard "o"
+// (output) and "r" (resize) events, the recorder periodically writes "k" (keyframe) events, which
+// hold a snapshot of the whole screen. The player uses them to seek without replaying the
+// recording from the beginning. When the chat of the session is recorded, the "c" (chat) events
+// hold its messages, as JSON objects. The output of the windows of the session, besides the main
+// one, is in "w" (window) events, which hold the ID of the window and its output, as JSON objects.
+const (
+	recordingEventOutput   = "o"
+	recordingEventResize   = "r"
+	recordingEventKeyframe = "k"
+	recordingEventChat     = "c"
+	recordingEventWindow   = "w"
+	recordingFileExt       = ".cast"
+	// defaultMaxFailedChunksSize is how much of a recording is kept while the sink fails, before
+	// the oldest chunks are dropped
+	defaultMaxFailedChunksSize = 16 * 1024 * 1024
+)
+
+var validRecordingID = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+var unsafeRecordingIDChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+type recordingHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// sessionRecorder records the output of one session. The events are buffered, and handed to the
+// sink in chunks, every flush interval.
+type sessionRecorder struct {
+	id               string
+	sink             RecordingSink
+	lock             sync.Mutex
+	closed           bool
+	startTime        time.Time
+	screen           *vtScreen
+	keyframeInterval time.Duration
+	lastKeyframe     time.Duration
+	// Bytes of an UTF-8 sequence that was split between two writes, of the main window and of the
+	// other windows, by their ID
+	pendingUTF8       []byte
+	pendingWindowUTF8 map[string][]byte
+	// The events which weren't handed to the sink yet
+	buffer bytes.Buffer
+
+	// flushLock serialises the writes to the sink, and protects the fields below
+	flushLock           sync.Mutex
+	nextChunk           int
+	failedChunks        []recordingChunk
+	failedChunksSize    int
+	maxFailedChunksSize int
+	stopFlushing        chan struct{}
+}
+
+type recordingChunk struct {
+	seq  int
+	data []byte
+}
+
+func newRecordingID(sessionID string, startTime time.Time) string {
+	return unsafeRecordingIDChars.ReplaceAllString(sessionID, "_") + "-" + startTime.UTC().Format("20060102T150405Z")
+}
+
+func newSessionRecorder(sink RecordingSink, sessionID string, cols, rows int, keyframeInterval, flushInterval time.Duration) (recorder *sessionRecorder, err error) {
+	startTime := time.Now()
+	recorder = &sessionRecorder{
+		id:                  newRecordingID(sessionID, startTime),
+		sink:                sink,
+		startTime:           startTime,
+		screen:              newVTScreen(cols, rows),
+		keyframeInterval:    keyframeInterval,
+		stopFlushing:        make(chan struct{}),
+		maxFailedChunksSize: defaultMaxFailedChunksSize,
+	}
+
+	header, err := json.Marshal(recordingHeader{
+		Version:   2,
+		Width:     recorder.screen.cols,
+		Height:    recorder.screen.rows,
+		Timestamp: startTime.Unix(),
+		Title:     sessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	recorder.buffer.Write(append(header, '\n'))
+
+	// Write the header right away, so a sink that doesn't work is noticed before the session starts
+	if err = recorder.flush(); err != nil {
+		return nil, err
+	}
+	go recorder.flushPeriodically(flushInterval)
+
+	log.Infof("Recording session %s as %s", sessionID, recorder.id)
+	return recorder, nil
+}
+
+// GetRecordingID returns the ID the recording can be played back with
+func (recorder *sessionRecorder) GetRecordingID() string {
+	return recorder.id
+}
+
+func (recorder *sessionRecorder) writeEvent(elapsed time.Duration, kind string, data string) error {
+	line, err := json.Marshal([]interface{}{elapsed.Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+	recorder.buffer.Write(append(line, '\n'))
+	return nil
+}
+
+// flush hands the buffered events to the sink, as a new chunk. The chunks that couldn't be written
+// are kept, and written again, in order, on the next flush. The oldest of them are dropped when they
+// take more than maxFailedChunksSize, so the recording misses some output, but the memory the
+// server uses is bounded when the sink is down.
+func (recorder *sessionRecorder) flush() (err error) {
+	recorder.flushLock.Lock()
+	defer recorder.flushLock.Unlock()
+
+	recorder.lock.Lock()
+	if recorder.buffer.Len() > 0 {
+		recorder.failedChunks = append(recorder.failedChunks, recordingChunk{
+			seq:  recorder.nextChunk,
+			data: append([]byte(nil), recorder.buffer.Bytes()...),
+		})
+		recorder.failedChunksSize += recorder.buffer.Len()
+		recorder.nextChunk++
+		recorder.buffer.Reset()
+	}
+	recorder.lock.Unlock()
+
+	dropped := 0
+	for recorder.failedChunksSize > recorder.maxFailedChunksSize && dropped < len(recorder.failedChunks)-1 {
+		recorder.failedChunksSize -= len(recorder.failedChunks[dropped].data)
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warnf("Dropped %d chunks of recording %s, which could not be written", dropped, recorder.id)
+		recorder.failedChunks = recorder.failedChunks[dropped:]
+	}
+
+	for len(recorder.failedChunks) > 0 {
+		chunk := recorder.failedChunks[0]
+		if err = recorder.sink.WriteChunk(recorder.id, chunk.seq, chunk.data); err != nil {
+			return
+		}
+		recorder.failedChunksSize -= len(chunk.data)
+		recorder.failedChunks = recorder.failedChunks[1:]
+	}
+	return
+}
+
+func (recorder *sessionRecorder) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := recorder.flush(); err != nil {
+				log.Warnf("Cannot write recording %s, will retry: %s", recorder.id, err.Error())
+			}
+		case <-recorder.stopFlushing:
+			return
+		}
+	}
+}
+
+// WriteOutput records the output of the command
+func (recorder *sessionRecorder) WriteOutput(data []byte) (err error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.closed {
+		return
+	}
+	elapsed := time.Since(recorder.startTime)
+	recorder.screen.Write(data)
+
+	data, recorder.pendingUTF8 = completeUTF8(recorder.pendingUTF8, data)
+	if len(data) == 0 {
+		return
+	}
+
+	if err = recorder.writeEvent(elapsed, recordingEventOutput, string(data)); err != nil {
+		return
+	}
+	if recorder.keyframeInterval > 0 && elapsed-recorder.lastKeyframe >= recorder.keyframeInterval {
+		recorder.lastKeyframe = elapsed
+		err = recorder.writeEvent(elapsed, recordingEventKeyframe, string(recorder.screen.Snapshot()))
+	}
+	return
+}
+
+// completeUTF8 returns the complete UTF-8 sequences of the output, after the pending bytes of the
+// previous write, and the bytes of a sequence that is not complete yet. The events are JSON
+// strings, so they can only hold complete UTF-8 sequences, and a sequence can be split by the PTY.
+func completeUTF8(pending, data []byte) (complete, rest []byte) {
+	data = append(pending, data...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	return data[:end], append([]byte(nil), data[end:]...)
+}
+
+// recordedWindowOutput is the data of a window event
+type recordedWindowOutput struct {
+	Window string `json:"window"`
+	Data   string `json:"data"`
+}
+
+// WriteWindowOutput records the output of the command of a window, besides the main one
+func (recorder *sessionRecorder) WriteWindowOutput(window string, data []byte) (err error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.closed {
+		return
+	}
+	if recorder.pendingWindowUTF8 == nil {
+		recorder.pendingWindowUTF8 = make(map[string][]byte)
+	}
+	data, recorder.pendingWindowUTF8[window] = completeUTF8(recorder.pendingWindowUTF8[window], data)
+	if len(data) == 0 {
+		return
+	}
+	event, err := json.Marshal(recordedWindowOutput{Window: window, Data: string(data)})
+	if err != nil {
+		return
+	}
+	return recorder.writeEvent(time.Since(recorder.startTime), recordingEventWindow, string(event))
+}
+
+// Resize records a change of the window size
+func (recorder *sessionRecorder) Resize(cols, rows int) (err error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.closed || cols <= 0 || rows <= 0 || (cols == recorder.screen.cols && rows == recorder.screen.rows) {
+		return
+	}
+	recorder.screen.Resize(cols, rows)
+	return recorder.writeEvent(time.Since(recorder.startTime), recordingEventResize,
+		strconv.Itoa(cols)+"x"+strconv.Itoa(rows))
+}
+
+// recordedChatMessage is the data of a chat event
+type recordedChatMessage struct {
+	Receiver string `json:"receiver"`
+	Name     string `json:"name"`
+	Identity string `json:"identity"`
+	Text     string `json:"text"`
+}
+
+// WriteChat records a message a receiver said in the chat of the session
+func (recorder *sessionRecorder) WriteChat(receiver *ttyReceiver, text string) (err error) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.closed {
+		return
+	}
+	data, err := json.Marshal(recordedChatMessage{
+		Receiver: receiver.id,
+		Name:     receiver.name,
+		Identity: receiver.identity.Name,
+		Text:     text,
+	})
+	if err != nil {
+		return
+	}
+	return recorder.writeEvent(time.Since(recorder.startTime), recordingEventChat, string(data))
+}
+
+// Close writes the rest of the recording to the sink, and finishes it
+func (recorder *sessionRecorder) Close() (err error) {
+	recorder.lock.Lock()
+	if recorder.closed {
+		recorder.lock.Unlock()
+		return
+	}
+	recorder.closed = true
+	recorder.lock.Unlock()
+
+	close(recorder.stopFlushing)
+	for attempt := 1; ; attempt++ {
+		if err = recorder.flush(); err == nil {
+			break
+		}
+		if attempt == 3 {
+			log.Errorf("Cannot write the end of recording %s: %s", recorder.id, err.Error())
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	err = recorder.sink.Finish(recorder.id)
+	log.Infof("Finished recording %s", recorder.id)
+	return
+}
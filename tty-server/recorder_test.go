@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingEvents returns the events of a recording, after its header
+func recordingEvents(t *testing.T, recording string) (events [][]interface{}) {
+	lines := strings.Split(strings.TrimSpace(recording), "\n")
+	for _, line := range lines[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("Invalid recording event %q", line)
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+func TestRecorderKeyframes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := newFileRecordingSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newSessionRecorder(sink, "keyframes", 20, 3, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The time of the session is moved forward by moving its start back
+	elapse := func(d time.Duration) {
+		recorder.lock.Lock()
+		recorder.startTime = recorder.startTime.Add(-d)
+		recorder.lock.Unlock()
+	}
+	recorder.WriteOutput([]byte("a"))
+	elapse(1500 * time.Millisecond)
+	recorder.WriteOutput([]byte("b"))
+	recorder.WriteOutput([]byte("c"))
+	recorder.Resize(10, 3)
+	elapse(time.Second)
+	recorder.WriteOutput([]byte("\x1b[2Jd"))
+	recorder.Close()
+
+	events := recordingEvents(t, readRecording(t, sink, recorder.GetRecordingID()))
+	var kinds []string
+	for _, event := range events {
+		kinds = append(kinds, event[1].(string))
+	}
+	if strings.Join(kinds, "") != "ookorok" {
+		t.Fatalf("Expected a keyframe after the output every second, got the events %v", kinds)
+	}
+
+	// A keyframe is at the time of the output before it, and replays the screen at that time
+	for i, expected := range map[int]string{2: "ab", 6: "   d"} {
+		keyframe := events[i]
+		if keyframe[0] != events[i-1][0] {
+			t.Errorf("Expected the keyframe at %v, got %v", events[i-1][0], keyframe[0])
+		}
+		screen := newVTScreen(20, 3)
+		screen.Write([]byte(keyframe[2].(string)))
+		if text := screenText(screen.lines)[0]; text != expected {
+			t.Errorf("Expected the keyframe to show %q, got %q", expected, text)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errRecordingNotFound = errors.New("Recording not found")
+var errRecordingSinkNotReadable = errors.New("The recordings can't be read back from this sink")
+
+// RecordingSink is where the recorder stores the recordings. The recorder sends a recording to the
+// sink in chunks, every few seconds, so only the last seconds of a recording are lost if the server
+// stops unexpectedly.
+type RecordingSink interface {
+	// WriteChunk stores the next chunk of a recording. The chunks of a recording are numbered from
+	// zero and written in order. If writing a chunk fails, it is written again later, with the
+	// same number, so writing a chunk has to be idempotent.
+	WriteChunk(recordingID string, seq int, data []byte) error
+	// Finish is called after the last chunk of a recording was written
+	Finish(recordingID string) error
+	// Open returns the recording with the given ID, or errRecordingNotFound. Sinks which can't
+	// read the recordings back return errRecordingSinkNotReadable.
+	Open(recordingID string) (recordingReader, error)
+}
+
+// recordingReader gives random access to a recording, which the player needs to seek and to find
+// out the duration
+type recordingReader interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// fileRecordingSink stores each recording in a file, in a local folder
+type fileRecordingSink struct {
+	dir        string
+	lock       sync.Mutex
+	recordings map[string]*fileRecordingState
+}
+
+type fileRecordingState struct {
+	file *os.File
+	// The number and the start offset of the last chunk written, so a retried chunk replaces a
+	// partially written one
+	lastSeq    int
+	lastOffset int64
+}
+
+func newFileRecordingSink(dir string) (*fileRecordingSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &fileRecordingSink{
+		dir:        dir,
+		recordings: make(map[string]*fileRecordingState),
+	}, nil
+}
+
+func (sink *fileRecordingSink) WriteChunk(recordingID string, seq int, data []byte) (err error) {
+	sink.lock.Lock()
+	state := sink.recordings[recordingID]
+	if state == nil {
+		file, err := os.OpenFile(recordingPath(sink.dir, recordingID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err != nil {
+			sink.lock.Unlock()
+			return err
+		}
+		state = &fileRecordingState{file: file, lastSeq: -1}
+		sink.recordings[recordingID] = state
+	}
+	sink.lock.Unlock()
+
+	offset := state.lastOffset
+	if seq != state.lastSeq {
+		if offset, err = state.file.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+	} else if err = state.file.Truncate(offset); err != nil {
+		return
+	}
+	state.lastSeq, state.lastOffset = seq, offset
+
+	_, err = state.file.WriteAt(data, offset)
+	return
+}
+
+func (sink *fileRecordingSink) Finish(recordingID string) error {
+	sink.lock.Lock()
+	state := sink.recordings[recordingID]
+	delete(sink.recordings, recordingID)
+	sink.lock.Unlock()
+
+	if state == nil {
+		return nil
+	}
+	return state.file.Close()
+}
+
+func (sink *fileRecordingSink) Open(recordingID string) (recordingReader, error) {
+	file, err := os.Open(recordingPath(sink.dir, recordingID))
+	if os.IsNotExist(err) {
+		return nil, errRecordingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileRecordingReader{file}, nil
+}
+
+type fileRecordingReader struct {
+	*os.File
+}
+
+func (reader *fileRecordingReader) Size() int64 {
+	info, err := reader.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func recordingPath(dir, recordingID string) string {
+	return filepath.Join(dir, recordingID+recordingFileExt)
+}
+
+// streamRecordingSink writes the recordings to a stream, like the standard output, so they can be
+// collected together with the logs. Several recordings can be written at the same time, so every
+// line of a recording is wrapped in a JSON object holding the ID of the recording.
+type streamRecordingSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+type streamRecordingLine struct {
+	RecordingID string          `json:"recording_id"`
+	Line        json.RawMessage `json:"line"`
+}
+
+func newStreamRecordingSink(writer io.Writer) *streamRecordingSink {
+	return &streamRecordingSink{writer: writer}
+}
+
+func (sink *streamRecordingSink) WriteChunk(recordingID string, seq int, data []byte) (err error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		if err = encoder.Encode(streamRecordingLine{RecordingID: recordingID, Line: line}); err != nil {
+			return
+		}
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err = sink.writer.Write(out.Bytes())
+	return
+}
+
+func (sink *streamRecordingSink) Finish(recordingID string) error {
+	return nil
+}
+
+func (sink *streamRecordingSink) Open(recordingID string) (recordingReader, error) {
+	return nil, errRecordingSinkNotReadable
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config holds the settings of an S3 compatible object store (AWS S3, MinIO, Ceph, etc.)
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// SessionToken is only needed for temporary credentials
+	SessionToken string
+	// PathStyle addresses the bucket as endpoint/bucket instead of bucket.endpoint, which is what
+	// most self hosted object stores need
+	PathStyle bool
+}
+
+// s3RecordingSink stores every chunk of a recording as a separate object, named
+// <prefix><recording id>/<chunk number>.part. The objects are written as soon as the chunks are
+// ready, so nothing that was uploaded is lost if the server stops before the recording is
+// finished, and reading a recording back only needs to concatenate its chunks.
+type s3RecordingSink struct {
+	client *s3Client
+	prefix string
+}
+
+func newS3RecordingSink(config S3Config) (*s3RecordingSink, error) {
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	return &s3RecordingSink{
+		client: client,
+		prefix: config.Prefix,
+	}, nil
+}
+
+func (sink *s3RecordingSink) chunkKey(recordingID string, seq int) string {
+	return fmt.Sprintf("%s%s/%08d.part", sink.prefix, recordingID, seq)
+}
+
+func (sink *s3RecordingSink) WriteChunk(recordingID string, seq int, data []byte) error {
+	return sink.client.putObject(sink.chunkKey(recordingID, seq), data)
+}
+
+func (sink *s3RecordingSink) Finish(recordingID string) error {
+	return nil
+}
+
+func (sink *s3RecordingSink) Open(recordingID string) (recordingReader, error) {
+	objects, err := sink.client.listObjects(sink.prefix + recordingID + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &s3RecordingReader{client: sink.client}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".part") {
+			continue
+		}
+		reader.chunks = append(reader.chunks, s3RecordingChunk{key: object.Key, offset: reader.size, size: object.Size})
+		reader.size += object.Size
+	}
+	if len(reader.chunks) == 0 {
+		return nil, errRecordingNotFound
+	}
+	return reader, nil
+}
+
+type s3RecordingChunk struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+// s3RecordingReader reads a recording as if its chunks were a single file. The chunks are small,
+// so they are downloaded whole, and the last one is kept, as the reads are mostly sequential.
+type s3RecordingReader struct {
+	client *s3Client
+	chunks []s3RecordingChunk
+	size   int64
+
+	lock        sync.Mutex
+	cachedIndex int
+	cachedData  []byte
+}
+
+func (reader *s3RecordingReader) Size() int64 {
+	return reader.size
+}
+
+func (reader *s3RecordingReader) Close() error {
+	return nil
+}
+
+func (reader *s3RecordingReader) chunkData(index int) (data []byte, err error) {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+
+	if reader.cachedData != nil && reader.cachedIndex == index {
+		return reader.cachedData, nil
+	}
+	if data, err = reader.client.getObject(reader.chunks[index].key); err != nil {
+		return
+	}
+	reader.cachedIndex, reader.cachedData = index, data
+	return
+}
+
+func (reader *s3RecordingReader) ReadAt(p []byte, offset int64) (n int, err error) {
+	index := sort.Search(len(reader.chunks), func(i int) bool {
+		return reader.chunks[i].offset+reader.chunks[i].size > offset
+	})
+	for n < len(p) && index < len(reader.chunks) {
+		var data []byte
+		if data, err = reader.chunkData(index); err != nil {
+			return
+		}
+		start := offset + int64(n) - reader.chunks[index].offset
+		if start < int64(len(data)) {
+			n += copy(p[n:], data[start:])
+		}
+		index++
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// s3Client is a minimal client for the S3 REST API, signing the requests with AWS Signature
+// Version 4. Only the few operations the recording sink needs are implemented.
+type s3Client struct {
+	config     S3Config
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+type s3Object struct {
+	Key  string
+	Size int64
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func newS3Client(config S3Config) (*s3Client, error) {
+	if config.Bucket == "" {
+		return nil, &TTYServerError{msg: "No S3 bucket configured"}
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Client{
+		config:     config,
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (client *s3Client) objectURL(key string, query url.Values) *url.URL {
+	objectURL := *client.endpoint
+	path := strings.TrimRight(objectURL.Path, "/")
+	if client.config.PathStyle {
+		path += "/" + client.config.Bucket
+	} else {
+		objectURL.Host = client.config.Bucket + "." + objectURL.Host
+	}
+	if key != "" {
+		path += "/" + key
+	} else {
+		path += "/"
+	}
+	objectURL.Path = path
+	objectURL.RawPath = s3EscapePath(path)
+	objectURL.RawQuery = s3CanonicalQuery(query)
+	return &objectURL
+}
+
+func (client *s3Client) do(method, key string, query url.Values, body []byte) (response *http.Response, err error) {
+	request, err := http.NewRequest(method, client.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	client.sign(request, body, time.Now())
+
+	response, err = client.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, errRecordingNotFound
+		}
+		return nil, fmt.Errorf("S3 %s %s failed: %s %s", method, key, response.Status, string(message))
+	}
+	return
+}
+
+func (client *s3Client) putObject(key string, data []byte) error {
+	response, err := client.do("PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (client *s3Client) getObject(key string) ([]byte, error) {
+	response, err := client.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+func (client *s3Client) listObjects(prefix string) (objects []s3Object, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var response *http.Response
+		if response, err = client.do("GET", "", query, nil); err != nil {
+			return
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return
+}
+
+// sign adds the AWS Signature Version 4 headers to the request
+func (client *s3Client) sign(request *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if client.config.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", client.config.SessionToken)
+	}
+
+	headerNames := []string{"host"}
+	for name := range request.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := request.Host
+		if name != "host" {
+			value = strings.TrimSpace(request.Header.Get(name))
+		} else if value == "" {
+			value = request.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + client.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+client.config.SecretKey), date)
+	key = hmacSHA256(key, client.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+client.config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes a string the way AWS expects it in the canonical request: everything except
+// the unreserved characters is percent encoded
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			escaped.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return escaped.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
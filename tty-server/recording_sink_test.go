@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObjectStore is a stand-in for an S3 compatible object store, like MinIO, implementing just
+// what the recording sink uses, with path style addressing
+type fakeObjectStore struct {
+	t       *testing.T
+	bucket  string
+	lock    sync.Mutex
+	objects map[string][]byte
+	// The number of PUT requests to fail, before accepting them again
+	failPuts int
+}
+
+func newFakeObjectStore(t *testing.T, bucket string) (*fakeObjectStore, *httptest.Server) {
+	store := &fakeObjectStore{t: t, bucket: bucket, objects: make(map[string][]byte)}
+	return store, httptest.NewServer(store)
+}
+
+func (store *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+store.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+store.bucket+"/")
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	switch {
+	case r.Method == "PUT":
+		if store.failPuts > 0 {
+			store.failPuts--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		store.objects[key] = body
+	case r.Method == "GET" && key == "" && r.URL.Query().Get("list-type") == "2":
+		result := s3ListBucketResult{}
+		for objectKey, data := range store.objects {
+			if strings.HasPrefix(objectKey, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, s3Object{Key: objectKey, Size: int64(len(data))})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET":
+		data, ok := store.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Sink(t *testing.T, endpoint string) *s3RecordingSink {
+	sink, err := newS3RecordingSink(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "tty",
+		Prefix:    "recordings/",
+		AccessKey: "test-key",
+		SecretKey: "test-secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create the S3 sink: %s", err.Error())
+	}
+	return sink
+}
+
+func readRecording(t *testing.T, sink RecordingSink, recordingID string) string {
+	recording, err := sink.Open(recordingID)
+	if err != nil {
+		t.Fatalf("Cannot open recording %s: %s", recordingID, err.Error())
+	}
+	defer recording.Close()
+	data, err := ioutil.ReadAll(io.NewSectionReader(recording, 0, recording.Size()))
+	if err != nil {
+		t.Fatalf("Cannot read recording %s: %s", recordingID, err.Error())
+	}
+	return string(data)
+}
+
+func TestS3SinkRecording(t *testing.T) {
+	store, server := newFakeObjectStore(t, "tty")
+	defer server.Close()
+	sink := newTestS3Sink(t, server.URL)
+
+	recorder, err := newSessionRecorder(sink, "s3-session", 80, 24, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot start the recording: %s", err.Error())
+	}
+	recorder.WriteOutput([]byte("first chunk\r\n"))
+	if err = recorder.flush(); err != nil {
+		t.Fatalf("Cannot flush the recording: %s", err.Error())
+	}
+	recorder.WriteOutput([]byte("second chunk\r\n"))
+	recorder.Close()
+
+	if len(store.objects) != 3 {
+		t.Fatalf("Expected the header and two chunks to be uploaded, got %d objects", len(store.objects))
+	}
+	data := readRecording(t, sink, recorder.GetRecordingID())
+	if !strings.Contains(data, `"first chunk\r\n"`) || !strings.Contains(data, `"second chunk\r\n"`) {
+		t.Fatalf("Unexpected recording content: %s", data)
+	}
+
+	recording, _ := sink.Open(recorder.GetRecordingID())
+	duration, err := recordingDuration(recording)
+	if err != nil || duration <= 0 {
+		t.Fatalf("Unexpected duration of the recording: %f, %v", duration, err)
+	}
+
+	if _, err = sink.Open("missing"); err != errRecordingNotFound {
+		t.Fatalf("Expected errRecordingNotFound for a missing recording, got %v", err)
+	}
+}
+
+func TestRecorderRetriesFailedChunks(t *testing.T) {
+	store, server := newFakeObjectStore(t, "tty")
+	defer server.Close()
+	sink := newTestS3Sink(t, server.URL)
+
+	recorder, err := newSessionRecorder(sink, "retried", 80, 24, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot start the recording: %s", err.Error())
+	}
+
+	store.failPuts = 2
+	recorder.WriteOutput([]byte("one"))
+	if err = recorder.flush(); err == nil {
+		t.Fatalf("Expected the flush to fail")
+	}
+	recorder.WriteOutput([]byte("two"))
+	if err = recorder.flush(); err == nil {
+		t.Fatalf("Expected the flush to fail")
+	}
+	recorder.WriteOutput([]byte("three"))
+	recorder.Close()
+
+	data := readRecording(t, sink, recorder.GetRecordingID())
+	one, two, three := strings.Index(data, `"one"`), strings.Index(data, `"two"`), strings.Index(data, `"three"`)
+	if one < 0 || two < one || three < two {
+		t.Fatalf("The events of the recording are missing, or out of order: %s", data)
+	}
+}
+
+func TestFileSinkRewritesRetriedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := newFileRecordingSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.WriteChunk("rec", 0, []byte("header\n"))
+	sink.WriteChunk("rec", 1, []byte("partial"))
+	sink.WriteChunk("rec", 1, []byte("event 1\n"))
+	sink.WriteChunk("rec", 2, []byte("event 2\n"))
+	sink.Finish("rec")
+
+	if data := readRecording(t, sink, "rec"); data != "header\nevent 1\nevent 2\n" {
+		t.Fatalf("Unexpected recording content: %q", data)
+	}
+}
+
+func TestStreamSinkWrapsLines(t *testing.T) {
+	var out bytes.Buffer
+	newStreamRecordingSink(&out).WriteChunk("rec", 0, []byte("{\"version\":2}\n[0.5,\"o\",\"a\"]\n"))
+	expected := "{\"recording_id\":\"rec\",\"line\":{\"version\":2}}\n{\"recording_id\":\"rec\",\"line\":[0.5,\"o\",\"a\"]}\n"
+	if out.String() != expected {
+		t.Fatalf("Unexpected stream sink output: %q", out.String())
+	}
+}
+
+func TestRecorderDropsOldestFailedChunks(t *testing.T) {
+	store, server := newFakeObjectStore(t, "tty")
+	defer server.Close()
+	sink := newTestS3Sink(t, server.URL)
+
+	recorder, err := newSessionRecorder(sink, "dropped", 80, 24, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot start the recording: %s", err.Error())
+	}
+	recorder.maxFailedChunksSize = 60
+
+	store.failPuts = 3
+	for _, output := range []string{"one", "two", "three"} {
+		recorder.WriteOutput([]byte(output))
+		if err = recorder.flush(); err == nil {
+			t.Fatalf("Expected the flush to fail")
+		}
+	}
+	if len(recorder.failedChunks) != 2 || recorder.failedChunksSize > 60 {
+		t.Errorf("Expected the oldest chunk to be dropped, %d chunks of %d bytes are kept",
+			len(recorder.failedChunks), recorder.failedChunksSize)
+	}
+	recorder.Close()
+
+	data := readRecording(t, sink, recorder.GetRecordingID())
+	if strings.Contains(data, `"one"`) || !strings.Contains(data, `"two"`) || !strings.Contains(data, `"three"`) {
+		t.Fatalf("Expected only the oldest chunk to be missing from the recording: %s", data)
+	}
+}
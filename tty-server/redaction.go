@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// redactionContextSize is how much of the text already sent is kept, for the rules to match
+	// the secrets split across reads
+	redactionContextSize = 256
+	// redactionMaxHold is the longest word at the end of a read which is held back, until the
+	// next read tells if it is a secret
+	redactionMaxHold = 256
+	// redactionMaxPending is how much output can wait for the end of an escape sequence
+	redactionMaxPending = 64 << 10
+	// redactionFlushDelay is how long the output held back waits for more output
+	redactionFlushDelay = 15 * time.Millisecond
+	redactionMask       = '*'
+)
+
+// redactionRule masks the text matching its pattern, or only its first group, if it has one
+type redactionRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// The secrets masked when the built-in detectors are enabled
+var builtinRedactionRules = []redactionRule{
+	{Name: "aws-access-key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "aws-secret-key", Pattern: `(?i)aws_secret_access_key\s*[=:]\s*"?([A-Za-z0-9/+]{40})\b`},
+	{Name: "github-token", Pattern: `\bgh[pousr]_[A-Za-z0-9]{36,255}\b`},
+	{Name: "github-fine-grained-token", Pattern: `\bgithub_pat_[A-Za-z0-9_]{22,255}\b`},
+	{Name: "gitlab-token", Pattern: `\bglpat-[A-Za-z0-9_-]{20,}\b`},
+	{Name: "slack-token", Pattern: `\bxox[abposr]-[A-Za-z0-9-]{10,}\b`},
+	{Name: "google-api-key", Pattern: `\bAIza[0-9A-Za-z_-]{35}\b`},
+	{Name: "stripe-key", Pattern: `\b[rs]k_live_[0-9A-Za-z]{24,}\b`},
+	{Name: "jwt", Pattern: `\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`},
+}
+
+// The private keys span many lines, so everything between their markers is masked
+var (
+	privateKeyBegin = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----`)
+	privateKeyEnd   = []byte("-----END ")
+)
+
+// redactionRules are the compiled rules the sessions mask their output with
+type redactionRules struct {
+	patterns    []*regexp.Regexp
+	privateKeys bool
+}
+
+// loadRedactionRules compiles the rules of a JSON file holding a list of rules, if path is set, and
+// the built-in detectors, if builtin is set. It returns nil if there are no rules.
+func loadRedactionRules(path string, builtin bool) (*redactionRules, error) {
+	var rules []redactionRule
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &rules); err != nil {
+			return nil, &TTYServerError{msg: "Cannot parse the redaction rules in " + path + ": " + err.Error()}
+		}
+	}
+	if builtin {
+		rules = append(rules, builtinRedactionRules...)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := &redactionRules{privateKeys: builtin}
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, &TTYServerError{msg: "Invalid pattern in the redaction rule " + rule.Name + ": " + err.Error()}
+		}
+		compiled.patterns = append(compiled.patterns, pattern)
+	}
+	return compiled, nil
+}
+
+// redactor masks the secrets in the output of a session, before it is sent anywhere. The escape
+// sequences are left untouched, and the secrets are looked for in the text around them, and in the
+// strings some of them hold, such as the window titles.
+//
+// A secret can be split across two reads, so the word at the end of a read is held back until the
+// next read, or until redactionFlushDelay passes without any.
+type redactor struct {
+	rules *redactionRules
+	emit  func([]byte)
+	lock  sync.Mutex
+	timer *time.Timer
+	// pending is the output held back
+	pending []byte
+	// context is the end of the text already emitted, as it was before being masked
+	context      []byte
+	inPrivateKey bool
+}
+
+func newRedactor(rules *redactionRules, emit func([]byte)) *redactor {
+	return &redactor{rules: rules, emit: emit}
+}
+
+// Write masks the secrets of the output, and emits what doesn't have to be held back
+func (redactor *redactor) Write(data []byte) {
+	redactor.lock.Lock()
+	defer redactor.lock.Unlock()
+	redactor.pending = append(redactor.pending, data...)
+	redactor.process(len(redactor.pending) > redactionMaxPending)
+	if len(redactor.pending) == 0 {
+		return
+	}
+	if redactor.timer == nil {
+		redactor.timer = time.AfterFunc(redactionFlushDelay, redactor.Flush)
+	} else {
+		redactor.timer.Reset(redactionFlushDelay)
+	}
+}
+
+// Flush emits the output held back
+func (redactor *redactor) Flush() {
+	redactor.lock.Lock()
+	defer redactor.lock.Unlock()
+	if redactor.timer != nil {
+		redactor.timer.Stop()
+	}
+	if len(redactor.pending) > 0 {
+		redactor.process(true)
+	}
+}
+
+// isWordByte tells if a byte can be part of a secret
+func isWordByte(b byte) bool {
+	return b > ' ' && b != 0x7f
+}
+
+// escapeSequence is an escape sequence in the output, with the string it holds, if any
+type escapeSequence struct {
+	start, end               int
+	payloadStart, payloadEnd int
+}
+
+// parseEscape returns the escape sequence starting at buf[start], which is an ESC, or false if it
+// isn't complete yet
+func parseEscape(buf []byte, start int) (sequence escapeSequence, complete bool) {
+	sequence = escapeSequence{start: start}
+	if start+1 >= len(buf) {
+		return sequence, false
+	}
+	i := start + 2
+	switch buf[start+1] {
+	case '[':
+		// CSI: parameters and intermediates, and a final byte
+		for i < len(buf) && buf[i] >= 0x20 && buf[i] <= 0x3f {
+			i++
+		}
+		if i >= len(buf) {
+			return sequence, false
+		}
+		sequence.end = i
+		if buf[i] >= 0x40 && buf[i] <= 0x7e {
+			sequence.end = i + 1
+		}
+		return sequence, true
+	case ']', 'P', 'X', '^', '_':
+		// OSC, DCS, SOS, PM and APC: a string ended by BEL or ST
+		sequence.payloadStart = i
+		for ; i < len(buf); i++ {
+			if buf[i] == 0x07 {
+				sequence.payloadEnd, sequence.end = i, i+1
+				return sequence, true
+			}
+			if buf[i] == 0x1b {
+				if i+1 >= len(buf) {
+					return sequence, false
+				}
+				sequence.payloadEnd, sequence.end = i, i
+				if buf[i+1] == '\\' {
+					sequence.end = i + 2
+				}
+				return sequence, true
+			}
+		}
+		return sequence, false
+	default:
+		// Intermediates, and a final byte
+		i = start + 1
+		for i < len(buf) && buf[i] >= 0x20 && buf[i] <= 0x2f {
+			i++
+		}
+		if i >= len(buf) {
+			return sequence, false
+		}
+		sequence.end = i + 1
+		return sequence, true
+	}
+}
+
+// process masks the pending output, and emits it, except for its end if it may be the start of a
+// secret or of an escape sequence, unless final is set. It has to be called with the lock held.
+func (redactor *redactor) process(final bool) {
+	buf := redactor.pending
+	inEscape := make([]bool, len(buf))
+	var escapes []escapeSequence
+	// The indexes in buf of the bytes of the text
+	var textIndexes []int
+	cut := len(buf)
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != 0x1b {
+			textIndexes = append(textIndexes, i)
+			continue
+		}
+		sequence, complete := parseEscape(buf, i)
+		if !complete {
+			if !final {
+				cut = i
+				break
+			}
+			sequence.end = len(buf)
+		}
+		for j := sequence.start; j < sequence.end; j++ {
+			inEscape[j] = true
+		}
+		escapes = append(escapes, sequence)
+		i = sequence.end - 1
+	}
+	if !final {
+		// The last word is held back, with the escape sequences in it
+		held := 0
+		for cut > 0 && (inEscape[cut-1] || isWordByte(buf[cut-1]) && held < redactionMaxHold) {
+			if !inEscape[cut-1] {
+				held++
+			}
+			cut--
+		}
+	}
+
+	text := make([]byte, 0, len(redactor.context)+len(textIndexes))
+	text = append(text, redactor.context...)
+	for _, i := range textIndexes {
+		text = append(text, buf[i])
+	}
+	offset := len(redactor.context)
+	emitted := 0
+	for emitted < len(textIndexes) && textIndexes[emitted] < cut {
+		emitted++
+	}
+
+	// Only the text emitted now is masked, the text held back is looked at again with what follows
+	mask := make([]bool, len(buf))
+	maskText := func(from, to int) {
+		for t := from; t < to; t++ {
+			if t >= offset && t-offset < emitted {
+				mask[textIndexes[t-offset]] = true
+			}
+		}
+	}
+	for _, pattern := range redactor.rules.patterns {
+		for _, match := range pattern.FindAllSubmatchIndex(text, -1) {
+			if len(match) > 2 && match[2] >= 0 {
+				match = match[2:4]
+			}
+			maskText(match[0], match[1])
+		}
+	}
+	if redactor.rules.privateKeys {
+		redactor.maskPrivateKeys(text, offset, offset+emitted, maskText)
+	}
+	for _, sequence := range escapes {
+		if sequence.end > cut || sequence.payloadEnd <= sequence.payloadStart {
+			continue
+		}
+		payload := buf[sequence.payloadStart:sequence.payloadEnd]
+		for _, pattern := range redactor.rules.patterns {
+			for _, match := range pattern.FindAllSubmatchIndex(payload, -1) {
+				if len(match) > 2 && match[2] >= 0 {
+					match = match[2:4]
+				}
+				for j := match[0]; j < match[1]; j++ {
+					mask[sequence.payloadStart+j] = true
+				}
+			}
+		}
+	}
+
+	// Each masked character is replaced by one mask, so the layout of the screen doesn't change
+	output := make([]byte, 0, cut)
+	for i := 0; i < cut; i++ {
+		switch {
+		case !mask[i] || buf[i] < ' ' || buf[i] == 0x7f:
+			output = append(output, buf[i])
+		case buf[i] < 0x80 || buf[i] >= 0xc0:
+			output = append(output, redactionMask)
+		}
+	}
+
+	redactor.context = append(redactor.context, text[offset:offset+emitted]...)
+	if len(redactor.context) > redactionContextSize {
+		redactor.context = append([]byte(nil), redactor.context[len(redactor.context)-redactionContextSize:]...)
+	}
+	redactor.pending = append([]byte(nil), buf[cut:]...)
+	if len(output) > 0 {
+		redactor.emit(output)
+	}
+}
+
+// maskPrivateKeys masks the private keys between from and to in the text, which may have started
+// before it
+func (redactor *redactor) maskPrivateKeys(text []byte, from, to int, maskText func(from, to int)) {
+	for from < to {
+		if redactor.inPrivateKey {
+			end := bytes.Index(text[from:], privateKeyEnd)
+			if end >= 0 {
+				end += from
+			}
+			if end < 0 || end >= to {
+				maskText(from, to)
+				return
+			}
+			maskText(from, end)
+			redactor.inPrivateKey = false
+			from = end + len(privateKeyEnd)
+			continue
+		}
+		// The markers ending before from were seen before, but a marker can start in the context
+		var begin []int
+		for _, match := range privateKeyBegin.FindAllIndex(text[:to], -1) {
+			if match[1] > from {
+				begin = match
+				break
+			}
+		}
+		if begin == nil {
+			return
+		}
+		redactor.inPrivateKey = true
+		from = begin[1]
+	}
+}
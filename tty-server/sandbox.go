@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// sandboxInitCommand is the argument the server re-executes itself with, to set up the
+	// sandbox of a session from inside its namespaces, before running its command
+	sandboxInitCommand = "sandbox-init"
+	// sandboxEnvName is the variable holding the sandbox settings of the process set up by the
+	// server re-executed with sandboxInitCommand. It isn't passed on to the command.
+	sandboxEnvName         = "TTY_SERVER_SANDBOX"
+	defaultSandboxHostname = "sandbox"
+)
+
+// sandboxMount is a directory or a file of the host, bind mounted in a sandbox
+type sandboxMount struct {
+	Source string `json:"source"`
+	// Target is where the source is mounted in the sandbox, which is the source path by default
+	Target   string `json:"target,omitempty"`
+	Writable bool   `json:"writable,omitempty"`
+}
+
+// sandboxConfig isolates the sessions of a profile from each other and from the host, by running
+// their command in new user, PID, mount, UTS and IPC namespaces, and, optionally, in a new network
+// namespace.
+type sandboxConfig struct {
+	// Root is the root filesystem of the sandbox, which is mounted read-only unless Overlay is set,
+	// or the root of the host if empty
+	Root string `json:"root,omitempty"`
+	// Overlay keeps the changes made to Root in memory, so each session gets a writable copy of it,
+	// which is discarded when the session ends
+	Overlay bool           `json:"overlay,omitempty"`
+	Mounts  []sandboxMount `json:"mounts,omitempty"`
+	// PrivateTmp mounts an empty /tmp for each session
+	PrivateTmp bool `json:"private_tmp,omitempty"`
+	// IsolateNetwork gives the sessions a network namespace with only a loopback interface
+	IsolateNetwork bool   `json:"isolate_network,omitempty"`
+	Hostname       string `json:"hostname,omitempty"`
+
+	// The directory the root of the sandbox is assembled in, created for each session
+	StagingDir string `json:"staging_dir,omitempty"`
+}
+
+// validate checks the sandbox settings of a profile, and fills in the default mount targets
+func (sandbox *sandboxConfig) validate(profileName string) error {
+	invalid := func(reason string) error {
+		return &TTYServerError{msg: "Invalid sandbox in the profile " + profileName + ": " + reason}
+	}
+	if sandbox.Root != "" {
+		if info, err := os.Stat(sandbox.Root); err != nil || !info.IsDir() {
+			return invalid("the root " + sandbox.Root + " is not a directory")
+		}
+	} else if sandbox.Overlay {
+		return invalid("an overlay needs a root")
+	}
+	for i := range sandbox.Mounts {
+		mount := &sandbox.Mounts[i]
+		if mount.Target == "" {
+			mount.Target = mount.Source
+		}
+		if !filepath.IsAbs(mount.Source) || !filepath.IsAbs(mount.Target) {
+			return invalid("the mounts need absolute paths")
+		}
+		if _, err := os.Stat(mount.Source); err != nil {
+			return invalid(err.Error())
+		}
+		mount.Target = filepath.Clean(mount.Target)
+	}
+	if sandbox.Hostname == "" {
+		sandbox.Hostname = defaultSandboxHostname
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// command returns the command running a session in the sandbox. The server runs itself in the new
+// namespaces, as the root of the user namespace, which is the user of the session outside of it,
+// or the server's user, to set up the mounts, and then runs the command of the session. It returns a function removing
+// what was created for the session on the host, to be called once the session ended.
+func (sandbox *sandboxConfig) command(name string, args []string, env []string, user *sessionUser) (cmd *exec.Cmd, cleanup func(), err error) {
+	hostUID, hostGID := os.Geteuid(), os.Getegid()
+	if user != nil {
+		hostUID, hostGID = int(user.UID), int(user.GID)
+	}
+	if hostUID == 0 {
+		return nil, nil, &TTYServerError{msg: "The sandboxed sessions can't run as root, they need a user"}
+	}
+
+	config := *sandbox
+	cleanup = func() {}
+	if config.Root != "" {
+		if config.StagingDir, err = ioutil.TempDir("", "tty-server-sandbox"); err != nil {
+			return
+		}
+		staging := config.StagingDir
+		cleanup = func() { os.Remove(staging) }
+		if err = os.Chown(staging, hostUID, hostGID); err != nil {
+			cleanup()
+			return
+		}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		cleanup()
+		return
+	}
+
+	cmd = &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: append([]string{"tty-server", sandboxInitCommand, name}, args...),
+	}
+	if user != nil {
+		cmd.Env = user.environment(env)
+	} else {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Env = append(cmd.Env, sandboxEnvName+"="+string(data))
+
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC)
+	if config.IsolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  flags,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostUID, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostGID, Size: 1}},
+	}
+	if os.Geteuid() == 0 {
+		// The supplementary groups of the server are dropped, which only root can do in a user
+		// namespace. An unprivileged server's groups are its user's anyway.
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{}}
+	}
+	return
+}
+
+// runSandboxInit sets up the sandbox of a session, from inside its namespaces, and runs its
+// command. It only returns if that fails.
+func runSandboxInit() {
+	if err := initSandbox(); err != nil {
+		// This goes to the terminal of the session
+		fmt.Fprintf(os.Stderr, "Cannot set up the sandbox: %s\r\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func initSandbox() error {
+	if err := waitForServer(); err != nil {
+		return err
+	}
+	var sandbox sandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxEnvName)), &sandbox); err != nil {
+		return err
+	}
+	os.Unsetenv(sandboxEnvName)
+	if len(os.Args) < 3 {
+		return &TTYServerError{msg: "No command to run"}
+	}
+
+	// Nothing mounted in the sandbox is seen by the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	root := "/"
+	if sandbox.Root != "" {
+		if err := unix.Mount("tmpfs", sandbox.StagingDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+			return err
+		}
+		root = filepath.Join(sandbox.StagingDir, "root")
+		if err := os.Mkdir(root, 0755); err != nil {
+			return err
+		}
+		if sandbox.Overlay {
+			upper, work := filepath.Join(sandbox.StagingDir, "upper"), filepath.Join(sandbox.StagingDir, "work")
+			for _, dir := range []string{upper, work} {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					return err
+				}
+			}
+			// The root can't have other filesystems mounted in it, which the user namespace can't
+			// unmount
+			options := "lowerdir=" + sandbox.Root + ",upperdir=" + upper + ",workdir=" + work + ",userxattr"
+			if err := unix.Mount("overlay", root, "overlay", 0, options); err != nil {
+				return &TTYServerError{msg: "Cannot mount the overlay: " + err.Error()}
+			}
+		} else if err := bindMount(sandbox.Root, root, true); err != nil {
+			return err
+		}
+		// The devices of the host, which include the PTY of the session
+		if err := bindMount("/dev", filepath.Join(root, "dev"), false); err != nil {
+			return err
+		}
+	}
+
+	if sandbox.PrivateTmp {
+		if err := unix.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return err
+		}
+	}
+	for _, mount := range sandbox.Mounts {
+		if err := bindMount(mount.Source, filepath.Join(root, mount.Target), !mount.Writable); err != nil {
+			return err
+		}
+	}
+	// The processes of the sandbox only see each other
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("proc", proc, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	if err := unix.Sethostname([]byte(sandbox.Hostname)); err != nil {
+		return err
+	}
+	if sandbox.IsolateNetwork {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+
+	if sandbox.Root != "" {
+		// Once the root is swapped, the old one is stacked under it, and unmounted
+		if err := os.Chdir(root); err != nil {
+			return err
+		}
+		if err := unix.PivotRoot(".", "."); err != nil {
+			return err
+		}
+		if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+			return err
+		}
+	}
+	if os.Chdir(os.Getenv("HOME")) != nil {
+		os.Chdir("/")
+	}
+
+	path, err := exec.LookPath(os.Args[2])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, os.Args[2:], os.Environ())
+}
+
+// bindMount mounts a directory or a file of the host in the sandbox
+func bindMount(source, target string, readOnly bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return &TTYServerError{msg: "Cannot create the mount point " + target + ": " + err.Error()}
+	}
+
+	if err = unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return &TTYServerError{msg: "Cannot mount " + source + ": " + err.Error()}
+	}
+	if !readOnly {
+		return nil
+	}
+	// A user namespace can't clear the flags the mount had on the host, which have the same values
+	// in statfs and in mount
+	var stat unix.Statfs_t
+	if err = unix.Statfs(target, &stat); err != nil {
+		return err
+	}
+	locked := uintptr(stat.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	if err = unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|locked, ""); err != nil {
+		return &TTYServerError{msg: "Cannot make " + target + " read-only: " + err.Error()}
+	}
+	return nil
+}
+
+// loopbackUp brings the loopback interface of a new network namespace up
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// struct ifreq, with the flags of the interface
+	var request struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(request.name[:], "lo")
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		return errno
+	}
+	request.flags |= unix.IFF_UP
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func (sandbox *sandboxConfig) command(name string, args []string, env []string, user *sessionUser) (*exec.Cmd, func(), error) {
+	return nil, nil, &TTYServerError{msg: "The sandboxes need Linux namespaces"}
+}
+
+func runSandboxInit() {
+	fmt.Fprintln(os.Stderr, "The sandboxes need Linux namespaces")
+	os.Exit(1)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary set up the sandboxes, and start the sessions with cgroups, as the
+// server does when it runs itself
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitCommand {
+		runSandboxInit()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == sessionInitCommand {
+		runSessionInit()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestSandboxValidate(t *testing.T) {
+	invalid := []sandboxConfig{
+		{Root: "/no/such/root"},
+		{Overlay: true},
+		{Mounts: []sandboxMount{{Source: "relative"}}},
+		{Mounts: []sandboxMount{{Source: "/no/such/source"}}},
+		{Mounts: []sandboxMount{{Source: "/", Target: "relative"}}},
+	}
+	for _, sandbox := range invalid {
+		if err := sandbox.validate("p"); err == nil {
+			t.Errorf("Expected %+v to be refused", sandbox)
+		}
+	}
+
+	sandbox := sandboxConfig{Root: "/", Mounts: []sandboxMount{{Source: "/etc"}}}
+	if err := sandbox.validate("p"); err != nil {
+		t.Fatal(err)
+	}
+	if sandbox.Mounts[0].Target != "/etc" || sandbox.Hostname != defaultSandboxHostname {
+		t.Errorf("Expected the defaults to be filled in, got %+v", sandbox)
+	}
+}
+
+func TestSandboxCommand(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The sandboxes need Linux")
+	}
+	var user *sessionUser
+	if os.Geteuid() == 0 {
+		var err error
+		if user, err = lookupSessionUser("nobody"); err != nil {
+			t.Skip("No user to run the sandbox as")
+		}
+	}
+
+	run := func(sandbox sandboxConfig, script string) string {
+		if err := sandbox.validate("p"); err != nil {
+			t.Fatal(err)
+		}
+		cmd, cleanup, err := sandbox.command("sh", []string{"-c", script}, []string{"TTY_SHARE=1"}, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			// The kernel, or the container the tests run in, may not allow the namespaces
+			t.Skipf("Cannot run the sandbox: %v %s", err, output)
+		}
+		return string(output)
+	}
+
+	output := run(sandboxConfig{PrivateTmp: true, IsolateNetwork: true, Hostname: "box"},
+		`hostname; id -u; ls -A /tmp | wc -l; echo $$ $TTY_SHARE; [ -z "$TTY_SERVER_SANDBOX" ] && echo clean`)
+	if fields := strings.Fields(output); strings.Join(fields, " ") != "box 0 0 1 1 clean" {
+		t.Errorf("Expected an isolated process, got %q", output)
+	}
+
+	output = run(sandboxConfig{Root: "/"}, `touch /tty-share-sandbox-test 2>/dev/null || echo read-only`)
+	if strings.TrimSpace(output) != "read-only" {
+		t.Errorf("Expected the root to be read-only, got %q", output)
+	}
+
+	if _, err := os.Stat("/tty-share-sandbox-test"); err == nil {
+		os.Remove("/tty-share-sandbox-test")
+		t.Errorf("Expected the host not to be changed")
+	}
+
+	output = run(sandboxConfig{Root: "/usr", Overlay: true}, `touch /tty-share-sandbox-test && echo written`)
+	if strings.TrimSpace(output) != "written" {
+		t.Errorf("Expected the overlay to be writable, got %q", output)
+	}
+	if _, err := os.Stat("/usr/tty-share-sandbox-test"); err == nil {
+		os.Remove("/usr/tty-share-sandbox-test")
+		t.Errorf("Expected the root of the overlay not to be changed")
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"html/template"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
+
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
@@ -26,23 +28,85 @@ type SessionTemplateModel struct {
 	SessionID string
 	Salt      string
 	WSPath    string
+	CSRFToken string
 }
 
 // TTYServerConfig is used to configure the tty server before it is started
 type TTYServerConfig struct {
-	Once         bool
-	WebAddress   string
-	FrontendPath string
-	CommandName  string
-	CommandArgs  string
+	Once                   bool
+	WebAddress             string
+	FrontendPath           string
+	CommandName            string
+	CommandArgs            string
+	RecordingSink          RecordingSink
+	RecordKeyframeInterval time.Duration
+	RecordFlushInterval    time.Duration
+	AuditLog               *auditLog
+	ShellIntegration       *shellIntegration
+	OutputHistorySize      int
+	// TLS makes the server listen for HTTPS connections, when set
+	TLS *tlsProvider
+	// HTTPRedirectAddress is where plain HTTP requests are redirected to HTTPS from, when TLS is
+	// used. Nothing listens for them if it is empty.
+	HTTPRedirectAddress string
+	// ClientCertAuth identifies the receivers from their TLS client certificates, when set
+	ClientCertAuth *clientCertAuth
+	// Login makes the users log in before they can use the server, when set
+	Login loginProvider
+	// Cookies signs the cookies the logged in users are identified with
+	Cookies *cookieSigner
+	// Profiles are the kinds of sessions which can be opened, by their name. Without them, the
+	// sessions run CommandName.
+	Profiles map[string]*sessionProfile
+	// Policy decides what the users can do, when set
+	Policy *policy
+	// CSRF makes the requests changing something, and the websockets, need a token from the pages
+	// of the server, when set
+	CSRF *csrfProtector
+	// AllowedOrigins are the origins ("https://host[:port]", or "*") of the other sites whose pages
+	// can open websockets, besides the server itself
+	AllowedOrigins []string
+	// FrameAncestors are the Content-Security-Policy sources of the pages which can frame the
+	// server's. No page can if it is empty.
+	FrameAncestors []string
+	// Shares mints the share links of the sessions, when set
+	Shares *shareManager
+	// RequireShare makes the receivers need a share link to join a running session
+	RequireShare bool
+	// Cgroups creates the cgroups of the sessions of the profiles with limits
+	Cgroups *cgroupManager
+	// RateLimits limits how fast the clients can create sessions, connect and type, and how many
+	// sessions and receivers there can be
+	RateLimits *rateLimiter
+	// Chat is how the chats of the sessions are kept
+	Chat chatConfig
+	// WaitingRoomTimeout is how long the receivers wait to join the sessions with a waiting room,
+	// before they are turned away
+	WaitingRoomTimeout time.Duration
+	// Redaction masks the secrets in the output of the sessions, when set
+	Redaction *redactionRules
+	// HSTSMaxAge is how long the browsers have to keep using HTTPS, once they connected with it. No
+	// HSTS header is sent if it is 0.
+	HSTSMaxAge time.Duration
+	// Metrics counts what the server does, for Prometheus, when set
+	Metrics *serverMetrics
+	// MetricsAddress is where the metrics are served on their own, without logging in, besides on
+	// the metrics path of the server. Nothing listens for them there if it is empty.
+	MetricsAddress string
 }
 
 // TTYServer represents the instance of a tty server
 type TTYServer struct {
 	httpServer           *http.Server
+	redirectServer       *http.Server
+	metricsServer        *http.Server
 	config               TTYServerConfig
 	activeSessions       map[string]*ptyMaster
 	activeSessionsRWLock sync.RWMutex
+	// liveSessions is the number of sessions being started, or whose command hasn't exited yet,
+	// which the number of sessions is limited by
+	liveSessions     int
+	liveSessionsLock sync.Mutex
 }
 
 // TTYServerError represents the instance of a tty server error
@@ -58,7 +122,6 @@ func (err *TTYServerError) Error() string {
 	return err.msg
 }
 
-
 func (server *TTYServer) serveContent(w http.ResponseWriter, r *http.Request, name string) {
 	// If a path to the frontend resources was passed, serve from there, otherwise, serve from the
 	// builtin bundle
@@ -100,32 +163,97 @@ func NewTTYServer(config TTYServerConfig) (server *TTYServer) {
 	server.httpServer = &http.Server{
 		Addr: config.WebAddress,
 	}
+	if config.TLS != nil {
+		server.httpServer.TLSConfig = config.TLS.TLSConfig()
+		if config.HTTPRedirectAddress != "" {
+			server.redirectServer = &http.Server{
+				Addr:    config.HTTPRedirectAddress,
+				Handler: config.TLS.HTTPHandler(httpsRedirectHandler(config.WebAddress)),
+			}
+		}
+	}
 	routesHandler := mux.NewRouter()
 
 	routesHandler.PathPrefix("/static/").Handler(http.StripPrefix("/static/",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			server.serveContent(w, r, r.URL.Path)
-		})))
+		}))).Name(actionStatic)
 
 	routesHandler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Default session
 		http.Redirect(w, r, "/s/1", http.StatusMovedPermanently)
-	})
+	}).Name(actionIndex)
 	routesHandler.HandleFunc("/s/{sessionID}", func(w http.ResponseWriter, r *http.Request) {
 		server.handleSession(w, r)
-	})
+	}).Name(actionSessionPage)
 	routesHandler.HandleFunc("/ws/{sessionID}", func(w http.ResponseWriter, r *http.Request) {
 		server.handleWebsocket(w, r)
-	})
+	}).Name(actionSessionConnect)
 	routesHandler.HandleFunc("/l", func(w http.ResponseWriter, r *http.Request) {
 		server.listSessions(w, r)
-	})
+	}).Name(actionSessionList)
+	routesHandler.HandleFunc(loginPath, func(w http.ResponseWriter, r *http.Request) {
+		server.handleLogin(w, r)
+	}).Name(actionAuthLogin)
+	routesHandler.HandleFunc(logoutPath, func(w http.ResponseWriter, r *http.Request) {
+		server.handleLogout(w, r)
+	}).Name(actionAuthLogout)
+	routesHandler.HandleFunc(csrfPath, func(w http.ResponseWriter, r *http.Request) {
+		server.handleCSRFToken(w, r)
+	}).Name(actionAuthCSRF)
+	if config.Login != nil {
+		config.Login.RegisterRoutes(routesHandler, server)
+	}
+	routesHandler.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		server.handleMetrics(w, r)
+	}).Name(actionMetrics)
+	if config.Metrics != nil && config.MetricsAddress != "" {
+		metricsHandler := http.NewServeMux()
+		metricsHandler.HandleFunc(metricsPath, server.handleMetrics)
+		server.metricsServer = &http.Server{Addr: config.MetricsAddress, Handler: metricsHandler}
+	}
+	routesHandler.HandleFunc("/api/me", func(w http.ResponseWriter, r *http.Request) {
+		server.handleMe(w, r)
+	}).Name(actionAPIMe)
+	routesHandler.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		server.handleSessionList(w, r)
+	}).Name(actionSessionList)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}/commands", func(w http.ResponseWriter, r *http.Request) {
+		server.handleSessionCommands(w, r)
+	}).Name(actionSessionCommands)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}/transcript", func(w http.ResponseWriter, r *http.Request) {
+		server.handleSessionTranscript(w, r)
+	}).Name(actionSessionTranscript)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}/shares", func(w http.ResponseWriter, r *http.Request) {
+		server.handleShareCreate(w, r)
+	}).Methods("POST").Name(actionShareCreate)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}/shares", func(w http.ResponseWriter, r *http.Request) {
+		server.handleShareList(w, r)
+	}).Methods("GET").Name(actionShareList)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}/shares/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+		server.handleShareRevoke(w, r)
+	}).Methods("DELETE").Name(actionShareRevoke)
+	routesHandler.HandleFunc("/api/sessions/{sessionID}", func(w http.ResponseWriter, r *http.Request) {
+		server.handleSessionKill(w, r)
+	}).Methods("DELETE").Name(actionSessionKill)
+	routesHandler.HandleFunc("/r/{recordingID}", func(w http.ResponseWriter, r *http.Request) {
+		server.handlePlayer(w, r)
+	}).Name(actionRecordingView)
+	routesHandler.HandleFunc("/r/{recordingID}/events", func(w http.ResponseWriter, r *http.Request) {
+		server.handleRecordingEvents(w, r)
+	}).Name(actionRecordingEvents)
+	routesHandler.HandleFunc("/r/{recordingID}/transcript", func(w http.ResponseWriter, r *http.Request) {
+		server.handleRecordingTranscript(w, r)
+	}).Name(actionRecordingTranscript)
+	routesHandler.Use(server.authMiddleware)
+	routesHandler.Use(server.csrfMiddleware)
+	routesHandler.Use(server.policyMiddleware)
 	routesHandler.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		server.serveContent(w, r, "404.html")
 	})
 
 	server.activeSessions = make(map[string]*ptyMaster)
-	server.httpServer.Handler = routesHandler
+	server.httpServer.Handler = server.securityHeaders(routesHandler)
 	return server
 }
 
@@ -159,45 +287,100 @@ func (server *TTYServer) handleWebsocket(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	// Checked before a session is created for the request, and not only by the upgrader
+	if !server.checkOrigin(r) {
+		server.config.Metrics.AuthFailure("csrf")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	session := server.getSession(sessionID)
+	identity := server.identify(r)
+	var grant *shareGrant
+	if limitErr := server.config.RateLimits.Connect(r.RemoteAddr, identity); limitErr != nil {
+		log.Warnf("Refused the websocket of %s from %s: %s", identity.Name, r.RemoteAddr, limitErr.Error())
+		limitErr.write(w)
+		return
+	}
+
+	// The share link is only counted as used once the receiver is let in
+	shareToken := r.URL.Query().Get(shareQueryName)
+	if shareToken != "" {
+		// The share links only join running sessions
+		var err error
+		if grant, err = server.config.Shares.Check(shareToken, sessionID, identity); err != nil || session == nil {
+			log.Warnf("Refused the share link of session %s to %s: %v", sessionID, identity.Name, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else if session != nil && server.config.RequireShare {
+		log.Warnf("Refused %s joining session %s without a share link", identity.Name, sessionID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if session != nil && session.IsBanned(identity, r.RemoteAddr) {
+		log.Warnf("Refused %s from %s joining session %s: banned", identity.Name, r.RemoteAddr, sessionID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// No valid session with this ID, create a new one and start it
+	created := session == nil
+	if session == nil {
+		limitErr := server.config.RateLimits.SessionCreate(r.RemoteAddr, identity)
+		if limitErr == nil {
+			limitErr = server.reserveSession()
+		}
+		if limitErr != nil {
+			log.Warnf("Refused creating session %s for %s from %s: %s", sessionID, identity.Name, r.RemoteAddr, limitErr.Error())
+			limitErr.write(w)
+			return
+		}
+		var status int
+		if session, status = server.startSession(r, sessionID); session == nil {
+			w.WriteHeader(status)
+			return
+		}
+	} else if limitErr := server.config.RateLimits.Receivers(len(session.GetReceivers())); limitErr != nil {
+		log.Warnf("Refused %s joining session %s: %s", identity.Name, sessionID, limitErr.Error())
+		limitErr.write(w)
+		return
+	}
+	if grant != nil {
+		// Checked again, as the link may have been used up by somebody else in the meantime
+		if _, err := server.config.Shares.Use(shareToken, sessionID, identity); err != nil {
+			log.Warnf("Refused the share link of session %s to %s: %v", sessionID, identity.Name, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
 
 	// Upgrade to Websocket mode.
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		CheckOrigin:     server.checkOrigin,
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
 		log.Error("Cannot create the WS connection for session ", sessionID, ". Error: ", err.Error())
+		server.config.Metrics.WebsocketError("upgrade")
 		return
 	}
 
-	session := server.getSession(sessionID)
-
-	// No valid session with this ID, create a new one and start it
-	if session == nil {
-		session = server.createNewSession(sessionID)
-		go func() {
-			
-			server.addSession(sessionID, session)
-			session.Wait()
-			log.Infof("Session %s stopped", sessionID)
-
-			server.removeSession(session)
-		}()
+	// The session keeps running when its receivers leave, until its command exits
+	receiver := newTTYReceiver(newWSConnection(conn), identity)
+	receiver.name = displayName(receiver, r.URL.Query().Get(displayNameQueryName))
+	if grant != nil {
+		receiver.share = grant.ID
+		receiver.viewOnly = grant.Role == shareRoleView
 	}
-
-	// TODO: attach the ptyMaster
-	//session.HandleReceiver(newWSConnection(conn))
-	// Remove the session when it's closed from the browser
-	if session.HandleReceiver(newWSConnection(conn)) {
-		server.removeSession(session)
-		//stop the server after the session is removed
-		if server.config.Once != false {
-		    log.Infof("Closing server because -once flag was supplied")
-		    server.Stop()
-		}
+	if created {
+		session.SetOwner(receiver)
 	}
+	session.HandleReceiver(receiver)
 }
 
 func (server *TTYServer) handleSession(w http.ResponseWriter, r *http.Request) {
@@ -207,40 +390,53 @@ func (server *TTYServer) handleSession(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Session ID is: %s", sessionID)
 	log.Debugf("Handling web TTYReceiver session: %s", sessionID)
 
+	// The session is created by the websocket of the page, which needs the CSRF token, so another
+	// site can't make the browsers of the users create sessions
 	session := server.getSession(sessionID)
-
-	// No valid session with this ID, create a new one and start it
-	if session == nil {
-		session = server.createNewSession(sessionID)
-		go func() {
-			server.addSession(sessionID, session)
-			session.Wait()
-			log.Infof("Session %s stopped", sessionID)
-
-			server.removeSession(session)
-			//stop the server after the session is stopped/closed
-		}()
+	shareToken := r.URL.Query().Get(shareQueryName)
+	if shareToken != "" {
+		if _, err := server.config.Shares.Check(shareToken, sessionID, server.identify(r)); err != nil {
+			server.renderShareError(w, err)
+			return
+		}
+		if session == nil {
+			server.renderShareError(w, errShareNoSuchSession)
+			return
+		}
+	} else if session != nil {
+		if server.config.RequireShare {
+			server.renderShareError(w, errShareNeeded)
+			return
+		}
 		//Allow only one active connection to this session
-	}else{
 		log.Infof("Session %s already running", sessionID)
 		return
+	} else if server.getProfile(r.URL.Query().Get("profile")) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	var t *template.Template
-	var err error
-	if server.config.FrontendPath == "" {
-		templateDta, err := Asset("tty-receiver.in.html")
-
-		if err != nil {
-			panic("Cannot find the tty-receiver html template")
-		}
-
-		t = template.New("tty-receiver.html")
-		_, err = t.Parse(string(templateDta))
-	} else {
-		t, err = template.ParseFiles(server.config.FrontendPath + string(os.PathSeparator) + "tty-receiver.in.html")
+	csrfToken := server.csrfToken(w, r)
+	wsQuery := url.Values{}
+	if profile := r.URL.Query().Get("profile"); profile != "" {
+		wsQuery.Set("profile", profile)
+	}
+	if shareToken != "" {
+		wsQuery.Set(shareQueryName, shareToken)
+	}
+	if name := r.URL.Query().Get(displayNameQueryName); name != "" {
+		wsQuery.Set(displayNameQueryName, name)
+	}
+	if csrfToken != "" {
+		wsQuery.Set(csrfFieldName, csrfToken)
+	}
+	wsPath := getWSPath(sessionID)
+	if len(wsQuery) > 0 {
+		wsPath += "?" + wsQuery.Encode()
 	}
 
+	t, err := server.loadTemplate("tty-receiver.in.html")
+
 	if err != nil {
 		panic("Cannot parse the tty-receiver html template")
 	}
@@ -248,7 +444,8 @@ func (server *TTYServer) handleSession(w http.ResponseWriter, r *http.Request) {
 	templateModel := SessionTemplateModel{
 		SessionID: sessionID,
 		Salt:      "salt&pepper",
-		WSPath:    getWSPath(sessionID),
+		WSPath:    wsPath,
+		CSRFToken: csrfToken,
 	}
 	err = t.Execute(w, templateModel)
 
@@ -257,30 +454,173 @@ func (server *TTYServer) handleSession(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// loadTemplate loads a html template from the frontend resources, either from the builtin bundle,
+// or from the frontend path, if one was passed
+func (server *TTYServer) loadTemplate(name string) (t *template.Template, err error) {
+	if server.config.FrontendPath == "" {
+		var templateData []byte
+		templateData, err = Asset(name)
+
+		if err != nil {
+			return
+		}
+
+		t = template.New(name)
+		_, err = t.Parse(string(templateData))
+		return
+	}
+	return template.ParseFiles(server.config.FrontendPath + string(os.PathSeparator) + name)
+}
+
+// removeSession removes a session which stopped, unless another one took its ID since
 func (server *TTYServer) removeSession(session *ptyMaster) {
 	server.activeSessionsRWLock.Lock()
-	delete(server.activeSessions, session.GetSessionID())
+	if server.activeSessions[session.GetSessionID()] == session {
+		delete(server.activeSessions, session.GetSessionID())
+	}
 	server.activeSessionsRWLock.Unlock()
 }
 
 func (server *TTYServer) addSession(sessionID string, session *ptyMaster) (err error) {
 	server.activeSessionsRWLock.Lock()
+	defer server.activeSessionsRWLock.Unlock()
 	var ok bool
 	if _, ok = server.activeSessions[sessionID]; ok {
 		log.Warnf("Can not add session %s: already exists", sessionID)
 		return &TTYServerError{msg: "Session exists"}
 	}
 	server.activeSessions[sessionID] = session
-	server.activeSessionsRWLock.Unlock()
 	return
 }
 
-func (server *TTYServer) createNewSession(sessionID string) (session *ptyMaster) {
+// startSession creates the session a receiver asked for, with the profile in the query, and starts
+// it. The HTTP status to fail the request with is returned if it can't be created. The session has
+// to be reserved with reserveSession, and is released once its command exits, or if it can't start.
+func (server *TTYServer) startSession(r *http.Request, sessionID string) (session *ptyMaster, status int) {
+	defer func() {
+		if session == nil {
+			server.releaseSession()
+		}
+	}()
+	profile := server.getProfile(r.URL.Query().Get("profile"))
+	if profile == nil {
+		return nil, http.StatusNotFound
+	}
+	identity := server.identify(r)
+	if !server.config.Policy.Allow(identity, actionSessionCreate, sessionID, profile.Name) {
+		return nil, http.StatusForbidden
+	}
+	user, err := profile.sessionUser(identity)
+	if err != nil {
+		log.Warnf("Cannot create session %s for %s: %s", sessionID, identity.Name, err.Error())
+		return nil, http.StatusForbidden
+	}
+
+	if session, err = server.createNewSession(sessionID, profile, user); err != nil {
+		log.Errorf("Cannot start session %s: %s", sessionID, err.Error())
+		return nil, http.StatusInternalServerError
+	}
+	// Added before the receiver joins it, so the next receivers join the same session
+	if err = server.addSession(sessionID, session); err != nil {
+		session.Stop()
+		session.Wait()
+		return nil, http.StatusConflict
+	}
+	go func() {
+		session.Wait()
+		server.releaseSession()
+		log.Infof("Session %s stopped", sessionID)
+
+		server.removeSession(session)
+		server.config.Shares.RemoveSession(sessionID)
+		//stop the server after the session is removed
+		if server.config.Once {
+			log.Infof("Closing server because -once flag was supplied")
+			server.Stop()
+		}
+	}()
+	return session, http.StatusOK
+}
+
+func (server *TTYServer) createNewSession(sessionID string, profile *sessionProfile, user *sessionUser) (session *ptyMaster, err error) {
+	sizePolicy, err := parseWindowSize(profile.WindowSize, profile.Name)
+	if err != nil {
+		return nil, err
+	}
 	session = ptyMasterNew(sessionID)
-	session.Start(server.config.CommandName, strings.Fields(server.config.CommandArgs))
+	session.SetProfile(profile.Name)
+	if user != nil {
+		log.Infof("Session %s runs as %s (uid %d, gid %d)", sessionID, user.Name, user.UID, user.GID)
+		session.SetUser(user)
+	}
+	if profile.Sandbox != nil {
+		sandbox := *profile.Sandbox
+		if integration := server.config.ShellIntegration; integration != nil {
+			// The shell integration scripts are read from inside the sandbox too
+			sandbox.Mounts = append(append([]sandboxMount{}, sandbox.Mounts...), sandboxMount{Source: integration.dir, Target: integration.dir})
+		}
+		session.SetSandbox(&sandbox)
+	}
+	if profile.Limits != nil {
+		cgroup, err := server.config.Cgroups.Create(sessionID, profile.Limits)
+		if err != nil {
+			return nil, err
+		}
+		session.SetCgroup(cgroup)
+	}
+	session.SetPolicy(server.config.Policy)
+	session.SetMetrics(server.config.Metrics)
+	session.SetRateLimiter(server.config.RateLimits)
+	session.SetRedaction(server.config.Redaction)
+	session.SetFloorControl(profile.FloorControl)
+	session.SetWindows(profile.windows())
+	session.SetWindowSizePolicy(sizePolicy)
+	if profile.WaitingRoom {
+		session.SetWaitingRoom(server.config.WaitingRoomTimeout)
+	}
+	session.SetChat(server.config.Chat)
+	session.SetAuditLog(server.config.AuditLog)
+	session.SetOutputHistory(newOutputHistory(server.config.OutputHistorySize))
+	if server.config.RecordingSink != nil {
+		recorder, err := newSessionRecorder(server.config.RecordingSink, sessionID, 0, 0,
+			server.config.RecordKeyframeInterval, server.config.RecordFlushInterval)
+		if err != nil {
+			log.Errorf("Cannot record session %s: %s", sessionID, err.Error())
+		} else {
+			session.SetRecorder(recorder)
+		}
+	}
+	command, args, env := server.config.ShellIntegration.Wrap(profile.Command, profile.Args)
+	err = session.Start(command, args, env)
 	return
 }
 
+// reserveSession counts a session about to be started, unless there are as many sessions as the
+// server can run. The session is counted until releaseSession is called, once its command exits.
+func (server *TTYServer) reserveSession() *limitError {
+	server.liveSessionsLock.Lock()
+	defer server.liveSessionsLock.Unlock()
+	if limitErr := server.config.RateLimits.Sessions(server.liveSessions); limitErr != nil {
+		return limitErr
+	}
+	server.liveSessions++
+	return nil
+}
+
+// releaseSession stops counting a session reserved with reserveSession
+func (server *TTYServer) releaseSession() {
+	server.liveSessionsLock.Lock()
+	server.liveSessions--
+	server.liveSessionsLock.Unlock()
+}
+
+// sessionCount returns how many sessions are running, or being started
+func (server *TTYServer) sessionCount() int {
+	server.liveSessionsLock.Lock()
+	defer server.liveSessionsLock.Unlock()
+	return server.liveSessions
+}
+
 func (server *TTYServer) getSession(sessionID string) (session *ptyMaster) {
 	// TODO: move this in a better place
 	server.activeSessionsRWLock.RLock()
@@ -291,7 +631,28 @@ func (server *TTYServer) getSession(sessionID string) (session *ptyMaster) {
 
 // Listen starts listening on connections
 func (server *TTYServer) Listen() (err error) {
-	err = server.httpServer.ListenAndServe()
+	if server.metricsServer != nil {
+		go func() {
+			if err := server.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Errorf("The metrics server stopped: %s", err.Error())
+			}
+		}()
+	}
+	if server.config.TLS == nil {
+		err = server.httpServer.ListenAndServe()
+		log.Debug("Server finished")
+		return
+	}
+
+	if server.redirectServer != nil {
+		go func() {
+			if err := server.redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Errorf("The HTTP redirect server stopped: %s", err.Error())
+			}
+		}()
+	}
+	// The certificates come from the TLS config
+	err = server.httpServer.ListenAndServeTLS("", "")
 	log.Debug("Server finished")
 	return
 }
@@ -300,7 +661,11 @@ func (server *TTYServer) Listen() (err error) {
 func (server *TTYServer) Stop() (err error) {
 	log.Debug("Stopping the server")
 	err = server.httpServer.Close()
+	if server.redirectServer != nil {
+		server.redirectServer.Close()
+	}
+	if server.metricsServer != nil {
+		server.metricsServer.Close()
+	}
 	return
 }
-
-
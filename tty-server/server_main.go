@@ -1,33 +1,338 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	logrus "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
 )
 
+// stringListFlag is a command line flag that can be passed several times
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 // MainLogger is the logger that will be used across the whole main package. I whish I knew of a better way
 var MainLogger = logrus.New()
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitCommand {
+		runSandboxInit()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == sessionInitCommand {
+		runSessionInit()
+		return
+	}
 	commandName := flag.String("command", "bash", "The base command to run when a client attach")
 	commandArgs := flag.String("args", "", "The base command arguments")
 	webAddress := flag.String("web_address", ":80", "The bind address for the web interface. This is the listening address for the web server that hosts the \"browser terminal\". You might want to change this if you don't want to use the port 80, or only bind the localhost.")
 	frontendPath := flag.String("frontend_path", "", "The path to the frontend resources. By default, these resources are included in the server binary, so you only need this path if you don't want to use the bundled ones.")
-	once := flag.Bool("once",false,"Close server after active session is closed")
+	once := flag.Bool("once", false, "Close server after active session is closed")
+	recordSink := flag.String("record_sink", "file", "Where the sessions are recorded: \"file\" (in the -record_dir folder), \"s3\" (in an S3 compatible object store, see the -s3_* flags) or \"stdout\" (as JSON lines, which can't be played back by the server).")
+	recordDir := flag.String("record_dir", "", "The directory where the sessions are recorded, with the \"file\" sink. The sessions are not recorded if this is empty. The recordings can be played back at /r/<recording id>.")
+	recordKeyframeInterval := flag.Duration("record_keyframe_interval", 10*time.Second, "How often a snapshot of the screen is added to the recordings. Shorter intervals make seeking in the player faster, but the recordings bigger.")
+	recordFlushInterval := flag.Duration("record_flush_interval", 2*time.Second, "How often the recordings are written to the sink. This is at most how much of a recording is lost if the server stops unexpectedly.")
+	s3Endpoint := flag.String("s3_endpoint", "", "The URL of the S3 compatible object store, e.g. http://minio:9000. Defaults to AWS S3 in -s3_region. The credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.")
+	s3Region := flag.String("s3_region", "us-east-1", "The region of the S3 bucket")
+	s3Bucket := flag.String("s3_bucket", "", "The S3 bucket the recordings are stored in")
+	s3Prefix := flag.String("s3_prefix", "recordings/", "The prefix of the S3 object names of the recordings")
+	s3PathStyle := flag.Bool("s3_path_style", true, "Use path style S3 URLs (endpoint/bucket), instead of virtual host style ones (bucket.endpoint)")
+	auditLogPath := flag.String("audit_log", "", "The file where the audit log is appended, in JSON lines. It records who joined and left the sessions, what they typed, the window size changes and the end of the sessions. No audit log is written if this is empty.")
+	auditInput := flag.String("audit_input", "full", "How much of the receivers' input is written in the audit log: \"full\", \"redact\" (replacing the input matching the -audit_redact patterns), \"size\" (only the number of bytes) or \"none\".")
+	var auditRedact stringListFlag
+	flag.Var(&auditRedact, "audit_redact", "A regular expression matching input to be redacted from the audit log, when -audit_input is \"redact\". Can be passed several times.")
+	auditRedactNoEcho := flag.Bool("audit_redact_noecho", true, "Redact from the audit log the input typed while the terminal doesn't echo it, e.g. passwords")
+	shellIntegrationEnabled := flag.Bool("shell_integration", false, "Make bash and zsh mark the commands in their output, so the server keeps a history of the commands run in each session, with their exit codes, at /api/sessions/<session id>/commands")
+	outputHistorySize := flag.Int("output_history", 4*1024*1024, "How many bytes of the output of each live session are kept, to export transcripts of it at /api/sessions/<session id>/transcript. 0 disables the transcripts of live sessions.")
+	tlsCert := flag.String("tls_cert", "", "The certificate file (PEM encoded) the server uses for HTTPS. The server listens for HTTPS on -web_address if this and -tls_key are set. The files are loaded again when they change, so renewed certificates are used without a restart.")
+	tlsKey := flag.String("tls_key", "", "The key file (PEM encoded) of the -tls_cert certificate")
+	var acmeDomains stringListFlag
+	flag.Var(&acmeDomains, "acme_domain", "A domain to get a certificate for from an ACME CA (Let's Encrypt by default), instead of using -tls_cert. Can be passed several times.")
+	acmeEmail := flag.String("acme_email", "", "The contact email of the ACME account")
+	acmeCacheDir := flag.String("acme_cache_dir", "acme-cache", "The directory the ACME account key and certificates are kept in")
+	acmeDirectory := flag.String("acme_directory", acme.LetsEncryptURL, "The directory URL of the ACME CA, e.g. https://localhost:14000/dir for a local Pebble")
+	acmeCARoots := flag.String("acme_ca_roots", "", "A PEM file with the certificates to verify the ACME CA with, instead of the system ones. Needed for test CAs, like Pebble.")
+	httpRedirectAddress := flag.String("http_redirect_address", "", "When HTTPS is used, the bind address of a plain HTTP server which redirects everything to HTTPS, e.g. :80. It also answers the ACME HTTP challenges. No such server runs if this is empty.")
+	tlsClientCA := flag.String("tls_client_ca", "", "A PEM file with the CA certificates the TLS client certificates are verified with. When set, the clients have to connect with a certificate signed by one of these CAs, and are identified by it.")
+	tlsClientCertOptional := flag.Bool("tls_client_cert_optional", false, "Let the clients connect without a client certificate, as anonymous receivers, when -tls_client_ca is set")
+	tlsClientIdentity := flag.String("tls_client_identity", "cn", "The field of the client certificates the identity of the receivers is taken from: \"cn\" (the common name of the subject), or the first \"email\", \"dns\" or \"uri\" SAN")
+	var roleMap stringListFlag
+	flag.Var(&roleMap, "role_map", "Maps a group (\"<group>=<role>\") or a user (\"user:<name>=<role>\") to a role. The first matching mapping gives the role of a receiver. The groups of a client certificate are the organizational units of its subject. Can be passed several times.")
+	defaultRoleName := flag.String("default_role", defaultRole, "The role of the authenticated receivers no -role_map matches")
+	oidcIssuer := flag.String("oidc_issuer", "", "The URL of the OpenID Connect identity provider the users log in with. The users don't log in if this is empty. The client secret, if any, is read from the OIDC_CLIENT_SECRET environment variable.")
+	oidcClientID := flag.String("oidc_client_id", "", "The client ID of the server at the OpenID Connect identity provider")
+	oidcRedirectURL := flag.String("oidc_redirect_url", "", "The URL the identity provider sends the users back to, e.g. https://tty.example.com/auth/oidc/callback. Found out from the requests by default, which doesn't work behind a proxy.")
+	oidcScopes := flag.String("oidc_scopes", "openid profile email", "The OpenID Connect scopes requested, separated by spaces")
+	oidcUsernameClaim := flag.String("oidc_username_claim", "preferred_username", "The claim of the ID token the identity of the users is taken from")
+	oidcGroupsClaim := flag.String("oidc_groups_claim", "groups", "The claim of the ID token holding the groups of the users, which are mapped to roles with -role_map")
+	ldapURL := flag.String("ldap_url", "", "The ldap:// or ldaps:// URL of the LDAP server the users log in with, instead of OpenID Connect. The password of -ldap_bind_dn is read from the LDAP_BIND_PASSWORD environment variable.")
+	ldapStartTLS := flag.Bool("ldap_start_tls", false, "Upgrade the ldap:// connections to TLS with StartTLS")
+	ldapCARoots := flag.String("ldap_ca_roots", "", "A PEM file with the certificates the LDAP server is verified with, instead of the system ones")
+	ldapBindDN := flag.String("ldap_bind_dn", "", "The DN of the account the users are looked up with. The lookups are anonymous if this is empty.")
+	ldapUserBase := flag.String("ldap_user_base", "", "The DN the users are looked up under, e.g. ou=people,dc=example,dc=com")
+	ldapUserFilter := flag.String("ldap_user_filter", "(uid={username})", "The filter the users are looked up with. {username} is replaced with the name they log in with. Use (sAMAccountName={username}) for Active Directory.")
+	ldapUsernameAttribute := flag.String("ldap_username_attribute", "uid", "The attribute of the users the identity is taken from")
+	ldapGroupBase := flag.String("ldap_group_base", "", "The DN the groups are looked up under. The same as -ldap_user_base if empty.")
+	ldapGroupFilter := flag.String("ldap_group_filter", "", "The filter the groups of a user are looked up with, e.g. (member={dn}) or (memberUid={username}). The memberOf attribute of the users is used if this is empty.")
+	ldapGroupAttribute := flag.String("ldap_group_attribute", "cn", "The attribute the groups are named by, for -role_map")
+	cookieSecretFile := flag.String("cookie_secret_file", "", "A file holding the secret the login cookies are signed with. A random secret is used if this is empty, so the users have to log in again when the server restarts.")
+	profilesPath := flag.String("profiles", "", "A JSON file with the profiles the sessions can be opened with, by their name, e.g. {\"prod-shell\": {\"command\": \"ssh\", \"args\": [\"prod\"]}}. The receivers choose one with the profile query parameter. The \"default\" profile runs -command, unless the file has one.")
+	policyPath := flag.String("policy", "", "A JSON file with the rules deciding what the users can do. Everything is allowed to everyone if this is empty.")
+	var allowedOrigins stringListFlag
+	flag.Var(&allowedOrigins, "allowed_origin", "An origin (e.g. https://portal.example.com) whose pages can open websockets to the server, besides the server itself. \"*\" allows any. Can be passed several times.")
+	var frameAncestors stringListFlag
+	flag.Var(&frameAncestors, "frame_ancestor", "A Content-Security-Policy source (e.g. https://portal.example.com) of the pages which can show the server's in a frame. No page can if none is given. Can be passed several times.")
+	hstsMaxAge := flag.Duration("hsts_max_age", 365*24*time.Hour, "How long the browsers have to keep using HTTPS once they connected with it (the Strict-Transport-Security header). 0 disables the header.")
+	shareMaxTTL := flag.Duration("share_max_ttl", 7*24*time.Hour, "How long the share links minted with the API can be valid for, at most")
+	requireShare := flag.Bool("require_share", false, "Make the receivers need a share link to join a running session, instead of only its URL")
+	sessionUserName := flag.String("session_user", "", "The local user (name or uid) the sessions of the default profile run as. They run as the server's user if this is empty. Running them as another user needs the server to run as root.")
+	cgroupRoot := flag.String("cgroup_root", defaultCgroupRoot, "The cgroup v2 the cgroups of the sessions of the profiles with limits are created in. The server has to be able to write to it, and the controllers have to be enabled in its parent.")
+	sessionRate := flag.String("session_rate", "20/1m", "How many sessions each client IP, and each logged in user, can create, as a count and a duration. Empty for no limit.")
+	connectRate := flag.String("connect_rate", "120/1m", "How many times each client IP, and each logged in user, can connect to the sessions, as a count and a duration. Empty for no limit.")
+	inputRate := flag.String("input_rate", "1048576/1s", "How many bytes each client IP, and each logged in user, can type in the sessions, as a count and a duration. Empty for no limit.")
+	maxSessions := flag.Int("max_sessions", 0, "The maximum number of sessions running at once, or 0 for no limit")
+	maxReceivers := flag.Int("max_receivers", 0, "The maximum number of receivers of each session, or 0 for no limit")
+	floorControl := flag.String("floor_control", "", "Make one receiver at a time type in the sessions of the default profile, and drop (drop) or queue (queue) the input of the others, who ask for the keyboard. Empty to let every receiver type.")
+	maxWindows := flag.Int("max_windows", defaultMaxWindows, "How many windows the sessions of the default profile can have, with the main one. 1 to let the receivers open no windows.")
+	windowSize := flag.String("window_size", windowSizeLast, "How the sessions of the default profile are resized, when their receivers have different sizes: to the size of the receiver which resized last (last), of the owner (owner), to the smallest size of all the receivers (smallest), or to a fixed size (fixed:<cols>x<rows>)")
+	waitingRoom := flag.Bool("waiting_room", false, "Make the receivers joining the sessions of the default profile wait until their owner, or an admin, lets them in")
+	waitingRoomTimeout := flag.Duration("waiting_room_timeout", defaultWaitingRoomTimeout, "How long the receivers wait to join the sessions with a waiting room, before they are turned away")
+	chatHistory := flag.Int("chat_history", defaultChatHistorySize, "How many of the last messages of the chat of each session are sent to the receivers joining it")
+	recordChat := flag.Bool("record_chat", false, "Record the chat messages of the sessions, with their output, when they are recorded")
+	auditChat := flag.Bool("audit_chat", false, "Write the chat messages of the sessions in the audit log")
+	redact := flag.Bool("redact", false, "Mask the common secrets, like API keys, tokens and private keys, in the output of the sessions, before it reaches the receivers and the recordings")
+	redactionRulesPath := flag.String("redaction_rules", "", "A JSON file with a list of rules ({\"name\": ..., \"pattern\": ...}) whose regular expressions are masked in the output of the sessions, besides the secrets of -redact")
+	metricsEnabled := flag.Bool("metrics", true, "Serve the metrics of the server, for Prometheus, on /metrics, to the users the policy lets do metrics")
+	metricsAddress := flag.String("metrics_address", "", "Also serve the metrics on this address (e.g. 127.0.0.1:9090), without logging in, for a Prometheus which can't log in. Nothing listens there if this is empty.")
 	flag.Parse()
 
 	log := MainLogger
 	log.SetLevel(logrus.DebugLevel)
 
+	var recordingSink RecordingSink
+	var err error
+	switch *recordSink {
+	case "file":
+		if *recordDir != "" {
+			recordingSink, err = newFileRecordingSink(*recordDir)
+		}
+	case "s3":
+		recordingSink, err = newS3RecordingSink(S3Config{
+			Endpoint:     *s3Endpoint,
+			Region:       *s3Region,
+			Bucket:       *s3Bucket,
+			Prefix:       *s3Prefix,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			PathStyle:    *s3PathStyle,
+		})
+	case "stdout":
+		recordingSink = newStreamRecordingSink(os.Stdout)
+	default:
+		log.Fatalf("Unknown recording sink: %s", *recordSink)
+	}
+	if err != nil {
+		log.Fatalf("Cannot set up the recording sink: %s", err.Error())
+	}
+	if *recordFlushInterval <= 0 {
+		log.Fatalf("The recording flush interval has to be positive, got %s", *recordFlushInterval)
+	}
+
+	var audit *auditLog
+	if *auditLogPath != "" {
+		audit, err = newAuditLog(AuditConfig{
+			Path:           *auditLogPath,
+			Input:          *auditInput,
+			RedactPatterns: auditRedact,
+			RedactNoEcho:   *auditRedactNoEcho,
+		})
+		if err != nil {
+			log.Fatalf("Cannot open the audit log: %s", err.Error())
+		}
+		defer audit.Close()
+	}
+
+	var integration *shellIntegration
+	if *shellIntegrationEnabled {
+		if integration, err = newShellIntegration(); err != nil {
+			log.Fatalf("Cannot set up the shell integration: %s", err.Error())
+		}
+		defer integration.Close()
+	}
+
+	var tlsProvider *tlsProvider
+	if *tlsCert != "" || *tlsKey != "" || len(acmeDomains) > 0 {
+		tlsProvider, err = newTLSProvider(TLSConfig{
+			CertFile:           *tlsCert,
+			KeyFile:            *tlsKey,
+			ACMEDomains:        acmeDomains,
+			ACMEEmail:          *acmeEmail,
+			ACMECacheDir:       *acmeCacheDir,
+			ACMEDirectoryURL:   *acmeDirectory,
+			ACMECARootsFile:    *acmeCARoots,
+			ClientCAFile:       *tlsClientCA,
+			ClientCertOptional: *tlsClientCertOptional,
+		})
+		if err != nil {
+			log.Fatalf("Cannot set up TLS: %s", err.Error())
+		}
+	}
+
+	roles, err := newRoleMapping(roleMap, *defaultRoleName)
+	if err != nil {
+		log.Fatalf("Cannot parse the role mappings: %s", err.Error())
+	}
+	var certAuth *clientCertAuth
+	if *tlsClientCA != "" {
+		if tlsProvider == nil {
+			log.Fatalf("Client certificates need TLS, see -tls_cert or -acme_domain")
+		}
+		if certAuth, err = newClientCertAuth(*tlsClientIdentity, roles); err != nil {
+			log.Fatalf("Cannot set up the client certificate authentication: %s", err.Error())
+		}
+	}
+
+	var cookies *cookieSigner
+	var login loginProvider
+	if *oidcIssuer != "" && *ldapURL != "" {
+		log.Fatalf("Only one of -oidc_issuer and -ldap_url can be used")
+	}
+	var cookieSecret []byte
+	if *oidcIssuer != "" || *ldapURL != "" {
+		if *cookieSecretFile != "" {
+			if cookieSecret, err = ioutil.ReadFile(*cookieSecretFile); err != nil {
+				log.Fatalf("Cannot read the cookie secret: %s", err.Error())
+			}
+			if cookieSecret = bytes.TrimSpace(cookieSecret); len(cookieSecret) == 0 {
+				log.Fatalf("The cookie secret file %s is empty", *cookieSecretFile)
+			}
+		} else {
+			log.Warnf("No -cookie_secret_file, so the users have to log in again when the server restarts")
+			cookieSecret = []byte(randomString())
+		}
+		cookies = newCookieSigner(cookieSecret)
+	}
+	if *oidcIssuer != "" {
+		login, err = newOIDCProvider(OIDCConfig{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   *oidcRedirectURL,
+			Scopes:        strings.Fields(*oidcScopes),
+			UsernameClaim: *oidcUsernameClaim,
+			GroupsClaim:   *oidcGroupsClaim,
+		}, roles, cookies)
+		if err != nil {
+			log.Fatalf("Cannot set up the OIDC login: %s", err.Error())
+		}
+	}
+	if *ldapURL != "" {
+		login, err = newLDAPProvider(LDAPConfig{
+			URL:               *ldapURL,
+			StartTLS:          *ldapStartTLS,
+			CARootsFile:       *ldapCARoots,
+			BindDN:            *ldapBindDN,
+			BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+			UserBase:          *ldapUserBase,
+			UserFilter:        *ldapUserFilter,
+			UsernameAttribute: *ldapUsernameAttribute,
+			GroupBase:         *ldapGroupBase,
+			GroupFilter:       *ldapGroupFilter,
+			GroupAttribute:    *ldapGroupAttribute,
+		}, roles)
+		if err != nil {
+			log.Fatalf("Cannot set up the LDAP login: %s", err.Error())
+		}
+	}
+
+	profiles, err := loadProfiles(*profilesPath, sessionProfile{Command: *commandName, Args: strings.Fields(*commandArgs), User: *sessionUserName, FloorControl: *floorControl, MaxWindows: *maxWindows, WindowSize: *windowSize, WaitingRoom: *waitingRoom})
+	if err != nil {
+		log.Fatalf("Cannot load the profiles: %s", err.Error())
+	}
+	var rateLimits [3]rateLimit
+	for i, limit := range []string{*sessionRate, *connectRate, *inputRate} {
+		if rateLimits[i], err = parseRateLimit(limit); err != nil {
+			log.Fatalf("Cannot parse the rate limits: %s", err.Error())
+		}
+	}
+	redaction, err := loadRedactionRules(*redactionRulesPath, *redact)
+	if err != nil {
+		log.Fatalf("Cannot load the redaction rules: %s", err.Error())
+	}
+	var cgroups *cgroupManager
+	for _, profile := range profiles {
+		if profile.Limits != nil && cgroups == nil {
+			if cgroups, err = newCgroupManager(*cgroupRoot); err != nil {
+				log.Fatalf("Cannot set up the cgroups of the sessions: %s", err.Error())
+			}
+		}
+	}
+	// The CSRF tokens stay valid when the server restarts, if the cookies do. The share links don't,
+	// as the sessions they are for end when the server stops.
+	csrfKey := []byte(randomString())
+	if cookieSecret != nil {
+		csrfKey = append([]byte("csrf\x00"), cookieSecret...)
+	}
+	var accessPolicy *policy
+	if *policyPath != "" {
+		if accessPolicy, err = loadPolicy(*policyPath); err != nil {
+			log.Fatalf("Cannot load the policy: %s", err.Error())
+		}
+	}
+
 	config := TTYServerConfig{
-		Once:         *once,
-		WebAddress:   *webAddress,
-		FrontendPath: *frontendPath,
-		CommandName:  *commandName,
-		CommandArgs:  *commandArgs,
+		Once:                   *once,
+		WebAddress:             *webAddress,
+		FrontendPath:           *frontendPath,
+		CommandName:            *commandName,
+		CommandArgs:            *commandArgs,
+		RecordingSink:          recordingSink,
+		RecordKeyframeInterval: *recordKeyframeInterval,
+		RecordFlushInterval:    *recordFlushInterval,
+		AuditLog:               audit,
+		ShellIntegration:       integration,
+		OutputHistorySize:      *outputHistorySize,
+		TLS:                    tlsProvider,
+		HTTPRedirectAddress:    *httpRedirectAddress,
+		ClientCertAuth:         certAuth,
+		Login:                  login,
+		Profiles:               profiles,
+		Policy:                 accessPolicy,
+		CSRF:                   newCSRFProtector(csrfKey),
+		Shares:                 newShareManager([]byte(randomString()), *shareMaxTTL),
+		Cgroups:                cgroups,
+		RateLimits:             newRateLimiter(rateLimits[0], rateLimits[1], rateLimits[2], *maxSessions, *maxReceivers),
+		Redaction:              redaction,
+		Chat:                   chatConfig{HistorySize: *chatHistory, Record: *recordChat, Audit: *auditChat},
+		WaitingRoomTimeout:     *waitingRoomTimeout,
+		RequireShare:           *requireShare,
+		AllowedOrigins:         allowedOrigins,
+		FrameAncestors:         frameAncestors,
+		HSTSMaxAge:             *hstsMaxAge,
+		Cookies:                cookies,
+		MetricsAddress:         *metricsAddress,
+	}
+	if *metricsEnabled {
+		var profileNames []string
+		for name := range profiles {
+			profileNames = append(profileNames, name)
+		}
+		config.Metrics = newServerMetrics(profileNames...)
 	}
 
 	server := NewTTYServer(config)
@@ -42,8 +347,12 @@ func main() {
 		server.Stop()
 	}()
 
-	log.Info("Listening on address: http://", config.WebAddress)
-	err := server.Listen()
+	if config.TLS != nil {
+		log.Info("Listening on address: https://", config.WebAddress)
+	} else {
+		log.Info("Listening on address: http://", config.WebAddress)
+	}
+	err = server.Listen()
 
 	log.Debug("Exiting. Error: ", err)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+	"github.com/gorilla/websocket"
+)
+
+// messageConn keeps the messages sent to a receiver
+type messageConn struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (conn *messageConn) Read(data []byte) (int, error) {
+	select {}
+}
+
+func (conn *messageConn) Write(data []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.buffer.Write(data)
+}
+
+func (conn *messageConn) Close() error {
+	return nil
+}
+
+// messages returns the data of the messages of a type the receiver was sent
+func (conn *messageConn) messages(t *testing.T, msgType ttyCommon.ProtocolMessageIDType) (messages [][]byte) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	decoder := json.NewDecoder(bytes.NewReader(conn.buffer.Bytes()))
+	for decoder.More() {
+		var msg ttyCommon.MsgAll
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == msgType {
+			messages = append(messages, msg.Data)
+		}
+	}
+	return
+}
+
+// output returns the output of the main window the receiver was sent
+func (conn *messageConn) output(t *testing.T) string {
+	return conn.windowOutput(t, "")
+}
+
+// joinSession makes a receiver join a session, like its websocket would, and returns the messages
+// it is sent. The receiver is anonymous and named by its ID, unless it says otherwise.
+func joinSession(session *ptyMaster, receiver *ttyReceiver, owner bool) *messageConn {
+	conn := &messageConn{}
+	receiver.conn = ttyCommon.NewTTYProtocolConn(conn)
+	if receiver.name == "" {
+		receiver.name = receiver.id
+	}
+	if receiver.identity.Name == "" {
+		receiver.identity = anonymous
+	}
+	if owner {
+		session.SetOwner(receiver)
+	}
+	if !session.waitingRoomJoin(receiver) {
+		session.attachReceiver(receiver)
+	}
+	return conn
+}
+
+// wsClient is a receiver connected to a test server with a websocket, which keeps the messages
+// it is sent
+type wsClient struct {
+	*messageConn
+	ws     *websocket.Conn
+	closed chan struct{}
+}
+
+// dialSession connects a websocket to a session of a test server
+func dialSession(t *testing.T, ttyServer *httptest.Server, path string) (*wsClient, int) {
+	ws, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ttyServer.URL, "http")+path, nil)
+	if err != nil {
+		if response == nil {
+			t.Fatal(err)
+		}
+		return nil, response.StatusCode
+	}
+	client := &wsClient{messageConn: &messageConn{}, ws: ws, closed: make(chan struct{})}
+	go func() {
+		defer close(client.closed)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			client.messageConn.Write(data)
+		}
+	}()
+	return client, http.StatusSwitchingProtocols
+}
+
+// send sends a message of the protocol to the session
+func (client *wsClient) send(t *testing.T, msg interface{}) {
+	data, err := ttyCommon.MarshalMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits until a condition holds, or fails the test
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for i := 0; !condition(); i++ {
+		if i == 100 {
+			t.Fatalf("Expected %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWebsocketSession(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{CommandName: "cat", FrontendPath: "../frontend/templates"})
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	owner, status := dialSession(t, ttyServer, "/ws/1")
+	if owner == nil {
+		t.Fatalf("Expected the session to be created, got %d", status)
+	}
+	defer server.getSession("1").Stop()
+	waitFor(t, "the owner to be told it owns the session", func() bool {
+		presence := owner.lastPresence(t)
+		return len(presence.Receivers) == 1 && presence.Receivers[0].Owner
+	})
+
+	other, _ := dialSession(t, ttyServer, "/ws/1")
+	waitFor(t, "the owner to see the other receiver join", func() bool {
+		return len(owner.messages(t, ttyCommon.MsgIDReceiverJoined)) == 1
+	})
+	other.send(t, ttyCommon.MsgTTYWrite{Data: []byte("hello\n"), Size: 6})
+	waitFor(t, "both receivers to get the output", func() bool {
+		return strings.Contains(owner.output(t), "hello") && strings.Contains(other.output(t), "hello")
+	})
+
+	other.ws.Close()
+	waitFor(t, "the owner to see the other receiver leave", func() bool {
+		return len(owner.messages(t, ttyCommon.MsgIDReceiverLeft)) == 1
+	})
+	owner.send(t, ttyCommon.MsgTTYWrite{Data: []byte("again\n"), Size: 6})
+	waitFor(t, "the owner to still get the output", func() bool {
+		return strings.Contains(owner.output(t), "again")
+	})
+
+	// The sizes which don't match the data are kept within it
+	owner.send(t, ttyCommon.MsgTTYWrite{Data: []byte("ignored\n"), Size: -1})
+	owner.send(t, ttyCommon.MsgTTYWrite{Data: []byte("bigger\n"), Size: 100})
+	waitFor(t, "the owner to get the output of the bigger size", func() bool {
+		return strings.Contains(owner.output(t), "bigger")
+	})
+	if strings.Contains(owner.output(t), "ignored") {
+		t.Errorf("Expected the input of a negative size to be dropped")
+	}
+}
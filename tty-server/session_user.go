@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// identityUsersAny is the key of the identity_users mapping applying to every identity, and,
+	// as its value, the local user named like the identity
+	identityUsersAny = "*"
+	defaultShell     = "/bin/sh"
+	// defaultMinUID is the lowest uid of the users which are not system users, on most systems
+	defaultMinUID = 1000
+)
+
+// sessionUser is the local user a session runs as
+type sessionUser struct {
+	Name   string
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+	Home   string
+	Shell  string
+}
+
+// validateUser checks the user settings of a profile
+func (profile *sessionProfile) validateUser() error {
+	settings := 0
+	if len(profile.IdentityUsers) > 0 {
+		settings++
+	}
+	if profile.User != "" {
+		settings++
+	}
+	if profile.UID != nil {
+		settings++
+	}
+	if settings > 1 {
+		return &TTYServerError{msg: "Only one of identity_users, user and uid can be set in the profile " + profile.Name}
+	}
+	if (profile.GID != nil || len(profile.Groups) > 0) && settings == 0 {
+		return &TTYServerError{msg: "The profile " + profile.Name + " has a gid or groups, but no user"}
+	}
+	return nil
+}
+
+// sessionUser returns the local user a session opened by identity runs as, or nil if it runs as
+// the server's user
+func (profile *sessionProfile) sessionUser(identity Identity) (*sessionUser, error) {
+	var u *sessionUser
+	var err error
+	switch {
+	case len(profile.IdentityUsers) > 0:
+		name, ok := profile.IdentityUsers[identity.Name]
+		if !ok {
+			name, ok = profile.IdentityUsers[identityUsersAny]
+		}
+		if !ok || identity.Method == authMethodNone {
+			return nil, &TTYServerError{msg: "No local user for " + identity.Name + " in the profile " + profile.Name}
+		}
+		sameName := name == identityUsersAny
+		if sameName {
+			name = identity.Name
+		}
+		if u, err = lookupSessionUser(name); err != nil {
+			return nil, err
+		}
+		// An identity provider shouldn't be able to log anyone in as root, or as a system user
+		if sameName && u.UID == 0 {
+			return nil, &TTYServerError{msg: "Refusing to run the session of " + identity.Name + " as root"}
+		}
+		minUID := uint32(defaultMinUID)
+		if profile.MinUID != nil {
+			minUID = *profile.MinUID
+		}
+		if sameName && u.UID < minUID {
+			return nil, &TTYServerError{msg: "Refusing to run the session of " + identity.Name + " as the system user " +
+				u.Name + ", whose uid is below " + strconv.FormatUint(uint64(minUID), 10)}
+		}
+	case profile.User != "":
+		if u, err = lookupSessionUser(profile.User); err != nil {
+			return nil, err
+		}
+	case profile.UID != nil:
+		if u, err = lookupSessionUser(strconv.FormatUint(uint64(*profile.UID), 10)); err != nil {
+			// A user without an entry in the passwd database
+			if profile.GID == nil {
+				return nil, &TTYServerError{msg: "The profile " + profile.Name + " needs a gid, as its uid has no user"}
+			}
+			u = &sessionUser{Name: strconv.FormatUint(uint64(*profile.UID), 10), UID: *profile.UID, Home: "/", Shell: defaultShell}
+		}
+	default:
+		return nil, nil
+	}
+
+	if profile.GID != nil {
+		u.GID = *profile.GID
+	}
+	if len(profile.Groups) > 0 {
+		u.Groups = profile.Groups
+	}
+	return u, nil
+}
+
+// lookupSessionUser finds a local user by name, or by uid
+func lookupSessionUser(name string) (*sessionUser, error) {
+	found, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, parseErr := strconv.ParseUint(name, 10, 32); parseErr == nil {
+			found, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, &TTYServerError{msg: "Cannot find the local user " + name + ": " + err.Error()}
+	}
+
+	uid, err := strconv.ParseUint(found.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(found.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	u := &sessionUser{
+		Name:  found.Username,
+		UID:   uint32(uid),
+		GID:   uint32(gid),
+		Home:  found.HomeDir,
+		Shell: loginShell(found.Uid),
+	}
+	groupIDs, err := found.GroupIds()
+	if err != nil {
+		log.Warnf("Cannot find the groups of %s: %s", name, err.Error())
+	}
+	for _, groupID := range groupIDs {
+		if id, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+			u.Groups = append(u.Groups, uint32(id))
+		}
+	}
+	return u, nil
+}
+
+// loginShell returns the shell of a user from /etc/passwd, which os/user doesn't tell
+func loginShell(uid string) string {
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		return defaultShell
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[2] == uid && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return defaultShell
+}
+
+// credential returns the credentials the session process is started with
+func (u *sessionUser) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: u.UID, Gid: u.GID, Groups: u.Groups}
+}
+
+// environment returns the environment of the session, which only keeps the variables of the
+// server describing the terminal and the locale, so none of the server's secrets leak to the user
+func (u *sessionUser) environment(env []string) []string {
+	userEnv := []string{
+		"HOME=" + u.Home,
+		"USER=" + u.Name,
+		"LOGNAME=" + u.Name,
+		"SHELL=" + u.Shell,
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+	}
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if name == "TERM" || name == "LANG" || name == "TZ" || strings.HasPrefix(name, "LC_") {
+			userEnv = append(userEnv, variable)
+		}
+	}
+	return append(userEnv, env...)
+}
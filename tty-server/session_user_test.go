@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionUser(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("Cannot find the current user")
+	}
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	alice := Identity{Name: "alice", Method: authMethodOIDC}
+
+	if u, err := (&sessionProfile{Name: "p"}).sessionUser(alice); u != nil || err != nil {
+		t.Errorf("Expected the session to run as the server's user, got %v %v", u, err)
+	}
+
+	byName, err := (&sessionProfile{Name: "p", User: current.Username}).sessionUser(alice)
+	if err != nil || byName.UID != uint32(uid) || byName.Home != current.HomeDir {
+		t.Fatalf("Expected the session to run as %s, got %v %v", current.Username, byName, err)
+	}
+	gid := uint32(4242)
+	byUID, err := (&sessionProfile{Name: "p", UID: &byName.UID, GID: &gid, Groups: []uint32{7}}).sessionUser(alice)
+	if err != nil || byUID.Name != current.Username || byUID.GID != gid || len(byUID.Groups) != 1 {
+		t.Errorf("Expected the uid to be found, with the gid and groups of the profile, got %v %v", byUID, err)
+	}
+	unknownUID := uint32(4242424)
+	if _, err = (&sessionProfile{Name: "p", UID: &unknownUID}).sessionUser(alice); err == nil {
+		t.Errorf("Expected an unknown uid without a gid to be refused")
+	}
+	if u, err := (&sessionProfile{Name: "p", UID: &unknownUID, GID: &gid}).sessionUser(alice); err != nil || u.UID != unknownUID {
+		t.Errorf("Expected an unknown uid with a gid to be used, got %v %v", u, err)
+	}
+
+	mapped := &sessionProfile{Name: "p", IdentityUsers: map[string]string{"alice": current.Username, "*": "*"}}
+	if u, err := mapped.sessionUser(alice); err != nil || u.Name != current.Username {
+		t.Errorf("Expected alice to be mapped to %s, got %v %v", current.Username, u, err)
+	}
+	if _, err = mapped.sessionUser(anonymous); err == nil {
+		t.Errorf("Expected the anonymous users not to be mapped")
+	}
+	if _, err = mapped.sessionUser(Identity{Name: "root", Method: authMethodOIDC}); err == nil {
+		t.Errorf("Expected root not to be mapped by its name")
+	}
+	if _, err = mapped.sessionUser(Identity{Name: "no-such-user-here", Method: authMethodOIDC}); err == nil {
+		t.Errorf("Expected an unknown local user to be refused")
+	}
+
+	// The system users are only mapped by their name below the minimum uid of the profile
+	if _, err := user.Lookup("daemon"); err == nil {
+		daemon := Identity{Name: "daemon", Method: authMethodOIDC}
+		if _, err = mapped.sessionUser(daemon); err == nil {
+			t.Errorf("Expected the system user daemon not to be mapped by its name")
+		}
+		minUID := uint32(1)
+		mapped.MinUID = &minUID
+		if u, err := mapped.sessionUser(daemon); err != nil || u.Name != "daemon" {
+			t.Errorf("Expected daemon to be mapped with a lower minimum uid, got %v %v", u, err)
+		}
+	}
+}
+
+func TestValidateSessionUser(t *testing.T) {
+	uid := uint32(1000)
+	invalid := []sessionProfile{
+		{Name: "p", User: "alice", UID: &uid},
+		{Name: "p", User: "alice", IdentityUsers: map[string]string{"*": "*"}},
+		{Name: "p", GID: &uid},
+		{Name: "p", Groups: []uint32{1}},
+	}
+	for _, profile := range invalid {
+		if err := profile.validateUser(); err == nil {
+			t.Errorf("Expected %+v to be refused", profile)
+		}
+	}
+	if err := (&sessionProfile{Name: "p", UID: &uid, GID: &uid}).validateUser(); err != nil {
+		t.Errorf("Expected a uid and a gid to be valid, got %v", err)
+	}
+}
+
+func TestSessionUserEnvironment(t *testing.T) {
+	os.Setenv("TERM", "xterm")
+	os.Setenv("TTY_SERVER_SECRET", "secret")
+	defer os.Unsetenv("TTY_SERVER_SECRET")
+	u := &sessionUser{Name: "bob", Home: "/home/bob", Shell: "/bin/bash"}
+	env := strings.Join(u.environment([]string{"TTY_SHARE=1"}), "\n")
+	for _, expected := range []string{"HOME=/home/bob", "USER=bob", "LOGNAME=bob", "SHELL=/bin/bash", "TERM=xterm", "TTY_SHARE=1"} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("Expected %s in the environment, got %s", expected, env)
+		}
+	}
+	if strings.Contains(env, "secret") {
+		t.Errorf("Expected the server's environment not to leak, got %s", env)
+	}
+}
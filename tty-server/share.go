@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	shareRoleView    = "view"
+	shareRoleControl = "control"
+
+	shareQueryName     = "share"
+	defaultShareTTL    = time.Hour
+	defaultShareMaxTTL = 7 * 24 * time.Hour
+)
+
+// The reasons a share link can't be used, which are shown to the users
+var (
+	errShareInvalid       = errors.New("This link is not valid")
+	errShareExpired       = errors.New("This link has expired")
+	errShareRevoked       = errors.New("This link has been revoked")
+	errShareUsedUp        = errors.New("This link has already been used as many times as it could")
+	errShareWrongUser     = errors.New("This link was shared with somebody else")
+	errShareNeeded        = errors.New("This session can only be joined with a share link")
+	errShareNoSuchSession = errors.New("This session doesn't exist, or has already ended")
+)
+
+// shareGrant is what a share token grants, signed by the server
+type shareGrant struct {
+	ID        string `json:"id"`
+	SessionID string `json:"session_id"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"expires_at"`
+	MaxUses   int    `json:"max_uses,omitempty"`
+	// Identity is the name of the only user who can use the token, if set
+	Identity string `json:"identity,omitempty"`
+}
+
+// shareInfo is a share link, as the API shows it
+type shareInfo struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	Uses      int       `json:"uses"`
+	Revoked   bool      `json:"revoked"`
+	// Only set when the link is created
+	Token string `json:"token,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// shareManager mints the share tokens, and keeps how many times they were used, and which ones
+// were revoked. That state is lost when the server restarts, like the sessions the tokens are for.
+type shareManager struct {
+	key    []byte
+	maxTTL time.Duration
+	lock   sync.Mutex
+	shares map[string]*shareInfo
+}
+
+func newShareManager(key []byte, maxTTL time.Duration) *shareManager {
+	if maxTTL <= 0 {
+		maxTTL = defaultShareMaxTTL
+	}
+	return &shareManager{key: key, maxTTL: maxTTL, shares: make(map[string]*shareInfo)}
+}
+
+func (manager *shareManager) mac(payload string) string {
+	mac := hmac.New(sha256.New, manager.key)
+	mac.Write([]byte("share\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Create mints a share token for a session
+func (manager *shareManager) Create(grant shareGrant, ttl time.Duration, createdBy string) (info shareInfo, err error) {
+	if grant.Role != shareRoleView && grant.Role != shareRoleControl {
+		return info, &TTYServerError{msg: "The role of a share link has to be view or control"}
+	}
+	if ttl <= 0 || ttl > manager.maxTTL {
+		return info, &TTYServerError{msg: "The share links can be valid for at most " + manager.maxTTL.String()}
+	}
+	if grant.MaxUses < 0 {
+		return info, &TTYServerError{msg: "Invalid maximum number of uses"}
+	}
+	grant.ID = randomString()[:16]
+	expiresAt := time.Now().Add(ttl)
+	grant.ExpiresAt = expiresAt.Unix()
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.prune()
+	manager.shares[grant.ID] = &shareInfo{
+		ID:        grant.ID,
+		SessionID: grant.SessionID,
+		Role:      grant.Role,
+		ExpiresAt: expiresAt,
+		MaxUses:   grant.MaxUses,
+		Identity:  grant.Identity,
+		CreatedBy: createdBy,
+	}
+	info = *manager.shares[grant.ID]
+	info.Token = payload + "." + manager.mac(payload)
+	info.URL = "/s/" + url.PathEscape(grant.SessionID) + "?" + shareQueryName + "=" + info.Token
+	return
+}
+
+// prune forgets the expired shares. It has to be called with the lock held.
+func (manager *shareManager) prune() {
+	now := time.Now()
+	for id, share := range manager.shares {
+		if now.After(share.ExpiresAt) {
+			delete(manager.shares, id)
+		}
+	}
+}
+
+// check returns what a token grants to a user, in a session, or why it can't be used. It has to be
+// called with the lock held.
+func (manager *shareManager) check(token, sessionID string, identity Identity) (*shareInfo, *shareGrant, error) {
+	separator := strings.LastIndexByte(token, '.')
+	if separator < 0 {
+		return nil, nil, errShareInvalid
+	}
+	payload, mac := token[:separator], token[separator+1:]
+	if !hmac.Equal([]byte(mac), []byte(manager.mac(payload))) {
+		return nil, nil, errShareInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil, errShareInvalid
+	}
+	var grant shareGrant
+	if err = json.Unmarshal(data, &grant); err != nil || grant.SessionID != sessionID {
+		return nil, nil, errShareInvalid
+	}
+	if time.Now().Unix() > grant.ExpiresAt {
+		return nil, nil, errShareExpired
+	}
+	share, ok := manager.shares[grant.ID]
+	if !ok {
+		// Forgotten when its session ended, or when the server restarted
+		return nil, nil, errShareNoSuchSession
+	}
+	if share.Revoked {
+		return nil, nil, errShareRevoked
+	}
+	if grant.MaxUses > 0 && share.Uses >= grant.MaxUses {
+		return nil, nil, errShareUsedUp
+	}
+	if grant.Identity != "" && (identity.Method == authMethodNone || identity.Name != grant.Identity) {
+		return nil, nil, errShareWrongUser
+	}
+	return share, &grant, nil
+}
+
+// Check tells if a token can be used by a user to join a session, without using it
+func (manager *shareManager) Check(token, sessionID string, identity Identity) (grant *shareGrant, err error) {
+	if manager == nil {
+		return nil, errShareInvalid
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	_, grant, err = manager.check(token, sessionID, identity)
+	return
+}
+
+// Use checks a token, and counts that it was used to join the session
+func (manager *shareManager) Use(token, sessionID string, identity Identity) (grant *shareGrant, err error) {
+	if manager == nil {
+		return nil, errShareInvalid
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	share, grant, err := manager.check(token, sessionID, identity)
+	if err == nil {
+		share.Uses++
+	}
+	return
+}
+
+// Revoke makes a share link unusable. The receivers which already joined with it stay connected.
+func (manager *shareManager) Revoke(sessionID, id string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	share, ok := manager.shares[id]
+	if !ok || share.SessionID != sessionID {
+		return false
+	}
+	share.Revoked = true
+	return true
+}
+
+// List returns the share links of a session which haven't expired yet
+func (manager *shareManager) List(sessionID string) []shareInfo {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.prune()
+	shares := []shareInfo{}
+	for _, share := range manager.shares {
+		if share.SessionID == sessionID {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].ExpiresAt.Before(shares[j].ExpiresAt) })
+	return shares
+}
+
+// RemoveSession forgets the share links of a session which ended
+func (manager *shareManager) RemoveSession(sessionID string) {
+	if manager == nil {
+		return
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	for id, share := range manager.shares {
+		if share.SessionID == sessionID {
+			delete(manager.shares, id)
+		}
+	}
+}
+
+// ShareErrorTemplateModel is used for templating the page shown for the share links which can't be
+// used
+type ShareErrorTemplateModel struct {
+	Reason string
+}
+
+func (server *TTYServer) renderShareError(w http.ResponseWriter, err error) {
+	t, terr := server.loadTemplate("share-error.in.html")
+
+	if terr != nil {
+		panic("Cannot parse the share-error html template")
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	terr = t.Execute(w, ShareErrorTemplateModel{Reason: err.Error()})
+
+	if terr != nil {
+		panic("Cannot execute the share-error html template")
+	}
+}
+
+type shareRequest struct {
+	Role      string `json:"role"`
+	ExpiresIn string `json:"expires_in"`
+	MaxUses   int    `json:"max_uses"`
+	Identity  string `json:"identity"`
+}
+
+// sharedSession returns the session of a request on its share links, if the user making it can
+// share the session: its owner, logged in, or an admin. The request is failed otherwise.
+func (server *TTYServer) sharedSession(w http.ResponseWriter, r *http.Request) *ptyMaster {
+	session := server.getSession(mux.Vars(r)["sessionID"])
+	if server.config.Shares == nil || session == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	identity := server.identify(r)
+	if !session.IsOwnedBy(identity) && !server.config.Policy.IsAdmin(identity, session.GetProfile()) {
+		log.Warnf("Refused %s managing the share links of session %s, which they don't own", identity.Name, session.GetSessionID())
+		http.Error(w, "Only the owner of the session, logged in, or an admin can share it", http.StatusForbidden)
+		return nil
+	}
+	return session
+}
+
+// canSeeSession tells if a request can see what happens in a session, through the API. Any request
+// can, unless the server requires share links, in which case only the owner of the session, logged
+// in, an admin, or a request with a valid share link of the session can.
+func (server *TTYServer) canSeeSession(r *http.Request, session *ptyMaster) bool {
+	if !server.config.RequireShare {
+		return true
+	}
+	identity := server.identify(r)
+	if session.IsOwnedBy(identity) || server.config.Policy.IsAdmin(identity, session.GetProfile()) {
+		return true
+	}
+	_, err := server.config.Shares.Check(r.URL.Query().Get(shareQueryName), session.GetSessionID(), identity)
+	return err == nil
+}
+
+// seenSession returns the session of a request, if the request can see it. The request is failed
+// otherwise.
+func (server *TTYServer) seenSession(w http.ResponseWriter, r *http.Request) *ptyMaster {
+	session := server.getSession(mux.Vars(r)["sessionID"])
+	if session == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if !server.canSeeSession(r, session) {
+		log.Warnf("Refused %s seeing session %s without a share link", server.identify(r).Name, session.GetSessionID())
+		http.Error(w, errShareNeeded.Error(), http.StatusForbidden)
+		return nil
+	}
+	return session
+}
+
+// handleShareCreate creates a share link for a session, from the JSON request
+func (server *TTYServer) handleShareCreate(w http.ResponseWriter, r *http.Request) {
+	session := server.sharedSession(w, r)
+	if session == nil {
+		return
+	}
+	request := shareRequest{Role: shareRoleView}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultShareTTL
+	if request.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.ExpiresIn); err != nil {
+			http.Error(w, "Invalid expires_in: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	createdBy := server.identify(r).Name
+	info, err := server.config.Shares.Create(shareGrant{
+		SessionID: session.GetSessionID(),
+		Role:      request.Role,
+		MaxUses:   request.MaxUses,
+		Identity:  request.Identity,
+	}, ttl, createdBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("%s shared session %s with the %s role, until %s (share %s)", createdBy,
+		info.SessionID, info.Role, info.ExpiresAt.Format(time.RFC3339), info.ID)
+	writeJSONStatus(w, http.StatusCreated, info)
+}
+
+// handleShareList sends the share links of a session, without their tokens, as JSON
+func (server *TTYServer) handleShareList(w http.ResponseWriter, r *http.Request) {
+	session := server.sharedSession(w, r)
+	if session == nil {
+		return
+	}
+	writeJSON(w, server.config.Shares.List(session.GetSessionID()))
+}
+
+func (server *TTYServer) handleShareRevoke(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if server.sharedSession(w, r) == nil {
+		return
+	}
+	if !server.config.Shares.Revoke(vars["sessionID"], vars["shareID"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Infof("%s revoked the share %s of session %s", server.identify(r).Name, vars["shareID"], vars["sessionID"])
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareTokens(t *testing.T) {
+	manager := newShareManager([]byte("test key"), time.Hour)
+	bob := Identity{Name: "bob", Method: authMethodOIDC}
+
+	if _, err := manager.Create(shareGrant{SessionID: "1", Role: "admin"}, time.Minute, "alice"); err == nil {
+		t.Errorf("Expected an unknown role to be refused")
+	}
+	if _, err := manager.Create(shareGrant{SessionID: "1", Role: shareRoleView}, 2*time.Hour, "alice"); err == nil {
+		t.Errorf("Expected a link valid for longer than the maximum to be refused")
+	}
+
+	share, err := manager.Create(shareGrant{SessionID: "1", Role: shareRoleControl, MaxUses: 2}, time.Minute, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if grant, err := manager.Use(share.Token, "1", anonymous); err != nil || grant.Role != shareRoleControl {
+			t.Fatalf("Expected use %d to be allowed, got %v", i+1, err)
+		}
+	}
+	if _, err = manager.Use(share.Token, "1", anonymous); err != errShareUsedUp {
+		t.Errorf("Expected the link to be used up, got %v", err)
+	}
+	if _, err = manager.Check(share.Token, "2", anonymous); err != errShareInvalid {
+		t.Errorf("Expected the link not to be valid for another session, got %v", err)
+	}
+
+	bound, _ := manager.Create(shareGrant{SessionID: "1", Role: shareRoleView, Identity: "bob"}, time.Minute, "alice")
+	if _, err = manager.Check(bound.Token, "1", anonymous); err != errShareWrongUser {
+		t.Errorf("Expected the link to be refused to somebody else, got %v", err)
+	}
+	if _, err = manager.Check(bound.Token, "1", bob); err != nil {
+		t.Errorf("Expected the link to be accepted for bob, got %v", err)
+	}
+	// The role can't be changed without breaking the signature
+	payload, _ := json.Marshal(shareGrant{ID: bound.ID, SessionID: "1", Role: shareRoleControl, ExpiresAt: bound.ExpiresAt.Unix(), Identity: "bob"})
+	forged := base64.RawURLEncoding.EncodeToString(payload) + bound.Token[strings.LastIndexByte(bound.Token, '.'):]
+	if _, err = manager.Check(forged, "1", bob); err != errShareInvalid {
+		t.Errorf("Expected a forged link to be refused, got %v", err)
+	}
+
+	if !manager.Revoke("1", bound.ID) {
+		t.Fatalf("Expected the link to be revoked")
+	}
+	if _, err = manager.Check(bound.Token, "1", bob); err != errShareRevoked {
+		t.Errorf("Expected the link to be revoked, got %v", err)
+	}
+
+	// An expired token, signed by the server
+	payload, _ = json.Marshal(shareGrant{ID: share.ID, SessionID: "1", Role: shareRoleView, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	if _, err = manager.Check(encoded+"."+manager.mac(encoded), "1", anonymous); err != errShareExpired {
+		t.Errorf("Expected the link to be expired, got %v", err)
+	}
+
+	manager.RemoveSession("1")
+	if shares := manager.List("1"); len(shares) != 0 {
+		t.Errorf("Expected the links of the session to be forgotten, got %v", shares)
+	}
+}
+
+func TestShareAPI(t *testing.T) {
+	cookies := newCookieSigner([]byte("test secret"))
+	server := NewTTYServer(TTYServerConfig{
+		Shares:       newShareManager([]byte("test key"), time.Hour),
+		RequireShare: true,
+		Cookies:      cookies,
+		FrontendPath: "../frontend/templates",
+	})
+	bob := Identity{Name: "bob", Role: defaultRole, Method: authMethodOIDC}
+	session := ptyMasterNew("1")
+	session.SetOwner(&ttyReceiver{id: "r1", identity: bob})
+	server.addSession("1", session)
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+
+	request := func(method, path, body string, identity Identity) (int, string) {
+		r, _ := http.NewRequest(method, ttyServer.URL+path, strings.NewReader(body))
+		if identity.Method != authMethodNone {
+			encoded, _ := cookies.Encode(authCookieName, identity, time.Hour)
+			r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusCreated && response.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON response, got %s", response.Header.Get("Content-Type"))
+		}
+		data, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(data)
+	}
+
+	if status, body := request("GET", "/s/1", "", anonymous); status != http.StatusForbidden || !strings.Contains(body, errShareNeeded.Error()) {
+		t.Errorf("Expected the session to need a share link, got %d", status)
+	}
+
+	// Only the owner shares the session
+	alice := Identity{Name: "alice", Role: defaultRole, Method: authMethodOIDC}
+	for _, identity := range []Identity{anonymous, alice} {
+		if status, _ := request("POST", "/api/sessions/1/shares", `{"role": "control"}`, identity); status != http.StatusForbidden {
+			t.Errorf("Expected %s not to share the session, got %d", identity.Name, status)
+		}
+		if status, _ := request("GET", "/api/sessions/1/shares", "", identity); status != http.StatusForbidden {
+			t.Errorf("Expected %s not to list the links, got %d", identity.Name, status)
+		}
+	}
+
+	status, body := request("POST", "/api/sessions/1/shares", `{"role": "view", "expires_in": "10m", "max_uses": 1}`, bob)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected the link to be created, got %d %s", status, body)
+	}
+	var share shareInfo
+	json.Unmarshal([]byte(body), &share)
+
+	if status, body := request("GET", share.URL, "", anonymous); status != http.StatusOK || !strings.Contains(body, "share="+share.Token) {
+		t.Errorf("Expected the share link to show the session, got %d", status)
+	}
+	if status, body := request("GET", "/api/sessions/1/shares", "", bob); status != http.StatusOK || !strings.Contains(body, share.ID) ||
+		strings.Contains(body, share.Token) {
+		t.Errorf("Expected the link to be listed without its token, got %d %s", status, body)
+	}
+
+	// What happens in the session is only seen by its owner, or with a share link
+	for _, path := range []string{"/api/sessions/1/commands", "/api/sessions/1/transcript"} {
+		if status, _ := request("GET", path, "", alice); status != http.StatusForbidden {
+			t.Errorf("Expected alice not to get %s without a share link, got %d", path, status)
+		}
+		for _, allowed := range []struct {
+			path     string
+			identity Identity
+		}{{path, bob}, {path + "?share=" + share.Token, anonymous}} {
+			if status, _ := request("GET", allowed.path, "", allowed.identity); status != http.StatusOK {
+				t.Errorf("Expected %s to get %s, got %d", allowed.identity.Name, allowed.path, status)
+			}
+		}
+	}
+	if _, body := request("GET", "/api/sessions", "", alice); body != "[]" {
+		t.Errorf("Expected alice not to see the session, got %s", body)
+	}
+	if _, body := request("GET", "/api/sessions", "", bob); !strings.Contains(body, `"id":"1"`) {
+		t.Errorf("Expected bob to see the session, got %s", body)
+	}
+
+	if status, _ := request("DELETE", "/api/sessions/1/shares/"+share.ID, "", alice); status != http.StatusForbidden {
+		t.Errorf("Expected somebody else not to revoke the link, got %d", status)
+	}
+	if status, _ := request("DELETE", "/api/sessions/1/shares/"+share.ID, "", bob); status != http.StatusNoContent {
+		t.Fatalf("Expected the link to be revoked, got %d", status)
+	}
+	if status, body := request("GET", share.URL, "", anonymous); status != http.StatusForbidden || !strings.Contains(body, errShareRevoked.Error()) {
+		t.Errorf("Expected the revoked link to show an error page, got %d", status)
+	}
+}
+
+func TestShareLinkUsedOnceAdmitted(t *testing.T) {
+	server := NewTTYServer(TTYServerConfig{
+		Shares:       newShareManager([]byte("test key"), time.Hour),
+		RequireShare: true,
+		FrontendPath: "../frontend/templates",
+	})
+	session := ptyMasterNew("1")
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+	server.addSession("1", session)
+	ttyServer := httptest.NewServer(server.httpServer.Handler)
+	defer ttyServer.Close()
+	share, err := server.config.Shares.Create(shareGrant{SessionID: "1", Role: shareRoleView, MaxUses: 1}, time.Minute, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses := func() int {
+		return server.config.Shares.List("1")[0].Uses
+	}
+
+	// A banned user is refused, without using up the link
+	session.bans.lock.Lock()
+	session.bans.addresses["127.0.0.1"] = true
+	session.bans.lock.Unlock()
+	if client, status := dialSession(t, ttyServer, "/ws/1?share="+share.Token); client != nil || status != http.StatusForbidden {
+		t.Fatalf("Expected the banned user to be refused, got %d", status)
+	}
+	if uses() != 0 {
+		t.Fatalf("Expected the refused join not to use the link, got %d uses", uses())
+	}
+
+	session.bans.lock.Lock()
+	delete(session.bans.addresses, "127.0.0.1")
+	session.bans.lock.Unlock()
+	client, status := dialSession(t, ttyServer, "/ws/1?share="+share.Token)
+	if client == nil {
+		t.Fatalf("Expected the share link to join the session, got %d", status)
+	}
+	defer client.ws.Close()
+	if uses() != 1 {
+		t.Fatalf("Expected the link to be used once, got %d uses", uses())
+	}
+	if _, status = dialSession(t, ttyServer, "/ws/1?share="+share.Token); status != http.StatusForbidden {
+		t.Fatalf("Expected the used up link to be refused, got %d", status)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The bash integration is loaded with --rcfile, instead of ~/.bashrc, so it loads the user's files
+// first. PS0 marks the start of the output, which is where the command line is reported.
+const bashIntegration = `[ -f /etc/bash.bashrc ] && . /etc/bash.bashrc
+[ -f ~/.bashrc ] && . ~/.bashrc
+
+__tty_share_urlencode() {
+	local LC_ALL=C s="$1" out="" c i
+	for ((i = 0; i < ${#s}; i++)); do
+		c="${s:i:1}"
+		case "$c" in
+		[a-zA-Z0-9._~/-]) out+="$c" ;;
+		*) printf -v c '%%%02X' "'$c"; out+="$c" ;;
+		esac
+	done
+	printf '%s' "$out"
+}
+
+__tty_share_preexec() {
+	local cmd
+	cmd="$(HISTTIMEFORMAT= builtin history 1 | sed 's/^ *[0-9]*[* ] *//')"
+	printf '\033]133;C;cmdline_url=%s\007' "$(__tty_share_urlencode "$cmd")"
+}
+
+__tty_share_precmd() {
+	local ret=$?
+	if [ -n "$__tty_share_prompted" ]; then
+		printf '\033]133;D;%s\007' "$ret"
+	fi
+	__tty_share_prompted=1
+	printf '\033]133;A\007'
+	return $ret
+}
+
+PROMPT_COMMAND="__tty_share_precmd${PROMPT_COMMAND:+; $PROMPT_COMMAND}"
+PS1="$PS1\[\033]133;B\007\]"
+PS0='$(__tty_share_preexec)'"$PS0"
+`
+
+// The zsh integration is loaded by pointing ZDOTDIR to its folder. Each of its files loads the
+// user's file with the same name, and .zshrc restores ZDOTDIR at the end.
+const zshIntegrationEnv = `[ -f "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zshenv" ] && . "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zshenv"
+`
+
+const zshIntegrationProfile = `[ -f "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zprofile" ] && . "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zprofile"
+`
+
+const zshIntegrationRC = `[ -f "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zshrc" ] && . "${TTY_SHARE_USER_ZDOTDIR:-$HOME}/.zshrc"
+
+__tty_share_preexec() {
+	emulate -L zsh
+	setopt extendedglob
+	local cmd="$1" out="" c i b
+	for ((i = 1; i <= ${#cmd}; i++)); do
+		c="${cmd[i]}"
+		if [[ "$c" == [a-zA-Z0-9._~/-] ]]; then
+			out+="$c"
+		else
+			for b in ${(s: :)"$(printf '%s' "$c" | od -An -tx1)"}; do
+				out+="%${(U)b}"
+			done
+		fi
+	done
+	__tty_share_running=1
+	printf '\033]133;C;cmdline_url=%s\007' "$out"
+}
+
+__tty_share_precmd() {
+	local ret=$?
+	if [ -n "$__tty_share_running" ]; then
+		printf '\033]133;D;%s\007' "$ret"
+	fi
+	unset __tty_share_running
+	printf '\033]133;A\007'
+}
+
+autoload -Uz add-zsh-hook
+add-zsh-hook preexec __tty_share_preexec
+add-zsh-hook precmd __tty_share_precmd
+PS1="$PS1%{$(printf '\033]133;B\007')%}"
+
+if [ -n "$TTY_SHARE_USER_ZDOTDIR" ]; then
+	ZDOTDIR="$TTY_SHARE_USER_ZDOTDIR"
+else
+	unset ZDOTDIR
+fi
+unset TTY_SHARE_USER_ZDOTDIR
+`
+
+// shellIntegration makes bash and zsh mark the prompts and the commands in their output, so the
+// server can tell where each command starts and ends, and what its exit code was. The scripts are
+// written in a temporary folder when the server starts.
+type shellIntegration struct {
+	dir string
+}
+
+func newShellIntegration() (integration *shellIntegration, err error) {
+	dir, err := ioutil.TempDir("", "tty-server-shell")
+	if err != nil {
+		return
+	}
+	// The sessions running as other users read the files too
+	if err = os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return
+	}
+	files := map[string]string{
+		"bashrc":        bashIntegration,
+		"zsh/.zshenv":   zshIntegrationEnv,
+		"zsh/.zprofile": zshIntegrationProfile,
+		"zsh/.zshrc":    zshIntegrationRC,
+	}
+	if err = os.Mkdir(filepath.Join(dir, "zsh"), 0755); err != nil {
+		os.RemoveAll(dir)
+		return
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			return
+		}
+	}
+	return &shellIntegration{dir: dir}, nil
+}
+
+// Wrap changes the command line and the environment of a shell so it loads the integration. Other
+// commands, and shells the integration can't be injected in, are returned unchanged.
+func (integration *shellIntegration) Wrap(command string, args []string) (string, []string, []string) {
+	if integration == nil {
+		return command, args, nil
+	}
+
+	switch filepath.Base(command) {
+	case "bash":
+		// Login shells, and shells running a script or a command, don't read the rc file
+		for _, arg := range args {
+			if arg == "-l" || arg == "--login" || arg == "-c" || !strings.HasPrefix(arg, "-") {
+				log.Debugf("Not loading the shell integration in: %s %s", command, strings.Join(args, " "))
+				return command, args, nil
+			}
+		}
+		return command, append([]string{"--rcfile", filepath.Join(integration.dir, "bashrc")}, args...), nil
+	case "zsh":
+		env := []string{"ZDOTDIR=" + filepath.Join(integration.dir, "zsh")}
+		if userZDOTDIR, ok := os.LookupEnv("ZDOTDIR"); ok {
+			env = append(env, "TTY_SHARE_USER_ZDOTDIR="+userZDOTDIR)
+		}
+		return command, args, env
+	}
+	return command, args, nil
+}
+
+// Close removes the integration scripts
+func (integration *shellIntegration) Close() error {
+	if integration == nil {
+		return nil
+	}
+	return os.RemoveAll(integration.dir)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How often, at most, the certificate files are checked for changes
+const certificateCheckInterval = time.Second
+
+// TLSConfig configures where the server gets its certificate from: either from a certificate and
+// a key file, or from an ACME CA, like Let's Encrypt
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ACMEDomains are the domains the certificates are requested for. ACME is only used if this
+	// is not empty.
+	ACMEDomains []string
+	ACMEEmail   string
+	// ACMECacheDir is where the account key and the certificates are kept between restarts
+	ACMECacheDir string
+	// ACMEDirectoryURL is the directory of the ACME CA. Defaults to Let's Encrypt.
+	ACMEDirectoryURL string
+	// ACMECARootsFile holds the PEM encoded certificates used to verify the ACME server itself,
+	// e.g. the one of a local test CA like Pebble. The system roots are used if this is empty.
+	ACMECARootsFile string
+	// ClientCAFile holds the PEM encoded CA certificates the client certificates are verified
+	// with. The clients are not asked for a certificate if this is empty.
+	ClientCAFile string
+	// ClientCertOptional lets the clients connect without a certificate. The certificates they
+	// do send are still verified.
+	ClientCertOptional bool
+}
+
+// tlsProvider gives the TLS configuration of the server, and the HTTP handler answering the ACME
+// challenges, when ACME is used
+type tlsProvider struct {
+	tlsConfig   *tls.Config
+	acmeManager *autocert.Manager
+}
+
+func newTLSProvider(config TLSConfig) (provider *tlsProvider, err error) {
+	provider = &tlsProvider{}
+
+	if len(config.ACMEDomains) > 0 {
+		if config.CertFile != "" || config.KeyFile != "" {
+			return nil, &TTYServerError{msg: "A certificate file and ACME can't be used at the same time"}
+		}
+		client := &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+		if config.ACMECARootsFile != "" {
+			var pemData []byte
+			if pemData, err = ioutil.ReadFile(config.ACMECARootsFile); err != nil {
+				return nil, err
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pemData) {
+				return nil, &TTYServerError{msg: "No certificates found in " + config.ACMECARootsFile}
+			}
+			client.HTTPClient = &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+		}
+		provider.acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+			Email:      config.ACMEEmail,
+			Client:     client,
+		}
+		if config.ACMECacheDir != "" {
+			provider.acmeManager.Cache = autocert.DirCache(config.ACMECacheDir)
+		}
+		provider.tlsConfig = provider.acmeManager.TLSConfig()
+	} else {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, &TTYServerError{msg: "Both a certificate and a key file are needed for TLS"}
+		}
+		var reloader *certificateReloader
+		if reloader, err = newCertificateReloader(config.CertFile, config.KeyFile); err != nil {
+			return nil, err
+		}
+		provider.tlsConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	if err = provider.setClientAuth(config); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// setClientAuth makes the server ask the clients for certificates, signed by the client CAs
+func (provider *tlsProvider) setClientAuth(config TLSConfig) error {
+	if config.ClientCAFile == "" {
+		return nil
+	}
+	pemData, err := ioutil.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pemData) {
+		return &TTYServerError{msg: "No certificates found in " + config.ClientCAFile}
+	}
+	provider.tlsConfig.ClientCAs = clientCAs
+	provider.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.ClientCertOptional {
+		provider.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// TLSConfig returns the configuration the HTTPS server is started with
+func (provider *tlsProvider) TLSConfig() *tls.Config {
+	return provider.tlsConfig
+}
+
+// HTTPHandler answers the ACME HTTP challenges, and passes all the other requests to fallback
+func (provider *tlsProvider) HTTPHandler(fallback http.Handler) http.Handler {
+	if provider.acmeManager == nil {
+		return fallback
+	}
+	return provider.acmeManager.HTTPHandler(fallback)
+}
+
+// certificateReloader serves a certificate loaded from files, and loads it again when the files
+// change, so renewed certificates are used without restarting the server
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (reloader *certificateReloader, err error) {
+	reloader = &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err = reloader.reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (reloader *certificateReloader) reload() error {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	if reloader.certificate != nil {
+		log.Infof("Loaded the new certificate from %s", reloader.certFile)
+	}
+	reloader.certificate = &certificate
+	reloader.certModTime, reloader.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate returns the current certificate, checking first if the files changed
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	if time.Since(reloader.lastCheck) >= certificateCheckInterval {
+		reloader.lastCheck = time.Now()
+		// While the files are being replaced, the certificate and the key might not match. The
+		// previous certificate is kept until they do.
+		if err := reloader.reload(); err != nil {
+			log.Warnf("Cannot load the certificate from %s: %s", reloader.certFile, err.Error())
+		}
+	}
+	return reloader.certificate, nil
+}
+
+// httpsRedirectHandler redirects the requests to the same URL over HTTPS, on the port of the
+// HTTPS server
+func httpsRedirectHandler(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self signed certificate for name, and its key, in PEM files
+func writeTestCertificate(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certFile != "" {
+		ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+		os.Chtimes(certFile, modTime, modTime)
+	}
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func certificateName(t *testing.T, reloader *certificateReloader) string {
+	reloader.lastCheck = time.Time{}
+	certificate, _ := reloader.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	writeTestCertificate(t, certFile, keyFile, "first", now.Add(-time.Minute))
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Cannot load the certificate: %s", err.Error())
+	}
+	if name := certificateName(t, reloader); name != "first" {
+		t.Fatalf("Unexpected certificate: %s", name)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second", now)
+	if name := certificateName(t, reloader); name != "second" {
+		t.Fatalf("The changed certificate was not loaded, got %s", name)
+	}
+
+	// A key not matching the certificate, like in the middle of a renewal, keeps the old one
+	writeTestCertificate(t, "", keyFile, "third", now.Add(time.Minute))
+	if name := certificateName(t, reloader); name != "second" {
+		t.Fatalf("Expected the previous certificate to be kept, got %s", name)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for address, expected := range map[string]string{
+		":443":  "https://example.com/s/1?a=b",
+		":8443": "https://example.com:8443/s/1?a=b",
+	} {
+		recorder := httptest.NewRecorder()
+		httpsRedirectHandler(address).ServeHTTP(recorder, httptest.NewRequest("GET", "http://example.com:80/s/1?a=b", nil))
+		if location := recorder.Header().Get("Location"); location != expected {
+			t.Fatalf("Unexpected redirect for %s: %s", address, location)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	transcriptFormatText = "text"
+	transcriptFormatHTML = "html"
+)
+
+// transcriptEvent is a piece of the output of a session, or a change of its window size when cols
+// and rows are set. The time is in seconds from the start of the session, and the offset is the
+// number of bytes of output of the same window before the event. The window is empty for the main
+// window of the session.
+type transcriptEvent struct {
+	time       float64
+	offset     int64
+	window     string
+	data       []byte
+	cols, rows int
+}
+
+// outputHistory keeps the last output of a live session, so transcripts can be exported from it.
+// All the methods can be called on a nil outputHistory, which keeps nothing.
+type outputHistory struct {
+	lock      sync.Mutex
+	startTime time.Time
+	maxSize   int
+	size      int
+	// The number of bytes of output of each window so far, by its ID
+	offsets map[string]int64
+	events  []transcriptEvent
+	// The last window size change dropped from the history, which the oldest output is shown with
+	droppedResize *transcriptEvent
+}
+
+func newOutputHistory(maxSize int) *outputHistory {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &outputHistory{startTime: time.Now(), maxSize: maxSize, offsets: make(map[string]int64)}
+}
+
+func (history *outputHistory) add(event transcriptEvent) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	event.time = time.Since(history.startTime).Seconds()
+	event.offset = history.offsets[event.window]
+	history.offsets[event.window] += int64(len(event.data))
+	history.size += len(event.data)
+	history.events = append(history.events, event)
+
+	dropped := 0
+	for history.size > history.maxSize && dropped < len(history.events)-1 {
+		if history.events[dropped].cols > 0 {
+			resize := history.events[dropped]
+			history.droppedResize = &resize
+		}
+		history.size -= len(history.events[dropped].data)
+		dropped++
+	}
+	history.events = history.events[dropped:]
+}
+
+// WriteOutput adds output of the session to the history
+func (history *outputHistory) WriteOutput(data []byte) {
+	if history == nil {
+		return
+	}
+	history.add(transcriptEvent{data: append([]byte(nil), data...)})
+}
+
+// WriteWindowOutput adds output of a window of the session, besides the main one, to the history
+func (history *outputHistory) WriteWindowOutput(window string, data []byte) {
+	if history == nil {
+		return
+	}
+	history.add(transcriptEvent{window: window, data: append([]byte(nil), data...)})
+}
+
+// Resize adds a change of the window size to the history
+func (history *outputHistory) Resize(cols, rows int) {
+	if history == nil || cols <= 0 || rows <= 0 {
+		return
+	}
+	history.add(transcriptEvent{cols: cols, rows: rows})
+}
+
+// Events returns the events in the history, the oldest first
+func (history *outputHistory) Events() []transcriptEvent {
+	if history == nil {
+		return nil
+	}
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	events := make([]transcriptEvent, 0, len(history.events)+1)
+	if history.droppedResize != nil {
+		resize := *history.droppedResize
+		if len(history.events) > 0 {
+			resize.time, resize.offset = history.events[0].time, history.events[0].offset
+		}
+		events = append(events, resize)
+	}
+	return append(events, history.events...)
+}
+
+// transcriptRange selects the part of a session a transcript is made of, by time (in seconds from
+// the start of the session) and by output offset (in bytes), and the window it is the output of,
+// which is empty for the main window. The ends are ignored when negative.
+type transcriptRange struct {
+	window     string
+	fromTime   float64
+	toTime     float64
+	fromOffset int64
+	toOffset   int64
+}
+
+// transcriptBuilder plays the output of a session on a vtScreen, and collects the lines that were
+// shown within the range: the ones scrolled off the top of the screen, and what is left on the
+// screen at the end. Cursor movements and redraws are applied to the screen first, so the
+// transcript holds what was displayed, and not the raw control sequences.
+type transcriptBuilder struct {
+	screen    *vtScreen
+	txRange   transcriptRange
+	started   bool
+	finished  bool
+	startLine int
+	lines     [][]vtCell
+}
+
+func newTranscriptBuilder(txRange transcriptRange) *transcriptBuilder {
+	builder := &transcriptBuilder{
+		screen:  newVTScreen(0, 0),
+		txRange: txRange,
+	}
+	builder.screen.onScrollOut = builder.scrolledOut
+	// A range ending before it starts is empty
+	builder.finished = (txRange.toTime >= 0 && txRange.fromTime > txRange.toTime) ||
+		(txRange.toOffset >= 0 && txRange.fromOffset > txRange.toOffset)
+	return builder
+}
+
+func (builder *transcriptBuilder) scrolledOut(line []vtCell) {
+	if !builder.started {
+		return
+	}
+	// The lines above the one the range started on are not part of it
+	if builder.startLine > 0 {
+		builder.startLine--
+		return
+	}
+	builder.lines = append(builder.lines, line)
+}
+
+func (builder *transcriptBuilder) start() {
+	builder.started = true
+	builder.startLine = builder.screen.cy
+	if builder.screen.altActive {
+		builder.startLine = 0
+	}
+}
+
+// Add plays an event of the session. The output of the other windows is skipped, but the window
+// size changes apply to all of them, and their offsets are the ones of the main window.
+func (builder *transcriptBuilder) Add(event transcriptEvent) {
+	txRange := builder.txRange
+	if event.cols == 0 && event.window != txRange.window {
+		return
+	}
+	ownOffset := event.cols == 0 || txRange.window == ""
+	if builder.finished || (txRange.toTime >= 0 && event.time > txRange.toTime) ||
+		(ownOffset && txRange.toOffset >= 0 && event.offset >= txRange.toOffset) {
+		builder.finished = true
+		return
+	}
+	if event.cols > 0 {
+		builder.screen.Resize(event.cols, event.rows)
+		return
+	}
+
+	data := event.data
+	if !builder.started && event.time >= txRange.fromTime {
+		// The range might start in the middle of this output
+		if skip := txRange.fromOffset - event.offset; skip < int64(len(data)) {
+			if skip < 0 {
+				skip = 0
+			}
+			builder.screen.Write(data[:skip])
+			data = data[skip:]
+			event.offset += skip
+			builder.start()
+		}
+	}
+	if builder.started && txRange.toOffset >= 0 && event.offset+int64(len(data)) > txRange.toOffset {
+		end := txRange.toOffset - event.offset
+		if end < 0 {
+			end = 0
+		}
+		data = data[:end]
+		builder.finished = true
+	}
+	builder.screen.Write(data)
+}
+
+// Lines returns the lines of the transcript
+func (builder *transcriptBuilder) Lines() [][]vtCell {
+	if !builder.started {
+		return nil
+	}
+	screenLines := builder.screen.lines
+	if builder.screen.altActive {
+		screenLines = builder.screen.mainLines
+	}
+	lines := append(builder.lines, screenLines[minInt(builder.startLine, len(screenLines)):]...)
+
+	// The empty lines at the bottom of the screen are not part of the transcript
+	for len(lines) > 0 && transcriptLineEnd(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// transcriptLineEnd returns the length of a line, without the blank cells at the end
+func transcriptLineEnd(line []vtCell) int {
+	end := len(line)
+	for end > 0 && (line[end-1].r == 0 || line[end-1].r == ' ') && line[end-1].attr.bg == vtColorDefault {
+		end--
+	}
+	return end
+}
+
+// renderTranscriptText writes the transcript as plain text, without any colors or attributes
+func renderTranscriptText(w io.Writer, lines [][]vtCell) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		for _, cell := range line[:transcriptLineEnd(line)] {
+			if cell.r == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteRune(cell.r)
+			}
+		}
+		// Without colors, the blanks left at the end of the line are not needed either
+		trimmed := bytes.TrimRight(buf.Bytes(), " ")
+		buf.Truncate(len(trimmed))
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// The colors the HTML transcripts are rendered with, which are xterm's
+var transcriptBaseColors = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+const (
+	transcriptForeground = "#e5e5e5"
+	transcriptBackground = "#000000"
+)
+
+// transcriptColor returns the CSS color of a vtScreen color
+func transcriptColor(color int32, def string) string {
+	switch {
+	case color == vtColorDefault:
+		return def
+	case color&vtColorRGB != 0:
+		return fmt.Sprintf("#%06x", color&0xffffff)
+	case color < 16:
+		return transcriptBaseColors[color]
+	case color < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		color -= 16
+		return fmt.Sprintf("#%02x%02x%02x", levels[color/36], levels[color/6%6], levels[color%6])
+	default:
+		level := 8 + 10*int(color-232)
+		return fmt.Sprintf("#%02x%02x%02x", level, level, level)
+	}
+}
+
+// transcriptStyle returns the inline CSS style of the cells with the given attributes
+func transcriptStyle(attr vtAttr) string {
+	fg := transcriptColor(attr.fg, transcriptForeground)
+	bg := transcriptColor(attr.bg, transcriptBackground)
+	// Bold text with one of the first 8 colors is shown with the bright version, like xterm does
+	if attr.flags&vtAttrBold != 0 && attr.fg >= 0 && attr.fg < 8 {
+		fg = transcriptBaseColors[attr.fg+8]
+	}
+	if attr.flags&vtAttrReverse != 0 {
+		fg, bg = bg, fg
+	}
+
+	var styles []string
+	if fg != transcriptForeground {
+		styles = append(styles, "color:"+fg)
+	}
+	if bg != transcriptBackground {
+		styles = append(styles, "background-color:"+bg)
+	}
+	if attr.flags&vtAttrBold != 0 {
+		styles = append(styles, "font-weight:bold")
+	}
+	if attr.flags&vtAttrFaint != 0 {
+		styles = append(styles, "opacity:0.6")
+	}
+	if attr.flags&vtAttrItalic != 0 {
+		styles = append(styles, "font-style:italic")
+	}
+	var decorations []string
+	if attr.flags&vtAttrUnderline != 0 {
+		decorations = append(decorations, "underline")
+	}
+	if attr.flags&vtAttrStrike != 0 {
+		decorations = append(decorations, "line-through")
+	}
+	if len(decorations) > 0 {
+		styles = append(styles, "text-decoration:"+strings.Join(decorations, " "))
+	}
+	if attr.flags&vtAttrHidden != 0 {
+		styles = append(styles, "visibility:hidden")
+	}
+	return strings.Join(styles, ";")
+}
+
+// renderTranscriptHTML writes the transcript as a standalone HTML document, keeping the colors
+// and the text attributes
+func renderTranscriptHTML(w io.Writer, title string, lines [][]vtCell) error {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>")
+	buf.WriteString(html.EscapeString(title))
+	buf.WriteString("</title>\n<style>\nbody { margin: 0; background-color: " + transcriptBackground + "; }\n" +
+		"pre { margin: 0; padding: 1em; color: " + transcriptForeground + "; background-color: " +
+		transcriptBackground + "; font-family: monospace; line-height: 1.2; }\n</style>\n</head>\n<body>\n<pre>")
+
+	for _, line := range lines {
+		style := ""
+		open := false
+		for _, cell := range line[:transcriptLineEnd(line)] {
+			if cellStyle := transcriptStyle(cell.attr); cellStyle != style || !open {
+				if open {
+					buf.WriteString("</span>")
+				}
+				style = cellStyle
+				buf.WriteString("<span")
+				if style != "" {
+					buf.WriteString(" style=\"" + style + "\"")
+				}
+				buf.WriteString(">")
+				open = true
+			}
+			if cell.r == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteString(html.EscapeString(string(cell.r)))
+			}
+		}
+		if open {
+			buf.WriteString("</span>")
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("</pre>\n</body>\n</html>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// recordingTranscriptEvents reads the events of a recording, and passes the output of all the
+// windows and the window size changes to add. The keyframes are skipped, as the whole recording is played.
+func recordingTranscriptEvents(recording io.Reader, add func(event transcriptEvent)) error {
+	reader := bufio.NewReaderSize(recording, 64*1024)
+
+	headerLine, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var header recordingHeader
+	if err = json.Unmarshal(headerLine, &header); err != nil {
+		return err
+	}
+	add(transcriptEvent{cols: header.Width, rows: header.Height})
+
+	// The number of bytes of output of each window so far, by its ID
+	offsets := make(map[string]int64)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if eventTime, eventType, ok := parseRecordingEvent(line); ok && (eventType == recordingEventOutput ||
+			eventType == recordingEventResize || eventType == recordingEventWindow) {
+			var event []interface{}
+			if err = json.Unmarshal(line, &event); err != nil || len(event) < 3 {
+				return &TTYServerError{msg: "Invalid recording event: " + string(line)}
+			}
+			data, _ := event[2].(string)
+			switch eventType {
+			case recordingEventOutput:
+				add(transcriptEvent{time: eventTime, offset: offsets[""], data: []byte(data)})
+				offsets[""] += int64(len(data))
+			case recordingEventWindow:
+				var output recordedWindowOutput
+				if err = json.Unmarshal([]byte(data), &output); err != nil {
+					return &TTYServerError{msg: "Invalid recording event: " + string(line)}
+				}
+				add(transcriptEvent{time: eventTime, offset: offsets[output.Window], window: output.Window,
+					data: []byte(output.Data)})
+				offsets[output.Window] += int64(len(output.Data))
+			default:
+				var cols, rows int
+				fmt.Sscanf(data, "%dx%d", &cols, &rows)
+				add(transcriptEvent{time: eventTime, offset: offsets[""], cols: cols, rows: rows})
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// parseTranscriptRequest reads the format and the range of a transcript from the query of the
+// request: "format" is "text" (the default) or "html", "from" and "to" are times in seconds, and
+// "from_offset" and "to_offset" are offsets in the output, in bytes, and "window" is the ID of the
+// window the output is of, the main one by default. A range can't end before it starts.
+func parseTranscriptRequest(r *http.Request) (format string, txRange transcriptRange, err error) {
+	query := r.URL.Query()
+	format = query.Get("format")
+	if format == "" {
+		format = transcriptFormatText
+	}
+	if format != transcriptFormatText && format != transcriptFormatHTML {
+		return "", txRange, &TTYServerError{msg: "Unknown transcript format: " + format}
+	}
+
+	txRange = transcriptRange{fromTime: 0, toTime: -1, fromOffset: 0, toOffset: -1}
+	if window := query.Get("window"); window != mainWindowID {
+		txRange.window = window
+	}
+	parseFloat := func(name string, value *float64) {
+		if s := query.Get(name); s != "" && err == nil {
+			if *value, err = strconv.ParseFloat(s, 64); err != nil || *value < 0 {
+				err = &TTYServerError{msg: "Invalid " + name + " parameter: " + s}
+			}
+		}
+	}
+	parseInt := func(name string, value *int64) {
+		if s := query.Get(name); s != "" && err == nil {
+			if *value, err = strconv.ParseInt(s, 10, 64); err != nil || *value < 0 {
+				err = &TTYServerError{msg: "Invalid " + name + " parameter: " + s}
+			}
+		}
+	}
+	parseFloat("from", &txRange.fromTime)
+	parseFloat("to", &txRange.toTime)
+	parseInt("from_offset", &txRange.fromOffset)
+	parseInt("to_offset", &txRange.toOffset)
+	if err == nil && ((txRange.toTime >= 0 && txRange.fromTime > txRange.toTime) ||
+		(txRange.toOffset >= 0 && txRange.fromOffset > txRange.toOffset)) {
+		err = &TTYServerError{msg: "The transcript range ends before it starts"}
+	}
+	return
+}
+
+// transcriptDisposition returns the Content-Disposition of a transcript, whose file name is quoted
+// and escaped, as it is made of the ID of the session or the recording
+func transcriptDisposition(filename string) string {
+	return mime.FormatMediaType("inline", map[string]string{"filename": filename})
+}
+
+func writeTranscript(w http.ResponseWriter, format, name string, lines [][]vtCell) {
+	var err error
+	if format == transcriptFormatHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", transcriptDisposition(name+".html"))
+		err = renderTranscriptHTML(w, name, lines)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", transcriptDisposition(name+".txt"))
+		err = renderTranscriptText(w, lines)
+	}
+	if err != nil {
+		log.Debugf("Cannot send the transcript of %s: %s", name, err.Error())
+	}
+}
+
+// handleSessionTranscript exports the transcript of a live session, from the output it still keeps
+func (server *TTYServer) handleSessionTranscript(w http.ResponseWriter, r *http.Request) {
+	session := server.seenSession(w, r)
+	if session == nil {
+		return
+	}
+	format, txRange, err := parseTranscriptRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	builder := newTranscriptBuilder(txRange)
+	for _, event := range session.GetOutputHistory() {
+		builder.Add(event)
+	}
+	writeTranscript(w, format, session.GetSessionID(), builder.Lines())
+}
+
+// handleRecordingTranscript exports the transcript of a recording
+func (server *TTYServer) handleRecordingTranscript(w http.ResponseWriter, r *http.Request) {
+	recordingID := mux.Vars(r)["recordingID"]
+	recording := server.openRecording(recordingID)
+	if recording == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer recording.Close()
+
+	format, txRange, err := parseTranscriptRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	builder := newTranscriptBuilder(txRange)
+	err = recordingTranscriptEvents(io.NewSectionReader(recording, 0, recording.Size()), builder.Add)
+	if err != nil {
+		log.Errorf("Cannot read recording %s: %s", recordingID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeTranscript(w, format, recordingID, builder.Lines())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildTestTranscript(txRange transcriptRange, output ...string) string {
+	builder := newTranscriptBuilder(txRange)
+	builder.Add(transcriptEvent{cols: 20, rows: 3})
+	var offset int64
+	for i, data := range output {
+		builder.Add(transcriptEvent{time: float64(i), offset: offset, data: []byte(data)})
+		offset += int64(len(data))
+	}
+	var out bytes.Buffer
+	renderTranscriptText(&out, builder.Lines())
+	return out.String()
+}
+
+func TestTranscriptInterpretsRedraws(t *testing.T) {
+	allOutput := transcriptRange{toTime: -1, toOffset: -1}
+	// A progress bar redrawn in place, a line edited with backspaces, colors, and enough lines to
+	// scroll the first ones off the screen
+	got := buildTestTranscript(allOutput, "$ ls\r\n", "10%\r50%\r100%\r\n", "abx\bc\r\n",
+		"\x1b[31mred\x1b[0m\r\n", "\x1b[2A\x1b[Kfixed\r\n\r\n")
+	expected := "$ ls\n100%\nfixed\nred\n"
+	if got != expected {
+		t.Fatalf("Unexpected transcript:\n%q\nexpected:\n%q", got, expected)
+	}
+
+	// Full screen applications on the alternate screen don't leave anything in the transcript
+	got = buildTestTranscript(allOutput, "$ vim\r\n", "\x1b[?1049h\x1b[Hediting\x1b[?1049l", "$ ")
+	if got != "$ vim\n$\n" {
+		t.Fatalf("Unexpected transcript after the alternate screen: %q", got)
+	}
+}
+
+func TestTranscriptRanges(t *testing.T) {
+	output := []string{"$ one\r\n", "1\r\n", "$ two\r\n", "2\r\n", "$ "}
+
+	got := buildTestTranscript(transcriptRange{fromTime: 2, toTime: 3, toOffset: -1}, output...)
+	if got != "$ two\n2\n" {
+		t.Fatalf("Unexpected transcript of a time range: %q", got)
+	}
+
+	// The output of the first command, like the command history reports it
+	got = buildTestTranscript(transcriptRange{fromOffset: 7, toTime: -1, toOffset: 10}, output...)
+	if got != "1\n" {
+		t.Fatalf("Unexpected transcript of an offset range: %q", got)
+	}
+
+	// A range ending before it starts is empty
+	got = buildTestTranscript(transcriptRange{fromOffset: 9, toTime: -1, toOffset: 8}, output...)
+	if got != "" {
+		t.Fatalf("Unexpected transcript of an inverted range: %q", got)
+	}
+}
+
+func TestParseTranscriptRequest(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"from_offset=50&to_offset=100": true,
+		"from=1.5&to=1.5":              true,
+		"from_offset=100":              true,
+		"from_offset=100&to_offset=50": false,
+		"from=2&to=1":                  false,
+		"from_offset=-1":               false,
+		"format=pdf":                   false,
+	} {
+		_, _, err := parseTranscriptRequest(httptest.NewRequest(http.MethodGet, "/transcript?"+query, nil))
+		if (err == nil) != valid {
+			t.Errorf("Expected %s to be valid: %t, got %v", query, valid, err)
+		}
+	}
+}
+
+func TestTranscriptDisposition(t *testing.T) {
+	if got := transcriptDisposition(`a"b; c.txt`); got != `inline; filename="a\"b; c.txt"` {
+		t.Fatalf("Unexpected Content-Disposition: %s", got)
+	}
+}
+
+func TestTranscriptFromRecording(t *testing.T) {
+	recording := `{"version":2,"width":20,"height":5,"timestamp":0}
+[0.1,"o","$ ls\r\n"]
+[0.2,"k","\u001bc\u001b[H\u001b[2Jignored"]
+[0.3,"r","30x5"]
+[0.4,"o","\u001b[1;32mfile\u001b[0m\r\n"]
+`
+	builder := newTranscriptBuilder(transcriptRange{toTime: -1, toOffset: -1})
+	if err := recordingTranscriptEvents(strings.NewReader(recording), builder.Add); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	renderTranscriptHTML(&out, "rec", builder.Lines())
+	html := out.String()
+	if !strings.Contains(html, "$ ls") || strings.Contains(html, "ignored") ||
+		!strings.Contains(html, `<span style="color:#00ff00;font-weight:bold">file</span>`) {
+		t.Fatalf("Unexpected HTML transcript: %s", html)
+	}
+}
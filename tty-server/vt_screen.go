@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+)
+
+// vtScreen is a small, server side model of a VT100/xterm compatible terminal. It is fed the raw
+// output of the PTY, and keeps track of what a terminal attached to it would be showing. It is not
+// meant to be a complete terminal emulator: it understands the control sequences shells and the
+// usual full screen applications rely on, and quietly ignores the rest.
+
+const (
+	vtAttrBold = 1 << iota
+	vtAttrFaint
+	vtAttrItalic
+	vtAttrUnderline
+	vtAttrBlink
+	vtAttrReverse
+	vtAttrHidden
+	vtAttrStrike
+)
+
+// vtColorDefault is the color used when no color was set. Colors 0-255 are the xterm palette, and
+// colors with vtColorRGB set are true colors, with the RGB value in the lower 24 bits.
+const (
+	vtColorDefault = -1
+	vtColorRGB     = 1 << 24
+)
+
+const (
+	vtStateGround = iota
+	vtStateEscape
+	vtStateCharset
+	vtStateCSI
+	vtStateOSC
+	vtStateString
+	vtStateStringEscape
+)
+
+type vtAttr struct {
+	fg    int32
+	bg    int32
+	flags uint8
+}
+
+type vtCell struct {
+	r    rune
+	attr vtAttr
+}
+
+type vtScreen struct {
+	cols, rows int
+	lines      [][]vtCell
+	mainLines  [][]vtCell
+	altActive  bool
+
+	cx, cy      int
+	wrapPending bool
+	attr        vtAttr
+	top, bottom int
+	hideCursor  bool
+
+	savedX, savedY int
+	savedAttr      vtAttr
+
+	// onScrollOut, if set, is called with every line scrolled off the top of the main screen
+	onScrollOut func(line []vtCell)
+
+	state   int
+	params  []byte
+	utf8Buf []byte
+}
+
+var vtDefaultAttr = vtAttr{fg: vtColorDefault, bg: vtColorDefault}
+
+func newVTScreen(cols, rows int) *vtScreen {
+	if cols <= 0 {
+		cols = 80
+	}
+	if rows <= 0 {
+		rows = 24
+	}
+	screen := &vtScreen{
+		attr:      vtDefaultAttr,
+		savedAttr: vtDefaultAttr,
+	}
+	screen.cols, screen.rows = cols, rows
+	screen.lines = screen.newLines(rows)
+	screen.top, screen.bottom = 0, rows-1
+	return screen
+}
+
+func (screen *vtScreen) newLine() []vtCell {
+	line := make([]vtCell, screen.cols)
+	for i := range line {
+		line[i].attr = vtDefaultAttr
+	}
+	return line
+}
+
+func (screen *vtScreen) newLines(n int) [][]vtCell {
+	lines := make([][]vtCell, n)
+	for i := range lines {
+		lines[i] = screen.newLine()
+	}
+	return lines
+}
+
+// Resize changes the size of the screen, keeping as much of the content as possible
+func (screen *vtScreen) Resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 || (cols == screen.cols && rows == screen.rows) {
+		return
+	}
+	// Like xterm, drop lines from the top only when needed to keep the cursor on the screen
+	dropped := maxInt(screen.cy-(rows-1), 0)
+	resize := func(lines [][]vtCell, scrollOut bool) [][]vtCell {
+		if lines == nil {
+			return nil
+		}
+		if scrollOut && screen.onScrollOut != nil {
+			for _, line := range lines[:dropped] {
+				screen.onScrollOut(line)
+			}
+		}
+		lines = lines[dropped:]
+		resized := make([][]vtCell, rows)
+		for y := range resized {
+			resized[y] = make([]vtCell, cols)
+			for x := range resized[y] {
+				resized[y][x].attr = vtDefaultAttr
+			}
+			if y < len(lines) {
+				copy(resized[y], lines[y])
+			}
+		}
+		return resized
+	}
+	screen.lines = resize(screen.lines, !screen.altActive)
+	screen.mainLines = resize(screen.mainLines, true)
+	screen.cy -= dropped
+	screen.cols, screen.rows = cols, rows
+	screen.top, screen.bottom = 0, rows-1
+	screen.cx = clampInt(screen.cx, 0, cols-1)
+	screen.cy = clampInt(screen.cy, 0, rows-1)
+	screen.wrapPending = false
+}
+
+// Write feeds the screen with terminal output
+func (screen *vtScreen) Write(data []byte) (int, error) {
+	for _, b := range data {
+		screen.feed(b)
+	}
+	return len(data), nil
+}
+
+func (screen *vtScreen) feed(b byte) {
+	switch screen.state {
+	case vtStateGround:
+		screen.feedGround(b)
+	case vtStateEscape:
+		screen.feedEscape(b)
+	case vtStateCharset:
+		// Character set designations are ignored, we only care about the character after them
+		screen.state = vtStateGround
+	case vtStateCSI:
+		if b >= 0x40 && b <= 0x7e {
+			screen.executeCSI(b)
+			screen.state = vtStateGround
+		} else if b == 0x1b {
+			screen.state = vtStateEscape
+		} else if b == 0x18 || b == 0x1a {
+			screen.state = vtStateGround
+		} else if len(screen.params) < 128 {
+			screen.params = append(screen.params, b)
+		}
+	case vtStateOSC:
+		if b == 0x07 {
+			screen.state = vtStateGround
+		} else if b == 0x1b {
+			screen.state = vtStateStringEscape
+		}
+	case vtStateString:
+		if b == 0x1b {
+			screen.state = vtStateStringEscape
+		} else if b == 0x07 {
+			screen.state = vtStateGround
+		}
+	case vtStateStringEscape:
+		if b == '\\' {
+			screen.state = vtStateGround
+		} else {
+			screen.state = vtStateEscape
+			screen.feedEscape(b)
+		}
+	}
+}
+
+func (screen *vtScreen) feedGround(b byte) {
+	if len(screen.utf8Buf) > 0 || b >= 0x80 {
+		screen.utf8Buf = append(screen.utf8Buf, b)
+		if utf8.FullRune(screen.utf8Buf) {
+			r, _ := utf8.DecodeRune(screen.utf8Buf)
+			screen.utf8Buf = screen.utf8Buf[:0]
+			screen.put(r)
+		}
+		return
+	}
+
+	switch b {
+	case 0x1b:
+		screen.state = vtStateEscape
+	case '\r':
+		screen.cx = 0
+		screen.wrapPending = false
+	case '\n', 0x0b, 0x0c:
+		screen.lineFeed()
+	case '\b':
+		if screen.cx > 0 {
+			screen.cx--
+		}
+		screen.wrapPending = false
+	case '\t':
+		screen.cx = minInt((screen.cx/8+1)*8, screen.cols-1)
+		screen.wrapPending = false
+	default:
+		if b >= 0x20 && b != 0x7f {
+			screen.put(rune(b))
+		}
+	}
+}
+
+func (screen *vtScreen) feedEscape(b byte) {
+	screen.state = vtStateGround
+	switch b {
+	case '[':
+		screen.params = screen.params[:0]
+		screen.state = vtStateCSI
+	case ']':
+		screen.state = vtStateOSC
+	case 'P', 'X', '^', '_':
+		screen.state = vtStateString
+	case '(', ')', '*', '+', '#', '%':
+		screen.state = vtStateCharset
+	case '7':
+		screen.saveCursor()
+	case '8':
+		screen.restoreCursor()
+	case 'D':
+		screen.lineFeed()
+	case 'E':
+		screen.cx = 0
+		screen.lineFeed()
+	case 'M':
+		screen.reverseLineFeed()
+	case 'c':
+		screen.reset()
+	}
+}
+
+func (screen *vtScreen) reset() {
+	screen.lines = screen.newLines(screen.rows)
+	screen.mainLines = nil
+	screen.altActive = false
+	screen.cx, screen.cy = 0, 0
+	screen.wrapPending = false
+	screen.attr = vtDefaultAttr
+	screen.top, screen.bottom = 0, screen.rows-1
+	screen.hideCursor = false
+}
+
+func (screen *vtScreen) put(r rune) {
+	if screen.wrapPending {
+		screen.cx = 0
+		screen.lineFeed()
+	}
+	screen.lines[screen.cy][screen.cx] = vtCell{r: r, attr: screen.attr}
+	if screen.cx == screen.cols-1 {
+		screen.wrapPending = true
+	} else {
+		screen.cx++
+	}
+}
+
+func (screen *vtScreen) lineFeed() {
+	screen.wrapPending = false
+	if screen.cy == screen.bottom {
+		screen.scrollUp(1)
+	} else if screen.cy < screen.rows-1 {
+		screen.cy++
+	}
+}
+
+func (screen *vtScreen) reverseLineFeed() {
+	screen.wrapPending = false
+	if screen.cy == screen.top {
+		screen.scrollDown(1)
+	} else if screen.cy > 0 {
+		screen.cy--
+	}
+}
+
+func (screen *vtScreen) scrollUp(n int) {
+	n = minInt(n, screen.bottom-screen.top+1)
+	for i := 0; i < n; i++ {
+		if screen.top == 0 && !screen.altActive && screen.onScrollOut != nil {
+			screen.onScrollOut(screen.lines[0])
+		}
+		copy(screen.lines[screen.top:screen.bottom], screen.lines[screen.top+1:screen.bottom+1])
+		screen.lines[screen.bottom] = screen.newLine()
+	}
+}
+
+func (screen *vtScreen) scrollDown(n int) {
+	n = minInt(n, screen.bottom-screen.top+1)
+	for i := 0; i < n; i++ {
+		copy(screen.lines[screen.top+1:screen.bottom+1], screen.lines[screen.top:screen.bottom])
+		screen.lines[screen.top] = screen.newLine()
+	}
+}
+
+func (screen *vtScreen) saveCursor() {
+	screen.savedX, screen.savedY = screen.cx, screen.cy
+	screen.savedAttr = screen.attr
+}
+
+func (screen *vtScreen) restoreCursor() {
+	screen.cx = clampInt(screen.savedX, 0, screen.cols-1)
+	screen.cy = clampInt(screen.savedY, 0, screen.rows-1)
+	screen.attr = screen.savedAttr
+	screen.wrapPending = false
+}
+
+func (screen *vtScreen) setAltScreen(on bool) {
+	if on == screen.altActive {
+		return
+	}
+	if on {
+		screen.mainLines = screen.lines
+		screen.lines = screen.newLines(screen.rows)
+	} else {
+		screen.lines = screen.mainLines
+		screen.mainLines = nil
+	}
+	screen.altActive = on
+}
+
+func (screen *vtScreen) clearCells(y, from, to int) {
+	line := screen.lines[y]
+	for x := maxInt(from, 0); x < minInt(to, screen.cols); x++ {
+		line[x] = vtCell{attr: vtAttr{fg: vtColorDefault, bg: screen.attr.bg}}
+	}
+}
+
+// parseParams splits the CSI parameters. Sub-parameters separated by ':' are treated like regular
+// parameters, which is enough for the colour sequences that use them.
+func (screen *vtScreen) parseParams() (private byte, params []int) {
+	raw := screen.params
+	if len(raw) > 0 && (raw[0] == '?' || raw[0] == '>' || raw[0] == '<' || raw[0] == '=') {
+		private = raw[0]
+		raw = raw[1:]
+	}
+	if len(raw) == 0 {
+		return
+	}
+	for _, field := range bytes.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ':' }) {
+		n, err := strconv.Atoi(string(bytes.TrimRight(field, " !\"#$%&'()*+,-./")))
+		if err != nil {
+			n = 0
+		}
+		params = append(params, n)
+	}
+	return
+}
+
+func vtParam(params []int, i, def int) int {
+	if i >= len(params) || params[i] == 0 {
+		return def
+	}
+	return params[i]
+}
+
+func (screen *vtScreen) executeCSI(final byte) {
+	private, params := screen.parseParams()
+	if private == '?' {
+		if final == 'h' || final == 'l' {
+			screen.setPrivateModes(params, final == 'h')
+		}
+		return
+	}
+	if private != 0 {
+		return
+	}
+
+	screen.wrapPending = false
+	switch final {
+	case 'A':
+		screen.cy = maxInt(screen.cy-vtParam(params, 0, 1), 0)
+	case 'B', 'e':
+		screen.cy = minInt(screen.cy+vtParam(params, 0, 1), screen.rows-1)
+	case 'C', 'a':
+		screen.cx = minInt(screen.cx+vtParam(params, 0, 1), screen.cols-1)
+	case 'D':
+		screen.cx = maxInt(screen.cx-vtParam(params, 0, 1), 0)
+	case 'E':
+		screen.cx = 0
+		screen.cy = minInt(screen.cy+vtParam(params, 0, 1), screen.rows-1)
+	case 'F':
+		screen.cx = 0
+		screen.cy = maxInt(screen.cy-vtParam(params, 0, 1), 0)
+	case 'G', '`':
+		screen.cx = clampInt(vtParam(params, 0, 1)-1, 0, screen.cols-1)
+	case 'd':
+		screen.cy = clampInt(vtParam(params, 0, 1)-1, 0, screen.rows-1)
+	case 'H', 'f':
+		screen.cy = clampInt(vtParam(params, 0, 1)-1, 0, screen.rows-1)
+		screen.cx = clampInt(vtParam(params, 1, 1)-1, 0, screen.cols-1)
+	case 'J':
+		switch vtParam(params, 0, 0) {
+		case 0:
+			screen.clearCells(screen.cy, screen.cx, screen.cols)
+			for y := screen.cy + 1; y < screen.rows; y++ {
+				screen.clearCells(y, 0, screen.cols)
+			}
+		case 1:
+			screen.clearCells(screen.cy, 0, screen.cx+1)
+			for y := 0; y < screen.cy; y++ {
+				screen.clearCells(y, 0, screen.cols)
+			}
+		case 2, 3:
+			for y := 0; y < screen.rows; y++ {
+				screen.clearCells(y, 0, screen.cols)
+			}
+		}
+	case 'K':
+		switch vtParam(params, 0, 0) {
+		case 0:
+			screen.clearCells(screen.cy, screen.cx, screen.cols)
+		case 1:
+			screen.clearCells(screen.cy, 0, screen.cx+1)
+		case 2:
+			screen.clearCells(screen.cy, 0, screen.cols)
+		}
+	case '@':
+		n := minInt(vtParam(params, 0, 1), screen.cols-screen.cx)
+		line := screen.lines[screen.cy]
+		copy(line[screen.cx+n:], line[screen.cx:])
+		screen.clearCells(screen.cy, screen.cx, screen.cx+n)
+	case 'P':
+		n := minInt(vtParam(params, 0, 1), screen.cols-screen.cx)
+		line := screen.lines[screen.cy]
+		copy(line[screen.cx:], line[screen.cx+n:])
+		screen.clearCells(screen.cy, screen.cols-n, screen.cols)
+	case 'X':
+		screen.clearCells(screen.cy, screen.cx, screen.cx+vtParam(params, 0, 1))
+	case 'L', 'M':
+		if screen.cy < screen.top || screen.cy > screen.bottom {
+			return
+		}
+		top := screen.top
+		screen.top = screen.cy
+		if final == 'L' {
+			screen.scrollDown(vtParam(params, 0, 1))
+		} else {
+			screen.scrollUp(vtParam(params, 0, 1))
+		}
+		screen.top = top
+		screen.cx = 0
+	case 'S':
+		screen.scrollUp(vtParam(params, 0, 1))
+	case 'T':
+		screen.scrollDown(vtParam(params, 0, 1))
+	case 'm':
+		screen.setGraphicRendition(params)
+	case 'r':
+		top := vtParam(params, 0, 1) - 1
+		bottom := vtParam(params, 1, screen.rows) - 1
+		if top < bottom && bottom < screen.rows {
+			screen.top, screen.bottom = top, bottom
+			screen.cx, screen.cy = 0, 0
+		}
+	case 's':
+		screen.saveCursor()
+	case 'u':
+		screen.restoreCursor()
+	}
+}
+
+func (screen *vtScreen) setPrivateModes(params []int, on bool) {
+	for _, mode := range params {
+		switch mode {
+		case 25:
+			screen.hideCursor = !on
+		case 47, 1047:
+			screen.setAltScreen(on)
+		case 1048:
+			if on {
+				screen.saveCursor()
+			} else {
+				screen.restoreCursor()
+			}
+		case 1049:
+			if on {
+				screen.saveCursor()
+				screen.setAltScreen(true)
+				for y := 0; y < screen.rows; y++ {
+					screen.clearCells(y, 0, screen.cols)
+				}
+			} else {
+				screen.setAltScreen(false)
+				screen.restoreCursor()
+			}
+		}
+	}
+}
+
+func (screen *vtScreen) setGraphicRendition(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			screen.attr = vtDefaultAttr
+		case p >= 1 && p <= 9:
+			screen.attr.flags |= []uint8{0, vtAttrBold, vtAttrFaint, vtAttrItalic, vtAttrUnderline,
+				vtAttrBlink, vtAttrBlink, vtAttrReverse, vtAttrHidden, vtAttrStrike}[p]
+		case p == 21 || p == 22:
+			screen.attr.flags &^= vtAttrBold | vtAttrFaint
+		case p == 23:
+			screen.attr.flags &^= vtAttrItalic
+		case p == 24:
+			screen.attr.flags &^= vtAttrUnderline
+		case p == 25:
+			screen.attr.flags &^= vtAttrBlink
+		case p == 27:
+			screen.attr.flags &^= vtAttrReverse
+		case p == 28:
+			screen.attr.flags &^= vtAttrHidden
+		case p == 29:
+			screen.attr.flags &^= vtAttrStrike
+		case p >= 30 && p <= 37:
+			screen.attr.fg = int32(p - 30)
+		case p == 39:
+			screen.attr.fg = vtColorDefault
+		case p >= 40 && p <= 47:
+			screen.attr.bg = int32(p - 40)
+		case p == 49:
+			screen.attr.bg = vtColorDefault
+		case p >= 90 && p <= 97:
+			screen.attr.fg = int32(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			screen.attr.bg = int32(p - 100 + 8)
+		case p == 38 || p == 48:
+			var color int32
+			if i+2 < len(params) && params[i+1] == 5 {
+				color = int32(params[i+2] & 0xff)
+				i += 2
+			} else if i+4 < len(params) && params[i+1] == 2 {
+				color = vtColorRGB | int32(params[i+2]&0xff)<<16 | int32(params[i+3]&0xff)<<8 | int32(params[i+4]&0xff)
+				i += 4
+			} else {
+				return
+			}
+			if p == 38 {
+				screen.attr.fg = color
+			} else {
+				screen.attr.bg = color
+			}
+		}
+	}
+}
+
+// sgrSequence returns the escape sequence that switches the graphic rendition to attr
+func (attr vtAttr) sgrSequence() string {
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[0")
+	codes := []int{1, 2, 3, 4, 5, 7, 8, 9}
+	for i, code := range codes {
+		if attr.flags&(1<<uint(i)) != 0 {
+			buf.WriteString(";" + strconv.Itoa(code))
+		}
+	}
+	writeColor := func(color int32, base int) {
+		switch {
+		case color == vtColorDefault:
+		case color&vtColorRGB != 0:
+			buf.WriteString(";" + strconv.Itoa(base+8) + ";2;" + strconv.Itoa(int(color>>16&0xff)) + ";" +
+				strconv.Itoa(int(color>>8&0xff)) + ";" + strconv.Itoa(int(color&0xff)))
+		case color < 8:
+			buf.WriteString(";" + strconv.Itoa(base+int(color)))
+		case color < 16:
+			buf.WriteString(";" + strconv.Itoa(base+60+int(color)-8))
+		default:
+			buf.WriteString(";" + strconv.Itoa(base+8) + ";5;" + strconv.Itoa(int(color)))
+		}
+	}
+	writeColor(attr.fg, 30)
+	writeColor(attr.bg, 40)
+	buf.WriteString("m")
+	return buf.String()
+}
+
+func (screen *vtScreen) writeLines(buf *bytes.Buffer, lines [][]vtCell) {
+	current := vtDefaultAttr
+	buf.WriteString(current.sgrSequence())
+	for y, line := range lines {
+		buf.WriteString("\x1b[" + strconv.Itoa(y+1) + ";1H")
+		// Trailing blank cells with the default background don't need to be drawn
+		end := len(line)
+		for end > 0 && line[end-1].r == 0 && line[end-1].attr.bg == vtColorDefault {
+			end--
+		}
+		for _, cell := range line[:end] {
+			if cell.attr != current {
+				current = cell.attr
+				buf.WriteString(current.sgrSequence())
+			}
+			if cell.r == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteRune(cell.r)
+			}
+		}
+	}
+}
+
+// Snapshot returns a sequence of bytes which, written to a freshly reset terminal of the same size,
+// reproduces what this screen is currently showing.
+func (screen *vtScreen) Snapshot() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x1bc\x1b[H\x1b[2J")
+	if screen.altActive {
+		screen.writeLines(&buf, screen.mainLines)
+		buf.WriteString("\x1b[?1049h")
+	}
+	screen.writeLines(&buf, screen.lines)
+	if screen.top != 0 || screen.bottom != screen.rows-1 {
+		buf.WriteString("\x1b[" + strconv.Itoa(screen.top+1) + ";" + strconv.Itoa(screen.bottom+1) + "r")
+	}
+	buf.WriteString("\x1b[" + strconv.Itoa(screen.cy+1) + ";" + strconv.Itoa(screen.cx+1) + "H")
+	buf.WriteString(screen.attr.sgrSequence())
+	if screen.hideCursor {
+		buf.WriteString("\x1b[?25l")
+	}
+	return buf.Bytes()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clampInt(v, low, high int) int {
+	return maxInt(low, minInt(v, high))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// screenText returns the lines shown on a screen, without the blanks at their end
+func screenText(lines [][]vtCell) []string {
+	text := make([]string, len(lines))
+	for y, line := range lines {
+		var b strings.Builder
+		for _, cell := range line {
+			if cell.r == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteRune(cell.r)
+			}
+		}
+		text[y] = strings.TrimRight(b.String(), " ")
+	}
+	return text
+}
+
+func expectScreen(t *testing.T, screen *vtScreen, expected ...string) {
+	t.Helper()
+	if text := screenText(screen.lines); !reflect.DeepEqual(text, expected) {
+		t.Errorf("Expected the screen %q, got %q", expected, text)
+	}
+}
+
+func TestVTScreenCursorMovement(t *testing.T) {
+	screen := newVTScreen(10, 4)
+	screen.Write([]byte("abc\x1b[3;5HX\x1b[AY\x1b[3DZ\x1b[2EW\x1b[1;10HE"))
+	expectScreen(t, screen, "abc      E", "   Z Y", "    X", "W")
+	if screen.cx != 9 || screen.cy != 0 || !screen.wrapPending {
+		t.Errorf("Expected the cursor to wait at the end of the first line, got %d,%d", screen.cx, screen.cy)
+	}
+
+	// Writing at the end of the line wraps, and the cursor movements can't leave the screen
+	screen.Write([]byte("F\x1b[20;20HG\x1b[s\x1b[H\x1b[uH"))
+	expectScreen(t, screen, "abc      E", "F  Z Y", "    X", "W        H")
+	screen.Write([]byte("\rback\x08\x08\x08\x1b[K"))
+	expectScreen(t, screen, "abc      E", "F  Z Y", "    X", "b")
+}
+
+func TestVTScreenScrolling(t *testing.T) {
+	screen := newVTScreen(5, 3)
+	var scrolledOut []string
+	screen.onScrollOut = func(line []vtCell) {
+		scrolledOut = append(scrolledOut, screenText([][]vtCell{line})[0])
+	}
+	screen.Write([]byte("1\r\n2\r\n3\r\n4"))
+	expectScreen(t, screen, "2", "3", "4")
+	if !reflect.DeepEqual(scrolledOut, []string{"1"}) {
+		t.Errorf("Expected the first line to scroll out, got %q", scrolledOut)
+	}
+
+	// Within a scroll region, the lines above it stay, and don't scroll out
+	screen.Write([]byte("\x1b[2;3r\x1b[3;1H\r\nA\r\nB"))
+	expectScreen(t, screen, "2", "A", "B")
+	if len(scrolledOut) != 1 {
+		t.Errorf("Expected no line to scroll out of a region, got %q", scrolledOut)
+	}
+	screen.Write([]byte("\x1b[2;1H\x1bMC\x1b[r\x1b[3;1H\x1b[L"))
+	expectScreen(t, screen, "2", "C", "")
+}
+
+func TestVTScreenErase(t *testing.T) {
+	screen := newVTScreen(6, 3)
+	fill := "\x1b[Haaaaaa\x1b[2;1Hbbbbbb\x1b[3;1Hcccccc"
+
+	for _, test := range []struct {
+		erase    string
+		expected []string
+	}{
+		{"\x1b[2;3H\x1b[K", []string{"aaaaaa", "bb", "cccccc"}},
+		{"\x1b[2;3H\x1b[1K", []string{"aaaaaa", "   bbb", "cccccc"}},
+		{"\x1b[2;3H\x1b[2K", []string{"aaaaaa", "", "cccccc"}},
+		{"\x1b[2;3H\x1b[J", []string{"aaaaaa", "bb", ""}},
+		{"\x1b[2;3H\x1b[1J", []string{"", "   bbb", "cccccc"}},
+		{"\x1b[2;3H\x1b[2J", []string{"", "", ""}},
+		{"\x1b[2;3H\x1b[2X", []string{"aaaaaa", "bb  bb", "cccccc"}},
+		{"\x1b[2;3H\x1b[2P", []string{"aaaaaa", "bbbb", "cccccc"}},
+	} {
+		screen.Write([]byte(fill + test.erase))
+		if text := screenText(screen.lines); !reflect.DeepEqual(text, test.expected) {
+			t.Errorf("Expected %q to erase the screen to %q, got %q", test.erase, test.expected, text)
+		}
+	}
+}
+
+func TestVTScreenAlternateScreen(t *testing.T) {
+	screen := newVTScreen(8, 3)
+	screen.Write([]byte("shell\r\n$ "))
+	screen.Write([]byte("\x1b[?1049h\x1b[Heditor"))
+	expectScreen(t, screen, "editor", "", "")
+	if !screen.altActive || !reflect.DeepEqual(screenText(screen.mainLines), []string{"shell", "$", ""}) {
+		t.Errorf("Expected the main screen to be kept, got %q", screenText(screen.mainLines))
+	}
+
+	// A keyframe taken on the alternate screen restores both screens
+	replayed := newVTScreen(8, 3)
+	replayed.Write(screen.Snapshot())
+	expectScreen(t, replayed, "editor", "", "")
+	if replayed.cx != screen.cx || replayed.cy != screen.cy {
+		t.Errorf("Expected the snapshot to restore the cursor at %d,%d, got %d,%d", screen.cx, screen.cy, replayed.cx, replayed.cy)
+	}
+
+	for _, s := range []*vtScreen{screen, replayed} {
+		s.Write([]byte("\x1b[?1049l"))
+		if s.altActive {
+			t.Errorf("Expected to leave the alternate screen")
+		}
+		expectScreen(t, s, "shell", "$", "")
+	}
+	if screen.cx != 2 || screen.cy != 1 {
+		t.Errorf("Expected the cursor to be back after the prompt, got %d,%d", screen.cx, screen.cy)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+const (
+	defaultWaitingRoomTimeout = 5 * time.Minute
+	// waitingRoomLimit is how many receivers can wait to join a session at once
+	waitingRoomLimit = 64
+)
+
+// waitingRoom holds the receivers joining a session until its owner, or an admin, lets them in.
+// They get nothing of the session until then, and are turned away if nobody lets them in in time.
+type waitingRoom struct {
+	timeout time.Duration
+	// lock is held while the receivers are let in, so they can't leave the room at the same time
+	lock    sync.Mutex
+	pending []*ttyReceiver
+	timers  map[*ttyReceiver]*time.Timer
+}
+
+// SetWaitingRoom makes the receivers wait until they are let in the session, for at most timeout.
+// It has to be called before the receivers join.
+func (pty *ptyMaster) SetWaitingRoom(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultWaitingRoomTimeout
+	}
+	pty.waiting = &waitingRoom{timeout: timeout, timers: make(map[*ttyReceiver]*time.Timer)}
+}
+
+// sendWaitingRoom tells the owner and the admins who is waiting, or only one of
+// them if to is set. It has to be called with the waiting room lock held.
+func (pty *ptyMaster) sendWaitingRoom(to *ttyReceiver) {
+	receivers := pty.GetReceivers()
+	if to != nil {
+		receivers = []*ttyReceiver{to}
+	}
+	for _, receiver := range receivers {
+		if !pty.isModerator(receiver) {
+			continue
+		}
+		msg := ttyCommon.MsgTTYWaitingRoom{Pending: []ttyCommon.PresenceReceiver{}}
+		for _, pending := range pty.waiting.pending {
+			msg.Pending = append(msg.Pending, pty.presenceReceiver(pending, receiver))
+		}
+		if err := receiver.conn.WriteMessage(msg); err != nil {
+			log.Debugf("Cannot send the waiting room to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// waitingRoomJoin puts a receiver joining the session in the waiting room, unless it can let
+// itself in. It tells if the receiver waits.
+func (pty *ptyMaster) waitingRoomJoin(receiver *ttyReceiver) bool {
+	room := pty.waiting
+	if room == nil {
+		return false
+	}
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if pty.isModerator(receiver) {
+		pty.sendWaitingRoom(receiver)
+		return false
+	}
+	if len(room.pending) >= waitingRoomLimit {
+		log.Warnf("Turned away receiver %s (%s) from session %s: the waiting room is full", receiver.id, receiver.identity.Name, pty.sessionID)
+		pty.audit.Admission(pty.sessionID, receiver, false, "the waiting room is full")
+		receiver.conn.WriteMessage(ttyCommon.MsgTTYJoinStatus{
+			State:   ttyCommon.JoinStateDenied,
+			Message: "Too many people are waiting to join this session, try again later",
+		})
+		receiver.conn.Close()
+		return true
+	}
+	room.pending = append(room.pending, receiver)
+	room.timers[receiver] = time.AfterFunc(room.timeout, func() {
+		pty.admit(receiver, false, nil)
+	})
+	log.Infof("Receiver %s (%s) waits to join session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+	receiver.conn.WriteMessage(ttyCommon.MsgTTYJoinStatus{
+		State:   ttyCommon.JoinStatePending,
+		Message: "Waiting for the owner of the session to let you in",
+	})
+	pty.sendWaitingRoom(nil)
+	return true
+}
+
+// waitingRoomPending tells if a receiver waits to join the session
+func (pty *ptyMaster) waitingRoomPending(receiver *ttyReceiver) bool {
+	room := pty.waiting
+	if room == nil {
+		return false
+	}
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return pty.removePending(receiver, false)
+}
+
+// removePending tells if a receiver is in the waiting room, and takes it out if remove is set. It
+// has to be called with the waiting room lock held.
+func (pty *ptyMaster) removePending(receiver *ttyReceiver, remove bool) bool {
+	room := pty.waiting
+	for i, r := range room.pending {
+		if r != receiver {
+			continue
+		}
+		if remove {
+			room.pending = append(room.pending[:i:i], room.pending[i+1:]...)
+			room.timers[receiver].Stop()
+			delete(room.timers, receiver)
+		}
+		return true
+	}
+	return false
+}
+
+// waitingRoomLeave takes a receiver disconnecting out of the waiting room. It tells if the receiver
+// never joined the session, as it was still waiting, or was turned away.
+func (pty *ptyMaster) waitingRoomLeave(receiver *ttyReceiver) bool {
+	room := pty.waiting
+	if room == nil {
+		return false
+	}
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if pty.removePending(receiver, true) {
+		log.Infof("Receiver %s (%s) left the waiting room of session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+		pty.sendWaitingRoom(nil)
+		return true
+	}
+	for _, r := range pty.GetReceivers() {
+		if r == receiver {
+			return false
+		}
+	}
+	return true
+}
+
+// admit lets a receiver waiting in the session, or turns it away. by is the receiver which decided,
+// or nil if nobody let it in in time.
+func (pty *ptyMaster) admit(receiver *ttyReceiver, admitted bool, by *ttyReceiver) {
+	room := pty.waiting
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	if !pty.removePending(receiver, true) {
+		return
+	}
+	status := ttyCommon.MsgTTYJoinStatus{State: ttyCommon.JoinStateDenied}
+	var reason string
+	switch {
+	case admitted:
+		reason = "let in by " + by.identity.Name
+		log.Infof("Receiver %s (%s) was %s in session %s", receiver.id, receiver.identity.Name, reason, pty.sessionID)
+		status.State = ttyCommon.JoinStateAdmitted
+	case by != nil:
+		reason = "turned away by " + by.identity.Name
+		log.Warnf("Receiver %s (%s) was %s from session %s", receiver.id, receiver.identity.Name, reason, pty.sessionID)
+		status.Message = "The owner of the session didn't let you in"
+	default:
+		reason = "timed out"
+		log.Warnf("Receiver %s (%s) timed out waiting to join session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+		status.Message = "Nobody let you in the session in time"
+	}
+	pty.audit.Admission(pty.sessionID, receiver, admitted, reason)
+	receiver.conn.WriteMessage(status)
+	if admitted {
+		pty.attachReceiver(receiver)
+	} else {
+		// Its connection ends, so it leaves the session
+		receiver.conn.Close()
+	}
+	pty.sendWaitingRoom(nil)
+}
+
+// handleAdmission handles the owner, or an admin, letting a receiver in the session, or turning it
+// away
+func (pty *ptyMaster) handleAdmission(receiver *ttyReceiver, msg ttyCommon.MsgTTYAdmission) {
+	room := pty.waiting
+	if room == nil {
+		return
+	}
+	if !pty.isModerator(receiver) {
+		log.Warnf("Receiver %s (%s) can't let receivers in session %s", receiver.id, receiver.identity.Name, pty.sessionID)
+		return
+	}
+	room.lock.Lock()
+	var pending *ttyReceiver
+	for _, r := range room.pending {
+		if r.id == msg.ReceiverID {
+			pending = r
+		}
+	}
+	room.lock.Unlock()
+	if pending != nil {
+		pty.admit(pending, msg.Admit, receiver)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// lastJoinStatus returns the last join status the receiver was sent
+func (conn *messageConn) lastJoinStatus(t *testing.T) (status ttyCommon.MsgTTYJoinStatus) {
+	if messages := conn.messages(t, ttyCommon.MsgIDJoinStatus); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &status)
+	}
+	return
+}
+
+// lastWaitingRoom returns the last receivers waiting to join the receiver was told about
+func (conn *messageConn) lastWaitingRoom(t *testing.T) (room ttyCommon.MsgTTYWaitingRoom) {
+	if messages := conn.messages(t, ttyCommon.MsgIDWaitingRoom); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &room)
+	}
+	return
+}
+
+func TestWaitingRoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waiting-room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := newAuditLog(AuditConfig{Path: filepath.Join(dir, "audit.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	session := ptyMasterNew("1")
+	session.SetAuditLog(audit)
+	session.SetWaitingRoom(200 * time.Millisecond)
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+
+	join := func(id string, owner bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: id}
+		return receiver, joinSession(session, receiver, owner)
+	}
+	attached := func(receiver *ttyReceiver) bool {
+		for _, r := range session.GetReceivers() {
+			if r == receiver {
+				return true
+			}
+		}
+		return false
+	}
+
+	owner, ownerConn := join("r1", true)
+	if !attached(owner) {
+		t.Fatalf("Expected the owner not to wait")
+	}
+	guest, guestConn := join("r2", false)
+	other, otherConn := join("r3", false)
+	if attached(guest) || !session.waitingRoomPending(guest) || guestConn.lastJoinStatus(t).State != ttyCommon.JoinStatePending {
+		t.Fatalf("Expected the guest to wait")
+	}
+	if len(guestConn.messages(t, ttyCommon.MsgIDPresence)) != 0 {
+		t.Errorf("Expected the guest to get nothing of the session while it waits")
+	}
+	if room := ownerConn.lastWaitingRoom(t); len(room.Pending) != 2 || room.Pending[0].ID != "r2" {
+		t.Errorf("Expected the owner to be told who waits, got %+v", room)
+	}
+
+	// Only the owner lets the receivers in
+	session.handleAdmission(guest, ttyCommon.MsgTTYAdmission{ReceiverID: "r3", Admit: true})
+	if attached(other) {
+		t.Errorf("Expected a waiting receiver not to let another one in")
+	}
+	session.handleAdmission(owner, ttyCommon.MsgTTYAdmission{ReceiverID: "r2", Admit: true})
+	if !attached(guest) || guestConn.lastJoinStatus(t).State != ttyCommon.JoinStateAdmitted ||
+		len(guestConn.messages(t, ttyCommon.MsgIDPresence)) != 1 {
+		t.Errorf("Expected the guest to be let in")
+	}
+	if session.waitingRoomLeave(guest) {
+		t.Errorf("Expected the guest to have joined the session")
+	}
+	if room := ownerConn.lastWaitingRoom(t); len(room.Pending) != 1 || room.Pending[0].ID != "r3" {
+		t.Errorf("Expected only the other receiver to wait, got %+v", room)
+	}
+
+	// Nobody lets it in in time
+	for i := 0; otherConn.lastJoinStatus(t).State != ttyCommon.JoinStateDenied; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the other receiver to be turned away")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if attached(other) || !session.waitingRoomLeave(other) {
+		t.Errorf("Expected the other receiver never to join the session")
+	}
+
+	denied, deniedConn := join("r4", false)
+	session.handleAdmission(owner, ttyCommon.MsgTTYAdmission{ReceiverID: "r4"})
+	if attached(denied) || deniedConn.lastJoinStatus(t).State != ttyCommon.JoinStateDenied {
+		t.Errorf("Expected the receiver to be turned away")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"event":"admit","session_id":"1","receiver":"r2"`, `"reason":"timed out"`, `"reason":"turned away by anonymous"`} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s in the audit log, got %s", expected, data)
+		}
+	}
+}
@@ -1,28 +1,50 @@
 package main
 
 import (
+	"io"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
 )
 
+// wsWriteTimeout is how long a write to a receiver can take. The output of a session is written to
+// its receivers one after the other, so a receiver which stopped reading would hold back the others.
+const wsWriteTimeout = 10 * time.Second
+
 type WSConnection struct {
 	connection *websocket.Conn
 	address    string
+	// The output of the session, and the messages of the server, are written from different
+	// goroutines
+	writeLock sync.Mutex
+	// reader is the message being read, which can take several reads
+	reader io.Reader
+	// writeTimeout is how long a write can take, after which the connection is broken
+	writeTimeout time.Duration
 }
 
 func newWSConnection(conn *websocket.Conn) *WSConnection {
 	return &WSConnection{
-		connection: conn,
-		address:    conn.RemoteAddr().String(),
+		connection:   conn,
+		address:      conn.RemoteAddr().String(),
+		writeTimeout: wsWriteTimeout,
 	}
 }
 
 func (handle *WSConnection) Write(data []byte) (n int, err error) {
+	handle.writeLock.Lock()
+	defer handle.writeLock.Unlock()
+	handle.connection.SetWriteDeadline(time.Now().Add(handle.writeTimeout))
 	w, err := handle.connection.NextWriter(websocket.TextMessage)
 	if err != nil {
 		return 0, err
 	}
-	n, err = w.Write(data)
-	w.Close()
+	if n, err = w.Write(data); err != nil {
+		w.Close()
+		return
+	}
+	err = w.Close()
 	return
 }
 
@@ -35,9 +57,23 @@ func (handle *WSConnection) Address() string {
 }
 
 func (handle *WSConnection) Read(data []byte) (int, error) {
-	_, r, err := handle.connection.NextReader()
-	if err != nil {
-		return 0, err
+	for {
+		if handle.reader == nil {
+			_, r, err := handle.connection.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			handle.reader = r
+		}
+		n, err := handle.reader.Read(data)
+		if err == io.EOF {
+			// The next read starts the next message
+			handle.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
 	}
-	return r.Read(data)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSConnectionWriteTimeout(t *testing.T) {
+	written := make(chan error, 1)
+	ttyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			written <- err
+			return
+		}
+		handle := newWSConnection(conn)
+		handle.writeTimeout = 100 * time.Millisecond
+		data := bytes.Repeat([]byte("x"), 64*1024)
+		for {
+			if _, err = handle.Write(data); err != nil {
+				written <- err
+				return
+			}
+		}
+	}))
+	defer ttyServer.Close()
+
+	// The client never reads what it is sent
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ttyServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	select {
+	case err = <-written:
+		if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+			t.Errorf("Expected the write to time out, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the writes to a receiver which doesn't read to time out")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+	ptyDevice "github.com/creack/pty"
+)
+
+const (
+	// mainWindowID is the window of the command the session was started with. The session ends
+	// with it, and the output and the input without a window are the ones of this window.
+	mainWindowID        = "1"
+	defaultMaxWindows   = 8
+	maxWindowNameLength = 32
+)
+
+// windowCommand is a command the receivers can open a window with
+type windowCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	env     []string
+}
+
+// windowsConfig says how many windows the receivers can open in a session, and what they can run
+// in them, besides the command of the session
+type windowsConfig struct {
+	Max      int
+	Commands map[string]windowCommand
+}
+
+// sessionWindow is a PTY of a session, besides the one of its main window, with its own command
+type sessionWindow struct {
+	id             string
+	name           string
+	command        *exec.Cmd
+	ptyFile        *os.File
+	sandboxCleanup func()
+	redactor       *redactor
+}
+
+// SetWindows lets the receivers open windows in the session. It has to be called before Start.
+func (pty *ptyMaster) SetWindows(config windowsConfig) {
+	pty.windowsConfig = config
+}
+
+// windowName cleans the name a receiver gave to a window
+func windowName(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if runes := []rune(name); len(runes) > maxWindowNameLength {
+		name = string(runes[:maxWindowNameLength])
+	}
+	return name
+}
+
+// windowsState returns the windows of the session, sorted by their ID, and what the receivers can
+// run in new ones
+func (pty *ptyMaster) windowsState(message string) ttyCommon.MsgTTYWindows {
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	state := ttyCommon.MsgTTYWindows{
+		Windows:  []ttyCommon.WindowInfo{{ID: mainWindowID, Name: pty.mainWindowName}},
+		Commands: []string{},
+		Max:      pty.windowsConfig.Max,
+		Message:  message,
+	}
+	for _, window := range pty.windows {
+		state.Windows = append(state.Windows, ttyCommon.WindowInfo{ID: window.id, Name: window.name})
+	}
+	sort.Slice(state.Windows, func(i, j int) bool {
+		a, _ := strconv.Atoi(state.Windows[i].ID)
+		b, _ := strconv.Atoi(state.Windows[j].ID)
+		return a < b
+	})
+	for name := range pty.windowsConfig.Commands {
+		state.Commands = append(state.Commands, name)
+	}
+	sort.Strings(state.Commands)
+	return state
+}
+
+// sendWindows tells the receivers which windows the session has, or only one of them if to is set
+func (pty *ptyMaster) sendWindows(to *ttyReceiver, message string) {
+	state := pty.windowsState(message)
+	receivers := pty.GetReceivers()
+	if to != nil {
+		receivers = []*ttyReceiver{to}
+	}
+	for _, receiver := range receivers {
+		if err := receiver.conn.WriteMessage(state); err != nil {
+			log.Debugf("Cannot send the windows to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// openWindow runs a command in a new window of the session. The command is one of the commands of
+// the windows, by its name, or the command of the session if it is empty.
+func (pty *ptyMaster) openWindow(commandName, name string) (*sessionWindow, error) {
+	command := pty.startCommand
+	if commandName != "" {
+		var ok bool
+		if command, ok = pty.windowsConfig.Commands[commandName]; !ok {
+			return nil, &TTYServerError{msg: "There is no command " + commandName + " for the windows"}
+		}
+		command.env = pty.startCommand.env
+	}
+
+	pty.windowsLock.Lock()
+	if pty.windowsClosed {
+		pty.windowsLock.Unlock()
+		return nil, &TTYServerError{msg: "The session has ended"}
+	}
+	if len(pty.windows)+1 >= pty.windowsConfig.Max {
+		pty.windowsLock.Unlock()
+		return nil, &TTYServerError{msg: "This session has as many windows as it can"}
+	}
+	pty.lastWindow++
+	window := &sessionWindow{id: strconv.Itoa(pty.lastWindow), name: windowName(name)}
+	if window.name == "" {
+		window.name = filepath.Base(command.Command)
+	}
+	// Counted before it starts, so the receivers can't open more windows at once
+	pty.windows[window.id] = window
+	pty.windowCommands[window.id] = newCommandTracker(window.id, defaultCommandsLimit)
+	pty.windowsLock.Unlock()
+
+	process, ptyFile, sandboxCleanup, err := pty.startProcess(command.Command, command.Args, command.env)
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	if err != nil {
+		delete(pty.windows, window.id)
+		delete(pty.windowCommands, window.id)
+		return nil, err
+	}
+	window.command, window.ptyFile, window.sandboxCleanup = process, ptyFile, sandboxCleanup
+	if pty.windowsClosed {
+		// The session ended while the command started
+		process.Process.Kill()
+	}
+	if pty.winRows > 0 && pty.winCols > 0 {
+		ptyDevice.Setsize(window.ptyFile, &ptyDevice.Winsize{Rows: uint16(pty.winRows), Cols: uint16(pty.winCols)})
+	}
+	if pty.redactionRules != nil {
+		window.redactor = newRedactor(pty.redactionRules, func(data []byte) {
+			pty.broadcastWindow(window, data)
+		})
+	}
+	pty.metrics.CommandStarted(pty.profile)
+	go pty.forwardWindowOutput(window)
+	go pty.waitWindow(window)
+	log.Infof("Opened window %s (%s) in session %s", window.id, window.name, pty.sessionID)
+	return window, nil
+}
+
+// forwardWindowOutput reads the output of the command of a window, and sends it to all the
+// receivers, with the ID of the window, and to the recorder
+func (pty *ptyMaster) forwardWindowOutput(window *sessionWindow) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := window.ptyFile.Read(buf)
+		if n > 0 {
+			pty.metrics.Bytes(metricsDirectionOut, n)
+			if window.redactor != nil {
+				window.redactor.Write(buf[:n])
+			} else {
+				pty.broadcastWindow(window, buf[:n])
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if window.redactor != nil {
+		window.redactor.Flush()
+	}
+}
+
+// broadcastWindow is broadcast for the windows, but the main one: their output is tagged with the
+// ID of the window in the history and the recording, and their commands are tracked apart
+func (pty *ptyMaster) broadcastWindow(window *sessionWindow, data []byte) {
+	pty.windowsLock.Lock()
+	tracker := pty.windowCommands[window.id]
+	pty.windowsLock.Unlock()
+	tracker.Write(data)
+	pty.history.WriteWindowOutput(window.id, data)
+	if pty.recorder != nil {
+		if err := pty.recorder.WriteWindowOutput(window.id, data); err != nil {
+			log.Warnf("Cannot record the output of window %s of session %s: %s", window.id, pty.sessionID, err.Error())
+		}
+	}
+
+	msg := ttyCommon.MsgTTYWrite{Data: data, Size: len(data), Window: window.id}
+	for _, receiver := range pty.GetReceivers() {
+		if err := receiver.conn.WriteMessage(msg); err != nil {
+			pty.dropReceiver(receiver, err)
+		}
+	}
+}
+
+// waitWindow removes a window once its command exits
+func (pty *ptyMaster) waitWindow(window *sessionWindow) {
+	window.command.Wait()
+	if state := window.command.ProcessState; state != nil {
+		pty.metrics.CommandExited(pty.profile, state.ExitCode())
+	}
+	window.ptyFile.Close()
+	if window.sandboxCleanup != nil {
+		window.sandboxCleanup()
+	}
+	pty.windowsLock.Lock()
+	delete(pty.windows, window.id)
+	pty.windowsLock.Unlock()
+	log.Infof("Closed window %s of session %s", window.id, pty.sessionID)
+	pty.sendWindows(nil, "")
+}
+
+// closeWindows kills the commands of all the windows, but the main one
+func (pty *ptyMaster) closeWindows() {
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	pty.windowsClosed = true
+	for _, window := range pty.windows {
+		if window.command != nil {
+			window.command.Process.Kill()
+		}
+	}
+}
+
+// resizeWindows sets the size of all the windows, but the main one
+func (pty *ptyMaster) resizeWindows(rows, cols int) {
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	pty.winRows, pty.winCols = rows, cols
+	for _, window := range pty.windows {
+		if window.ptyFile != nil {
+			ptyDevice.Setsize(window.ptyFile, &ptyDevice.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+		}
+	}
+}
+
+// refreshWindows makes the commands of the windows redraw themselves, as Refresh does for the main
+// one
+func (pty *ptyMaster) refreshWindows() {
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	rows, cols := pty.winRows, pty.winCols
+	if rows <= 1 || cols <= 0 {
+		return
+	}
+	for _, window := range pty.windows {
+		if window.ptyFile == nil {
+			continue
+		}
+		ptyDevice.Setsize(window.ptyFile, &ptyDevice.Winsize{Rows: uint16(rows - 1), Cols: uint16(cols)})
+		go func(ptyFile *os.File) {
+			time.Sleep(time.Millisecond * 50)
+			ptyDevice.Setsize(ptyFile, &ptyDevice.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+		}(window.ptyFile)
+	}
+}
+
+// inputFile returns the PTY the input of a receiver goes to, which is the one of the window it
+// shows, or of the main window
+func (pty *ptyMaster) inputFile(receiver *ttyReceiver) *os.File {
+	pty.windowsLock.Lock()
+	defer pty.windowsLock.Unlock()
+	if window, ok := pty.windows[receiver.window]; ok && window.ptyFile != nil {
+		return window.ptyFile
+	}
+	return pty.ptyFile
+}
+
+// handleWindowControl handles a receiver opening, showing, renaming or closing a window
+func (pty *ptyMaster) handleWindowControl(receiver *ttyReceiver, msg ttyCommon.MsgTTYWindowControl) {
+	if msg.Action != ttyCommon.WindowActionSwitch && receiver.viewOnly {
+		pty.sendWindows(receiver, "You can't change the windows of this session")
+		return
+	}
+	switch msg.Action {
+	case ttyCommon.WindowActionCreate:
+		window, err := pty.openWindow(msg.Command, msg.Name)
+		if err != nil {
+			log.Warnf("Receiver %s cannot open a window in session %s: %s", receiver.id, pty.sessionID, err.Error())
+			pty.sendWindows(receiver, err.Error())
+			return
+		}
+		pty.windowsLock.Lock()
+		receiver.window = window.id
+		pty.windowsLock.Unlock()
+	case ttyCommon.WindowActionSwitch:
+		pty.windowsLock.Lock()
+		receiver.window = msg.Window
+		pty.windowsLock.Unlock()
+		return
+	case ttyCommon.WindowActionRename:
+		name := windowName(msg.Name)
+		if name == "" {
+			return
+		}
+		pty.windowsLock.Lock()
+		if msg.Window == mainWindowID {
+			pty.mainWindowName = name
+		} else if window, ok := pty.windows[msg.Window]; ok {
+			window.name = name
+		}
+		pty.windowsLock.Unlock()
+	case ttyCommon.WindowActionClose:
+		pty.windowsLock.Lock()
+		window, ok := pty.windows[msg.Window]
+		if ok && window.command != nil {
+			// The window is removed once its command exits
+			window.command.Process.Kill()
+		}
+		pty.windowsLock.Unlock()
+		if msg.Window == mainWindowID {
+			pty.sendWindows(receiver, "The main window can't be closed")
+		}
+		return
+	default:
+		log.Warnf("Unknown window action %s from receiver %s", msg.Action, receiver.id)
+		return
+	}
+	pty.sendWindows(nil, "")
+}
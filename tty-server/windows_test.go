@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// lastWindows returns the last windows the receiver was told about
+func (conn *messageConn) lastWindows(t *testing.T) (windows ttyCommon.MsgTTYWindows) {
+	if messages := conn.messages(t, ttyCommon.MsgIDWindows); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &windows)
+	}
+	return
+}
+
+// windowOutput returns the output of a window the receiver was sent
+func (conn *messageConn) windowOutput(t *testing.T, window string) string {
+	var output strings.Builder
+	for _, data := range conn.messages(t, ttyCommon.MsgIDWrite) {
+		var msg ttyCommon.MsgTTYWrite
+		json.Unmarshal(data, &msg)
+		if msg.Window == window {
+			output.Write(msg.Data[:msg.Size])
+		}
+	}
+	return output.String()
+}
+
+func TestWindows(t *testing.T) {
+	session := ptyMasterNew("1")
+	session.SetWindows(windowsConfig{Max: 3, Commands: map[string]windowCommand{"cat": {Command: "cat"}}})
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+
+	join := func(id string, viewOnly bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: id, viewOnly: viewOnly}
+		return receiver, joinSession(session, receiver, false)
+	}
+	receiver, conn := join("r1", false)
+	viewer, viewerConn := join("r2", true)
+
+	if windows := conn.lastWindows(t); len(windows.Windows) != 1 || windows.Windows[0].ID != mainWindowID ||
+		windows.Windows[0].Name != "cat" || len(windows.Commands) != 1 || windows.Max != 3 {
+		t.Fatalf("Expected only the main window, got %+v", windows)
+	}
+
+	session.handleWindowControl(viewer, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionCreate})
+	if windows := viewerConn.lastWindows(t); len(windows.Windows) != 1 || windows.Message == "" {
+		t.Errorf("Expected the view only receiver not to open a window, got %+v", windows)
+	}
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionCreate, Command: "cat", Name: "logs\x1b"})
+	windows := viewerConn.lastWindows(t)
+	if len(windows.Windows) != 2 || windows.Windows[1].ID != "2" || windows.Windows[1].Name != "logs" {
+		t.Fatalf("Expected the window to be opened, got %+v", windows)
+	}
+	if receiver.window != "2" || session.inputFile(receiver) == session.ptyFile || session.inputFile(viewer) != session.ptyFile {
+		t.Errorf("Expected the input of the receiver to go to its new window")
+	}
+
+	// The output of the window is sent with its ID
+	session.inputFile(receiver).Write([]byte("window\n"))
+	for i := 0; !strings.Contains(viewerConn.windowOutput(t, "2"), "window"); i++ {
+		if i == 100 {
+			t.Fatalf("Expected the output of the window, got %q", viewerConn.windowOutput(t, "2"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if strings.Contains(viewerConn.windowOutput(t, ""), "window") {
+		t.Errorf("Expected the output of the window not to be sent as the one of the main window")
+	}
+
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionCreate})
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionCreate})
+	if windows := conn.lastWindows(t); len(windows.Windows) != 3 || !strings.Contains(windows.Message, "as many windows") {
+		t.Errorf("Expected the session to have at most 3 windows, got %+v", windows)
+	}
+
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionRename, Window: mainWindowID, Name: "main"})
+	if windows := conn.lastWindows(t); windows.Windows[0].Name != "main" {
+		t.Errorf("Expected the main window to be renamed, got %+v", windows)
+	}
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionClose, Window: mainWindowID})
+	if windows := conn.lastWindows(t); !strings.Contains(windows.Message, "main window") {
+		t.Errorf("Expected the main window not to be closed, got %+v", windows)
+	}
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionSwitch, Window: "2"})
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionClose, Window: "2"})
+	for i := 0; len(conn.lastWindows(t).Windows) != 2; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the window to be closed, got %+v", conn.lastWindows(t))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if session.inputFile(receiver) != session.ptyFile {
+		t.Errorf("Expected the input of the receiver to go to the main window once its window is closed")
+	}
+}
+
+func TestWindowsRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tty-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := newFileRecordingSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newSessionRecorder(sink, "1", 80, 24, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := ptyMasterNew("1")
+	session.SetWindows(windowsConfig{Max: 2})
+	session.SetRecorder(recorder)
+	session.SetOutputHistory(newOutputHistory(1024 * 1024))
+	if err := session.Start("cat", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer session.Stop()
+	receiver := &ttyReceiver{id: "r1"}
+	conn := joinSession(session, receiver, false)
+
+	session.handleWindowControl(receiver, ttyCommon.MsgTTYWindowControl{Action: ttyCommon.WindowActionCreate})
+	session.inputFile(receiver).Write([]byte("\x1b]133;C;cmdline_url=ls\x07window\n"))
+	waitFor(t, "the output of the window", func() bool {
+		return strings.Contains(conn.windowOutput(t, "2"), "window")
+	})
+
+	// The commands of the window are tracked, with their offsets in the output of the window
+	waitFor(t, "the command of the window to be tracked", func() bool {
+		commands := session.GetCommands()
+		return len(commands) == 1 && commands[0].Window == "2" && commands[0].Command == "ls"
+	})
+
+	transcript := func(window string, add func(add func(event transcriptEvent))) string {
+		builder := newTranscriptBuilder(transcriptRange{window: window, toTime: -1, toOffset: -1})
+		add(builder.Add)
+		var out bytes.Buffer
+		renderTranscriptText(&out, builder.Lines())
+		return out.String()
+	}
+	fromHistory := func(add func(event transcriptEvent)) {
+		for _, event := range session.GetOutputHistory() {
+			add(event)
+		}
+	}
+	if text := transcript("2", fromHistory); !strings.Contains(text, "window") {
+		t.Errorf("Expected the history to keep the output of the window, got %q", text)
+	}
+	if text := transcript("", fromHistory); strings.Contains(text, "window") {
+		t.Errorf("Expected the output of the window not to be in the transcript of the main one, got %q", text)
+	}
+
+	recorder.Close()
+	recording := readRecording(t, sink, recorder.GetRecordingID())
+	if !strings.Contains(recording, `"w","{\"window\":\"2\",\"data\":`) {
+		t.Fatalf("Expected the output of the window to be recorded, got %s", recording)
+	}
+	fromRecording := func(add func(event transcriptEvent)) {
+		if err := recordingTranscriptEvents(strings.NewReader(recording), add); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if text := transcript("2", fromRecording); !strings.Contains(text, "window") {
+		t.Errorf("Expected the transcript of the recorded window, got %q", text)
+	}
+	if text := transcript("", fromRecording); strings.Contains(text, "window") {
+		t.Errorf("Expected the output of the window not to be in the recorded main window, got %q", text)
+	}
+}
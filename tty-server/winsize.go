@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+)
+
+// The window size policies of the profiles
+const (
+	// windowSizeLast resizes the session to the size of the receiver which last asked for one
+	windowSizeLast = "last"
+	// windowSizeOwner resizes the session only to the size of its owner
+	windowSizeOwner = "owner"
+	// windowSizeSmallest resizes the session to the smallest size fitting all its receivers, like
+	// tmux does
+	windowSizeSmallest = "smallest"
+	// windowSizeFixed keeps the session at a fixed size, written fixed:<cols>x<rows>
+	windowSizeFixed = "fixed"
+	maxWindowSize   = 1000
+)
+
+// windowSizePolicy decides which size a session has, when its receivers have different sizes
+type windowSizePolicy struct {
+	mode string
+	// cols and rows are the size of the fixed policy
+	cols int
+	rows int
+}
+
+// parseWindowSize parses the window size policy of a profile, which is last if it is empty
+func parseWindowSize(policy, profileName string) (windowSizePolicy, error) {
+	switch policy {
+	case "", windowSizeLast:
+		return windowSizePolicy{mode: windowSizeLast}, nil
+	case windowSizeOwner, windowSizeSmallest:
+		return windowSizePolicy{mode: policy}, nil
+	}
+	if size := strings.TrimPrefix(policy, windowSizeFixed+":"); size != policy {
+		parts := strings.Split(size, "x")
+		if len(parts) == 2 {
+			cols, colsErr := strconv.Atoi(parts[0])
+			rows, rowsErr := strconv.Atoi(parts[1])
+			if colsErr == nil && rowsErr == nil && cols > 0 && rows > 0 && cols <= maxWindowSize && rows <= maxWindowSize {
+				return windowSizePolicy{mode: windowSizeFixed, cols: cols, rows: rows}, nil
+			}
+		}
+	}
+	return windowSizePolicy{}, &TTYServerError{msg: "The window size of the profile " + profileName + " has to be last, owner, smallest or fixed:<cols>x<rows>"}
+}
+
+// SetWindowSizePolicy sets how the session is resized, when its receivers have different sizes. It
+// has to be called before Start.
+func (pty *ptyMaster) SetWindowSizePolicy(policy windowSizePolicy) {
+	pty.sizePolicy = policy
+}
+
+// effectiveSize returns the size of the session, the way its policy decides it, after a receiver
+// asked for a size, or joined or left if from is nil. It has to be called with the size lock held.
+func (pty *ptyMaster) effectiveSize(from *ttyReceiver) (cols, rows int) {
+	cols, rows = pty.cols, pty.rows
+	switch pty.sizePolicy.mode {
+	case windowSizeFixed:
+		return pty.sizePolicy.cols, pty.sizePolicy.rows
+	case windowSizeOwner:
+		if from != nil && pty.IsOwner(from) {
+			return from.cols, from.rows
+		}
+	case windowSizeSmallest:
+		found := false
+		for _, receiver := range pty.GetReceivers() {
+			if receiver.cols <= 0 || receiver.rows <= 0 {
+				continue
+			}
+			if !found || receiver.cols < cols {
+				cols = receiver.cols
+			}
+			if !found || receiver.rows < rows {
+				rows = receiver.rows
+			}
+			found = true
+		}
+	default:
+		if from != nil {
+			return from.cols, from.rows
+		}
+	}
+	return
+}
+
+// applySize resizes the session, and tells its receivers, if its size changed. It has to be called
+// with the size lock held.
+func (pty *ptyMaster) applySize(cols, rows int) {
+	if cols <= 0 || rows <= 0 || cols == pty.cols && rows == pty.rows {
+		return
+	}
+	pty.cols, pty.rows = cols, rows
+	pty.SetWinSize(rows, cols)
+	msg := pty.sizeMessage()
+	for _, receiver := range pty.GetReceivers() {
+		if err := receiver.conn.WriteMessage(msg); err != nil {
+			log.Debugf("Cannot send the size to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+		}
+	}
+}
+
+// sizeMessage returns the size of the session. It has to be called with the size lock held.
+func (pty *ptyMaster) sizeMessage() ttyCommon.MsgTTYEffectiveSize {
+	return ttyCommon.MsgTTYEffectiveSize{Cols: pty.cols, Rows: pty.rows, Policy: pty.sizePolicy.mode}
+}
+
+// resizeRequest handles a receiver asking for the size of its browser. The view only receivers
+// watch the session at the size the others give it, so they are left out of the sizing.
+func (pty *ptyMaster) resizeRequest(receiver *ttyReceiver, cols, rows int) {
+	if receiver.viewOnly || cols <= 0 || rows <= 0 || cols > maxWindowSize || rows > maxWindowSize {
+		return
+	}
+	pty.sizeLock.Lock()
+	defer pty.sizeLock.Unlock()
+	receiver.cols, receiver.rows = cols, rows
+	pty.applySize(pty.effectiveSize(receiver))
+}
+
+// sizeJoin tells a receiver joining the session the size of the session
+func (pty *ptyMaster) sizeJoin(receiver *ttyReceiver) {
+	pty.sizeLock.Lock()
+	defer pty.sizeLock.Unlock()
+	if err := receiver.conn.WriteMessage(pty.sizeMessage()); err != nil {
+		log.Debugf("Cannot send the size to receiver %s of session %s: %s", receiver.id, pty.sessionID, err.Error())
+	}
+}
+
+// sizeLeave resizes the session, if the receiver leaving it was the one it was sized for
+func (pty *ptyMaster) sizeLeave(receiver *ttyReceiver) {
+	pty.sizeLock.Lock()
+	defer pty.sizeLock.Unlock()
+	pty.applySize(pty.effectiveSize(nil))
+}
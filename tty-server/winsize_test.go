@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	ttyCommon "github.com/Yi-Tseng/tty-share/common"
+	ptyDevice "github.com/creack/pty"
+)
+
+func TestParseWindowSize(t *testing.T) {
+	cases := map[string]windowSizePolicy{
+		"":               {mode: windowSizeLast},
+		"last":           {mode: windowSizeLast},
+		"owner":          {mode: windowSizeOwner},
+		"smallest":       {mode: windowSizeSmallest},
+		"fixed:120x40":   {mode: windowSizeFixed, cols: 120, rows: 40},
+		"fixed":          {},
+		"fixed:120":      {},
+		"fixed:0x40":     {},
+		"fixed:120x4000": {},
+		"largest":        {},
+	}
+	for policy, expected := range cases {
+		parsed, err := parseWindowSize(policy, "test")
+		if parsed != expected || (err != nil) != (expected.mode == "") {
+			t.Errorf("Expected %q to be parsed as %+v, got %+v (%v)", policy, expected, parsed, err)
+		}
+	}
+}
+
+// lastSize returns the last size of the session the receiver was sent
+func (conn *messageConn) lastSize(t *testing.T) (size ttyCommon.MsgTTYEffectiveSize) {
+	if messages := conn.messages(t, ttyCommon.MsgIDEffectiveSize); len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &size)
+	}
+	return
+}
+
+func TestWindowSizePolicies(t *testing.T) {
+	start := func(policy windowSizePolicy) *ptyMaster {
+		session := ptyMasterNew("1")
+		session.SetWindowSizePolicy(policy)
+		if err := session.Start("cat", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	join := func(session *ptyMaster, id string, owner bool) (*ttyReceiver, *messageConn) {
+		receiver := &ttyReceiver{id: id}
+		return receiver, joinSession(session, receiver, owner)
+	}
+	expectSize := func(session *ptyMaster, conn *messageConn, cols, rows int) {
+		t.Helper()
+		if size := conn.lastSize(t); size.Cols != cols || size.Rows != rows {
+			t.Errorf("Expected the receiver to be told the size is %dx%d, got %+v", cols, rows, size)
+		}
+		if ptyRows, ptyCols, _ := ptyDevice.Getsize(session.ptyFile); ptyCols != cols || ptyRows != rows {
+			t.Errorf("Expected the PTY to be %dx%d, got %dx%d", cols, rows, ptyCols, ptyRows)
+		}
+	}
+
+	t.Run("smallest", func(t *testing.T) {
+		session := start(windowSizePolicy{mode: windowSizeSmallest})
+		defer session.Stop()
+		big, bigConn := join(session, "r1", true)
+		small, _ := join(session, "r2", false)
+		session.resizeRequest(big, 200, 60)
+		expectSize(session, bigConn, 200, 60)
+		session.resizeRequest(small, 80, 70)
+		expectSize(session, bigConn, 80, 60)
+		// Once the smaller receiver leaves, the session grows back
+		session.removeReceiver(small)
+		session.sizeLeave(small)
+		expectSize(session, bigConn, 200, 60)
+	})
+
+	t.Run("view only", func(t *testing.T) {
+		for _, policy := range []string{windowSizeLast, windowSizeSmallest} {
+			session := start(windowSizePolicy{mode: policy})
+			owner, ownerConn := join(session, "r1", true)
+			viewer, _ := join(session, "r2", false)
+			viewer.viewOnly = true
+			session.resizeRequest(owner, 100, 30)
+			session.resizeRequest(viewer, 1, 1)
+			expectSize(session, ownerConn, 100, 30)
+			session.Stop()
+		}
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		session := start(windowSizePolicy{mode: windowSizeOwner})
+		defer session.Stop()
+		owner, _ := join(session, "r1", true)
+		other, otherConn := join(session, "r2", false)
+		session.resizeRequest(owner, 100, 30)
+		session.resizeRequest(other, 50, 20)
+		expectSize(session, otherConn, 100, 30)
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		session := start(windowSizePolicy{mode: windowSizeFixed, cols: 120, rows: 40})
+		defer session.Stop()
+		owner, conn := join(session, "r1", true)
+		expectSize(session, conn, 120, 40)
+		session.resizeRequest(owner, 100, 30)
+		expectSize(session, conn, 120, 40)
+		if size := conn.lastSize(t); size.Policy != windowSizeFixed {
+			t.Errorf("Expected the receiver to be told the policy, got %+v", size)
+		}
+	})
+}